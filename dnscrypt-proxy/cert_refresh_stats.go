@@ -0,0 +1,117 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// CertRefreshStats - Outcome of the periodic certificate refreshes for a server
+type CertRefreshStats struct {
+	Attempts      uint64
+	Successes     uint64
+	LastAttempt   time.Time
+	LastSuccess   time.Time
+	LastError     string    // Error of the last failed attempt, cleared after a success
+	CertNotBefore time.Time // Start of the validity period of the DNSCrypt certificate in use
+
+	ConsecutiveFailures int
+	Excluded            bool // Removed from the live servers after too many consecutive failures
+}
+
+// SuccessRate - Returns the fraction of refresh attempts that succeeded
+func (stats *CertRefreshStats) SuccessRate() float64 {
+	if stats.Attempts == 0 {
+		return 0.0
+	}
+	return float64(stats.Successes) / float64(stats.Attempts)
+}
+
+// CertAge - Returns how long ago the certificate in use started to be valid, or -1 if unknown
+func (stats *CertRefreshStats) CertAge(now time.Time) time.Duration {
+	if stats.CertNotBefore.IsZero() {
+		return -1
+	}
+	return now.Sub(stats.CertNotBefore)
+}
+
+// recordCertRefresh accounts for a certificate refresh attempt, and returns the number of consecutive
+// failures as well as whether the server had been excluded before this attempt
+func (serversInfo *ServersInfo) recordCertRefresh(serverName string, certNotBefore time.Time, err error) (int, bool) {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+
+	if serversInfo.certRefreshStats == nil {
+		serversInfo.certRefreshStats = make(map[string]*CertRefreshStats)
+	}
+	stats, ok := serversInfo.certRefreshStats[serverName]
+	if !ok {
+		stats = &CertRefreshStats{}
+		serversInfo.certRefreshStats[serverName] = stats
+	}
+	now := time.Now()
+	stats.Attempts++
+	stats.LastAttempt = now
+	wasExcluded := stats.Excluded
+	if err != nil {
+		stats.ConsecutiveFailures++
+		stats.LastError = err.Error()
+		return stats.ConsecutiveFailures, wasExcluded
+	}
+	stats.Successes++
+	stats.LastSuccess = now
+	stats.ConsecutiveFailures = 0
+	stats.LastError = ""
+	stats.Excluded = false
+	if !certNotBefore.IsZero() {
+		stats.CertNotBefore = certNotBefore
+	}
+	return 0, wasExcluded
+}
+
+// excludeServer removes a server from the live servers until its certificate can be refreshed again.
+// The last live server is never removed; fallback servers count as live servers, but servers only used for
+// query routes don't.
+func (serversInfo *ServersInfo) excludeServer(serverName string, consecutiveFailures int) bool {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+
+	for _, servers := range []*[]*ServerInfo{&serversInfo.inner, &serversInfo.fallback, &serversInfo.routeOnly} {
+		if serversInfo.removeServer(servers, serverName, consecutiveFailures) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeServer removes a server from servers, unless it is the last live server; serversInfo must be locked
+func (serversInfo *ServersInfo) removeServer(servers *[]*ServerInfo, serverName string, consecutiveFailures int) bool {
+	for i, server := range *servers {
+		if server.Name != serverName {
+			continue
+		}
+		if servers != &serversInfo.routeOnly && len(serversInfo.inner)+len(serversInfo.fallback) == 1 {
+			dlog.Warnf("[%s] certificate refresh failed %d times in a row, but this is the last live server", serverName, consecutiveFailures)
+			return false
+		}
+		*servers = append((*servers)[:i], (*servers)[i+1:]...)
+		if stats, ok := serversInfo.certRefreshStats[serverName]; ok {
+			stats.Excluded = true
+		}
+		dlog.Warnf("[%s] certificate refresh failed %d times in a row - server excluded until it recovers", serverName, consecutiveFailures)
+		return true
+	}
+	return false
+}
+
+// certRefreshSnapshot returns a copy of the certificate refresh statistics
+func (serversInfo *ServersInfo) certRefreshSnapshot() map[string]CertRefreshStats {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+
+	snapshot := make(map[string]CertRefreshStats, len(serversInfo.certRefreshStats))
+	for name, stats := range serversInfo.certRefreshStats {
+		snapshot[name] = *stats
+	}
+	return snapshot
+}
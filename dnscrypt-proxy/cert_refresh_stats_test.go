@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+func TestCertRefreshExclusion(t *testing.T) {
+	serversInfo := NewServersInfo()
+	serversInfo.inner = []*ServerInfo{{Name: "first"}, {Name: "second"}}
+	refreshErr := errors.New("refresh failed")
+
+	for i := 1; i <= 3; i++ {
+		failures, wasExcluded := serversInfo.recordCertRefresh("first", time.Time{}, refreshErr)
+		if failures != i || wasExcluded {
+			t.Fatalf("attempt %d: failures = %d, wasExcluded = %v", i, failures, wasExcluded)
+		}
+	}
+	if !serversInfo.excludeServer("first", 3) {
+		t.Fatal("server should have been excluded")
+	}
+	if len(serversInfo.inner) != 1 || serversInfo.inner[0].Name != "second" {
+		t.Fatalf("unexpected live servers after exclusion: %d", len(serversInfo.inner))
+	}
+	if !serversInfo.certRefreshSnapshot()["first"].Excluded {
+		t.Error("stats should report the server as excluded")
+	}
+
+	// The last live server is kept
+	if serversInfo.excludeServer("second", 3) {
+		t.Error("the last live server should not be excluded")
+	}
+	if len(serversInfo.inner) != 1 {
+		t.Errorf("live servers = %d, want 1", len(serversInfo.inner))
+	}
+
+	failures, wasExcluded := serversInfo.recordCertRefresh("first", time.Now(), nil)
+	if failures != 0 || !wasExcluded {
+		t.Errorf("after success: failures = %d, wasExcluded = %v", failures, wasExcluded)
+	}
+	stats := serversInfo.certRefreshSnapshot()["first"]
+	if stats.Excluded || stats.ConsecutiveFailures != 0 {
+		t.Errorf("stats not reset after a successful refresh: %+v", stats)
+	}
+	if stats.Attempts != 4 || stats.Successes != 1 {
+		t.Errorf("attempts = %d, successes = %d, want 4 and 1", stats.Attempts, stats.Successes)
+	}
+}
+
+func TestCertRefreshStatsIgnoreDoHServers(t *testing.T) {
+	proxy := newTestProxyWithDoHServers(t, newTestDoHServer(t, validDoHResponse), newTestDoHServer(t, validDoHResponse))
+	proxy.certRefreshMaxFailures = 1
+
+	// Nothing listens on that port, so the refresh fails
+	stamp := stamps.ServerStamp{Proto: stamps.StampProtoTypeDoH, ProviderName: "127.0.0.1:1", Path: "/dns-query"}
+	if err := proxy.serversInfo.refreshServer(proxy, "first", stamp); err == nil {
+		t.Fatal("the refresh should have failed")
+	}
+	if _, ok := proxy.serversInfo.certRefreshSnapshot()["first"]; ok {
+		t.Error("certificate refresh statistics should not be kept for DoH servers")
+	}
+	if len(proxy.serversInfo.inner) != 2 {
+		t.Errorf("live servers = %d, want 2", len(proxy.serversInfo.inner))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"codeberg.org/miekg/dns"
+	"github.com/jedisct1/dlog"
+)
+
+// ClientBlocklist - Blocking rules applied to the queries of a group of clients instead of the [blocked_names] rules
+type ClientBlocklist struct {
+	name             string
+	ranges           []netip.Prefix
+	blockedNamesFile string
+	blockedNames     *BlockedNames
+}
+
+// newClientBlocklists parses the client ranges of each group
+func newClientBlocklists(groupsConfig map[string]ClientBlocklistConfig) ([]*ClientBlocklist, error) {
+	groups := make([]*ClientBlocklist, 0, len(groupsConfig))
+	owners := make(map[netip.Prefix]string)
+	for name, groupConfig := range groupsConfig {
+		if len(groupConfig.BlockedNamesFile) == 0 {
+			return nil, fmt.Errorf("Client blocklist [%s]: blocked_names_file is required", name)
+		}
+		if len(groupConfig.ClientRanges) == 0 {
+			return nil, fmt.Errorf("Client blocklist [%s]: client_ranges is required", name)
+		}
+		group := &ClientBlocklist{name: name, blockedNamesFile: groupConfig.BlockedNamesFile}
+		for _, rangeStr := range groupConfig.ClientRanges {
+			rangeStr = strings.TrimSpace(rangeStr)
+			prefix, err := netip.ParsePrefix(rangeStr)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(rangeStr)
+				if addrErr != nil {
+					return nil, fmt.Errorf("Client blocklist [%s]: invalid client range [%s]: %v", name, rangeStr, err)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			prefix = prefix.Masked()
+			if other, ok := owners[prefix]; ok {
+				return nil, fmt.Errorf("[%s] is used by both the [%s] and [%s] client blocklists", prefix, other, name)
+			}
+			owners[prefix] = name
+			group.ranges = append(group.ranges, prefix)
+		}
+		groups = append(groups, group)
+	}
+	slices.SortFunc(groups, func(a, b *ClientBlocklist) int { return strings.Compare(a.name, b.name) })
+	return groups, nil
+}
+
+// clientBlocklist returns the group a client belongs to, or nil if the default rules apply.
+// If the client is in the ranges of several groups, the most specific range wins.
+func (proxy *Proxy) clientBlocklist(clientAddr *net.Addr) *ClientBlocklist {
+	if len(proxy.clientBlocklists) == 0 || clientAddr == nil {
+		return nil
+	}
+	var ip net.IP
+	switch addr := (*clientAddr).(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return nil
+	}
+	clientIP, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil
+	}
+	clientIP = clientIP.Unmap()
+	var match *ClientBlocklist
+	matchBits := -1
+	for _, group := range proxy.clientBlocklists {
+		for _, prefix := range group.ranges {
+			if prefix.Bits() > matchBits && prefix.Contains(clientIP) {
+				match, matchBits = group, prefix.Bits()
+			}
+		}
+	}
+	return match
+}
+
+// blockedNamesFor returns the blocking rules that apply to a query, or nil if there are none
+func (pluginsState *PluginsState) blockedNamesFor() *BlockedNames {
+	if group := pluginsState.clientBlocklist; group != nil {
+		return group.blockedNames
+	}
+	blockedNamesLock.RLock()
+	defer blockedNamesLock.RUnlock()
+	return blockedNames
+}
+
+// ---
+
+type PluginClientBlocklist struct{}
+
+func (plugin *PluginClientBlocklist) Name() string {
+	return "client_blocklist"
+}
+
+func (plugin *PluginClientBlocklist) Description() string {
+	return "Block DNS queries matching the name patterns of the group of the client"
+}
+
+func (plugin *PluginClientBlocklist) Init(proxy *Proxy) error {
+	for _, group := range proxy.clientBlocklists {
+		if group.blockedNames != nil {
+			continue
+		}
+		dlog.Noticef("Loading the set of blocking rules of the [%s] client group from [%s]", group.name, group.blockedNamesFile)
+		lines, err := ReadTextFile(group.blockedNamesFile)
+		if err != nil {
+			return err
+		}
+		blockedNames := &BlockedNames{
+			allWeeklyRanges: proxy.allWeeklyRanges,
+			patternMatcher:  NewPatternMatcher(),
+			ipCryptConfig:   proxy.ipCryptConfig,
+		}
+		if err := new(PluginBlockName).loadRules(lines, blockedNames); err != nil {
+			return err
+		}
+		group.blockedNames = blockedNames
+	}
+	return nil
+}
+
+func (plugin *PluginClientBlocklist) Drop() error {
+	return nil
+}
+
+func (plugin *PluginClientBlocklist) Reload() error {
+	return nil
+}
+
+func (plugin *PluginClientBlocklist) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	group := pluginsState.clientBlocklist
+	if group == nil || group.blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
+		return nil
+	}
+	_, err := group.blockedNames.check(pluginsState, pluginsState.qName, nil)
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestClientBlocklists(t *testing.T) {
+	if _, err := newClientBlocklists(map[string]ClientBlocklistConfig{
+		"kids": {ClientRanges: []string{"192.168.1.0/33"}, BlockedNamesFile: "kids.txt"},
+	}); err == nil {
+		t.Error("invalid client ranges should be rejected")
+	}
+	if _, err := newClientBlocklists(map[string]ClientBlocklistConfig{
+		"kids":  {ClientRanges: []string{"192.168.1.0/24"}, BlockedNamesFile: "kids.txt"},
+		"guest": {ClientRanges: []string{"192.168.1.1/24"}, BlockedNamesFile: "guest.txt"},
+	}); err == nil {
+		t.Error("a range used by several groups should be rejected")
+	}
+
+	dir := t.TempDir()
+	kidsFile, guestFile := filepath.Join(dir, "kids.txt"), filepath.Join(dir, "guest.txt")
+	if err := os.WriteFile(kidsFile, []byte("games.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(guestFile, []byte("admin.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := newClientBlocklists(map[string]ClientBlocklistConfig{
+		"kids":  {ClientRanges: []string{"192.168.1.64/26", "fd00:1::/64"}, BlockedNamesFile: kidsFile},
+		"guest": {ClientRanges: []string{"192.168.1.0/24", "192.168.2.10"}, BlockedNamesFile: guestFile},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy()
+	proxy.clientBlocklists = groups
+	if err := new(PluginClientBlocklist).Init(proxy); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		client    string
+		wantGroup string
+	}{
+		{"192.168.1.70", "kids"},
+		{"::ffff:192.168.1.70", "kids"},
+		{"fd00:1::42", "kids"},
+		{"192.168.1.10", "guest"},
+		{"192.168.2.10", "guest"},
+		{"192.168.2.11", ""},
+		{"10.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		var clientAddr net.Addr = &net.UDPAddr{IP: net.ParseIP(tt.client), Port: 5353}
+		name := ""
+		if group := proxy.clientBlocklist(&clientAddr); group != nil {
+			name = group.name
+		}
+		if name != tt.wantGroup {
+			t.Errorf("[%s] is in the group [%s], want [%s]", tt.client, name, tt.wantGroup)
+		}
+	}
+
+	blocked := func(client string, qName string) bool {
+		t.Helper()
+		var clientAddr net.Addr = &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}
+		pluginsState := NewPluginsState(proxy, "udp", &clientAddr, "udp", time.Now())
+		pluginsState.qName = qName
+		if err := new(PluginClientBlocklist).Eval(&pluginsState, dns.NewMsg(qName+".", dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+		return pluginsState.action == PluginsActionReject
+	}
+	if !blocked("192.168.1.70", "games.example") {
+		t.Error("the rules of the group should apply to its clients")
+	}
+	if blocked("192.168.1.70", "admin.example") {
+		t.Error("the rules of another group should not apply")
+	}
+	if blocked("10.0.0.1", "games.example") {
+		t.Error("the rules of a group should not apply to clients outside of it")
+	}
+}
@@ -90,6 +90,18 @@ func ReadPrefixed(conn *net.Conn) ([]byte, error) {
 	}
 }
 
+// setTCPNoDelay enables or disables Nagle's algorithm on a direct TCP connection.
+// Connections established through a proxy are left alone.
+func setTCPNoDelay(conn net.Conn, noDelay bool) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetNoDelay(noDelay); err != nil {
+		dlog.Debugf("Unable to set TCP_NODELAY on the connection to [%v]: %v", conn.RemoteAddr(), err)
+	}
+}
+
 func Min(a, b int) int {
 	if a < b {
 		return a
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+// ServerAnswer - Response of a single server to a comparison query
+type ServerAnswer struct {
+	Server  string   `json:"server"`
+	Rcode   string   `json:"rcode,omitempty"`
+	Records []string `json:"records"`
+	MinTTL  uint32   `json:"min_ttl"`
+	MaxTTL  uint32   `json:"max_ttl"`
+	RTT     int64    `json:"rtt_ms"`
+	Error   string   `json:"error,omitempty"`
+	Differs bool     `json:"differs"`
+}
+
+// answerKey returns what is compared between servers: the rcode and the records, ignoring TTLs
+func (answer *ServerAnswer) answerKey() string {
+	if len(answer.Error) > 0 {
+		return ""
+	}
+	return answer.Rcode + "|" + strings.Join(answer.Records, "|")
+}
+
+// newServerAnswer summarizes the response of a server
+func newServerAnswer(serverName string, response []byte) ServerAnswer {
+	answer := ServerAnswer{Server: serverName, Records: []string{}}
+	msg := dns.Msg{Data: response}
+	if err := msg.Unpack(); err != nil {
+		answer.Error = err.Error()
+		return answer
+	}
+	answer.Rcode = dns.RcodeToString[msg.Rcode]
+	for i, rr := range msg.Answer {
+		ttl := rr.Header().TTL
+		if i == 0 || ttl < answer.MinTTL {
+			answer.MinTTL = ttl
+		}
+		answer.MaxTTL = max(answer.MaxTTL, ttl)
+		record := dns.TypeToString[dns.RRToType(rr)] + " " + rr.Data().String()
+		answer.Records = append(answer.Records, record)
+	}
+	slices.Sort(answer.Records)
+	return answer
+}
+
+// markDifferingAnswers flags the answers that differ from the most common one, and returns how many servers agree with it
+func markDifferingAnswers(answers []ServerAnswer) int {
+	counts := make(map[string]int)
+	consensus, consensusCount := "", 0
+	for i := range answers {
+		key := answers[i].answerKey()
+		if len(key) == 0 {
+			continue
+		}
+		counts[key]++
+		if counts[key] > consensusCount {
+			consensus, consensusCount = key, counts[key]
+		}
+	}
+	for i := range answers {
+		key := answers[i].answerKey()
+		answers[i].Differs = len(key) > 0 && key != consensus
+	}
+	return consensusCount
+}
+
+// compareServers sends the same query to every live server, and prints the answers along with the ones that differ
+func (proxy *Proxy) compareServers(query string, jsonOutput bool) error {
+	name, qTypeStr, _ := strings.Cut(query, ",")
+	qType := dns.TypeA
+	if len(qTypeStr) > 0 {
+		var ok bool
+		if qType, ok = dns.StringToType[strings.ToUpper(strings.TrimSpace(qTypeStr))]; !ok {
+			return fmt.Errorf("Unsupported record type: [%s]", qTypeStr)
+		}
+	}
+	msg := dns.NewMsg(fqdn(strings.TrimSpace(name)), qType)
+	if msg == nil {
+		return fmt.Errorf("Unsupported record type: [%s]", qTypeStr)
+	}
+	msg.RecursionDesired = true
+	msg.UDPSize = uint16(MaxDNSPacketSize)
+	if err := msg.Pack(); err != nil {
+		return err
+	}
+
+	if liveServers, err := proxy.serversInfo.refresh(proxy); liveServers == 0 {
+		return fmt.Errorf("No servers are reachable: %v", err)
+	}
+	proxy.serversInfo.RLock()
+	servers := slices.Clone(proxy.serversInfo.inner)
+	proxy.serversInfo.RUnlock()
+
+	answers := make([]ServerAnswer, len(servers))
+	var wg sync.WaitGroup
+	for i, serverInfo := range servers {
+		wg.Add(1)
+		go func(i int, serverInfo *ServerInfo) {
+			defer wg.Done()
+			start := time.Now()
+			pluginsState := NewPluginsState(proxy, "compare", nil, proxy.xTransport.mainProto, start)
+			response, err := handleDNSExchange(proxy, serverInfo, &pluginsState, slices.Clone(msg.Data), proxy.xTransport.mainProto)
+			if err != nil {
+				answers[i] = ServerAnswer{Server: serverInfo.Name, Records: []string{}, Error: err.Error()}
+			} else {
+				answers[i] = newServerAnswer(serverInfo.Name, response)
+			}
+			answers[i].RTT = time.Since(start).Milliseconds()
+		}(i, serverInfo)
+	}
+	wg.Wait()
+	slices.SortFunc(answers, func(a, b ServerAnswer) int { return strings.Compare(a.Server, b.Server) })
+	agreeing := markDifferingAnswers(answers)
+
+	if jsonOutput {
+		jsonStr, err := json.MarshalIndent(answers, "", " ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jsonStr))
+		return nil
+	}
+
+	fmt.Printf("Comparing [%s] (%s) across %d servers\n\n", name, dns.TypeToString[qType], len(answers))
+	differing, failed := 0, 0
+	for _, answer := range answers {
+		status := ""
+		if len(answer.Error) > 0 {
+			failed++
+			fmt.Printf("%-30s error: %s\n", answer.Server, answer.Error)
+			continue
+		} else if answer.Differs {
+			differing++
+			status = "  <-- differs"
+		}
+		fmt.Printf("%-30s %-9s ttl %d-%d, %dms%s\n", answer.Server, answer.Rcode, answer.MinTTL, answer.MaxTTL, answer.RTT, status)
+		for _, record := range answer.Records {
+			fmt.Printf("%-30s   %s\n", "", record)
+		}
+	}
+	fmt.Printf("\n%d servers agree, %d returned a different answer, %d failed\n", agreeing, differing, failed)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+func packedAResponse(t *testing.T, rcode uint16, ttl uint32, addrs ...string) []byte {
+	t.Helper()
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	msg := EmptyResponseFromMessage(query)
+	msg.Rcode = rcode
+	for _, addr := range addrs {
+		rr := new(dns.A)
+		rr.Hdr = dns.Header{Name: "example.com.", Class: dns.ClassINET, TTL: ttl}
+		rr.A = rdata.A{Addr: netip.MustParseAddr(addr)}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	if err := msg.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	return msg.Data
+}
+
+func TestNewServerAnswer(t *testing.T) {
+	answer := newServerAnswer("server", packedAResponse(t, dns.RcodeSuccess, 300, "192.0.2.2", "192.0.2.1"))
+	if answer.Rcode != "NOERROR" {
+		t.Errorf("Rcode = %q, want NOERROR", answer.Rcode)
+	}
+	if len(answer.Records) != 2 || answer.Records[0] != "A 192.0.2.1" || answer.Records[1] != "A 192.0.2.2" {
+		t.Errorf("Records = %v", answer.Records)
+	}
+	if answer.MinTTL != 300 || answer.MaxTTL != 300 {
+		t.Errorf("TTLs = %d-%d, want 300-300", answer.MinTTL, answer.MaxTTL)
+	}
+	if broken := newServerAnswer("server", []byte{0x00, 0x01}); len(broken.Error) == 0 {
+		t.Error("an unparseable response should be reported as an error")
+	}
+}
+
+func TestMarkDifferingAnswers(t *testing.T) {
+	answers := []ServerAnswer{
+		newServerAnswer("a", packedAResponse(t, dns.RcodeSuccess, 300, "192.0.2.1", "192.0.2.2")),
+		newServerAnswer("b", packedAResponse(t, dns.RcodeSuccess, 60, "192.0.2.2", "192.0.2.1")),
+		newServerAnswer("c", packedAResponse(t, dns.RcodeSuccess, 300, "10.0.0.1")),
+		newServerAnswer("d", packedAResponse(t, dns.RcodeNameError, 300)),
+		{Server: "e", Error: "timeout"},
+	}
+	if agreeing := markDifferingAnswers(answers); agreeing != 2 {
+		t.Errorf("agreeing = %d, want 2", agreeing)
+	}
+	want := []bool{false, false, true, true, false}
+	for i, answer := range answers {
+		if answer.Differs != want[i] {
+			t.Errorf("[%s] Differs = %v, want %v", answer.Server, answer.Differs, want[i])
+		}
+	}
+}
@@ -8,6 +8,7 @@
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -23,91 +24,172 @@
 )
 
 type Config struct {
+	Include                  []string           `toml:"include"`
 	LogLevel                 int                `toml:"log_level"`
 	LogFile                  *string            `toml:"log_file"`
 	LogFileLatest            bool               `toml:"log_file_latest"`
 	UseSyslog                bool               `toml:"use_syslog"`
 	ServerNames              []string           `toml:"server_names"`
 	DisabledServerNames      []string           `toml:"disabled_server_names"`
+	FallbackServerNames      []string           `toml:"fallback_server_names"`
+	EmergencyResolver        string             `toml:"emergency_resolver"`
+	ServerNamesStrict        bool               `toml:"server_names_strict"`
 	ListenAddresses          []string           `toml:"listen_addresses"`
+	ListenReuseAddr          bool               `toml:"listen_reuse_addr"`
+	ListenReusePort          bool               `toml:"listen_reuse_port"`
+	ListenUDPRcvBuf          int                `toml:"listen_udp_rcvbuf"`
+	ListenUDPSndBuf          int                `toml:"listen_udp_sndbuf"`
 	LocalDoH                 LocalDoHConfig     `toml:"local_doh"`
 	MonitoringUI             MonitoringUIConfig `toml:"monitoring_ui"`
 	UserName                 string             `toml:"user_name"`
 	ForceTCP                 bool               `toml:"force_tcp"`
+	TCPPoolSize              int                `toml:"tcp_pool_size"`
+	TCPPoolIdleTimeout       int                `toml:"tcp_pool_idle_timeout"`
 	HTTP3                    bool               `toml:"http3"`
 	HTTP3Probe               bool               `toml:"http3_probe"`
+	HTTP3NegativeCacheTTL    int                `toml:"http3_negative_cache_ttl"`
+	AltSvcMaxHeaders         int                `toml:"alt_svc_max_headers"`
+	AltSvcMaxSegments        int                `toml:"alt_svc_max_segments"`
+	IPv6FastFailThreshold    int                `toml:"ipv6_fast_fail_threshold"`
+	IPv6FastFailCooldown     int                `toml:"ipv6_fast_fail_cooldown"`
 	Timeout                  int                `toml:"timeout"`
+	QueryDeadline            int                `toml:"query_deadline"`
+	OnMalformedResponse      string             `toml:"on_malformed_response"`
+	DNSCryptTruncated        string             `toml:"dnscrypt_truncated_response"`
+	OnQuestionMismatch       string             `toml:"on_question_mismatch"`
+	OnCaseMismatch           string             `toml:"on_case_mismatch"`
+	DoHContentTypeCheck      string             `toml:"doh_content_type_check"`
+	DoHDedupWindow           int                `toml:"doh_dedup_window"`
+	DoHCoalescing            bool               `toml:"doh_connection_coalescing"`
+	ShutdownGracePeriod      int                `toml:"shutdown_grace_period"`
 	KeepAlive                int                `toml:"keepalive"`
+	TCPNoDelay               bool               `toml:"tcp_nodelay"`
 	Proxy                    string             `toml:"proxy"`
 	CertRefreshConcurrency   int                `toml:"cert_refresh_concurrency"`
 	CertRefreshDelay         int                `toml:"cert_refresh_delay"`
+	CertRefreshMaxFailures   int                `toml:"cert_refresh_max_failures"`
 	CertIgnoreTimestamp      bool               `toml:"cert_ignore_timestamp"`
+	CertTimestampGrace       bool               `toml:"cert_timestamp_grace_until_clock_sync"`
+	WaitForClockSync         int                `toml:"wait_for_clock_sync"`
+	ClockSyncMinYear         int                `toml:"clock_sync_min_year"`
+	CertTimestampTolerance   int                `toml:"cert_timestamp_tolerance"`
 	EphemeralKeys            bool               `toml:"dnscrypt_ephemeral_keys"`
 	LBStrategy               string             `toml:"lb_strategy"`
 	LBEstimator              bool               `toml:"lb_estimator"`
+	LBExplorationRate        float64            `toml:"lb_exploration_rate"`
+	LBStateFile              string             `toml:"lb_state_file"`
+	LBStateMaxAge            int                `toml:"lb_state_max_age"`
+	LBWarmupGrace            int                `toml:"lb_warmup_grace"`
+	Fanout                   int                `toml:"fanout"`
+	FanoutRequireNoLog       bool               `toml:"fanout_require_nolog"`
+	CrossCheckDomains        []string           `toml:"cross_check_domains"`
+	CrossCheckAction         string             `toml:"cross_check_action"`
 	BlockIPv6                bool               `toml:"block_ipv6"`
 	BlockUnqualified         bool               `toml:"block_unqualified"`
 	BlockUndelegated         bool               `toml:"block_undelegated"`
+	PrivatePTR               bool               `toml:"private_ptr"`
+	PrivatePTRName           string             `toml:"private_ptr_name"`
+	HonorCDBit               bool               `toml:"honor_cd_bit"`
+	BlockRebinding           bool               `toml:"block_rebinding"`
+	RebindingAction          string             `toml:"rebinding_action"`
+	RebindingAllowedNames    []string           `toml:"rebinding_allowed_names"`
+	RebindingRanges          []string           `toml:"rebinding_ranges"`
+	MaxQNameLength           int                `toml:"max_qname_length"`
+	MaxQNameLabels           int                `toml:"max_qname_labels"`
 	EnableHotReload          bool               `toml:"enable_hot_reload"`
 	Cache                    bool
-	CacheSize                int                         `toml:"cache_size"`
-	CacheNegTTL              uint32                      `toml:"cache_neg_ttl"`
-	CacheNegMinTTL           uint32                      `toml:"cache_neg_min_ttl"`
-	CacheNegMaxTTL           uint32                      `toml:"cache_neg_max_ttl"`
-	CacheMinTTL              uint32                      `toml:"cache_min_ttl"`
-	CacheMaxTTL              uint32                      `toml:"cache_max_ttl"`
-	RejectTTL                uint32                      `toml:"reject_ttl"`
-	CloakTTL                 uint32                      `toml:"cloak_ttl"`
-	QueryLog                 QueryLogConfig              `toml:"query_log"`
-	NxLog                    NxLogConfig                 `toml:"nx_log"`
-	BlockName                BlockNameConfig             `toml:"blocked_names"`
-	BlockNameLegacy          BlockNameConfigLegacy       `toml:"blacklist"`
-	WhitelistNameLegacy      WhitelistNameConfigLegacy   `toml:"whitelist"`
-	AllowedName              AllowedNameConfig           `toml:"allowed_names"`
-	BlockIP                  BlockIPConfig               `toml:"blocked_ips"`
-	BlockIPLegacy            BlockIPConfigLegacy         `toml:"ip_blacklist"`
-	AllowIP                  AllowIPConfig               `toml:"allowed_ips"`
-	ForwardFile              string                      `toml:"forwarding_rules"`
-	CloakFile                string                      `toml:"cloaking_rules"`
-	CaptivePortals           CaptivePortalsConfig        `toml:"captive_portals"`
-	StaticsConfig            map[string]StaticConfig     `toml:"static"`
-	SourcesConfig            map[string]SourceConfig     `toml:"sources"`
-	BrokenImplementations    BrokenImplementationsConfig `toml:"broken_implementations"`
-	SourceRequireDNSSEC      bool                        `toml:"require_dnssec"`
-	SourceRequireNoLog       bool                        `toml:"require_nolog"`
-	SourceRequireNoFilter    bool                        `toml:"require_nofilter"`
-	SourceDNSCrypt           bool                        `toml:"dnscrypt_servers"`
-	SourceDoH                bool                        `toml:"doh_servers"`
-	SourceODoH               bool                        `toml:"odoh_servers"`
-	SourceIPv4               bool                        `toml:"ipv4_servers"`
-	SourceIPv6               bool                        `toml:"ipv6_servers"`
-	MaxClients               uint32                      `toml:"max_clients"`
-	TimeoutLoadReduction     float64                     `toml:"timeout_load_reduction"`
-	BootstrapResolversLegacy []string                    `toml:"fallback_resolvers"`
-	BootstrapResolvers       []string                    `toml:"bootstrap_resolvers"`
-	IgnoreSystemDNS          bool                        `toml:"ignore_system_dns"`
-	AllWeeklyRanges          map[string]WeeklyRangesStr  `toml:"schedules"`
-	LogMaxSize               int                         `toml:"log_files_max_size"`
-	LogMaxAge                int                         `toml:"log_files_max_age"`
-	LogMaxBackups            int                         `toml:"log_files_max_backups"`
-	TLSDisableSessionTickets bool                        `toml:"tls_disable_session_tickets"`
-	TLSCipherSuite           []uint16                    `toml:"tls_cipher_suite"`
-	TLSPreferRSA             bool                        `toml:"tls_prefer_rsa"`
-	TLSKeyLogFile            string                      `toml:"tls_key_log_file"`
-	NetprobeAddress          string                      `toml:"netprobe_address"`
-	NetprobeTimeout          int                         `toml:"netprobe_timeout"`
-	OfflineMode              bool                        `toml:"offline_mode"`
-	HTTPProxyURL             string                      `toml:"http_proxy"`
-	RefusedCodeInResponses   bool                        `toml:"refused_code_in_responses"`
-	BlockedQueryResponse     string                      `toml:"blocked_query_response"`
-	QueryMeta                []string                    `toml:"query_meta"`
-	CloakedPTR               bool                        `toml:"cloak_ptr"`
-	AnonymizedDNS            AnonymizedDNSConfig         `toml:"anonymized_dns"`
-	DoHClientX509Auth        DoHClientX509AuthConfig     `toml:"doh_client_x509_auth"`
-	DoHClientX509AuthLegacy  DoHClientX509AuthConfig     `toml:"tls_client_auth"`
-	DNS64                    DNS64Config                 `toml:"dns64"`
-	EDNSClientSubnet         []string                    `toml:"edns_client_subnet"`
-	IPEncryption             IPEncryptionConfig          `toml:"ip_encryption"`
+	CacheSize                int                              `toml:"cache_size"`
+	CacheNegTTL              uint32                           `toml:"cache_neg_ttl"`
+	CacheNegMinTTL           uint32                           `toml:"cache_neg_min_ttl"`
+	CacheNegMaxTTL           uint32                           `toml:"cache_neg_max_ttl"`
+	CacheMinTTL              uint32                           `toml:"cache_min_ttl"`
+	CacheMaxTTL              uint32                           `toml:"cache_max_ttl"`
+	CacheTTLOverrides        map[string]TTLOverrideConfig     `toml:"cache_ttl_overrides"`
+	CachePrefetchThreshold   string                           `toml:"cache_prefetch_threshold"`
+	CacheSlowUpstreamRTT     int                              `toml:"cache_slow_upstream_rtt"`
+	CacheSlowUpstreamStale   int                              `toml:"cache_slow_upstream_max_stale"`
+	RotateAnswers            bool                             `toml:"rotate_answers"`
+	RejectTTL                uint32                           `toml:"reject_ttl"`
+	CloakTTL                 uint32                           `toml:"cloak_ttl"`
+	SelfName                 string                           `toml:"self_name"`
+	LocalRecords             []string                         `toml:"local_records"`
+	QueryLog                 QueryLogConfig                   `toml:"query_log"`
+	QueryEventSocket         string                           `toml:"query_event_socket"`
+	NxLog                    NxLogConfig                      `toml:"nx_log"`
+	BlockName                BlockNameConfig                  `toml:"blocked_names"`
+	BlockNameLegacy          BlockNameConfigLegacy            `toml:"blacklist"`
+	WhitelistNameLegacy      WhitelistNameConfigLegacy        `toml:"whitelist"`
+	AllowedName              AllowedNameConfig                `toml:"allowed_names"`
+	BlockIP                  BlockIPConfig                    `toml:"blocked_ips"`
+	BlockIPLegacy            BlockIPConfigLegacy              `toml:"ip_blacklist"`
+	AllowIP                  AllowIPConfig                    `toml:"allowed_ips"`
+	ForwardFile              string                           `toml:"forwarding_rules"`
+	CloakFile                string                           `toml:"cloaking_rules"`
+	CaptivePortals           CaptivePortalsConfig             `toml:"captive_portals"`
+	StaticsConfig            map[string]StaticConfig          `toml:"static"`
+	ServerSettings           map[string]ServerSettingsConfig  `toml:"server_settings"`
+	ProviderIPOverrides      map[string]string                `toml:"provider_ip_overrides"`
+	CachedIPs                map[string]CachedIPsConfig       `toml:"cached_ips"`
+	SourcesConfig            map[string]SourceConfig          `toml:"sources"`
+	BrokenImplementations    BrokenImplementationsConfig      `toml:"broken_implementations"`
+	SourceRequireDNSSEC      bool                             `toml:"require_dnssec"`
+	SourceRequireNoLog       bool                             `toml:"require_nolog"`
+	SourceRequireNoFilter    bool                             `toml:"require_nofilter"`
+	SourceDNSCrypt           bool                             `toml:"dnscrypt_servers"`
+	SourceDoH                bool                             `toml:"doh_servers"`
+	SourceODoH               bool                             `toml:"odoh_servers"`
+	SourceIPv4               bool                             `toml:"ipv4_servers"`
+	SourceIPv6               bool                             `toml:"ipv6_servers"`
+	SourceMaxRedirects       int                              `toml:"source_max_redirects"`
+	HTTPCache                bool                             `toml:"http_cache"`
+	SourceContentEncodings   []string                         `toml:"source_content_encodings"`
+	MaxDecompressedBody      int64                            `toml:"max_decompressed_body"`
+	MaxClients               uint32                           `toml:"max_clients"`
+	TCPClientKeepalive       int                              `toml:"tcp_client_keepalive_ms"`
+	TimeoutLoadReduction     float64                          `toml:"timeout_load_reduction"`
+	BootstrapResolversLegacy []string                         `toml:"fallback_resolvers"`
+	BootstrapResolvers       []string                         `toml:"bootstrap_resolvers"`
+	IgnoreSystemDNS          bool                             `toml:"ignore_system_dns"`
+	ResolutionOrder          []string                         `toml:"resolution_order"`
+	AllWeeklyRanges          map[string]WeeklyRangesStr       `toml:"schedules"`
+	LogMaxSize               int                              `toml:"log_files_max_size"`
+	LogMaxAge                int                              `toml:"log_files_max_age"`
+	LogMaxBackups            int                              `toml:"log_files_max_backups"`
+	TLSDisableSessionTickets bool                             `toml:"tls_disable_session_tickets"`
+	TLSCipherSuite           []uint16                         `toml:"tls_cipher_suite"`
+	TLSPreferRSA             bool                             `toml:"tls_prefer_rsa"`
+	TLSKeyLogFile            string                           `toml:"tls_key_log_file"`
+	NetprobeAddress          string                           `toml:"netprobe_address"`
+	NetprobeTimeout          int                              `toml:"netprobe_timeout"`
+	NetprobeQuery            string                           `toml:"netprobe_query"`
+	NetprobeFailureAction    string                           `toml:"netprobe_failure_action"`
+	OfflineMode              bool                             `toml:"offline_mode"`
+	HTTPProxyURL             string                           `toml:"http_proxy"`
+	RefusedCodeInResponses   bool                             `toml:"refused_code_in_responses"`
+	BlockedQueryResponse     string                           `toml:"blocked_query_response"`
+	NegativeSOA              bool                             `toml:"negative_soa"`
+	NegativeSOAMName         string                           `toml:"negative_soa_mname"`
+	NegativeSOARName         string                           `toml:"negative_soa_rname"`
+	AllowedQTypes            []string                         `toml:"allowed_qtypes"`
+	BlockedQTypes            []string                         `toml:"blocked_qtypes"`
+	QueryMeta                []string                         `toml:"query_meta"`
+	CloakedPTR               bool                             `toml:"cloak_ptr"`
+	CloakCNAME               bool                             `toml:"cloak_cname"`
+	AnonymizedDNS            AnonymizedDNSConfig              `toml:"anonymized_dns"`
+	DoHClientX509Auth        DoHClientX509AuthConfig          `toml:"doh_client_x509_auth"`
+	DoHClientX509AuthLegacy  DoHClientX509AuthConfig          `toml:"tls_client_auth"`
+	DNS64                    DNS64Config                      `toml:"dns64"`
+	EDNSClientSubnet         []string                         `toml:"edns_client_subnet"`
+	EDNSClientSubnetMode     string                           `toml:"edns_client_subnet_mode"`
+	NSID                     bool                             `toml:"nsid"`
+	StripClientEDNSOptions   []int                            `toml:"strip_client_edns_options"`
+	ForwardClientEDNSOptions []int                            `toml:"forward_client_edns_options"`
+	IPEncryption             IPEncryptionConfig               `toml:"ip_encryption"`
+	IPOrigin                 IPOriginConfig                   `toml:"ip_origin"`
+	Quorum                   QuorumConfig                     `toml:"quorum"`
+	ListenerProfiles         map[string]ListenerProfileConfig `toml:"listener_profiles"`
+	ClientBlocklists         map[string]ClientBlocklistConfig `toml:"client_blocklists"`
+	QueryRoutes              map[string][]string              `toml:"query_routes"`
 }
 
 func newConfig() Config {
@@ -126,11 +208,19 @@ func newConfig() Config {
 		},
 		Timeout:                  5000,
 		KeepAlive:                5,
+		TCPNoDelay:               true,
 		CertRefreshConcurrency:   10,
 		CertRefreshDelay:         240,
+		CertRefreshMaxFailures:   3,
 		HTTP3:                    false,
 		HTTP3Probe:               false,
+		HTTP3NegativeCacheTTL:    int(DefaultHTTP3NegativeCacheTTL.Seconds()),
+		AltSvcMaxHeaders:         DefaultAltSvcMaxHeaders,
+		AltSvcMaxSegments:        DefaultAltSvcMaxSegments,
+		IPv6FastFailThreshold:    DefaultIPv6FastFailThreshold,
+		IPv6FastFailCooldown:     int(DefaultIPv6FastFailCooldown / time.Second),
 		CertIgnoreTimestamp:      false,
+		CertTimestampTolerance:   0,
 		EphemeralKeys:            false,
 		Cache:                    true,
 		CacheSize:                512,
@@ -139,6 +229,7 @@ func newConfig() Config {
 		CacheNegMaxTTL:           600,
 		CacheMinTTL:              60,
 		CacheMaxTTL:              86400,
+		CacheSlowUpstreamStale:   60,
 		RejectTTL:                600,
 		CloakTTL:                 600,
 		SourceRequireNoLog:       true,
@@ -148,6 +239,9 @@ func newConfig() Config {
 		SourceDNSCrypt:           true,
 		SourceDoH:                true,
 		SourceODoH:               false,
+		SourceMaxRedirects:       DefaultSourceMaxRedirects,
+		SourceContentEncodings:   DefaultContentEncodings,
+		MaxDecompressedBody:      MaxHTTPBodyLength,
 		MaxClients:               250,
 		TimeoutLoadReduction:     0.75,
 		BootstrapResolvers:       []string{DefaultBootstrapResolver},
@@ -160,10 +254,19 @@ func newConfig() Config {
 		TLSPreferRSA:             false,
 		TLSKeyLogFile:            "",
 		NetprobeTimeout:          60,
+		NetprobeFailureAction:    NetprobeFailureActionContinue,
 		OfflineMode:              false,
 		RefusedCodeInResponses:   false,
+		ClockSyncMinYear:         MinSynchronizedClockTime.Year(),
 		LBEstimator:              true,
+		LBStateMaxAge:            24,
+		FanoutRequireNoLog:       true,
+		CrossCheckAction:         CrossCheckActionLog,
+		EDNSClientSubnetMode:     ECSModeRandom,
 		BlockedQueryResponse:     "hinfo",
+		NegativeSOA:              true,
+		NegativeSOAMName:         DefaultNegativeSOAMName,
+		NegativeSOARName:         DefaultNegativeSOARName,
 		BrokenImplementations: BrokenImplementationsConfig{
 			FragmentsBlocked: []string{
 				"cisco", "cisco-ipv6", "cisco-familyshield", "cisco-familyshield-ipv6",
@@ -173,7 +276,26 @@ func newConfig() Config {
 		AnonymizedDNS: AnonymizedDNSConfig{
 			DirectCertFallback: true,
 		},
-		CloakedPTR: false,
+		Quorum: QuorumConfig{
+			Servers:  3,
+			MinAgree: 2,
+		},
+		CloakedPTR:          false,
+		CloakCNAME:          false,
+		HonorCDBit:          true,
+		ServerNamesStrict:   true,
+		OnMalformedResponse: OnMalformedResponseDrop,
+		DNSCryptTruncated:   DNSCryptTruncatedResponseTCP,
+		OnQuestionMismatch:  OnQuestionMismatchServFail,
+		OnCaseMismatch:      OnCaseMismatchNormalize,
+		DoHContentTypeCheck: DoHContentTypeCheckReject,
+		TCPPoolIdleTimeout:  int(DefaultTCPPoolIdleTimeout.Seconds()),
+		RebindingAction:     RebindingActionNXDomain,
+		ShutdownGracePeriod: int(DefaultShutdownGracePeriod.Seconds()),
+		QueryLog: QueryLogConfig{
+			BatchSize:     DefaultQueryLogExportBatchSize,
+			FlushInterval: int(DefaultQueryLogExportFlushInterval.Seconds()),
+		},
 	}
 }
 
@@ -181,6 +303,28 @@ type StaticConfig struct {
 	Stamp string
 }
 
+type TTLOverrideConfig struct {
+	MinTTL *uint32 `toml:"min_ttl"`
+	MaxTTL *uint32 `toml:"max_ttl"`
+}
+
+type ServerSettingsConfig struct {
+	MaxQPS            float64  `toml:"max_qps"`
+	IgnoreSystemDNS   *bool    `toml:"ignore_system_dns"`
+	ResolutionOrder   []string `toml:"resolution_order"`
+	Proxy             string   `toml:"proxy"`
+	HTTPProxy         string   `toml:"http_proxy"`
+	ExpectedCountries []string `toml:"expected_countries"`
+	ExpectedASNs      []uint   `toml:"expected_asns"`
+	ForceTCP          bool     `toml:"force_tcp"`
+	CacheMaxTTL       uint32   `toml:"cache_max_ttl"`
+	AcceptHeader      *string  `toml:"accept_header"`
+	ConnectTimeout    int      `toml:"connect_timeout"`
+	ResponseTimeout   int      `toml:"response_timeout"`
+	SessionResumption string   `toml:"tls_session_resumption"`
+	URITemplate       string   `toml:"uri_template"`
+}
+
 type SourceConfig struct {
 	URL            string
 	URLs           []string
@@ -190,12 +334,19 @@ type SourceConfig struct {
 	RefreshDelay   int    `toml:"refresh_delay"`
 	CacheTTL       int    `toml:"cache_ttl"`
 	Prefix         string
+	Enabled        *bool `toml:"enabled"` // Defaults to true
 }
 
 type QueryLogConfig struct {
 	File          string
 	Format        string
 	IgnoredQtypes []string `toml:"ignored_qtypes"`
+	SampleRate    int      `toml:"sample_rate"`
+	NotableOnly   bool     `toml:"notable_only"`
+	UpstreamIP    bool     `toml:"upstream_ip"`
+	Remote        string   `toml:"remote"`
+	BatchSize     int      `toml:"remote_batch_size"`
+	FlushInterval int      `toml:"remote_flush_interval"`
 }
 
 type NxLogConfig struct {
@@ -229,6 +380,7 @@ type AllowedNameConfig struct {
 
 type BlockIPConfig struct {
 	File    string `toml:"blocked_ips_file"`
+	Mode    string `toml:"mode"`
 	LogFile string `toml:"log_file"`
 	Format  string `toml:"log_format"`
 }
@@ -254,6 +406,7 @@ type AnonymizedDNSConfig struct {
 	Routes             []AnonymizedDNSRouteConfig `toml:"routes"`
 	SkipIncompatible   bool                       `toml:"skip_incompatible"`
 	DirectCertFallback bool                       `toml:"direct_cert_fallback"`
+	NoBodyHash         []string                   `toml:"no_body_hash"`
 }
 
 type BrokenImplementationsConfig struct {
@@ -269,16 +422,18 @@ type LocalDoHConfig struct {
 }
 
 type ServerSummary struct {
-	Name        string   `json:"name"`
-	Proto       string   `json:"proto"`
-	IPv6        bool     `json:"ipv6"`
-	Addrs       []string `json:"addrs,omitempty"`
-	Ports       []int    `json:"ports"`
-	DNSSEC      *bool    `json:"dnssec,omitempty"`
-	NoLog       bool     `json:"nolog"`
-	NoFilter    bool     `json:"nofilter"`
-	Description string   `json:"description,omitempty"`
-	Stamp       string   `json:"stamp"`
+	Name         string   `json:"name"`
+	Proto        string   `json:"proto"`
+	IPv6         bool     `json:"ipv6"`
+	Addrs        []string `json:"addrs,omitempty"`
+	Ports        []int    `json:"ports"`
+	DNSSEC       *bool    `json:"dnssec,omitempty"`
+	NoLog        bool     `json:"nolog"`
+	NoFilter     bool     `json:"nofilter"`
+	Description  string   `json:"description,omitempty"`
+	Stamp        string   `json:"stamp"`
+	ProviderName string   `json:"provider_name,omitempty"`
+	Path         string   `json:"path,omitempty"`
 }
 
 type TLSClientAuthCredsConfig struct {
@@ -302,6 +457,34 @@ type IPEncryptionConfig struct {
 	Algorithm string `toml:"algorithm"`
 }
 
+type CachedIPsConfig struct {
+	IPs []string `toml:"ips"`
+	TTL int      `toml:"ttl"`
+}
+
+type ListenerProfileConfig struct {
+	ListenAddresses  []string `toml:"listen_addresses"`
+	ServerNames      []string `toml:"server_names"`
+	BlockedNamesFile string   `toml:"blocked_names_file"`
+}
+
+type ClientBlocklistConfig struct {
+	ClientRanges     []string `toml:"client_ranges"`
+	BlockedNamesFile string   `toml:"blocked_names_file"`
+}
+
+type QuorumConfig struct {
+	Servers  int      `toml:"servers"`
+	MinAgree int      `toml:"min_agree"`
+	Names    []string `toml:"names"`
+}
+
+type IPOriginConfig struct {
+	CountryDatabase string `toml:"country_database"`
+	ASNDatabase     string `toml:"asn_database"`
+	Action          string `toml:"action"`
+}
+
 type CaptivePortalsConfig struct {
 	MapFile string `toml:"map_file"`
 }
@@ -312,11 +495,15 @@ type ConfigFlags struct {
 	ListAll                 *bool
 	IncludeRelays           *bool
 	JSONOutput              *bool
+	ListProto               *string
+	ListProperties          *string
+	ListName                *string
 	Check                   *bool
 	ConfigFile              *string
 	Child                   *bool
 	NetprobeTimeoutOverride *int
 	ShowCerts               *bool
+	Compare                 *string
 }
 
 func findConfigFile(configFile *string) (string, error) {
@@ -346,7 +533,7 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	}
 	WarnIfMaybeWritableByOtherUsers(foundConfigFile)
 	config := newConfig()
-	md, err := toml.DecodeFile(foundConfigFile, &config)
+	md, err := loadConfigFile(foundConfigFile, &config)
 	if err != nil {
 		return err
 	}
@@ -372,6 +559,10 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 
 	// Set up basic proxy properties
 	proxy.showCerts = *flags.ShowCerts || len(os.Getenv("SHOW_CERTS")) > 0
+	if flags.Compare != nil {
+		proxy.compareQuery = *flags.Compare
+		proxy.compareJSON = *flags.JSONOutput
+	}
 	proxy.logMaxSize = config.LogMaxSize
 	proxy.logMaxAge = config.LogMaxAge
 	proxy.logMaxBackups = config.LogMaxBackups
@@ -396,6 +587,16 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		return err
 	}
 
+	// Configure IP origin verification
+	if err := configureIPOrigin(proxy, &config); err != nil {
+		return err
+	}
+
+	// Configure per-server settings
+	if err := configureServerSettings(proxy, &config); err != nil {
+		return err
+	}
+
 	// Configure load balancing
 	configureLoadBalancing(proxy, &config)
 
@@ -407,6 +608,11 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		return err
 	}
 
+	// Configure EDNS options removed from client queries
+	if err := configureClientEDNSOptions(proxy, &config); err != nil {
+		return err
+	}
+
 	// Configure query logging
 	if err := configureQueryLog(proxy, &config); err != nil {
 		return err
@@ -461,6 +667,9 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 
 	// Configure source restrictions
 	configureSourceRestrictions(proxy, flags, &config)
+	if err := configureEmergencyResolver(proxy, &config); err != nil {
+		return err
+	}
 
 	// Initialize networking
 	if err := initializeNetworking(proxy, flags, &config); err != nil {
@@ -480,14 +689,24 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		if err := config.loadSources(proxy); err != nil {
 			return err
 		}
-		if len(proxy.registeredServers) == 0 {
-			return errors.New("None of the servers listed in the server_names list were found in the configured sources.")
+		if err := proxy.checkServerNames(config.ServerNamesStrict); err != nil {
+			return err
+		}
+		if !proxy.hasRegisteredServers() {
+			if proxy.emergencyResolver == nil {
+				return errors.New("None of the servers listed in the server_names list were found in the configured sources.")
+			}
+			dlog.Critical("None of the servers listed in the server_names list could be loaded - Only the emergency resolver is available")
 		}
 	}
 
 	// Handle listing servers if requested
 	if *flags.List || *flags.ListAll {
-		if err := config.printRegisteredServers(proxy, *flags.JSONOutput, *flags.IncludeRelays); err != nil {
+		filter, err := NewServerListFilter(*flags.ListProto, *flags.ListProperties, *flags.ListName)
+		if err != nil {
+			return err
+		}
+		if err := config.printRegisteredServers(proxy, *flags.JSONOutput, *flags.IncludeRelays, filter); err != nil {
 			return err
 		}
 		os.Exit(0)
@@ -567,10 +786,39 @@ func configureIPEncryption(proxy *Proxy, config *Config) error {
 	return nil
 }
 
-func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, includeRelays bool) error {
+// configureIPOrigin - Helper function for IP origin verification
+func configureIPOrigin(proxy *Proxy, config *Config) error {
+	switch config.IPOrigin.Action {
+	case "", IPOriginActionLog:
+		proxy.ipOriginAction = IPOriginActionLog
+	case IPOriginActionReject:
+		proxy.ipOriginAction = IPOriginActionReject
+	default:
+		return fmt.Errorf("Unsupported ip_origin action: [%s]", config.IPOrigin.Action)
+	}
+	if len(config.IPOrigin.CountryDatabase) == 0 && len(config.IPOrigin.ASNDatabase) == 0 {
+		return nil
+	}
+	databases, err := OpenIPOriginDatabases(config.IPOrigin.CountryDatabase, config.IPOrigin.ASNDatabase)
+	if err != nil {
+		return err
+	}
+	proxy.ipOriginDatabases = databases
+	return nil
+}
+
+func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, includeRelays bool, filter ServerListFilter) error {
 	var summary []ServerSummary
 	if includeRelays {
 		for _, registeredRelay := range proxy.registeredRelays {
+			nolog := true
+			nofilter := true
+			if registeredRelay.stamp.Proto == stamps.StampProtoTypeODoHRelay {
+				nolog = registeredRelay.stamp.Props&stamps.ServerInformalPropertyNoLog != 0
+			}
+			if !filter.matches(registeredRelay.name, registeredRelay.stamp.Proto, nolog, nofilter, false) {
+				continue
+			}
 			addrStr, port := registeredRelay.stamp.ServerAddrStr, stamps.DefaultPort
 			var hostAddr string
 			hostAddr, port = ExtractHostAndPort(addrStr, port)
@@ -585,21 +833,18 @@ func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, incl
 			if len(addrStr) > 0 {
 				addrs = append(addrs, hostAddr)
 			}
-			nolog := true
-			nofilter := true
-			if registeredRelay.stamp.Proto == stamps.StampProtoTypeODoHRelay {
-				nolog = registeredRelay.stamp.Props&stamps.ServerInformalPropertyNoLog != 0
-			}
 			serverSummary := ServerSummary{
-				Name:        registeredRelay.name,
-				Proto:       registeredRelay.stamp.Proto.String(),
-				IPv6:        strings.HasPrefix(addrStr, "["),
-				Ports:       []int{port},
-				Addrs:       addrs,
-				NoLog:       nolog,
-				NoFilter:    nofilter,
-				Description: registeredRelay.description,
-				Stamp:       registeredRelay.stamp.String(),
+				Name:         registeredRelay.name,
+				Proto:        registeredRelay.stamp.Proto.String(),
+				IPv6:         strings.HasPrefix(addrStr, "["),
+				Ports:        []int{port},
+				Addrs:        addrs,
+				NoLog:        nolog,
+				NoFilter:     nofilter,
+				Description:  registeredRelay.description,
+				Stamp:        registeredRelay.stamp.String(),
+				ProviderName: registeredRelay.stamp.ProviderName,
+				Path:         registeredRelay.stamp.Path,
 			}
 			if jsonOutput {
 				summary = append(summary, serverSummary)
@@ -609,6 +854,16 @@ func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, incl
 		}
 	}
 	for _, registeredServer := range proxy.registeredServers {
+		props := registeredServer.stamp.Props
+		if !filter.matches(
+			registeredServer.name,
+			registeredServer.stamp.Proto,
+			props&stamps.ServerInformalPropertyNoLog != 0,
+			props&stamps.ServerInformalPropertyNoFilter != 0,
+			props&stamps.ServerInformalPropertyDNSSEC != 0,
+		) {
+			continue
+		}
 		addrStr, port := registeredServer.stamp.ServerAddrStr, stamps.DefaultPort
 		var hostAddr string
 		hostAddr, port = ExtractHostAndPort(addrStr, port)
@@ -625,16 +880,18 @@ func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, incl
 		}
 		dnssec := registeredServer.stamp.Props&stamps.ServerInformalPropertyDNSSEC != 0
 		serverSummary := ServerSummary{
-			Name:        registeredServer.name,
-			Proto:       registeredServer.stamp.Proto.String(),
-			IPv6:        strings.HasPrefix(addrStr, "["),
-			Ports:       []int{port},
-			Addrs:       addrs,
-			DNSSEC:      &dnssec,
-			NoLog:       registeredServer.stamp.Props&stamps.ServerInformalPropertyNoLog != 0,
-			NoFilter:    registeredServer.stamp.Props&stamps.ServerInformalPropertyNoFilter != 0,
-			Description: registeredServer.description,
-			Stamp:       registeredServer.stamp.String(),
+			Name:         registeredServer.name,
+			Proto:        registeredServer.stamp.Proto.String(),
+			IPv6:         strings.HasPrefix(addrStr, "["),
+			Ports:        []int{port},
+			Addrs:        addrs,
+			DNSSEC:       &dnssec,
+			NoLog:        registeredServer.stamp.Props&stamps.ServerInformalPropertyNoLog != 0,
+			NoFilter:     registeredServer.stamp.Props&stamps.ServerInformalPropertyNoFilter != 0,
+			Description:  registeredServer.description,
+			Stamp:        registeredServer.stamp.String(),
+			ProviderName: registeredServer.stamp.ProviderName,
+			Path:         registeredServer.stamp.Path,
 		}
 		if jsonOutput {
 			summary = append(summary, serverSummary)
@@ -655,6 +912,12 @@ func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, incl
 func (config *Config) loadSources(proxy *Proxy) error {
 	for cfgSourceName, cfgSource_ := range config.SourcesConfig {
 		cfgSource := cfgSource_
+		if cfgSource.Enabled != nil && !*cfgSource.Enabled {
+			// Neither the servers nor the cache file of a disabled source are used
+			dlog.Noticef("Source [%s] is disabled", cfgSourceName)
+			proxy.disabledSources = append(proxy.disabledSources, cfgSourceName)
+			continue
+		}
 		rand.Shuffle(len(cfgSource.URLs), func(i, j int) {
 			cfgSource.URLs[i], cfgSource.URLs[j] = cfgSource.URLs[j], cfgSource.URLs[i]
 		})
@@ -673,10 +936,19 @@ func (config *Config) loadSources(proxy *Proxy) error {
 	}
 	if len(config.ServerNames) == 0 {
 		for serverName := range config.StaticsConfig {
-			config.ServerNames = append(config.ServerNames, serverName)
+			// Static servers listed in query routes are only used for their routes
+			if !proxy.isRouteOnlyServer(serverName) {
+				config.ServerNames = append(config.ServerNames, serverName)
+			}
+		}
+	}
+	staticNames := slices.Clone(config.ServerNames)
+	for _, serverName := range slices.Concat(config.FallbackServerNames, proxy.routeServerNames()) {
+		if !includesName(staticNames, serverName) {
+			staticNames = append(staticNames, serverName)
 		}
 	}
-	for _, serverName := range config.ServerNames {
+	for _, serverName := range staticNames {
 		staticConfig, ok := config.StaticsConfig[serverName]
 		if !ok {
 			continue
@@ -735,7 +1007,10 @@ func (config *Config) loadSource(proxy *Proxy, cfgSourceName string, cfgSource *
 	if err != nil {
 		if len(source.bin) <= 0 {
 			dlog.Criticalf("Unable to retrieve source [%s]: [%s]", cfgSourceName, err)
-			return err
+			if proxy.emergencyResolver == nil {
+				return err
+			}
+			dlog.Warnf("Source [%s] will be retried in the background - The emergency resolver is used in the meantime", cfgSourceName)
 		}
 		dlog.Infof("Downloading [%s] failed: %v, using cache file to startup", source.name, err)
 	}
@@ -752,6 +1027,53 @@ func includesName(names []string, name string) bool {
 	return false
 }
 
+// checkServerNames logs the configured servers that are missing from the sources. If none of the servers from
+// server_names were found and strict is false, all the servers matching the source requirements are used instead.
+func (proxy *Proxy) checkServerNames(strict bool) error {
+	if missingNames := missingServerNames(proxy.ServerNames, proxy.registeredServers); len(missingNames) > 0 {
+		dlog.Warnf("Servers not found in the configured sources: %v", missingNames)
+	}
+	for _, route := range proxy.queryRoutes {
+		if missingNames := missingServerNames(route.serverNames, proxy.registeredServers); len(missingNames) > 0 {
+			dlog.Warnf("Servers of the query route for [%s] not found in the configured sources: %v", route.zone, missingNames)
+		}
+	}
+	if !proxy.hasRegisteredServers() && !strict && len(proxy.ServerNames) > 0 {
+		dlog.Warn("None of the servers listed in the server_names list were found - Using all the servers matching the source requirements instead")
+		proxy.ServerNames = nil
+		return proxy.updateRegisteredServers()
+	}
+	return nil
+}
+
+// hasRegisteredServers returns true if servers other than the ones only used for query routes are registered
+func (proxy *Proxy) hasRegisteredServers() bool {
+	for _, registeredServer := range proxy.registeredServers {
+		if !proxy.isRouteOnlyServer(registeredServer.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingServerNames returns the names from server_names that don't match any registered server
+func missingServerNames(serverNames []string, registeredServers []RegisteredServer) []string {
+	var missingNames []string
+	for _, serverName := range serverNames {
+		found := false
+		for _, registeredServer := range registeredServers {
+			if strings.EqualFold(registeredServer.name, serverName) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missingNames = append(missingNames, serverName)
+		}
+	}
+	return missingNames
+}
+
 func cdFileDir(fileName string) error {
 	return os.Chdir(filepath.Dir(fileName))
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jedisct1/dlog"
+)
+
+// loadConfigFile - Decodes a configuration file, along with the files listed in its `include` directive.
+// Tables are merged, and when a key is defined in more than one file, included files override the
+// ones included before them, and the main file overrides all of them.
+func loadConfigFile(configFile string, config *Config) (toml.MetaData, error) {
+	md, err := toml.DecodeFile(configFile, config)
+	if err != nil || len(config.Include) == 0 {
+		return md, err
+	}
+	includedFiles, err := expandConfigIncludes(filepath.Dir(configFile), config.Include)
+	if err != nil {
+		return md, err
+	}
+	merged := make(map[string]any)
+	definedIn := make(map[string]string)
+	for _, file := range append(includedFiles, configFile) {
+		var tree map[string]any
+		if file != configFile {
+			WarnIfMaybeWritableByOtherUsers(file)
+		}
+		if _, err := toml.DecodeFile(file, &tree); err != nil {
+			return md, err
+		}
+		if _, found := tree["include"]; found && file != configFile {
+			return md, fmt.Errorf("Included configuration file [%s] cannot include other files", file)
+		}
+		mergeConfigTree(merged, tree, "", file, definedIn)
+	}
+	var encoded bytes.Buffer
+	if err := toml.NewEncoder(&encoded).Encode(merged); err != nil {
+		return md, err
+	}
+	*config = newConfig()
+	return toml.Decode(encoded.String(), config)
+}
+
+// expandConfigIncludes - Returns the files matching the include patterns, relative to the directory of the main file
+func expandConfigIncludes(configDir string, patterns []string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(configDir, pattern)
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			files = append(files, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid include pattern [%s]: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			dlog.Warnf("No configuration files match [%s]", pattern)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// mergeConfigTree - Merges the decoded content of a configuration file into dst, recursively merging tables
+func mergeConfigTree(dst map[string]any, src map[string]any, prefix string, file string, definedIn map[string]string) {
+	for key, value := range src {
+		keyPath := key
+		if len(prefix) > 0 {
+			keyPath = prefix + "." + key
+		}
+		if srcTable, ok := value.(map[string]any); ok {
+			dstTable, ok := dst[key].(map[string]any)
+			if !ok {
+				if previousFile, found := definedIn[keyPath]; found {
+					dlog.Warnf("[%s] is defined in [%s] and [%s] - Using the value from [%s]", keyPath, previousFile, file, file)
+				}
+				dstTable = make(map[string]any)
+				dst[key] = dstTable
+			}
+			definedIn[keyPath] = file
+			mergeConfigTree(dstTable, srcTable, keyPath, file, definedIn)
+			continue
+		}
+		if previousFile, found := definedIn[keyPath]; found && previousFile != file {
+			dlog.Warnf("[%s] is defined in [%s] and [%s] - Using the value from [%s]", keyPath, previousFile, file, file)
+		}
+		dst[key] = value
+		definedIn[keyPath] = file
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadConfigFileIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	mainFile := writeFile("dnscrypt-proxy.toml", `
+include = ['servers.toml', 'conf.d/*.toml']
+timeout = 2500
+
+[static.main]
+stamp = 'sdns://main'
+`)
+	writeFile("servers.toml", `
+server_names = ['first']
+timeout = 1000
+
+[static.included]
+stamp = 'sdns://included'
+`)
+	writeFile("conf.d/10-policy.toml", `
+server_names = ['second']
+block_ipv6 = true
+`)
+
+	config := newConfig()
+	md, err := loadConfigFile(mainFile, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		t.Errorf("undecoded keys: %v", undecoded)
+	}
+	if config.Timeout != 2500 {
+		t.Errorf("timeout = %d, the main file should take precedence", config.Timeout)
+	}
+	if !slices.Equal(config.ServerNames, []string{"second"}) {
+		t.Errorf("server_names = %v, files should override the ones included before them", config.ServerNames)
+	}
+	if !config.BlockIPv6 {
+		t.Error("settings only defined in included files should be used")
+	}
+	if len(config.StaticsConfig) != 2 || config.StaticsConfig["included"].Stamp != "sdns://included" {
+		t.Errorf("tables should be merged, got %v", config.StaticsConfig)
+	}
+	if config.CacheSize != newConfig().CacheSize {
+		t.Error("settings defined nowhere should keep their default value")
+	}
+
+	writeFile("conf.d/20-nested.toml", "include = ['other.toml']\n")
+	config = newConfig()
+	if _, err := loadConfigFile(mainFile, &config); err == nil {
+		t.Error("included files should not be allowed to include other files")
+	}
+}
+
+func TestLoadConfigFileWithoutIncludes(t *testing.T) {
+	mainFile := filepath.Join(t.TempDir(), "dnscrypt-proxy.toml")
+	if err := os.WriteFile(mainFile, []byte("timeout = 1234\nunknown_key = 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := newConfig()
+	md, err := loadConfigFile(mainFile, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Timeout != 1234 {
+		t.Errorf("timeout = %d, want 1234", config.Timeout)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) != 1 || undecoded[0].String() != "unknown_key" {
+		t.Errorf("undecoded keys = %v, want [unknown_key]", undecoded)
+	}
+}
@@ -7,12 +7,15 @@
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"codeberg.org/miekg/dns"
 	"github.com/jedisct1/dlog"
 	stamps "github.com/jedisct1/go-dnsstamps"
+	"golang.org/x/net/http/httpguts"
 	netproxy "golang.org/x/net/proxy"
 )
 
@@ -30,7 +33,7 @@ func configureLogging(proxy *Proxy, flags *ConfigFlags, config *Config) {
 	if flags.Check != nil && *flags.Check {
 		isCommandMode = true
 	}
-	if proxy.showCerts {
+	if proxy.showCerts || len(proxy.compareQuery) > 0 {
 		isCommandMode = true
 	}
 	if flags.List != nil && *flags.List {
@@ -45,9 +48,7 @@ func configureLogging(proxy *Proxy, flags *ConfigFlags, config *Config) {
 		return
 	}
 
-	if config.UseSyslog {
-		dlog.UseSyslog(true)
-	} else if config.LogFile != nil {
+	if config.LogFile != nil {
 		dlog.UseLogFile(*config.LogFile)
 		if !*flags.Child {
 			FileDescriptors = append(FileDescriptors, dlog.GetFileDescriptor())
@@ -56,6 +57,14 @@ func configureLogging(proxy *Proxy, flags *ConfigFlags, config *Config) {
 			FileDescriptorNum++
 		}
 	}
+	if config.UseSyslog {
+		// Log to both the system logger and the log file if both are configured
+		if logFile := dlog.GetFileDescriptor(); config.LogFile == nil || logFile == nil {
+			dlog.UseSyslog(true)
+		} else if err := teeLogToSystemLogger(logFile); err != nil {
+			dlog.Warnf("Unable to use the system logger in addition to the log file: %v", err)
+		}
+	}
 
 	if !*flags.Child {
 		dlog.Noticef("dnscrypt-proxy %s", AppVersion)
@@ -68,6 +77,22 @@ func configureXTransport(proxy *Proxy, config *Config) error {
 	proxy.xTransport.tlsPreferRSA = config.TLSPreferRSA
 	proxy.xTransport.http3 = config.HTTP3
 	proxy.xTransport.http3Probe = config.HTTP3Probe
+	if config.HTTP3NegativeCacheTTL < 0 {
+		return errors.New("http3_negative_cache_ttl cannot be negative")
+	}
+	proxy.xTransport.http3NegativeCacheTTL = time.Duration(config.HTTP3NegativeCacheTTL) * time.Second
+	if config.AltSvcMaxHeaders < 0 || config.AltSvcMaxSegments < 0 {
+		return errors.New("alt_svc_max_headers and alt_svc_max_segments cannot be negative")
+	}
+	proxy.xTransport.altSvcMaxHeaders = config.AltSvcMaxHeaders
+	proxy.xTransport.altSvcMaxSegments = config.AltSvcMaxSegments
+	if config.IPv6FastFailThreshold < 0 || config.IPv6FastFailCooldown < 0 {
+		return errors.New("ipv6_fast_fail_threshold and ipv6_fast_fail_cooldown cannot be negative")
+	}
+	proxy.xTransport.ipv6FastFail = NewIPv6FastFail(
+		config.IPv6FastFailThreshold,
+		time.Duration(config.IPv6FastFailCooldown)*time.Second,
+	)
 
 	// Configure bootstrap resolvers
 	if len(config.BootstrapResolvers) == 0 && len(config.BootstrapResolversLegacy) > 0 {
@@ -75,17 +100,91 @@ func configureXTransport(proxy *Proxy, config *Config) error {
 		config.BootstrapResolvers = config.BootstrapResolversLegacy
 	}
 	if len(config.BootstrapResolvers) > 0 {
-		for _, resolver := range config.BootstrapResolvers {
-			if err := isIPAndPort(resolver); err != nil {
-				return fmt.Errorf("Bootstrap resolver [%v]: %v", resolver, err)
-			}
+		bootstrapResolvers, priorities, err := parseBootstrapResolvers(config.BootstrapResolvers)
+		if err != nil {
+			return err
 		}
+		config.BootstrapResolvers = bootstrapResolvers
+		proxy.xTransport.resolverPriorities = priorities
 		proxy.xTransport.ignoreSystemDNS = config.IgnoreSystemDNS
 	}
 	proxy.xTransport.bootstrapResolvers = config.BootstrapResolvers
+
+	// Configure the order of resolution strategies, overriding ignore_system_dns
+	if len(config.ResolutionOrder) > 0 {
+		if err := validateResolutionOrder(config.ResolutionOrder); err != nil {
+			return err
+		}
+		proxy.xTransport.resolutionOrder = config.ResolutionOrder
+		dlog.Noticef("Resolution order for server names: %v", config.ResolutionOrder)
+	}
+
+	// Configure static IP addresses of server names, that are never resolved
+	if len(config.ProviderIPOverrides) > 0 {
+		overrides := make(map[string]net.IP, len(config.ProviderIPOverrides))
+		for host, ipStr := range config.ProviderIPOverrides {
+			ip := ParseIP(ipStr)
+			if ip == nil {
+				return fmt.Errorf("Invalid IP address for [%s] in provider_ip_overrides: [%s]", host, ipStr)
+			}
+			overrides[host] = ip
+		}
+		proxy.xTransport.setIPOverrides(overrides)
+	}
+
+	// Seed the cache with IP addresses of server names known in advance, that are resolved again once they expire
+	for host, cachedIPsConfig := range config.CachedIPs {
+		ips := make([]net.IP, 0, len(cachedIPsConfig.IPs))
+		for _, ipStr := range cachedIPsConfig.IPs {
+			ip := ParseIP(ipStr)
+			if ip == nil {
+				return fmt.Errorf("Invalid IP address for [%s] in cached_ips: [%s]", host, ipStr)
+			}
+			ips = append(ips, ip)
+		}
+		if cachedIPsConfig.TTL < 0 {
+			return fmt.Errorf("The TTL of [%s] in cached_ips cannot be negative", host)
+		}
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		proxy.xTransport.saveCachedIPs(host, ips, time.Duration(cachedIPsConfig.TTL)*time.Second)
+	}
+
 	proxy.xTransport.useIPv4 = config.SourceIPv4
 	proxy.xTransport.useIPv6 = config.SourceIPv6
+	if config.KeepAlive < 0 {
+		dlog.Warnf("keepalive cannot be negative, disabling it")
+		config.KeepAlive = 0
+	}
 	proxy.xTransport.keepAlive = time.Duration(config.KeepAlive) * time.Second
+	proxy.xTransport.tcpNoDelay = config.TCPNoDelay
+	if config.SourceMaxRedirects < 0 {
+		return errors.New("source_max_redirects cannot be negative")
+	}
+	proxy.xTransport.sourceMaxRedirects = config.SourceMaxRedirects
+	if config.HTTPCache {
+		proxy.xTransport.httpCache = NewHTTPCache()
+	}
+	if err := validateContentEncodings(config.SourceContentEncodings); err != nil {
+		return err
+	}
+	proxy.xTransport.contentEncodings = config.SourceContentEncodings
+	if config.MaxDecompressedBody <= 0 {
+		return errors.New("max_decompressed_body must be positive")
+	}
+	proxy.xTransport.maxDecompressedBody = config.MaxDecompressedBody
+	if config.DoHDedupWindow < 0 {
+		return errors.New("doh_dedup_window cannot be negative")
+	}
+	proxy.xTransport.dohDedupWindow = time.Duration(config.DoHDedupWindow) * time.Millisecond
+	if config.DoHCoalescing {
+		proxy.xTransport.dohCoalescing = NewDoHCoalescing()
+	}
+	switch config.DoHContentTypeCheck {
+	case DoHContentTypeCheckReject, DoHContentTypeCheckWarn:
+		proxy.xTransport.dohContentTypeCheck = config.DoHContentTypeCheck
+	default:
+		return fmt.Errorf("Unsupported doh_content_type_check value: [%s]", config.DoHContentTypeCheck)
+	}
 
 	// Configure HTTP proxy URL if specified
 	if len(config.HTTPProxyURL) > 0 {
@@ -165,8 +264,51 @@ func configureDoHClientAuth(proxy *Proxy, config *Config) error {
 // configureServerParams - Configures server parameters
 func configureServerParams(proxy *Proxy, config *Config) {
 	proxy.blockedQueryResponse = config.BlockedQueryResponse
+	proxy.negativeSOA = config.NegativeSOA
+	if len(config.NegativeSOAMName) == 0 || len(config.NegativeSOARName) == 0 {
+		dlog.Fatal("negative_soa_mname and negative_soa_rname cannot be empty")
+	}
+	proxy.negativeSOAMName = fqdn(config.NegativeSOAMName)
+	proxy.negativeSOARName = fqdn(config.NegativeSOARName)
 	proxy.timeout = time.Duration(config.Timeout) * time.Millisecond
+	if config.QueryDeadline < 0 {
+		dlog.Warnf("query_deadline cannot be negative, disabling it")
+		config.QueryDeadline = 0
+	}
+	proxy.queryDeadline = time.Duration(config.QueryDeadline) * time.Millisecond
+	switch config.OnMalformedResponse {
+	case OnMalformedResponseDrop, OnMalformedResponseServFail, OnMalformedResponseRetry:
+		proxy.onMalformedResponse = config.OnMalformedResponse
+	default:
+		dlog.Fatalf("Unsupported on_malformed_response value: [%s]", config.OnMalformedResponse)
+	}
+	switch config.DNSCryptTruncated {
+	case DNSCryptTruncatedResponseTCP, DNSCryptTruncatedResponseClient:
+		proxy.dnscryptTruncatedResponse = config.DNSCryptTruncated
+	default:
+		dlog.Fatalf("Unsupported dnscrypt_truncated_response value: [%s]", config.DNSCryptTruncated)
+	}
+	switch config.OnQuestionMismatch {
+	case OnQuestionMismatchServFail, OnQuestionMismatchRetry, OnQuestionMismatchIgnore:
+		proxy.onQuestionMismatch = config.OnQuestionMismatch
+	default:
+		dlog.Fatalf("Unsupported on_question_mismatch value: [%s]", config.OnQuestionMismatch)
+	}
+	switch config.OnCaseMismatch {
+	case OnCaseMismatchNormalize, OnCaseMismatchAccept, OnCaseMismatchReject:
+		proxy.onCaseMismatch = config.OnCaseMismatch
+	default:
+		dlog.Fatalf("Unsupported on_case_mismatch value: [%s]", config.OnCaseMismatch)
+	}
+	if config.ShutdownGracePeriod < 0 {
+		dlog.Fatal("shutdown_grace_period cannot be negative")
+	}
+	proxy.shutdownGracePeriod = time.Duration(config.ShutdownGracePeriod) * time.Second
 	proxy.maxClients = config.MaxClients
+	if config.TCPClientKeepalive < 0 {
+		dlog.Fatal("tcp_client_keepalive_ms cannot be negative")
+	}
+	proxy.tcpClientKeepalive = time.Duration(config.TCPClientKeepalive) * time.Millisecond
 	proxy.timeoutLoadReduction = config.TimeoutLoadReduction
 	if proxy.timeoutLoadReduction < 0.0 || proxy.timeoutLoadReduction > 1.0 {
 		dlog.Warnf("timeout_load_reduction must be between 0.0 and 1.0, using default 0.75")
@@ -176,16 +318,142 @@ func configureServerParams(proxy *Proxy, config *Config) {
 	if config.ForceTCP {
 		proxy.xTransport.mainProto = "tcp"
 	}
+	if config.TCPPoolSize > 0 {
+		if config.TCPPoolIdleTimeout <= 0 {
+			dlog.Fatal("tcp_pool_idle_timeout must be positive")
+		}
+		proxy.tcpConnPool = NewTCPConnPool(config.TCPPoolSize, time.Duration(config.TCPPoolIdleTimeout)*time.Second)
+	}
 
 	// Configure certificate refresh parameters
 	proxy.certRefreshConcurrency = Max(1, config.CertRefreshConcurrency)
 	proxy.certRefreshDelay = time.Duration(Max(60, config.CertRefreshDelay)) * time.Minute
 	proxy.certRefreshDelayAfterFailure = time.Duration(10 * time.Second)
+	if config.CertRefreshMaxFailures < 0 {
+		dlog.Fatalf("Invalid cert_refresh_max_failures value: %d", config.CertRefreshMaxFailures)
+	}
+	proxy.certRefreshMaxFailures = config.CertRefreshMaxFailures
 	proxy.certIgnoreTimestamp = config.CertIgnoreTimestamp
+	proxy.certTimestampGrace = config.CertTimestampGrace
+	if config.WaitForClockSync < 0 {
+		dlog.Fatal("wait_for_clock_sync cannot be negative")
+	}
+	proxy.clockSyncTimeout = time.Duration(config.WaitForClockSync) * time.Second
+	if config.ClockSyncMinYear < 1970 {
+		dlog.Fatalf("Invalid clock_sync_min_year value: %d", config.ClockSyncMinYear)
+	}
+	proxy.clockSyncMinTime = time.Date(config.ClockSyncMinYear, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if config.CertTimestampTolerance < 0 {
+		dlog.Fatal("cert_timestamp_tolerance cannot be negative")
+	}
+	proxy.certTimestampTolerance = time.Duration(config.CertTimestampTolerance) * time.Minute
 	proxy.ephemeralKeys = config.EphemeralKeys
 	proxy.monitoringUI = config.MonitoringUI
 }
 
+// configureServerSettings - Configures per-server settings
+func configureServerSettings(proxy *Proxy, config *Config) error {
+	serverProxies := make(map[string]HostProxy)
+	serverCacheMaxTTLs := make(map[string]uint32)
+	serverAcceptHeaders := make(map[string]string)
+	serverURITemplates := make(map[string]*DoHURITemplate)
+	for serverName, settings := range config.ServerSettings {
+		if settings.MaxQPS < 0 {
+			return fmt.Errorf("max_qps for [%v] cannot be negative", serverName)
+		}
+		if settings.ConnectTimeout < 0 || settings.ResponseTimeout < 0 {
+			return fmt.Errorf("connect_timeout and response_timeout for [%v] cannot be negative", serverName)
+		}
+		switch settings.SessionResumption {
+		case "", TLSSessionResumptionAll, TLSSessionResumptionTLS13, TLSSessionResumptionNone:
+		default:
+			return fmt.Errorf("[%v]: unsupported tls_session_resumption value: [%s]", serverName, settings.SessionResumption)
+		}
+		if len(settings.ResolutionOrder) > 0 {
+			if err := validateResolutionOrder(settings.ResolutionOrder); err != nil {
+				return fmt.Errorf("[%v]: %v", serverName, err)
+			}
+		}
+		if len(settings.ExpectedCountries) > 0 && (proxy.ipOriginDatabases == nil || proxy.ipOriginDatabases.countryDB == nil) {
+			return fmt.Errorf("[%v]: expected_countries requires a country_database in [ip_origin]", serverName)
+		}
+		if len(settings.ExpectedASNs) > 0 && (proxy.ipOriginDatabases == nil || proxy.ipOriginDatabases.asnDB == nil) {
+			return fmt.Errorf("[%v]: expected_asns requires an asn_database in [ip_origin]", serverName)
+		}
+		if len(settings.Proxy) > 0 || len(settings.HTTPProxy) > 0 {
+			hostProxy, err := newHostProxy(settings.Proxy, settings.HTTPProxy)
+			if err != nil {
+				return fmt.Errorf("[%v]: %v", serverName, err)
+			}
+			serverProxies[serverName] = hostProxy
+		}
+		if settings.CacheMaxTTL > 0 {
+			serverCacheMaxTTLs[serverName] = settings.CacheMaxTTL
+		}
+		if settings.AcceptHeader != nil {
+			accept := strings.TrimSpace(*settings.AcceptHeader)
+			if len(accept) == 0 || !httpguts.ValidHeaderFieldValue(accept) {
+				return fmt.Errorf("[%v]: invalid accept_header: [%s]", serverName, *settings.AcceptHeader)
+			}
+			serverAcceptHeaders[serverName] = accept
+		}
+		if len(settings.URITemplate) > 0 {
+			uriTemplate, err := parseDoHURITemplate(settings.URITemplate)
+			if err != nil {
+				return fmt.Errorf("[%v]: invalid uri_template [%s]: %v", serverName, settings.URITemplate, err)
+			}
+			serverURITemplates[serverName] = uriTemplate
+		}
+	}
+	proxy.serverSettings = config.ServerSettings
+	proxy.serverProxies = serverProxies
+	proxy.serverCacheMaxTTLs = serverCacheMaxTTLs
+	proxy.serverAcceptHeaders = serverAcceptHeaders
+	proxy.serverURITemplates = serverURITemplates
+	return nil
+}
+
+// newHostProxy - Parses the proxy and HTTP proxy URLs used to connect to a specific server
+func newHostProxy(proxyURL, httpProxyURL string) (HostProxy, error) {
+	var hostProxy HostProxy
+	if len(proxyURL) > 0 {
+		proxyDialerURL, err := url.Parse(proxyURL)
+		if err != nil {
+			return hostProxy, fmt.Errorf("Unable to parse the proxy URL [%v]", proxyURL)
+		}
+		proxyDialer, err := netproxy.FromURL(proxyDialerURL, netproxy.Direct)
+		if err != nil {
+			return hostProxy, fmt.Errorf("Unable to use the proxy: [%v]", err)
+		}
+		hostProxy.dialer = &proxyDialer
+	}
+	if len(httpProxyURL) > 0 {
+		parsedURL, err := url.Parse(httpProxyURL)
+		if err != nil {
+			return hostProxy, fmt.Errorf("Unable to parse the HTTP proxy URL [%v]", httpProxyURL)
+		}
+		hostProxy.httpProxyURL = parsedURL
+	}
+	return hostProxy, nil
+}
+
+// validateResolutionOrder - Checks a list of resolution strategies
+func validateResolutionOrder(resolutionOrder []string) error {
+	seen := make(map[string]bool)
+	for _, strategy := range resolutionOrder {
+		switch strategy {
+		case ResolutionStrategyInternal, ResolutionStrategyBootstrap, ResolutionStrategySystem:
+		default:
+			return fmt.Errorf("Unknown resolution strategy [%v] in resolution_order", strategy)
+		}
+		if seen[strategy] {
+			return fmt.Errorf("Resolution strategy [%v] is listed more than once in resolution_order", strategy)
+		}
+		seen[strategy] = true
+	}
+	return nil
+}
+
 // configureLoadBalancing - Configures load balancing strategy
 func configureLoadBalancing(proxy *Proxy, config *Config) {
 	lbStrategy := LBStrategy(DefaultLBStrategy)
@@ -220,6 +488,68 @@ func configureLoadBalancing(proxy *Proxy, config *Config) {
 	}
 	proxy.serversInfo.lbStrategy = lbStrategy
 	proxy.serversInfo.lbEstimator = config.LBEstimator
+	proxy.serversInfo.lbExplorationRate = config.LBExplorationRate
+	if config.LBExplorationRate < 0.0 || config.LBExplorationRate > 1.0 {
+		dlog.Warnf("lb_exploration_rate must be between 0.0 and 1.0, disabling exploration")
+		proxy.serversInfo.lbExplorationRate = 0.0
+	}
+	if config.LBWarmupGrace < 0 {
+		dlog.Warnf("lb_warmup_grace cannot be negative, disabling it")
+		config.LBWarmupGrace = 0
+	}
+	proxy.serversInfo.lbWarmupGrace = time.Duration(config.LBWarmupGrace) * time.Second
+	proxy.serversInfo.lbStateFile = config.LBStateFile
+	if len(config.LBStateFile) > 0 {
+		if err := proxy.serversInfo.loadLBState(time.Duration(config.LBStateMaxAge) * time.Hour); err != nil {
+			dlog.Warnf("Unable to load the load balancing state: %v", err)
+		}
+	}
+	if config.Fanout < 0 {
+		dlog.Warnf("fanout cannot be negative, disabling it")
+		config.Fanout = 0
+	}
+	proxy.fanout = config.Fanout
+	proxy.fanoutRequireNoLog = config.FanoutRequireNoLog
+	configureQuorum(proxy, config)
+	configureCrossCheck(proxy, config)
+}
+
+// configureCrossCheck - Configures the domains whose responses are compared between two servers
+func configureCrossCheck(proxy *Proxy, config *Config) {
+	switch config.CrossCheckAction {
+	case CrossCheckActionLog, CrossCheckActionBlock:
+		proxy.crossCheckAction = config.CrossCheckAction
+	default:
+		dlog.Fatalf("Unsupported cross_check_action value: [%s]", config.CrossCheckAction)
+	}
+	for _, name := range config.CrossCheckDomains {
+		name = strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")
+		if len(name) > 0 {
+			proxy.crossCheckDomains = append(proxy.crossCheckDomains, name)
+		}
+	}
+}
+
+// configureQuorum - Configures the names whose responses have to be confirmed by several servers
+func configureQuorum(proxy *Proxy, config *Config) {
+	quorum := config.Quorum
+	if len(quorum.Names) == 0 {
+		return
+	}
+	if quorum.Servers < 2 {
+		dlog.Fatal("quorum.servers must be at least 2")
+	}
+	if quorum.MinAgree < 1 || quorum.MinAgree > quorum.Servers {
+		dlog.Fatalf("quorum.min_agree must be between 1 and quorum.servers (%d)", quorum.Servers)
+	}
+	for _, name := range quorum.Names {
+		name = strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")
+		if len(name) > 0 {
+			proxy.quorumNames = append(proxy.quorumNames, name)
+		}
+	}
+	proxy.quorumServers = quorum.Servers
+	proxy.quorumMinAgree = quorum.MinAgree
 }
 
 // configurePlugins - Configures DNS plugins
@@ -227,6 +557,32 @@ func configurePlugins(proxy *Proxy, config *Config) {
 	// Configure listen addresses and paths
 	proxy.listenAddresses = config.ListenAddresses
 	proxy.localDoHListenAddresses = config.LocalDoH.ListenAddresses
+	if config.ListenUDPRcvBuf < 0 || config.ListenUDPSndBuf < 0 {
+		dlog.Fatal("listen_udp_rcvbuf and listen_udp_sndbuf cannot be negative")
+	}
+	proxy.listenUDPRcvBuf = config.ListenUDPRcvBuf
+	proxy.listenUDPSndBuf = config.ListenUDPSndBuf
+	listenerProfiles, err := newListenerProfiles(config.ListenAddresses, config.ListenerProfiles)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	proxy.listenerProfiles = listenerProfiles
+	clientBlocklists, err := newClientBlocklists(config.ClientBlocklists)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	proxy.clientBlocklists = clientBlocklists
+	queryRoutes, err := newQueryRoutes(config.QueryRoutes)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	proxy.queryRoutes = queryRoutes
+	if (config.ListenReuseAddr || config.ListenReusePort) && !reuseOptionsSupported {
+		dlog.Warn("listen_reuse_addr and listen_reuse_port are not supported on this platform")
+	} else {
+		proxy.listenReuseAddr = config.ListenReuseAddr
+		proxy.listenReusePort = config.ListenReusePort
+	}
 
 	if len(config.LocalDoH.Path) > 0 && config.LocalDoH.Path[0] != '/' {
 		dlog.Fatalf("local DoH: [%s] cannot be a valid URL path. Read the documentation", config.LocalDoH.Path)
@@ -239,6 +595,38 @@ func configurePlugins(proxy *Proxy, config *Config) {
 	proxy.pluginBlockIPv6 = config.BlockIPv6
 	proxy.pluginBlockUnqualified = config.BlockUnqualified
 	proxy.pluginBlockUndelegated = config.BlockUndelegated
+	proxy.pluginPrivatePTR = config.PrivatePTR
+	proxy.privatePTRName = config.PrivatePTRName
+	proxy.pluginBlockRebinding = config.BlockRebinding
+	switch config.RebindingAction {
+	case RebindingActionNXDomain, RebindingActionStrip, RebindingActionLog:
+		proxy.rebindingAction = config.RebindingAction
+	default:
+		dlog.Fatalf("Unsupported rebinding_action value: [%s]", config.RebindingAction)
+	}
+	proxy.rebindingAllowedNames = config.RebindingAllowedNames
+	proxy.rebindingRanges = config.RebindingRanges
+
+	// Configure DNS flags handling
+	proxy.honorCDBit = config.HonorCDBit
+
+	// Configure query name limits
+	if config.MaxQNameLength < 0 || config.MaxQNameLabels < 0 {
+		dlog.Fatal("max_qname_length and max_qname_labels must not be negative")
+	}
+	proxy.maxQNameLength = config.MaxQNameLength
+	proxy.maxQNameLabels = config.MaxQNameLabels
+
+	// Configure the record types that can be queried
+	allowedQTypes, err := parseQTypes("allowed_qtypes", config.AllowedQTypes)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	blockedQTypes, err := parseQTypes("blocked_qtypes", config.BlockedQTypes)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	proxy.allowedQTypes, proxy.blockedQTypes = allowedQTypes, blockedQTypes
 
 	// Configure cache
 	proxy.cache = config.Cache
@@ -254,14 +642,97 @@ func configurePlugins(proxy *Proxy, config *Config) {
 
 	proxy.cacheMinTTL = config.CacheMinTTL
 	proxy.cacheMaxTTL = config.CacheMaxTTL
+	cacheTTLOverrides, err := parseCacheTTLOverrides(config.CacheTTLOverrides, proxy.cacheMinTTL, proxy.cacheMaxTTL)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	proxy.cacheTTLOverrides = cacheTTLOverrides
+	if threshold := strings.TrimSpace(config.CachePrefetchThreshold); len(threshold) > 0 {
+		if percent, found := strings.CutSuffix(threshold, "%"); found {
+			ratio, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+			if err != nil || ratio <= 0 || ratio >= 100 {
+				dlog.Fatalf("Invalid cache_prefetch_threshold: [%s]", config.CachePrefetchThreshold)
+			}
+			proxy.cachePrefetchRatio = ratio / 100.0
+		} else {
+			seconds, err := strconv.Atoi(threshold)
+			if err != nil || seconds <= 0 {
+				dlog.Fatalf("Invalid cache_prefetch_threshold: [%s]", config.CachePrefetchThreshold)
+			}
+			proxy.cachePrefetchThreshold = time.Duration(seconds) * time.Second
+		}
+	}
+	if config.CacheSlowUpstreamRTT < 0 || config.CacheSlowUpstreamStale < 0 {
+		dlog.Fatal("cache_slow_upstream_rtt and cache_slow_upstream_max_stale cannot be negative")
+	}
+	proxy.cacheSlowUpstreamRTT = time.Duration(config.CacheSlowUpstreamRTT) * time.Millisecond
+	proxy.cacheSlowUpstreamMaxStale = time.Duration(config.CacheSlowUpstreamStale) * time.Second
+	proxy.rotateAnswers = config.RotateAnswers
 	proxy.rejectTTL = config.RejectTTL
 	proxy.cloakTTL = config.CloakTTL
+	proxy.selfName = config.SelfName
+	proxy.localRecords = config.LocalRecords
+	proxy.nsid = config.NSID
 	proxy.cloakedPTR = config.CloakedPTR
+	proxy.cloakCNAME = config.CloakCNAME
 
 	// Configure query meta
 	proxy.queryMeta = config.QueryMeta
 }
 
+// parseQTypes - Parses a list of record types, given by name (e.g. "MX") or number (e.g. "TYPE65280" or "65280")
+func parseQTypes(option string, qTypeStrs []string) (map[uint16]struct{}, error) {
+	if len(qTypeStrs) == 0 {
+		return nil, nil
+	}
+	qTypes := make(map[uint16]struct{}, len(qTypeStrs))
+	for _, qTypeStr := range qTypeStrs {
+		name := strings.ToUpper(strings.TrimSpace(qTypeStr))
+		qType, ok := dns.StringToType[name]
+		if !ok {
+			number, err := strconv.ParseUint(strings.TrimPrefix(name, "TYPE"), 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Unknown record type in %s: [%s]", option, qTypeStr)
+			}
+			qType = uint16(number)
+		}
+		qTypes[qType] = struct{}{}
+	}
+	return qTypes, nil
+}
+
+// parseCacheTTLOverrides - Parses the per-type TTL bounds, using the global bounds when one is not set
+func parseCacheTTLOverrides(
+	overrides map[string]TTLOverrideConfig,
+	minTTL, maxTTL uint32,
+) (map[uint16]CacheTTLClamp, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+	clamps := make(map[uint16]CacheTTLClamp, len(overrides))
+	for qTypeStr, override := range overrides {
+		qType, ok := dns.StringToType[strings.ToUpper(qTypeStr)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown record type in cache_ttl_overrides: [%s]", qTypeStr)
+		}
+		clamp := CacheTTLClamp{minTTL: minTTL, maxTTL: maxTTL}
+		switch {
+		case override.MinTTL != nil && override.MaxTTL != nil:
+			if *override.MinTTL > *override.MaxTTL {
+				return nil, fmt.Errorf("cache_ttl_overrides: the minimum TTL for [%s] is above its maximum TTL", qTypeStr)
+			}
+			clamp = CacheTTLClamp{minTTL: *override.MinTTL, maxTTL: *override.MaxTTL}
+		case override.MinTTL != nil:
+			// A global bound conflicting with the one that was set is adjusted
+			clamp = CacheTTLClamp{minTTL: *override.MinTTL, maxTTL: max(maxTTL, *override.MinTTL)}
+		case override.MaxTTL != nil:
+			clamp = CacheTTLClamp{minTTL: min(minTTL, *override.MaxTTL), maxTTL: *override.MaxTTL}
+		}
+		clamps[qType] = clamp
+	}
+	return clamps, nil
+}
+
 // configureEDNSClientSubnet - Configures EDNS client subnet
 func configureEDNSClientSubnet(proxy *Proxy, config *Config) error {
 	if len(config.EDNSClientSubnet) != 0 {
@@ -274,6 +745,39 @@ func configureEDNSClientSubnet(proxy *Proxy, config *Config) error {
 			proxy.ednsClientSubnets = append(proxy.ednsClientSubnets, ipnet)
 		}
 	}
+	switch config.EDNSClientSubnetMode {
+	case ECSModeRandom, ECSModeFirst, ECSModePerDomain:
+		proxy.ednsClientSubnetMode = config.EDNSClientSubnetMode
+	default:
+		return fmt.Errorf("Unsupported edns_client_subnet_mode value: [%s]", config.EDNSClientSubnetMode)
+	}
+	return nil
+}
+
+// configureClientEDNSOptions - Configures the EDNS options removed from client queries
+func configureClientEDNSOptions(proxy *Proxy, config *Config) error {
+	parseCodes := func(key string, codes []int) ([]uint16, error) {
+		parsed := make([]uint16, 0, len(codes))
+		for _, code := range codes {
+			if code <= 0 || code > 0xffff {
+				return nil, fmt.Errorf("Invalid EDNS option code in %s: [%d]", key, code)
+			}
+			parsed = append(parsed, uint16(code))
+		}
+		return parsed, nil
+	}
+	var err error
+	if proxy.stripClientEDNSOptions, err = parseCodes("strip_client_edns_options", config.StripClientEDNSOptions); err != nil {
+		return err
+	}
+	if proxy.forwardClientEDNSOptions, err = parseCodes("forward_client_edns_options", config.ForwardClientEDNSOptions); err != nil {
+		return err
+	}
+	for _, code := range proxy.stripClientEDNSOptions {
+		if slices.Contains(proxy.forwardClientEDNSOptions, code) {
+			return fmt.Errorf("EDNS option %d is listed in both strip_client_edns_options and forward_client_edns_options", code)
+		}
+	}
 	return nil
 }
 
@@ -290,6 +794,21 @@ func configureQueryLog(proxy *Proxy, config *Config) error {
 	proxy.queryLogFile = config.QueryLog.File
 	proxy.queryLogFormat = config.QueryLog.Format
 	proxy.queryLogIgnoredQtypes = config.QueryLog.IgnoredQtypes
+	if config.QueryLog.SampleRate < 0 {
+		return errors.New("Query log sample_rate cannot be negative")
+	}
+	proxy.queryLogSampleRate = uint64(max(1, config.QueryLog.SampleRate))
+	proxy.queryLogNotableOnly = config.QueryLog.NotableOnly
+	proxy.queryLogUpstreamIP = config.QueryLog.UpstreamIP
+	if len(config.QueryLog.Remote) > 0 {
+		if config.QueryLog.BatchSize <= 0 || config.QueryLog.FlushInterval <= 0 {
+			return errors.New("Query log remote_batch_size and remote_flush_interval must be positive")
+		}
+		proxy.queryLogRemote = config.QueryLog.Remote
+		proxy.queryLogRemoteBatchSize = config.QueryLog.BatchSize
+		proxy.queryLogRemoteFlushInterval = time.Duration(config.QueryLog.FlushInterval) * time.Second
+	}
+	proxy.queryEventSocketPath = config.QueryEventSocket
 
 	return nil
 }
@@ -381,7 +900,15 @@ func configureBlockedIPs(proxy *Proxy, config *Config) error {
 	if config.BlockIP.Format != "tsv" && config.BlockIP.Format != "ltsv" {
 		return errors.New("Unsupported IP block log format")
 	}
+	switch config.BlockIP.Mode {
+	case "":
+		config.BlockIP.Mode = BlockIPModeResponse
+	case BlockIPModeResponse, BlockIPModeRecords:
+	default:
+		return fmt.Errorf("Unsupported blocked_ips mode: [%s]", config.BlockIP.Mode)
+	}
 	proxy.blockIPFile = config.BlockIP.File
+	proxy.blockIPMode = config.BlockIP.Mode
 	proxy.blockIPFormat = config.BlockIP.Format
 	proxy.blockIPLogFile = config.BlockIP.LogFile
 
@@ -438,6 +965,25 @@ func configureAnonymizedDNS(proxy *Proxy, config *Config) {
 
 	proxy.skipAnonIncompatibleResolvers = config.AnonymizedDNS.SkipIncompatible
 	proxy.anonDirectCertFallback = config.AnonymizedDNS.DirectCertFallback
+	proxy.relaysWithoutBodyHash = config.AnonymizedDNS.NoBodyHash
+}
+
+// configureEmergencyResolver - Configures the resolver used as a last resort, when no other servers are available
+func configureEmergencyResolver(proxy *Proxy, config *Config) error {
+	if len(config.EmergencyResolver) == 0 {
+		return nil
+	}
+	stamp, err := stamps.NewServerStampFromString(config.EmergencyResolver)
+	if err != nil {
+		return fmt.Errorf("Stamp error for the emergency resolver: [%v]", err)
+	}
+	switch stamp.Proto {
+	case stamps.StampProtoTypeDNSCrypt, stamps.StampProtoTypeDoH:
+	default:
+		return fmt.Errorf("The emergency resolver must be a DNSCrypt or DoH server, not [%v]", stamp.Proto)
+	}
+	proxy.emergencyResolver = &stamp
+	return nil
 }
 
 // configureSourceRestrictions - Configures server source restrictions
@@ -445,6 +991,7 @@ func configureSourceRestrictions(proxy *Proxy, flags *ConfigFlags, config *Confi
 	if *flags.ListAll {
 		config.ServerNames = nil
 		config.DisabledServerNames = nil
+		config.FallbackServerNames = nil
 		config.SourceRequireDNSSEC = false
 		config.SourceRequireNoFilter = false
 		config.SourceRequireNoLog = false
@@ -469,6 +1016,7 @@ func configureSourceRestrictions(proxy *Proxy, flags *ConfigFlags, config *Confi
 	proxy.requiredProps = requiredProps
 	proxy.ServerNames = config.ServerNames
 	proxy.DisabledServerNames = config.DisabledServerNames
+	proxy.FallbackServerNames = config.FallbackServerNames
 	proxy.SourceIPv4 = config.SourceIPv4
 	proxy.SourceIPv6 = config.SourceIPv6
 	proxy.SourceDNSCrypt = config.SourceDNSCrypt
@@ -495,12 +1043,24 @@ func determineNetprobeAddress(flags *ConfigFlags, config *Config) (string, int)
 
 // initializeNetworking - Initializes networking
 func initializeNetworking(proxy *Proxy, flags *ConfigFlags, config *Config) error {
-	isCommandMode := *flags.Check || proxy.showCerts || *flags.List || *flags.ListAll
+	isCommandMode := *flags.Check || proxy.showCerts || len(proxy.compareQuery) > 0 || *flags.List || *flags.ListAll
 	if isCommandMode {
 		return nil
 	}
 
 	netprobeAddress, netprobeTimeout := determineNetprobeAddress(flags, config)
+	if len(config.NetprobeQuery) > 0 {
+		if _, err := netProbeQuery(config.NetprobeQuery); err != nil {
+			return fmt.Errorf("Invalid netprobe_query [%s]: %w", config.NetprobeQuery, err)
+		}
+		proxy.netprobeQuery = config.NetprobeQuery
+	}
+	switch config.NetprobeFailureAction {
+	case NetprobeFailureActionContinue, NetprobeFailureActionRetry, NetprobeFailureActionExit:
+		proxy.netprobeFailureAction = config.NetprobeFailureAction
+	default:
+		return fmt.Errorf("Unsupported netprobe_failure_action value: [%s]", config.NetprobeFailureAction)
+	}
 	if err := NetProbe(proxy, netprobeAddress, netprobeTimeout); err != nil {
 		return err
 	}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+func TestCheckServerNames(t *testing.T) {
+	var bin strings.Builder
+	for _, name := range []string{"alpha", "beta"} {
+		stamp := stamps.ServerStamp{Proto: stamps.StampProtoTypeDoH, ProviderName: name + ".example", Path: "/dns-query"}
+		bin.WriteString("## " + name + "\n" + stamp.String() + "\n\n")
+	}
+	newProxy := func(serverNames ...string) *Proxy {
+		proxy := NewProxy()
+		proxy.SourceDoH = true
+		proxy.ServerNames = serverNames
+		proxy.queryRoutes = []QueryRoute{{zone: "corp.example", serverNames: []string{"beta"}}}
+		proxy.sources = []*Source{{name: "test", format: SourceFormatV2, bin: []byte(bin.String())}}
+		if err := proxy.updateRegisteredServers(); err != nil {
+			t.Fatal(err)
+		}
+		return proxy
+	}
+	registeredNames := func(proxy *Proxy) []string {
+		var names []string
+		for _, registeredServer := range proxy.registeredServers {
+			names = append(names, registeredServer.name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	logFile, err := os.Create(filepath.Join(t.TempDir(), "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousLogFile, previousLogLevel := dlog.GetFileDescriptor(), dlog.LogLevel()
+	dlog.UseSyslog(false)
+	dlog.SetLogLevel(dlog.SeverityWarning)
+	dlog.SetFileDescriptor(logFile)
+	t.Cleanup(func() {
+		dlog.SetFileDescriptor(previousLogFile)
+		dlog.SetLogLevel(previousLogLevel)
+		logFile.Close()
+	})
+
+	proxy := newProxy("alpha", "gamma")
+	if err := proxy.checkServerNames(true); err != nil {
+		t.Fatal(err)
+	}
+	if names := registeredNames(proxy); !slices.Equal(names, []string{"alpha", "beta"}) {
+		t.Errorf("registered servers = %v, want [alpha beta]", names)
+	}
+	log, err := os.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), "Servers not found in the configured sources: [gamma]") {
+		t.Errorf("missing servers should be logged, got %q", log)
+	}
+
+	proxy = newProxy("gamma")
+	if err := proxy.checkServerNames(true); err != nil {
+		t.Fatal(err)
+	}
+	if names := registeredNames(proxy); !slices.Equal(names, []string{"beta"}) {
+		t.Errorf("strict: registered servers = %v, want the route server only", names)
+	}
+
+	proxy = newProxy("gamma")
+	if err := proxy.checkServerNames(false); err != nil {
+		t.Fatal(err)
+	}
+	if names := registeredNames(proxy); !slices.Equal(names, []string{"alpha", "beta"}) {
+		t.Errorf("not strict: registered servers = %v, want [alpha beta]", names)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ContentEncodingGzip   = "gzip"
+	ContentEncodingBrotli = "br"
+	ContentEncodingZstd   = "zstd"
+
+	// Largest zstd window accepted, to bound memory usage when decoding untrusted responses
+	MaxZstdWindowSize = 8 * 1024 * 1024
+
+	// Responses decompressing to more than MaxCompressionRatio times their compressed size are rejected,
+	// once at least CompressionRatioCheckThreshold bytes have been decompressed
+	MaxCompressionRatio            = 100
+	CompressionRatioCheckThreshold = 64 * 1024
+)
+
+var (
+	ErrDecompressedBodyTooLarge = errors.New("Decompressed response body is too large")
+	ErrSuspiciousCompression    = errors.New("Suspicious compression ratio in response body")
+)
+
+// Content encodings requested for source downloads, by order of preference
+var DefaultContentEncodings = []string{ContentEncodingZstd, ContentEncodingBrotli, ContentEncodingGzip}
+
+func validateContentEncodings(encodings []string) error {
+	for _, encoding := range encodings {
+		switch encoding {
+		case ContentEncodingGzip, ContentEncodingBrotli, ContentEncodingZstd:
+		default:
+			return fmt.Errorf("Unsupported content encoding: [%s]", encoding)
+		}
+	}
+	return nil
+}
+
+// acceptEncodingHeader returns the value of the Accept-Encoding header for a list of encodings
+func acceptEncodingHeader(encodings []string) string {
+	return strings.Join(encodings, ", ")
+}
+
+// newContentDecoder returns a reader decoding a response body, or nil if the encoding is not supported.
+// Reading fails once more than maxSize bytes have been decoded, or if the compression ratio is suspicious.
+func newContentDecoder(encoding string, reader io.Reader, maxSize int64) (io.ReadCloser, error) {
+	compressed := &countingReader{reader: reader}
+	var decoder io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case ContentEncodingGzip:
+		gzipReader, err := gzip.NewReader(compressed)
+		if err != nil {
+			return nil, err
+		}
+		decoder = gzipReader
+	case ContentEncodingBrotli:
+		decoder = io.NopCloser(brotli.NewReader(compressed))
+	case ContentEncodingZstd:
+		zstdDecoder, err := zstd.NewReader(
+			compressed,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(MaxZstdWindowSize),
+			zstd.WithDecoderMaxMemory(uint64(maxSize)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		decoder = zstdDecoder.IOReadCloser()
+	default:
+		return nil, nil
+	}
+	return &boundedDecoder{decoder: decoder, compressed: compressed, maxSize: maxSize}, nil
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.count += int64(n)
+	return n, err
+}
+
+// boundedDecoder aborts decompression early, instead of reading a decompression bomb up to the size limit
+type boundedDecoder struct {
+	decoder      io.ReadCloser
+	compressed   *countingReader
+	decompressed int64
+	maxSize      int64
+}
+
+func (bounded *boundedDecoder) Read(p []byte) (int, error) {
+	n, err := bounded.decoder.Read(p)
+	bounded.decompressed += int64(n)
+	if bounded.decompressed > bounded.maxSize {
+		return 0, ErrDecompressedBodyTooLarge
+	}
+	if bounded.decompressed > CompressionRatioCheckThreshold &&
+		bounded.decompressed > MaxCompressionRatio*bounded.compressed.count {
+		return 0, ErrSuspiciousCompression
+	}
+	return n, err
+}
+
+func (bounded *boundedDecoder) Close() error {
+	return bounded.decoder.Close()
+}
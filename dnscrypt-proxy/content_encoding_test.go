@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func encodeContent(t *testing.T, encoding string, content []byte) []byte {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case ContentEncodingGzip:
+		writer = gzip.NewWriter(&buf)
+	case ContentEncodingBrotli:
+		writer = brotli.NewWriter(&buf)
+	case ContentEncodingZstd:
+		encoder, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer = encoder
+	}
+	if _, err := writer.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchContentEncodings(t *testing.T) {
+	content := []byte(strings.Repeat("example.com\n", 1000))
+	var acceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		encoding := strings.TrimPrefix(r.URL.Path, "/")
+		if encoding == "identity" {
+			w.Write(content)
+			return
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(encodeContent(t, encoding, content))
+	}))
+	defer server.Close()
+
+	xTransport := NewXTransport()
+	xTransport.rebuildTransport()
+	for _, encoding := range []string{ContentEncodingZstd, ContentEncodingBrotli, ContentEncodingGzip, "identity"} {
+		t.Run(encoding, func(t *testing.T) {
+			u, err := url.Parse(server.URL + "/" + encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bin, _, _, _, err := xTransport.GetWithCompression(u, "", 5*time.Second)
+			if err != nil {
+				t.Fatalf("GetWithCompression() error = %v", err)
+			}
+			if !bytes.Equal(bin, content) {
+				t.Errorf("decoded body doesn't match, got %d bytes", len(bin))
+			}
+			if acceptEncoding != "zstd, br, gzip" {
+				t.Errorf("Accept-Encoding = %q", acceptEncoding)
+			}
+		})
+	}
+}
+
+func TestFetchDecompressionLimits(t *testing.T) {
+	random := make([]byte, 50000)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	payloads := map[string][]byte{
+		"bomb":   bytes.Repeat([]byte{0}, 10*MaxHTTPBodyLength),
+		"random": random,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", ContentEncodingGzip)
+		w.Write(encodeContent(t, ContentEncodingGzip, payloads[strings.TrimPrefix(r.URL.Path, "/")]))
+	}))
+	defer server.Close()
+
+	xTransport := NewXTransport()
+	xTransport.rebuildTransport()
+	fetch := func(name string) error {
+		u, err := url.Parse(server.URL + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, _, err = xTransport.GetWithCompression(u, "", 5*time.Second)
+		return err
+	}
+	if err := fetch("bomb"); !errors.Is(err, ErrSuspiciousCompression) {
+		t.Errorf("highly compressed payload: err = %v, want ErrSuspiciousCompression", err)
+	}
+	if err := fetch("random"); err != nil {
+		t.Errorf("payload within the limit: err = %v", err)
+	}
+	xTransport.maxDecompressedBody = 20000
+	if err := fetch("random"); !errors.Is(err, ErrDecompressedBodyTooLarge) {
+		t.Errorf("payload over max_decompressed_body: err = %v, want ErrDecompressedBodyTooLarge", err)
+	}
+}
+
+func TestValidateContentEncodings(t *testing.T) {
+	if err := validateContentEncodings([]string{"br", "gzip"}); err != nil {
+		t.Errorf("validateContentEncodings() error = %v", err)
+	}
+	if err := validateContentEncodings([]string{"deflate"}); err == nil {
+		t.Error("unsupported encodings should be rejected")
+	}
+}
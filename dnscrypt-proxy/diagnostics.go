@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// diagnosticsReport - Returns a snapshot of the state of the transport, of the caches and of the servers,
+// meant to be logged to diagnose issues. Every structure is only locked while it is being copied.
+func (proxy *Proxy) diagnosticsReport(now time.Time) []string {
+	xTransport := proxy.xTransport
+	report := []string{
+		"Transport:",
+		fmt.Sprintf("  main protocol: [%s], timeout: %v, keepalive: %v", xTransport.mainProto, xTransport.timeout, xTransport.keepAlive),
+		fmt.Sprintf("  IPv4: %v, IPv6: %v, HTTP/3: %v (probe: %v)", xTransport.useIPv4, xTransport.useIPv6, xTransport.http3, xTransport.http3Probe),
+		fmt.Sprintf("  bootstrap resolvers: %v, resolution order: %v, ignore system DNS: %v",
+			xTransport.bootstrapResolvers, xTransport.resolutionOrder, xTransport.ignoreSystemDNS),
+		fmt.Sprintf("  internal resolver ready: %v, proxy: %v", xTransport.internalResolverReady,
+			xTransport.proxyDialer != nil || xTransport.httpProxyFunction != nil),
+	}
+
+	report = append(report, "Connectivity:")
+	if xTransport.ipv6FastFail.Suppressed(now) {
+		report = append(report, "  IPv6: suppressed after consecutive connection failures")
+	} else {
+		report = append(report, "  IPv6: not suppressed")
+	}
+
+	report = append(report, "Cached IP addresses:")
+	report = append(report, xTransport.cachedIPs.diagnostics(now)...)
+	report = append(report, "Alt-Svc (HTTP/3) cache:")
+	report = append(report, xTransport.altSupport.diagnostics(now)...)
+	report = append(report, "Servers:")
+	report = append(report, proxy.serversInfo.diagnostics()...)
+	report = append(report, "TLS versions and cipher suites:")
+	tlsStats := proxy.serversInfo.tlsStatsSnapshot()
+	for _, entry := range tlsStats {
+		report = append(report, fmt.Sprintf("  %s: %s, %s: %d responses", entry.Server, entry.Version, entry.CipherSuite, entry.Responses))
+	}
+	if len(tlsStats) == 0 {
+		report = append(report, "  no responses received over TLS")
+	}
+	return report
+}
+
+// logDiagnostics - Logs the diagnostics report
+func (proxy *Proxy) logDiagnostics() {
+	dlog.Notice("Diagnostics report")
+	for _, line := range proxy.diagnosticsReport(time.Now()) {
+		dlog.Notice(line)
+	}
+}
+
+func (cachedIPs *CachedIPs) diagnostics(now time.Time) []string {
+	cachedIPs.RLock()
+	lines := make([]string, 0, len(cachedIPs.cache))
+	for host, item := range cachedIPs.cache {
+		ips := make([]string, len(item.ips))
+		for i, ip := range item.ips {
+			ips[i] = ip.String()
+		}
+		ttl := "never expires"
+		if item.expiration != nil {
+			ttl = "expires in " + item.expiration.Sub(now).Truncate(time.Second).String()
+		}
+		updating := ""
+		if item.updatingUntil != nil && now.Before(*item.updatingUntil) {
+			updating = ", being updated"
+		}
+		lines = append(lines, fmt.Sprintf("  %s: [%s] (%s%s)", host, strings.Join(ips, ", "), ttl, updating))
+	}
+	cachedIPs.RUnlock()
+	slices.Sort(lines)
+	return lines
+}
+
+func (altSupport *AltSupport) diagnostics(now time.Time) []string {
+	altSupport.RLock()
+	lines := make([]string, 0, len(altSupport.cache))
+	for host, entry := range altSupport.cache {
+		port := fmt.Sprintf("port %d", entry.port)
+		if entry.port == 0 {
+			port = "HTTP/3 failed"
+		}
+		ttl := "never expires"
+		if !entry.expiration.IsZero() {
+			ttl = "expires in " + entry.expiration.Sub(now).Truncate(time.Second).String()
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s (%s)", host, port, ttl))
+	}
+	altSupport.RUnlock()
+	slices.Sort(lines)
+	return lines
+}
+
+func (serversInfo *ServersInfo) diagnostics() []string {
+	certRefreshStats := serversInfo.certRefreshSnapshot()
+	connTimings := serversInfo.connTimingsSnapshot()
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	lines := []string{}
+	if serversInfo.fallbackMode {
+		lines = append(lines, "  fallback mode is active")
+	}
+	describe := func(server *ServerInfo, role string) {
+		line := fmt.Sprintf("  %s%s [%s]", server.Name, role, server.Proto.String())
+		if server.TCPAddr != nil {
+			line += " " + server.TCPAddr.String()
+		} else if server.URL != nil {
+			line += " " + server.URL.Host
+		}
+		line += fmt.Sprintf(": rtt: %dms, queries: %d, failures: %d", int(server.rtt.Value()), server.totalQueries, server.failedQueries)
+		if server.Relay != nil {
+			line += ", relay: " + server.Relay.Name
+		}
+		if stats, ok := certRefreshStats[server.Name]; ok && stats.ConsecutiveFailures > 0 {
+			line += fmt.Sprintf(", consecutive certificate refresh failures: %d", stats.ConsecutiveFailures)
+		}
+		if server.rateCapped {
+			line += ", rate capped"
+		}
+		if timing, ok := connTimings[server.Name]; ok {
+			line += fmt.Sprintf(", new connections: %d (setup: %dms, request: %dms), reused connections: %d (request: %dms)",
+				timing.NewConnections, timing.AverageSetupTime().Milliseconds(), timing.AverageRequestTime(false).Milliseconds(),
+				timing.ReusedConnections, timing.AverageRequestTime(true).Milliseconds())
+		}
+		lines = append(lines, line)
+	}
+	for _, server := range serversInfo.inner {
+		describe(server, "")
+	}
+	for _, server := range serversInfo.fallback {
+		describe(server, " (fallback)")
+	}
+	for _, server := range serversInfo.routeOnly {
+		describe(server, " (query routes only)")
+	}
+	if serversInfo.emergency != nil {
+		describe(serversInfo.emergency, " (emergency resolver, in use)")
+	}
+	for name, stats := range certRefreshStats {
+		if stats.Excluded {
+			lines = append(lines, fmt.Sprintf("  %s: excluded after %d certificate refresh failures", name, stats.ConsecutiveFailures))
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "  no live servers")
+	}
+	return lines
+}
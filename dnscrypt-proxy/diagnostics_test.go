@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/ewma"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+func TestDiagnosticsReport(t *testing.T) {
+	proxy := &Proxy{xTransport: NewXTransport(), serversInfo: NewServersInfo()}
+	proxy.xTransport.saveCachedIP("doh.example.com", ParseIP("192.0.2.1"), -1)
+	proxy.xTransport.altSupport.set("doh.example.com", 443, 0)
+	proxy.xTransport.altSupport.set("h2only.example.com", 0, time.Hour)
+	server := &ServerInfo{Name: "example", Proto: stamps.StampProtoTypeDoH, rtt: ewma.NewMovingAverage(RTTEwmaDecay), totalQueries: 10, failedQueries: 1}
+	server.rtt.Set(42)
+	proxy.serversInfo.inner = []*ServerInfo{server}
+
+	report := strings.Join(proxy.diagnosticsReport(time.Now()), "\n")
+	for _, want := range []string{
+		"doh.example.com: [192.0.2.1] (never expires)",
+		"doh.example.com: port 443 (never expires)",
+		"h2only.example.com: HTTP/3 failed (expires in",
+		"example [DoH]: rtt: 42ms, queries: 10, failures: 1",
+		"IPv6: not suppressed",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report doesn't contain [%s]:\n%s", want, report)
+		}
+	}
+}
+
+func TestDiagnosticsReportUnderLoad(t *testing.T) {
+	proxy := &Proxy{xTransport: NewXTransport(), serversInfo: NewServersInfo()}
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Go(func() {
+			for j := range 100 {
+				host := fmt.Sprintf("host%d-%d.example.com", i, j)
+				proxy.xTransport.saveCachedIP(host, ParseIP("192.0.2.1"), time.Hour)
+				proxy.xTransport.altSupport.set(host, 443, time.Hour)
+			}
+		})
+	}
+	for range 10 {
+		proxy.diagnosticsReport(time.Now())
+	}
+	wg.Wait()
+	if lines := proxy.xTransport.cachedIPs.diagnostics(time.Now()); len(lines) != 400 {
+		t.Errorf("got %d cached entries, want 400", len(lines))
+	}
+}
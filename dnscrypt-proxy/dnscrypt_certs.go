@@ -9,15 +9,66 @@
 
 	"codeberg.org/miekg/dns"
 	"github.com/jedisct1/dlog"
+	clocksmith "github.com/jedisct1/go-clocksmith"
 	"golang.org/x/crypto/ed25519"
 )
 
+// A clock set to an earlier date has most likely not been synchronized yet
+var MinSynchronizedClockTime = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ClockSyncPollInterval - How often the clock is checked while waiting for it to be synchronized
+const ClockSyncPollInterval = time.Second
+
+// clockLooksSynchronized returns true if the clock is set to a date after clock_sync_min_year
+func (proxy *Proxy) clockLooksSynchronized(now time.Time) bool {
+	minTime := proxy.clockSyncMinTime
+	if minTime.IsZero() {
+		minTime = MinSynchronizedClockTime
+	}
+	return !now.Before(minTime)
+}
+
+// waitForClockSync delays the initial certificate refresh until the clock looks synchronized, for at most
+// wait_for_clock_sync seconds. It returns false if the clock still doesn't look synchronized after that.
+func (proxy *Proxy) waitForClockSync() bool {
+	if proxy.clockSyncTimeout <= 0 || proxy.clockLooksSynchronized(time.Now()) {
+		return true
+	}
+	dlog.Noticef("The system clock doesn't look synchronized - Waiting up to %v before refreshing certificates", proxy.clockSyncTimeout)
+	start := time.Now()
+	for time.Since(start) < proxy.clockSyncTimeout {
+		clocksmith.Sleep(min(ClockSyncPollInterval, proxy.clockSyncTimeout))
+		if proxy.clockLooksSynchronized(time.Now()) {
+			dlog.Noticef("The system clock is now synchronized, after %v", time.Since(start).Truncate(time.Second))
+			return true
+		}
+	}
+	dlog.Warnf("The system clock still doesn't look synchronized after %v - Refreshing certificates anyway", proxy.clockSyncTimeout)
+	return false
+}
+
+// inClockSyncGrace returns true if cert_timestamp_grace_until_clock_sync is set, and the clock has never looked
+// synchronized so far. Certificate timestamps are not checked until then.
+func (proxy *Proxy) inClockSyncGrace(now time.Time) bool {
+	if !proxy.certTimestampGrace || proxy.clockSynchronized.Load() {
+		return false
+	}
+	if !proxy.clockLooksSynchronized(now) {
+		return true
+	}
+	if proxy.clockSynchronized.CompareAndSwap(false, true) {
+		dlog.Notice("The system clock looks synchronized - Certificate timestamps are now checked")
+	}
+	return false
+}
+
 type CertInfo struct {
 	ServerPk           [32]byte
 	SharedKey          [32]byte
 	MagicQuery         [ClientMagicLen]byte
 	CryptoConstruction CryptoConstruction
 	ForwardSecurity    bool
+	NotBefore          time.Time
 }
 
 func FetchCurrentDNSCryptCert(
@@ -71,6 +122,11 @@ func FetchCurrentDNSCryptCert(
 		return CertInfo{}, 0, fragmentsBlocked, err
 	}
 	now := uint32(time.Now().Unix())
+	ignoreTimestamps := proxy.certIgnoreTimestamp
+	if !ignoreTimestamps && proxy.inClockSyncGrace(time.Now()) {
+		dlog.Debugf("[%v] The system clock doesn't look synchronized yet - Not checking certificate timestamps", *serverName)
+		ignoreTimestamps = true
+	}
 	certInfo := CertInfo{CryptoConstruction: UndefinedConstruction}
 	highestSerial := uint32(0)
 	certCountStr := ""
@@ -139,16 +195,26 @@ func FetchCurrentDNSCryptCert(
 		} else {
 			certInfo.ForwardSecurity = true
 		}
-		if !proxy.certIgnoreTimestamp {
+		if !ignoreTimestamps {
 			if now > tsEnd || now < tsBegin {
-				dlog.Debugf(
-					"[%v] Certificate not valid at the current date (now: %v is not in [%v..%v])",
+				tolerance := int64(proxy.certTimestampTolerance.Seconds())
+				if int64(now) > int64(tsEnd)+tolerance || int64(now)+tolerance < int64(tsBegin) {
+					dlog.Debugf(
+						"[%v] Certificate not valid at the current date (now: %v is not in [%v..%v])",
+						*serverName,
+						now,
+						tsBegin,
+						tsEnd,
+					)
+					continue
+				}
+				dlog.Warnf(
+					"[%v] Certificate accepted within the clock skew tolerance (now: %v is not in [%v..%v]) -- check the system clock",
 					*serverName,
 					now,
 					tsBegin,
 					tsEnd,
 				)
-				continue
 			}
 		}
 		if serial < highestSerial {
@@ -173,6 +239,7 @@ func FetchCurrentDNSCryptCert(
 		certInfo.SharedKey = sharedKey
 		highestSerial = serial
 		certInfo.CryptoConstruction = cryptoConstruction
+		certInfo.NotBefore = time.Unix(int64(tsBegin), 0)
 		copy(certInfo.ServerPk[:], serverPk[:])
 		copy(certInfo.MagicQuery[:], binCert[104:112])
 		if isNew {
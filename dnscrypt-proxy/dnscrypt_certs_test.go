@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestClockSyncGrace(t *testing.T) {
+	proxy := &Proxy{}
+	if proxy.inClockSyncGrace(time.Unix(0, 0)) {
+		t.Error("timestamps should always be checked without cert_timestamp_grace_until_clock_sync")
+	}
+
+	proxy.certTimestampGrace = true
+	if !proxy.inClockSyncGrace(time.Unix(0, 0)) {
+		t.Error("timestamps should not be checked while the clock is not synchronized")
+	}
+	if !proxy.inClockSyncGrace(MinSynchronizedClockTime.Add(-time.Hour)) {
+		t.Error("timestamps should not be checked while the clock is not synchronized")
+	}
+	if proxy.inClockSyncGrace(MinSynchronizedClockTime.Add(time.Hour)) {
+		t.Error("timestamps should be checked once the clock is synchronized")
+	}
+	if proxy.inClockSyncGrace(time.Unix(0, 0)) {
+		t.Error("timestamps should still be checked if the clock goes back after having been synchronized")
+	}
+}
+
+func TestWaitForClockSync(t *testing.T) {
+	proxy := &Proxy{}
+	if !proxy.waitForClockSync() {
+		t.Error("nothing should be waited for without wait_for_clock_sync")
+	}
+
+	proxy.clockSyncTimeout = 50 * time.Millisecond
+	proxy.clockSyncMinTime = time.Now().Add(-time.Hour)
+	if !proxy.waitForClockSync() {
+		t.Error("the clock should look synchronized")
+	}
+
+	proxy.clockSyncMinTime = time.Now().AddDate(100, 0, 0)
+	start := time.Now()
+	if proxy.waitForClockSync() {
+		t.Error("the clock shouldn't look synchronized")
+	}
+	if elapsed := time.Since(start); elapsed < proxy.clockSyncTimeout {
+		t.Errorf("returned after %v, before the %v timeout", elapsed, proxy.clockSyncTimeout)
+	}
+	if proxy.clockLooksSynchronized(MinSynchronizedClockTime) {
+		t.Error("clock_sync_min_year should override the default threshold")
+	}
+}
+
+// newTestCertServer returns the address of a server answering certificate queries with the given certificate
+func newTestCertServer(t *testing.T, binCert []byte) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var txt strings.Builder
+	for _, c := range binCert {
+		fmt.Fprintf(&txt, "\\%03d", c)
+	}
+	go func() {
+		buffer := make([]byte, MaxDNSPacketSize)
+		for {
+			length, clientAddr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			query := dns.Msg{Data: append([]byte{}, buffer[:length]...)}
+			if err := query.Unpack(); err != nil {
+				continue
+			}
+			response := EmptyResponseFromMessage(&query)
+			rr := new(dns.TXT)
+			rr.Hdr = dns.Header{Name: query.Question[0].Header().Name, Class: dns.ClassINET, TTL: 60}
+			rr.Txt = []string{txt.String()}
+			response.Answer = []dns.RR{rr}
+			if err := response.Pack(); err != nil {
+				continue
+			}
+			conn.WriteTo(response.Data, clientAddr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// signedTestCert returns a certificate valid from tsBegin to tsEnd, signed with the given key
+func signedTestCert(sk ed25519.PrivateKey, tsBegin, tsEnd int64) []byte {
+	binCert := make([]byte, 124)
+	copy(binCert, CertMagic[:])
+	binary.BigEndian.PutUint16(binCert[4:6], 0x0002)
+	binary.BigEndian.PutUint32(binCert[112:116], 1)
+	binary.BigEndian.PutUint32(binCert[116:120], uint32(tsBegin))
+	binary.BigEndian.PutUint32(binCert[120:124], uint32(tsEnd))
+	copy(binCert[8:72], ed25519.Sign(sk, binCert[72:]))
+	return binCert
+}
+
+func TestCertTimestampTolerance(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Margin for the time elapsed between the creation of a certificate and its check
+	const margin = 10
+	now := time.Now().Unix()
+	tolerance := 10 * time.Minute
+	toleranceSecs := int64(tolerance.Seconds())
+	tests := []struct {
+		name      string
+		tolerance time.Duration
+		tsBegin   int64
+		tsEnd     int64
+		accepted  bool
+	}{
+		{"valid", tolerance, now - 3600, now + 3600, true},
+		{"expired within the tolerance", tolerance, now - 7200, now - toleranceSecs + margin, true},
+		{"expired beyond the tolerance", tolerance, now - 7200, now - toleranceSecs - margin, false},
+		{"not yet valid within the tolerance", tolerance, now + toleranceSecs - margin, now + 7200, true},
+		{"not yet valid beyond the tolerance", tolerance, now + toleranceSecs + margin, now + 7200, false},
+		{"valid without tolerance", 0, now - 3600, now + 3600, true},
+		{"expired without tolerance", 0, now - 7200, now - margin, false},
+		{"not yet valid without tolerance", 0, now + margin, now + 7200, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := NewProxy()
+			proxy.timeout = 2 * time.Second
+			proxy.certTimestampTolerance = tt.tolerance
+			serverAddress := newTestCertServer(t, signedTestCert(sk, tt.tsBegin, tt.tsEnd))
+			serverName := "test"
+			certInfo, _, _, err := FetchCurrentDNSCryptCert(
+				proxy, &serverName, "udp", pk, serverAddress, "2.dnscrypt-cert.example.com", false, nil, ServerBugs{},
+			)
+			if accepted := err == nil; accepted != tt.accepted {
+				t.Fatalf("accepted = %v, want %v (%v)", accepted, tt.accepted, err)
+			}
+			if tt.accepted && certInfo.NotBefore.Unix() != tt.tsBegin {
+				t.Errorf("NotBefore = %v, want %v", certInfo.NotBefore.Unix(), tt.tsBegin)
+			}
+		})
+	}
+}
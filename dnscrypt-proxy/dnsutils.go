@@ -14,6 +14,11 @@
 	"github.com/jedisct1/dlog"
 )
 
+const (
+	DefaultNegativeSOAMName = "a.root-servers.net."
+	DefaultNegativeSOARName = "h.invalid."
+)
+
 func EmptyResponseFromMessage(srcMsg *dns.Msg) *dns.Msg {
 	dstMsg := &dns.Msg{}
 	dstMsg.ID = srcMsg.ID
@@ -31,6 +36,12 @@ func EmptyResponseFromMessage(srcMsg *dns.Msg) *dns.Msg {
 	return dstMsg
 }
 
+// clientUDPPayloadSize - Returns the maximum size of a UDP response to a query: 512 bytes without EDNS, or the
+// payload size the client advertised, that cannot be lower than 512 bytes (RFC 6891)
+func clientUDPPayloadSize(msg *dns.Msg) int {
+	return Max(int(msg.UDPSize), 512)
+}
+
 func TruncatedResponse(packet []byte) ([]byte, error) {
 	srcMsg := dns.Msg{Data: packet}
 	if err := srcMsg.Unpack(); err != nil {
@@ -44,6 +55,16 @@ func TruncatedResponse(packet []byte) ([]byte, error) {
 	return dstMsg.Data, nil
 }
 
+// ServerFailureResponseFromMessage - Returns a SERVFAIL response with an Extended DNS Error
+func ServerFailureResponseFromMessage(srcMsg *dns.Msg, infoCode uint16, extraText string) *dns.Msg {
+	dstMsg := EmptyResponseFromMessage(srcMsg)
+	dstMsg.Rcode = dns.RcodeServerFailure
+	if dstMsg.UDPSize > 0 {
+		dstMsg.Pseudo = append(dstMsg.Pseudo, &dns.EDE{InfoCode: infoCode, ExtraText: extraText})
+	}
+	return dstMsg
+}
+
 func RefusedResponseFromMessage(srcMsg *dns.Msg, refusedCode bool, ipv4 net.IP, ipv6 net.IP, ttl uint32) *dns.Msg {
 	// Create an empty response based on the source message
 	dstMsg := EmptyResponseFromMessage(srcMsg)
@@ -111,6 +132,15 @@ func RefusedResponseFromMessage(srcMsg *dns.Msg, refusedCode bool, ipv4 net.IP,
 	return dstMsg
 }
 
+// parentZone - Returns the parent zone of a fully qualified name, or the root zone for top-level names
+func parentZone(qName string) string {
+	i := strings.Index(qName, ".")
+	if i < 0 || i+1 >= len(qName) {
+		return "."
+	}
+	return qName[i+1:]
+}
+
 func HasTCFlag(packet []byte) bool {
 	return packet[2]&2 == 2
 }
@@ -255,6 +285,38 @@ func addEDNS0PaddingIfNoneFound(msg *dns.Msg, unpaddedPacket []byte, paddingLen
 	return msg.Data, nil
 }
 
+// removeTCPKeepalive removes the edns-tcp-keepalive option from a query, and returns true if it was present.
+// The option only applies to the connection between the client and the proxy, and is not forwarded.
+func removeTCPKeepalive(msg *dns.Msg) bool {
+	found := false
+	kept := msg.Pseudo[:0]
+	for _, rr := range msg.Pseudo {
+		if _, ok := rr.(*dns.TCPKEEPALIVE); ok {
+			found = true
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	msg.Pseudo = kept
+	return found
+}
+
+// addTCPKeepalive advertises how long a TCP connection is kept open to the client, in units of 100 milliseconds
+func addTCPKeepalive(packet []byte, timeout uint16) ([]byte, error) {
+	msg := dns.Msg{Data: packet}
+	if err := msg.Unpack(); err != nil {
+		return packet, err
+	}
+	if msg.UDPSize == 0 {
+		msg.UDPSize = uint16(MaxDNSPacketSize)
+	}
+	msg.Pseudo = append(msg.Pseudo, &dns.TCPKEEPALIVE{Timeout: timeout})
+	if err := msg.Pack(); err != nil {
+		return packet, err
+	}
+	return msg.Data, nil
+}
+
 func removeEDNS0Options(msg *dns.Msg) bool {
 	if len(msg.Pseudo) == 0 {
 		return false
@@ -470,9 +532,12 @@ func _dnsExchange(
 		}
 		now := time.Now()
 		var pc net.Conn
-		proxyDialer := proxy.xTransport.proxyDialer
+		proxyDialer := proxy.xTransport.proxyDialerFor(tcpAddr.IP.String())
 		if proxyDialer == nil {
 			pc, err = net.DialTimeout("tcp", upstreamAddr.String(), proxy.timeout)
+			if err == nil {
+				setTCPNoDelay(pc, proxy.xTransport.tcpNoDelay)
+			}
 		} else {
 			pc, err = (*proxyDialer).Dial("tcp", tcpAddr.String())
 		}
@@ -502,3 +567,40 @@ func _dnsExchange(
 	}
 	return DNSExchangeResponse{response: &msg, rtt: rtt, err: nil}
 }
+
+// rotateAnswers rotates the order of A and AAAA records, leaving other records in place.
+// The packet is returned unchanged if it doesn't contain several records of the same type.
+func rotateAnswers(packet []byte, offset uint32) []byte {
+	msg := dns.Msg{Data: packet}
+	if err := msg.Unpack(); err != nil {
+		return packet
+	}
+	rotated := false
+	for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var positions []int
+		for i, rr := range msg.Answer {
+			if dns.RRToType(rr) == rrType {
+				positions = append(positions, i)
+			}
+		}
+		if len(positions) < 2 {
+			continue
+		}
+		records := make([]dns.RR, len(positions))
+		for i, position := range positions {
+			records[i] = msg.Answer[position]
+		}
+		shift := int(offset % uint32(len(records)))
+		for i, position := range positions {
+			msg.Answer[position] = records[(i+shift)%len(records)]
+		}
+		rotated = rotated || shift != 0
+	}
+	if !rotated {
+		return packet
+	}
+	if err := msg.Pack(); err != nil {
+		return packet
+	}
+	return msg.Data
+}
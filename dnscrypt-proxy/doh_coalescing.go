@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalescingEndpoint - A DoH server that answered over HTTP/2, whose connections can be shared with other server names
+type coalescingEndpoint struct {
+	authority string // Host and port connections are established to
+	port      int
+	ips       []net.IP
+	leaf      *x509.Certificate
+}
+
+// DoHCoalescing - Keeps track of the HTTP/2 connections that queries to other server names can reuse.
+// A connection is only reused for a name that resolves to one of the addresses it was established to,
+// and that is covered by the certificate the server presented (RFC 9113 section 9.1.1).
+type DoHCoalescing struct {
+	sync.RWMutex
+	endpoints map[string]coalescingEndpoint
+	excluded  map[string]bool // Names the servers refused to answer over a shared connection
+}
+
+func NewDoHCoalescing() *DoHCoalescing {
+	return &DoHCoalescing{
+		endpoints: make(map[string]coalescingEndpoint),
+		excluded:  make(map[string]bool),
+	}
+}
+
+// recordCoalescingEndpoint remembers that a host answered over HTTP/2, so that its connections can be reused
+func (xTransport *XTransport) recordCoalescingEndpoint(host string, port int, authority string, state *tls.ConnectionState) {
+	if state == nil || state.NegotiatedProtocol != "h2" || len(state.PeerCertificates) == 0 {
+		return
+	}
+	ips := xTransport.coalescingIPs(host)
+	if len(ips) == 0 {
+		return
+	}
+	coalescing := xTransport.dohCoalescing
+	coalescing.Lock()
+	coalescing.endpoints[strings.Trim(host, "[]")] = coalescingEndpoint{
+		authority: authority,
+		port:      port,
+		ips:       ips,
+		leaf:      state.PeerCertificates[0],
+	}
+	coalescing.Unlock()
+}
+
+// coalescedAuthority returns the host and port of a connection that can be reused to send queries to a host
+func (xTransport *XTransport) coalescedAuthority(host string, port int, now time.Time) (string, bool) {
+	host = strings.Trim(host, "[]")
+	ips := xTransport.coalescingIPs(host)
+	if len(ips) == 0 {
+		return "", false
+	}
+	hostTimeout, _ := xTransport.hostTimeout(host)
+	coalescing := xTransport.dohCoalescing
+	coalescing.RLock()
+	defer coalescing.RUnlock()
+	if _, ok := coalescing.endpoints[host]; ok || coalescing.excluded[host] {
+		return "", false
+	}
+	for otherHost, endpoint := range coalescing.endpoints {
+		if endpoint.port != port || !sharesIP(ips, endpoint.ips) {
+			continue
+		}
+		if now.Before(endpoint.leaf.NotBefore) || now.After(endpoint.leaf.NotAfter) || endpoint.leaf.VerifyHostname(host) != nil {
+			continue
+		}
+		// Both names must be reached the same way
+		otherTimeout, _ := xTransport.hostTimeout(otherHost)
+		if otherTimeout != hostTimeout || xTransport.proxyDialerFor(otherHost) != xTransport.proxyDialerFor(host) {
+			continue
+		}
+		return endpoint.authority, true
+	}
+	return "", false
+}
+
+// excludeFromCoalescing stops sharing connections with a host after it refused a query sent over a shared connection
+func (xTransport *XTransport) excludeFromCoalescing(host string) {
+	coalescing := xTransport.dohCoalescing
+	coalescing.Lock()
+	coalescing.excluded[strings.Trim(host, "[]")] = true
+	coalescing.Unlock()
+}
+
+// coalescingIPs returns the addresses a host name resolves to, or the address itself if it is an IP address
+func (xTransport *XTransport) coalescingIPs(host string) []net.IP {
+	if ip := ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return []net.IP{ip}
+	}
+	ips, _, _ := xTransport.loadCachedIPs(host)
+	return ips
+}
+
+func sharesIP(a []net.IP, b []net.IP) bool {
+	for _, ipA := range a {
+		for _, ipB := range b {
+			if ipA.Equal(ipB) {
+				return true
+			}
+		}
+	}
+	return false
+}
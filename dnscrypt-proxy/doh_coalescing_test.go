@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoHConnectionCoalescing(t *testing.T) {
+	var connections atomic.Int32
+	var hostsMu sync.Mutex
+	var hosts []string
+	var misdirect atomic.Bool
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostsMu.Lock()
+		hosts = append(hosts, r.Host)
+		hostsMu.Unlock()
+		if misdirect.Load() {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	server.EnableHTTP2 = true
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	serverURL, _ := url.Parse(server.URL)
+	port := serverURL.Port()
+
+	xTransport := NewXTransport()
+	xTransport.dohCoalescing = NewDoHCoalescing()
+	xTransport.rebuildTransport()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	xTransport.transport.TLSClientConfig.RootCAs = rootCAs
+	// The test certificate is valid for example.com, but not for example.net
+	xTransport.saveCachedIP("example.com", ParseIP("127.0.0.1"), -1*time.Second)
+	xTransport.saveCachedIP("example.net", ParseIP("127.0.0.1"), -1*time.Second)
+
+	get := func(host string) (*tls.ConnectionState, error) {
+		t.Helper()
+		_, _, state, _, err := xTransport.Get(&url.URL{Scheme: "https", Host: host + ":" + port, Path: "/"}, "", 5*time.Second)
+		return state, err
+	}
+	if state, err := get("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	} else if state.NegotiatedProtocol != "h2" {
+		t.Fatalf("negotiated protocol = %q, want h2", state.NegotiatedProtocol)
+	}
+	if _, err := get("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if n := connections.Load(); n != 1 {
+		t.Errorf("%d connections after querying two names covered by the certificate, want 1", n)
+	}
+	hostsMu.Lock()
+	if lastHost := hosts[len(hosts)-1]; lastHost != "example.com:"+port {
+		t.Errorf("the coalesced request was sent for [%s], want [example.com:%s]", lastHost, port)
+	}
+	hostsMu.Unlock()
+
+	if _, err := get("example.net"); err == nil {
+		t.Error("a name that the certificate doesn't cover should not be queried over a shared connection")
+	}
+	if n := connections.Load(); n != 2 {
+		t.Errorf("%d connections after querying a name not covered by the certificate, want 2", n)
+	}
+
+	portNumber, _ := strconv.Atoi(port)
+	if _, ok := xTransport.coalescedAuthority("example.com", portNumber, time.Now()); !ok {
+		t.Fatal("[example.com] should be coalesced onto the connection to [127.0.0.1]")
+	}
+	misdirect.Store(true)
+	if _, err := get("example.com"); err == nil {
+		t.Fatal("a misdirected request should fail")
+	}
+	misdirect.Store(false)
+	if authority, ok := xTransport.coalescedAuthority("example.com", portNumber, time.Now()); ok {
+		t.Errorf("[example.com] should not be coalesced onto [%s] any more after a misdirected request", authority)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// ConnTiming - How the connection a DoH query was sent over was obtained
+type ConnTiming struct {
+	Traced bool          // Set once the transport reported the connection; HTTP/3 connections are not traced
+	Reused bool          // The query was sent over an existing connection
+	Setup  time.Duration // Time spent resolving, connecting and completing the handshake, for a new connection
+}
+
+type connTimingKey struct{}
+
+// withConnTiming - Returns a context recording how the connection of a request was obtained into timing
+func withConnTiming(ctx context.Context, timing *ConnTiming) context.Context {
+	return context.WithValue(ctx, connTimingKey{}, timing)
+}
+
+// traceConnTiming - Adds a trace to a request context that has a ConnTiming to record
+func traceConnTiming(ctx context.Context) context.Context {
+	timing, ok := ctx.Value(connTimingKey{}).(*ConnTiming)
+	if !ok {
+		return ctx
+	}
+	var getConn time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(string) {
+			getConn = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			timing.Traced, timing.Reused, timing.Setup = true, info.Reused, 0
+			if !info.Reused && !getConn.IsZero() {
+				timing.Setup = time.Since(getConn)
+			}
+		},
+	})
+}
+
+// ConnTimingStats - Time spent establishing new connections to a DoH server, and sending queries over them,
+// compared to the time spent sending queries over existing connections
+type ConnTimingStats struct {
+	NewConnections    uint64
+	ReusedConnections uint64
+	SetupTime         time.Duration
+	NewRequestTime    time.Duration // Excluding the setup time
+	ReusedRequestTime time.Duration
+}
+
+// AverageSetupTime - Returns the average time it took to establish a new connection
+func (stats *ConnTimingStats) AverageSetupTime() time.Duration {
+	if stats.NewConnections == 0 {
+		return 0
+	}
+	return stats.SetupTime / time.Duration(stats.NewConnections)
+}
+
+// AverageRequestTime - Returns the average time between getting a connection and receiving the response,
+// for queries sent over new or existing connections
+func (stats *ConnTimingStats) AverageRequestTime(reused bool) time.Duration {
+	if reused {
+		if stats.ReusedConnections == 0 {
+			return 0
+		}
+		return stats.ReusedRequestTime / time.Duration(stats.ReusedConnections)
+	}
+	if stats.NewConnections == 0 {
+		return 0
+	}
+	return stats.NewRequestTime / time.Duration(stats.NewConnections)
+}
+
+// ConnTimings - Connection timing statistics of the DoH and ODoH servers
+type ConnTimings struct {
+	sync.Mutex
+	servers map[string]*ConnTimingStats
+}
+
+// recordConnTiming accounts for a query whose response was received after rtt
+func (serversInfo *ServersInfo) recordConnTiming(serverName string, timing *ConnTiming, rtt time.Duration) {
+	if !timing.Traced {
+		return
+	}
+	requestTime := max(rtt-timing.Setup, 0)
+	if timing.Reused {
+		dlog.Debugf("[%s] response received in %v over an existing connection", serverName, requestTime)
+	} else {
+		dlog.Debugf("[%s] new connection established in %v, response received %v later", serverName, timing.Setup, requestTime)
+	}
+	connTimings := &serversInfo.connTimings
+	connTimings.Lock()
+	defer connTimings.Unlock()
+	if connTimings.servers == nil {
+		connTimings.servers = make(map[string]*ConnTimingStats)
+	}
+	stats, ok := connTimings.servers[serverName]
+	if !ok {
+		stats = &ConnTimingStats{}
+		connTimings.servers[serverName] = stats
+	}
+	if timing.Reused {
+		stats.ReusedConnections++
+		stats.ReusedRequestTime += requestTime
+	} else {
+		stats.NewConnections++
+		stats.SetupTime += timing.Setup
+		stats.NewRequestTime += requestTime
+	}
+}
+
+// connTimingsSnapshot returns a copy of the connection timing statistics of each server
+func (serversInfo *ServersInfo) connTimingsSnapshot() map[string]ConnTimingStats {
+	connTimings := &serversInfo.connTimings
+	connTimings.Lock()
+	defer connTimings.Unlock()
+	snapshot := make(map[string]ConnTimingStats, len(connTimings.servers))
+	for name, stats := range connTimings.servers {
+		snapshot[name] = *stats
+	}
+	return snapshot
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestConnTiming(t *testing.T) {
+	server := newTestDoHServer(t, validDoHResponse)
+	proxy := newTestProxyWithDoHServers(t, server)
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		pluginsState := PluginsState{}
+		if _, err := processDoHQuery(proxy, proxy.serversInfo.inner[0], &pluginsState, query.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, ok := proxy.serversInfo.connTimingsSnapshot()["first"]
+	if !ok {
+		t.Fatal("connection timings should have been recorded")
+	}
+	if stats.NewConnections != 1 || stats.ReusedConnections != 2 {
+		t.Errorf("expected 1 new and 2 reused connections, got %+v", stats)
+	}
+	if stats.SetupTime <= 0 || stats.AverageSetupTime() != stats.SetupTime {
+		t.Errorf("the setup time of the new connection should have been measured, got %+v", stats)
+	}
+
+	proxy.serversInfo.recordConnTiming("other", &ConnTiming{}, time.Second)
+	proxy.serversInfo.recordConnTiming("other", &ConnTiming{Traced: true, Setup: 30 * time.Millisecond}, 20*time.Millisecond)
+	other := proxy.serversInfo.connTimingsSnapshot()["other"]
+	if other.NewConnections != 1 || other.NewRequestTime != 0 || other.AverageRequestTime(true) != 0 {
+		t.Errorf("untraced connections should be ignored and request times should not be negative, got %+v", other)
+	}
+}
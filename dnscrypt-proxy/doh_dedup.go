@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DoHResponse - Outcome of a DoH request, shared by coalesced identical requests
+type DoHResponse struct {
+	body         []byte
+	statusCode   int
+	tls          *tls.ConnectionState
+	rtt          time.Duration
+	upstreamAddr string
+	connTiming   ConnTiming
+	err          error
+}
+
+type inFlightDoHRequest struct {
+	start    time.Time
+	done     chan struct{}
+	response DoHResponse
+}
+
+// InFlightDoHRequests - DoH requests being sent, keyed by method, URL and body
+type InFlightDoHRequests struct {
+	sync.Mutex
+	requests map[string]*inFlightDoHRequest
+}
+
+func NewInFlightDoHRequests() *InFlightDoHRequests {
+	return &InFlightDoHRequests{requests: make(map[string]*inFlightDoHRequest)}
+}
+
+// Do - Sends a request using send(), unless an identical request started less than window ago is still in flight.
+// In that case, its response is waited for and shared. Every caller gets its own copy of the response body.
+// The request is sent in the background, so that a caller giving up when ctx is done doesn't cancel it for the others.
+func (inFlight *InFlightDoHRequests) Do(ctx context.Context, key string, window time.Duration, send func() DoHResponse) DoHResponse {
+	inFlight.Lock()
+	request, found := inFlight.requests[key]
+	if !found || time.Since(request.start) >= window {
+		request = &inFlightDoHRequest{start: time.Now(), done: make(chan struct{})}
+		inFlight.requests[key] = request
+		go func() {
+			request.response = send()
+			inFlight.Lock()
+			if inFlight.requests[key] == request {
+				delete(inFlight.requests, key)
+			}
+			inFlight.Unlock()
+			close(request.done)
+		}()
+	}
+	inFlight.Unlock()
+
+	select {
+	case <-request.done:
+		response := request.response
+		response.body = slices.Clone(response.body)
+		return response
+	case <-ctx.Done():
+		return DoHResponse{err: ctx.Err()}
+	}
+}
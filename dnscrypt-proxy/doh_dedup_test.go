@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestDoHQueryDeduplication(t *testing.T) {
+	var requests atomic.Int32
+	server := newTestDoHServer(t, func(query []byte) []byte {
+		requests.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return validDoHResponse(query)
+	})
+
+	packQuery := func(name string) []byte {
+		query := dns.NewMsg(name, dns.TypeA)
+		if err := query.Pack(); err != nil {
+			t.Fatal(err)
+		}
+		return query.Data
+	}
+	sendConcurrently := func(proxy *Proxy, queries ...[]byte) [][]byte {
+		responses := make([][]byte, len(queries))
+		var wg sync.WaitGroup
+		for i, query := range queries {
+			wg.Go(func() {
+				response, _, _, _, err := proxy.xTransport.DoHQuery(context.Background(), false, proxy.serversInfo.inner[0].URL, query, proxy.timeout)
+				if err != nil {
+					t.Error(err)
+				}
+				responses[i] = response
+			})
+		}
+		wg.Wait()
+		return responses
+	}
+
+	t.Run("identical queries are coalesced", func(t *testing.T) {
+		requests.Store(0)
+		proxy := newTestProxyWithDoHServers(t, server)
+		proxy.xTransport.dohDedupWindow = time.Second
+		query := packQuery("example.com.")
+		responses := sendConcurrently(proxy, query, query, query, query, query)
+		if got := requests.Load(); got != 1 {
+			t.Errorf("%d requests were sent, want 1", got)
+		}
+		// Every caller gets its own copy, as transaction IDs are restored in place
+		SetTransactionID(responses[0], 0xcafe)
+		for i, response := range responses[1:] {
+			if !isParseableResponse(response) || TransactionID(response) == 0xcafe {
+				t.Errorf("response %d should be a separate, valid copy", i+1)
+			}
+			if i > 0 && !bytes.Equal(response, responses[1]) {
+				t.Errorf("response %d differs from the shared response", i+1)
+			}
+		}
+	})
+
+	t.Run("different queries are not coalesced", func(t *testing.T) {
+		requests.Store(0)
+		proxy := newTestProxyWithDoHServers(t, server)
+		proxy.xTransport.dohDedupWindow = time.Second
+		sendConcurrently(proxy, packQuery("example.com."), packQuery("example.net."))
+		if got := requests.Load(); got != 2 {
+			t.Errorf("%d requests were sent, want 2", got)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		requests.Store(0)
+		proxy := newTestProxyWithDoHServers(t, server)
+		query := packQuery("example.com.")
+		sendConcurrently(proxy, query, query, query)
+		if got := requests.Load(); got != 3 {
+			t.Errorf("%d requests were sent, want 3", got)
+		}
+	})
+}
+
+func TestInFlightDoHRequestsWindow(t *testing.T) {
+	inFlight := NewInFlightDoHRequests()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go inFlight.Do(context.Background(), "key", 10*time.Millisecond, func() DoHResponse {
+		close(started)
+		<-release
+		return DoHResponse{body: []byte("first")}
+	})
+	<-started
+	time.Sleep(20 * time.Millisecond)
+
+	// The first request is still in flight, but was sent before the window
+	response := inFlight.Do(context.Background(), "key", 10*time.Millisecond, func() DoHResponse {
+		return DoHResponse{body: []byte("second")}
+	})
+	close(release)
+	if string(response.body) != "second" {
+		t.Errorf("got %q, a new request should be sent after the window", response.body)
+	}
+}
+
+func TestInFlightDoHRequestsCancel(t *testing.T) {
+	inFlight := NewInFlightDoHRequests()
+	release := make(chan struct{})
+	var sent atomic.Int32
+	send := func() DoHResponse {
+		sent.Add(1)
+		<-release
+		return DoHResponse{body: []byte("shared")}
+	}
+
+	// Neither the caller that started the request nor the callers waiting for it are stuck once their context is done
+	for _, name := range []string{"leader", "follower"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		response := inFlight.Do(ctx, "key", time.Second, send)
+		cancel()
+		if !errors.Is(response.err, context.DeadlineExceeded) {
+			t.Errorf("%s: err = %v, want a deadline error", name, response.err)
+		}
+	}
+
+	// The request keeps going for the remaining callers
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	response := inFlight.Do(context.Background(), "key", time.Second, send)
+	if response.err != nil || string(response.body) != "shared" {
+		t.Errorf("got %q, %v, want the shared response", response.body, response.err)
+	}
+	if got := sent.Load(); got != 1 {
+		t.Errorf("%d requests were sent, want 1", got)
+	}
+}
+
+func TestDoHQueryDeduplicationTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := newTestDoHServer(t, func(query []byte) []byte {
+		<-release
+		return validDoHResponse(query)
+	})
+	t.Cleanup(func() { close(release) })
+	proxy := newTestProxyWithDoHServers(t, server)
+	proxy.xTransport.dohDedupWindow = time.Second
+
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, _, _, _, err := proxy.xTransport.DoHQuery(context.Background(), false, proxy.serversInfo.inner[0].URL, query.Data, 100*time.Millisecond); err == nil {
+		t.Fatal("the query should have timed out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the query took %v, longer than its timeout", elapsed)
+	}
+}
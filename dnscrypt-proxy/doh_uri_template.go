@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// DoHURITemplate - RFC 8484 URI template of a DoH server, with a single variable that the encoded query is assigned to.
+// Simple (`{dns}`), form-style query (`{?dns}`) and query continuation (`{&dns}`) expressions are supported.
+type DoHURITemplate struct {
+	template string
+	prefix   string
+	operator string
+	variable string
+	suffix   string
+}
+
+// parseDoHURITemplate parses a template, that either replaces the path and query of the server URL if it starts with
+// a `/`, or is appended to them otherwise
+func parseDoHURITemplate(template string) (*DoHURITemplate, error) {
+	if strings.Contains(template, "://") {
+		return nil, errors.New("the template must only include a path and a query, the host comes from the stamp")
+	}
+	start, end := strings.IndexByte(template, '{'), strings.IndexByte(template, '}')
+	if start < 0 || end < start {
+		return nil, errors.New("the template must contain an expression such as {?dns}")
+	}
+	uriTemplate := &DoHURITemplate{template: template, prefix: template[:start], suffix: template[end+1:]}
+	if strings.ContainsAny(uriTemplate.prefix, "{}") || strings.ContainsAny(uriTemplate.suffix, "{}") {
+		return nil, errors.New("the template must contain a single expression")
+	}
+	expression := template[start+1 : end]
+	if len(expression) > 0 && (expression[0] == '?' || expression[0] == '&') {
+		uriTemplate.operator, expression = expression[:1], expression[1:]
+	}
+	if len(expression) == 0 {
+		return nil, errors.New("the expression of the template has no variable")
+	}
+	for _, c := range expression {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '_' {
+			return nil, fmt.Errorf("unsupported expression: {%s}", template[start+1:end])
+		}
+	}
+	uriTemplate.variable = expression
+	base := &url.URL{Scheme: "https", Host: "example.com"}
+	for _, value := range []string{"", "AAABAAABAAAAAAAA"} {
+		if _, err := uriTemplate.expand(base, value); err != nil {
+			return nil, err
+		}
+	}
+	return uriTemplate, nil
+}
+
+// expand returns the URL of the server to send a query to. An empty value leaves the variable undefined,
+// for POST requests.
+func (uriTemplate *DoHURITemplate) expand(base *url.URL, value string) (*url.URL, error) {
+	expansion := ""
+	if len(value) > 0 {
+		// Base64url-encoded queries only contain unreserved characters, that don't have to be escaped
+		switch uriTemplate.operator {
+		case "":
+			expansion = value
+		default:
+			expansion = uriTemplate.operator + uriTemplate.variable + "=" + value
+		}
+	}
+	uri := uriTemplate.prefix + expansion + uriTemplate.suffix
+	if !strings.HasPrefix(uri, "/") {
+		uri = base.RequestURI() + uri
+	}
+	expanded, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URI template expansion [%s]: %w", uri, err)
+	}
+	if len(expanded.Scheme) > 0 || len(expanded.Host) > 0 {
+		return nil, fmt.Errorf("the expansion of [%s] must only include a path and a query", uriTemplate.template)
+	}
+	result := *base
+	result.Path, result.RawPath, result.RawQuery = expanded.Path, expanded.RawPath, expanded.RawQuery
+	return &result, nil
+}
+
+func (uriTemplate *DoHURITemplate) String() string {
+	return uriTemplate.template
+}
+
+type uriTemplateKey struct{}
+
+// withURITemplate - Returns a context expanding a URI template to get the URL of DoH queries, unless uriTemplate is nil
+func withURITemplate(ctx context.Context, uriTemplate *DoHURITemplate) context.Context {
+	if uriTemplate == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, uriTemplateKey{}, uriTemplate)
+}
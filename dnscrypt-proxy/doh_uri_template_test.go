@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestParseDoHURITemplate(t *testing.T) {
+	for _, template := range []string{"", "/dns-query", "{?}", "{?dns", "{?dns}{&ct}", "{?dns,ct}", "{+dns}", "https://other.example{?dns}"} {
+		if _, err := parseDoHURITemplate(template); err == nil {
+			t.Errorf("template [%s] should be rejected", template)
+		}
+	}
+
+	base, _ := url.Parse("https://dns.example/dns-query?ct=1")
+	for _, test := range []struct {
+		template, value, want string
+	}{
+		{"{&query}", "AAAB", "https://dns.example/dns-query?ct=1&query=AAAB"},
+		{"{&query}", "", "https://dns.example/dns-query?ct=1"},
+		{"/resolve{?q}", "AAAB", "https://dns.example/resolve?q=AAAB"},
+		{"/resolve{?q}", "", "https://dns.example/resolve"},
+		{"/dns/{dns}/wire", "AAAB", "https://dns.example/dns/AAAB/wire"},
+	} {
+		uriTemplate, err := parseDoHURITemplate(test.template)
+		if err != nil {
+			t.Fatalf("[%s]: %v", test.template, err)
+		}
+		expanded, err := uriTemplate.expand(base, test.value)
+		if err != nil || expanded.String() != test.want {
+			t.Errorf("[%s] with [%s] expanded to [%v] (%v), want [%s]", test.template, test.value, expanded, err, test.want)
+		}
+	}
+	if base.String() != "https://dns.example/dns-query?ct=1" {
+		t.Errorf("the server URL should not be modified, got [%s]", base)
+	}
+}
+
+func TestDoHURITemplateQuery(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/resolve" || r.URL.Query().Has("dns") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("name"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(validDoHResponse(query))
+	}))
+	t.Cleanup(server.Close)
+	proxy := newTestProxyWithDoHServers(t, server)
+	serverInfo := proxy.serversInfo.inner[0]
+	serverInfo.useGet = true
+
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	pluginsState := PluginsState{}
+	if _, err := processDoHQuery(proxy, serverInfo, &pluginsState, query.Data); err == nil {
+		t.Fatal("the query should have failed without the template")
+	}
+	uriTemplate, err := parseDoHURITemplate("/resolve{?name}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverInfo.uriTemplate = uriTemplate
+	pluginsState = PluginsState{}
+	response, err := processDoHQuery(proxy, serverInfo, &pluginsState, query.Data)
+	if err != nil || !isParseableResponse(response) {
+		t.Fatalf("the query should have been sent using the template: %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+
+	"codeberg.org/miekg/dns"
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	CrossCheckActionLog   = "log"
+	CrossCheckActionBlock = "block"
+)
+
+var (
+	ErrQuorumNotReached   = errors.New("Upstream servers didn't agree on the response")
+	ErrCrossCheckMismatch = errors.New("Upstream servers returned different responses")
+)
+
+type fanoutResult struct {
+	serverInfo   *ServerInfo
+	pluginsState PluginsState
+	response     []byte
+	err          error
+}
+
+// exchangeContext - Returns the context upstream queries are sent with, that is cancelled when they are part of a fanout
+// and another server answered first
+func (pluginsState *PluginsState) exchangeContext() context.Context {
+	if pluginsState.fanoutCtx == nil {
+		return context.Background()
+	}
+	return pluginsState.fanoutCtx
+}
+
+// fanoutServers - Returns the selected server followed by up to count-1 other servers to send a query to at the
+// same time. With fanout_require_nolog, every one of them must have the nolog property, so the selected server is
+// replaced with other servers if it doesn't. If no servers have that property, only the selected server is returned.
+func (proxy *Proxy) fanoutServers(serverInfo *ServerInfo, count int) []*ServerInfo {
+	if proxy.fanoutRequireNoLog && !serverInfo.noLog {
+		if servers := proxy.serversInfo.getFanout(serverInfo, count, true); len(servers) > 0 {
+			return servers
+		}
+		return []*ServerInfo{serverInfo}
+	}
+	return append([]*ServerInfo{serverInfo}, proxy.serversInfo.getFanout(serverInfo, count-1, proxy.fanoutRequireNoLog)...)
+}
+
+// fanoutExchange - Sends a query to the selected server and to other servers at the same time, and returns the server
+// that sent the first valid response along with that response. The queries still in flight are then cancelled.
+// SERVFAIL responses are only returned if no other server returned a better response.
+func (proxy *Proxy) fanoutExchange(
+	serverInfo *ServerInfo,
+	pluginsState *PluginsState,
+	query []byte,
+	serverProto string,
+) (*ServerInfo, []byte, error) {
+	servers := proxy.fanoutServers(serverInfo, proxy.fanout)
+	serverInfo = servers[0]
+	if len(servers) == 1 {
+		pluginsState.setServer(serverInfo)
+		response, err := handleDNSExchange(proxy, serverInfo, pluginsState, query, serverProto)
+		return serverInfo, response, err
+	}
+	dlog.Debugf("Sending [%s] to %d servers", pluginsState.qName, len(servers))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := proxy.startFanout(ctx, servers, pluginsState, query, serverProto)
+
+	var fallback *fanoutResult
+	for range servers {
+		result := <-results
+		if result.err == nil && len(result.response) > 0 {
+			if Rcode(result.response) != dns.RcodeServerFailure {
+				return proxy.fanoutOutcome(pluginsState, &result)
+			}
+			if fallback == nil || fallback.err != nil {
+				fallback = &result
+			}
+			continue
+		}
+		if fallback == nil || (fallback.err != nil && result.serverInfo == serverInfo) {
+			fallback = &result
+		}
+	}
+	if fallback.err != nil {
+		if stale, ok := pluginsState.sessionData["stale"]; ok {
+			dlog.Debug("Serving stale response")
+			staleMsg := stale.(*dns.Msg)
+			if err := staleMsg.Pack(); err == nil {
+				return serverInfo, staleMsg.Data, nil
+			}
+		}
+	}
+	return proxy.fanoutOutcome(pluginsState, fallback)
+}
+
+// quorumExchange - Sends a query to the selected server and to other servers at the same time, and only returns a
+// response once at least quorumMinAgree of them returned the same answer. ErrQuorumNotReached is returned otherwise.
+func (proxy *Proxy) quorumExchange(
+	serverInfo *ServerInfo,
+	pluginsState *PluginsState,
+	query []byte,
+	serverProto string,
+) (*ServerInfo, []byte, error) {
+	servers := proxy.fanoutServers(serverInfo, proxy.quorumServers)
+	dlog.Debugf("Sending [%s] to %d servers for a quorum of %d", pluginsState.qName, len(servers), proxy.quorumMinAgree)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := proxy.startFanout(ctx, servers, pluginsState, query, serverProto)
+
+	votes := make(map[string][]*fanoutResult)
+	var first *fanoutResult
+	for range servers {
+		result := <-results
+		if first == nil {
+			first = &result
+		}
+		if result.err != nil || len(result.response) == 0 {
+			continue
+		}
+		answer := newServerAnswer(result.serverInfo.Name, result.response)
+		key := answer.answerKey()
+		if len(key) == 0 {
+			continue
+		}
+		votes[key] = append(votes[key], &result)
+		if len(votes[key]) >= proxy.quorumMinAgree {
+			return proxy.fanoutOutcome(pluginsState, votes[key][0])
+		}
+	}
+	dlog.Warnf("No quorum for [%s]: fewer than %d of %d servers returned the same answer", pluginsState.qName, proxy.quorumMinAgree, len(servers))
+	failure := *first
+	failure.response, failure.err = nil, ErrQuorumNotReached
+	return proxy.fanoutOutcome(pluginsState, &failure)
+}
+
+// requiresQuorum - Returns true if the response for a name must be confirmed by a quorum of servers
+func (proxy *Proxy) requiresQuorum(qName string) bool {
+	return inZones(qName, proxy.quorumNames)
+}
+
+// crossCheckExchange - Sends a query to the selected server and to another server at the same time, and compares
+// their answers. Differences are logged, and ErrCrossCheckMismatch is returned if the action is to block them.
+// The response of the other server is only used for the comparison.
+func (proxy *Proxy) crossCheckExchange(
+	serverInfo *ServerInfo,
+	pluginsState *PluginsState,
+	query []byte,
+	serverProto string,
+) (*ServerInfo, []byte, error) {
+	servers := proxy.fanoutServers(serverInfo, 2)
+	serverInfo = servers[0]
+	if len(servers) == 1 {
+		dlog.Debugf("No other server to cross-check [%s] with", pluginsState.qName)
+		pluginsState.setServer(serverInfo)
+		response, err := handleDNSExchange(proxy, serverInfo, pluginsState, query, serverProto)
+		return serverInfo, response, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := proxy.startFanout(ctx, servers, pluginsState, query, serverProto)
+
+	var selected, other fanoutResult
+	for range servers {
+		if result := <-results; result.serverInfo == serverInfo {
+			selected = result
+		} else {
+			other = result
+		}
+	}
+	if selected.err == nil && len(selected.response) > 0 && other.err == nil && len(other.response) > 0 {
+		selectedAnswer := newServerAnswer(selected.serverInfo.Name, selected.response)
+		otherAnswer := newServerAnswer(other.serverInfo.Name, other.response)
+		if selectedKey, otherKey := selectedAnswer.answerKey(), otherAnswer.answerKey(); selectedKey != otherKey {
+			dlog.Warnf("Cross-check failed for [%s]: [%s] answered [%s], [%s] answered [%s]",
+				pluginsState.qName, selected.serverInfo.Name, selectedKey, other.serverInfo.Name, otherKey)
+			if proxy.crossCheckAction == CrossCheckActionBlock {
+				selected.response, selected.err = nil, ErrCrossCheckMismatch
+			}
+		}
+	}
+	return proxy.fanoutOutcome(pluginsState, &selected)
+}
+
+// startFanout - Sends a query to all the given servers in parallel, each with its own copy of the plugins state.
+// Results are sent to the returned channel as they arrive.
+func (proxy *Proxy) startFanout(
+	ctx context.Context,
+	servers []*ServerInfo,
+	pluginsState *PluginsState,
+	query []byte,
+	serverProto string,
+) chan fanoutResult {
+	// Stale responses are only served once all the servers failed
+	sessionData := maps.Clone(pluginsState.sessionData)
+	delete(sessionData, "stale")
+
+	results := make(chan fanoutResult, len(servers))
+	for _, server := range servers {
+		branchState := *pluginsState
+		branchState.fanoutCtx = ctx
+		branchState.deferLogging = true
+		branchState.sessionData = sessionData
+		branchState.setServer(server)
+		go func() {
+			response, err := handleDNSExchange(proxy, server, &branchState, slices.Clone(query), serverProto)
+			results <- fanoutResult{serverInfo: server, pluginsState: branchState, response: response, err: err}
+		}()
+	}
+	return results
+}
+
+// fanoutOutcome - Keeps the state of the query that was sent to the server whose response is used,
+// and logs the query if that failed
+func (proxy *Proxy) fanoutOutcome(pluginsState *PluginsState, result *fanoutResult) (*ServerInfo, []byte, error) {
+	sessionData := pluginsState.sessionData
+	*pluginsState = result.pluginsState
+	pluginsState.sessionData = sessionData
+	pluginsState.fanoutCtx = nil
+	pluginsState.deferLogging = false
+	if pluginsState.loggingDeferred {
+		pluginsState.loggingDeferred = false
+		pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+	}
+	if result.err != nil {
+		dlog.Debugf("No server of the fanout answered [%s]: %v", pluginsState.qName, result.err)
+	}
+	return result.serverInfo, result.response, result.err
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+func TestFanoutFirstAnswerWins(t *testing.T) {
+	cancelled := make(chan struct{})
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+			return
+		case <-time.After(5 * time.Second):
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(validDoHResponse(query))
+	}))
+	t.Cleanup(slow.Close)
+	fast := newTestDoHServer(t, validDoHResponse)
+
+	proxy := newTestProxyWithDoHServers(t, slow, fast)
+	proxy.fanout = 2
+	proxy.fanoutRequireNoLog = true
+	primary, other := proxy.serversInfo.inner[0], proxy.serversInfo.inner[1]
+
+	if servers := proxy.serversInfo.getFanout(primary, 1, true); len(servers) != 0 {
+		t.Errorf("servers without the nolog property should not be used, got %v", servers)
+	}
+	other.noLog = true
+	if servers := proxy.serversInfo.getFanout(primary, 1, true); len(servers) != 1 || servers[0] != other {
+		t.Fatalf("getFanout() = %v, want [%s]", servers, other.Name)
+	}
+	// The selected server must also have the nolog property to be part of the fanout
+	primary.noLog = true
+
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	response := proxy.processIncomingQuery("test", "udp", query.Data, nil, nil, time.Now(), false)
+	if len(response) == 0 || Rcode(response) != dns.RcodeSuccess {
+		t.Fatalf("expected a response from the fastest server, got %v", response)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("the response took %v, the slowest server was waited for", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(3 * time.Second):
+		t.Error("the query to the slowest server should have been cancelled")
+	}
+}
+
+// tamperedDoHResponse answers with another address than validDoHResponse
+func tamperedDoHResponse(query []byte) []byte {
+	msg := dns.Msg{Data: validDoHResponse(query)}
+	if err := msg.Unpack(); err != nil {
+		return nil
+	}
+	msg.Answer[0].(*dns.A).A = rdata.A{Addr: netip.MustParseAddr("198.51.100.1")}
+	if err := msg.Pack(); err != nil {
+		return nil
+	}
+	return msg.Data
+}
+
+// resolveAddr sends a query for the A record of a name through the proxy, and returns the address it resolved to,
+// or the response code if it failed
+func resolveAddr(t *testing.T, proxy *Proxy, name string) string {
+	t.Helper()
+	query := dns.NewMsg(name, dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	response := dns.Msg{Data: proxy.processIncomingQuery("test", "udp", query.Data, nil, nil, time.Now(), false)}
+	if err := response.Unpack(); err != nil {
+		t.Fatal(err)
+	}
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+		return dns.RcodeToString[response.Rcode]
+	}
+	return response.Answer[0].(*dns.A).A.Addr.String()
+}
+
+func TestQuorum(t *testing.T) {
+	proxy := newTestProxyWithDoHServers(t, newTestDoHServer(t, tamperedDoHResponse),
+		newTestDoHServer(t, validDoHResponse), newTestDoHServer(t, validDoHResponse))
+	proxy.quorumServers = 3
+	proxy.quorumNames = []string{"example.com"}
+
+	proxy.quorumMinAgree = 2
+	if addr := resolveAddr(t, proxy, "www.example.com."); addr != "192.0.2.1" {
+		t.Errorf("the answer of the majority should be returned, got %q", addr)
+	}
+	if addr := resolveAddr(t, proxy, "example.net."); addr != "198.51.100.1" {
+		t.Errorf("names not subject to quorum should only be sent to the selected server, got %q", addr)
+	}
+
+	proxy.quorumMinAgree = 3
+	if addr := resolveAddr(t, proxy, "example.com."); addr != "SERVFAIL" {
+		t.Errorf("a SERVFAIL response was expected without a quorum, got %q", addr)
+	}
+}
+
+func TestCrossCheck(t *testing.T) {
+	proxy := newTestProxyWithDoHServers(t, newTestDoHServer(t, tamperedDoHResponse), newTestDoHServer(t, validDoHResponse))
+	proxy.crossCheckDomains = []string{"example.com"}
+
+	proxy.crossCheckAction = CrossCheckActionLog
+	if addr := resolveAddr(t, proxy, "www.example.com."); addr != "198.51.100.1" {
+		t.Errorf("differences should only be logged, got %q", addr)
+	}
+	proxy.crossCheckAction = CrossCheckActionBlock
+	if addr := resolveAddr(t, proxy, "www.example.com."); addr != "SERVFAIL" {
+		t.Errorf("differences should be blocked, got %q", addr)
+	}
+	if addr := resolveAddr(t, proxy, "example.net."); addr != "198.51.100.1" {
+		t.Errorf("other names should not be cross-checked, got %q", addr)
+	}
+}
+
+func TestFanoutRequireNoLogPrimary(t *testing.T) {
+	var loggingRequests atomic.Int32
+	logging := newTestDoHServer(t, func(query []byte) []byte {
+		loggingRequests.Add(1)
+		return validDoHResponse(query)
+	})
+	proxy := newTestProxyWithDoHServers(t, logging, newTestDoHServer(t, validDoHResponse))
+	proxy.fanout = 2
+	proxy.fanoutRequireNoLog = true
+	primary, noLog := proxy.serversInfo.inner[0], proxy.serversInfo.inner[1]
+	noLog.noLog = true
+
+	if servers := proxy.fanoutServers(primary, 2); len(servers) != 1 || servers[0] != noLog {
+		t.Fatalf("fanoutServers() = %v, want only [%s]", servers, noLog.Name)
+	}
+	if addr := resolveAddr(t, proxy, "example.com."); addr != "192.0.2.1" {
+		t.Errorf("unexpected response: %q", addr)
+	}
+	if got := loggingRequests.Load(); got != 0 {
+		t.Errorf("the server without the nolog property received %d queries", got)
+	}
+
+	noLog.noLog = false
+	if servers := proxy.fanoutServers(primary, 2); len(servers) != 1 || servers[0] != primary {
+		t.Errorf("fanoutServers() = %v, want only the selected server when none have the nolog property", servers)
+	}
+}
+
+func TestDNSCryptExchangeCancel(t *testing.T) {
+	// Servers that never answer
+	udpServer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udpServer.Close() })
+	tcpServer, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcpServer.Close() })
+	go func() {
+		for {
+			conn, err := tcpServer.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	proxy := NewProxy()
+	proxy.xTransport = NewXTransport()
+	serverInfo := &ServerInfo{
+		Name:    "silent",
+		UDPAddr: udpServer.LocalAddr().(*net.UDPAddr),
+		TCPAddr: tcpServer.Addr().(*net.TCPAddr),
+	}
+	exchanges := map[string]func(ctx context.Context) error{
+		"udp": func(ctx context.Context) error {
+			var sharedKey [32]byte
+			_, err := proxy.exchangeWithUDPServer(ctx, serverInfo, &sharedKey, []byte("query"), make([]byte, HalfNonceSize), 5*time.Second)
+			return err
+		},
+		"tcp": func(ctx context.Context) error {
+			var sharedKey [32]byte
+			_, err := proxy.exchangeWithTCPServer(ctx, serverInfo, &sharedKey, []byte("query"), make([]byte, HalfNonceSize), 5*time.Second)
+			return err
+		},
+	}
+	for name, exchange := range exchanges {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			start := time.Now()
+			if err := exchange(ctx); !errors.Is(err, context.Canceled) {
+				t.Errorf("err = %v, want a cancellation", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("the exchange took %v after being cancelled", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/jedisct1/dlog"
+)
+
+// FragmentationSuspicionThreshold - Number of consecutive large UDP queries that have to time out,
+// while being answered over TCP, before suggesting to add a server to fragments_blocked
+const FragmentationSuspicionThreshold = 3
+
+// FragmentationDiagnostic - Detects DNSCrypt servers whose path seems to drop fragmented UDP queries
+type FragmentationDiagnostic struct {
+	sync.Mutex
+	timeouts  int
+	suggested bool
+}
+
+// record - Records the outcome of a UDP query larger than MaxDNSUDPSafePacketSize.
+// Returns true the first time the threshold is reached.
+func (diagnostic *FragmentationDiagnostic) record(timedOut bool) bool {
+	diagnostic.Lock()
+	defer diagnostic.Unlock()
+	if !timedOut {
+		diagnostic.timeouts = 0
+		return false
+	}
+	diagnostic.timeouts++
+	if diagnostic.suggested || diagnostic.timeouts < FragmentationSuspicionThreshold {
+		return false
+	}
+	diagnostic.suggested = true
+	return true
+}
+
+// noticeLargeUDPQuery - Records whether a UDP query that may have been fragmented had to be sent again over TCP,
+// and suggests adding the server to fragments_blocked if this keeps happening
+func (serverInfo *ServerInfo) noticeLargeUDPQuery(timedOut bool) {
+	if serverInfo.fragmentation == nil || !serverInfo.fragmentation.record(timedOut) {
+		return
+	}
+	dlog.Warnf(
+		"[%v] Large UDP queries keep timing out while TCP works - fragments are probably dropped on the way. Consider adding [%v] to fragments_blocked",
+		serverInfo.Name,
+		serverInfo.Name,
+	)
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestFragmentationDiagnostic(t *testing.T) {
+	diagnostic := &FragmentationDiagnostic{}
+	for i := 1; i < FragmentationSuspicionThreshold; i++ {
+		if diagnostic.record(true) {
+			t.Fatalf("timeout %d should not trigger a suggestion yet", i)
+		}
+	}
+
+	// A large query answered over UDP shows that fragments can get through
+	if diagnostic.record(false) {
+		t.Fatal("a successful query should not trigger a suggestion")
+	}
+	for i := 1; i < FragmentationSuspicionThreshold; i++ {
+		if diagnostic.record(true) {
+			t.Fatalf("timeouts should have been reset after a successful query")
+		}
+	}
+	if !diagnostic.record(true) {
+		t.Fatal("reaching the threshold should trigger a suggestion")
+	}
+
+	// The suggestion is only made once
+	for range FragmentationSuspicionThreshold * 2 {
+		if diagnostic.record(true) {
+			t.Fatal("the suggestion should only be made once")
+		}
+	}
+
+	// Servers already known to block fragments are not diagnosed
+	serverInfo := &ServerInfo{Name: "blocked"}
+	serverInfo.noticeLargeUDPQuery(true)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MaxHTTPCacheEntries = 64
+
+type HTTPCacheEntry struct {
+	body         []byte
+	expiration   time.Time
+	etag         string
+	lastModified string
+	tls          *tls.ConnectionState
+}
+
+// HTTPCache - In-memory cache of source and metadata downloads, honoring Cache-Control
+type HTTPCache struct {
+	sync.Mutex
+	entries map[string]*HTTPCacheEntry
+}
+
+func NewHTTPCache() *HTTPCache {
+	return &HTTPCache{entries: make(map[string]*HTTPCacheEntry)}
+}
+
+// httpCacheLifetime returns for how long a response can be served from the cache without being
+// revalidated, and whether it can be stored at all
+func httpCacheLifetime(header http.Header, now time.Time) (time.Duration, bool) {
+	lifetime, explicit := time.Duration(0), false
+	for _, directive := range strings.Split(strings.ToLower(header.Get("Cache-Control")), ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-store":
+			return 0, false
+		case directive == "no-cache":
+			lifetime, explicit = 0, true
+		case strings.HasPrefix(directive, "max-age="):
+			if explicit {
+				continue
+			}
+			if maxAge, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64); err == nil && maxAge >= 0 {
+				lifetime, explicit = time.Duration(maxAge)*time.Second, true
+			}
+		}
+	}
+	if !explicit {
+		if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+			lifetime, explicit = max(0, expires.Sub(now)), true
+		}
+	}
+	hasValidators := len(header.Get("ETag")) > 0 || len(header.Get("Last-Modified")) > 0
+	if lifetime <= 0 && !hasValidators {
+		return 0, false
+	}
+	return lifetime, true
+}
+
+// Get - Returns a cached entry, and whether it is still fresh
+func (cache *HTTPCache) Get(key string, now time.Time) (*HTTPCacheEntry, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return entry, now.Before(entry.expiration)
+}
+
+// Put - Stores a response, unless its headers prevent it from being cached
+func (cache *HTTPCache) Put(key string, body []byte, header http.Header, tls *tls.ConnectionState, now time.Time) {
+	lifetime, cacheable := httpCacheLifetime(header, now)
+	cache.Lock()
+	defer cache.Unlock()
+	if !cacheable {
+		delete(cache.entries, key)
+		return
+	}
+	if _, ok := cache.entries[key]; !ok && len(cache.entries) >= MaxHTTPCacheEntries {
+		cache.evictOldest()
+	}
+	cache.entries[key] = &HTTPCacheEntry{
+		body:         body,
+		expiration:   now.Add(lifetime),
+		etag:         header.Get("ETag"),
+		lastModified: header.Get("Last-Modified"),
+		tls:          tls,
+	}
+}
+
+// Revalidated - Extends the lifetime of an entry after a "304 Not Modified" response
+func (cache *HTTPCache) Revalidated(key string, header http.Header, now time.Time) ([]byte, bool) {
+	lifetime, _ := httpCacheLifetime(header, now)
+	cache.Lock()
+	defer cache.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry.expiration = now.Add(lifetime)
+	return entry.body, true
+}
+
+func (cache *HTTPCache) evictOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range cache.entries {
+		if len(oldestKey) == 0 || entry.expiration.Before(oldest) {
+			oldestKey, oldest = key, entry.expiration
+		}
+	}
+	delete(cache.entries, oldestKey)
+}
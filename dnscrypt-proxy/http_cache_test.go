@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPCacheLifetime(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name          string
+		header        http.Header
+		wantLifetime  time.Duration
+		wantCacheable bool
+	}{
+		{name: "max-age", header: http.Header{"Cache-Control": {"public, max-age=300"}}, wantLifetime: 300 * time.Second, wantCacheable: true},
+		{name: "no-store", header: http.Header{"Cache-Control": {"max-age=300, no-store"}}},
+		{name: "no-cache without validators", header: http.Header{"Cache-Control": {"no-cache"}}},
+		{name: "no-cache with etag", header: http.Header{"Cache-Control": {"no-cache, max-age=300"}, "Etag": {`"v1"`}}, wantCacheable: true},
+		{name: "expires", header: http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, wantLifetime: time.Hour, wantCacheable: true},
+		{name: "no headers", header: http.Header{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lifetime, cacheable := httpCacheLifetime(tt.header, now)
+			if cacheable != tt.wantCacheable {
+				t.Fatalf("cacheable = %v, want %v", cacheable, tt.wantCacheable)
+			}
+			if diff := lifetime - tt.wantLifetime; diff < -time.Second || diff > time.Second {
+				t.Errorf("lifetime = %v, want %v", lifetime, tt.wantLifetime)
+			}
+		})
+	}
+}
+
+func TestFetchHTTPCache(t *testing.T) {
+	var requests, notModified atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=300")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/revalidate":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				notModified.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	xTransport := NewXTransport()
+	xTransport.httpCache = NewHTTPCache()
+	xTransport.rebuildTransport()
+
+	tests := []struct {
+		path            string
+		wantRequests    int32
+		wantNotModified int32
+	}{
+		{path: "/fresh", wantRequests: 1},
+		{path: "/no-store", wantRequests: 3},
+		{path: "/revalidate", wantRequests: 3, wantNotModified: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			requests.Store(0)
+			notModified.Store(0)
+			u, err := url.Parse(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 3 {
+				bin, _, _, _, err := xTransport.GetSource(u, 5*time.Second)
+				if err != nil {
+					t.Fatalf("GetSource() error = %v", err)
+				}
+				if string(bin) != "content of "+tt.path {
+					t.Fatalf("body = %q", bin)
+				}
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", got, tt.wantRequests)
+			}
+			if got := notModified.Load(); got != tt.wantNotModified {
+				t.Errorf("not modified responses = %d, want %d", got, tt.wantNotModified)
+			}
+		})
+	}
+}
+
+func TestFetchHTTPCacheCompleteBodies(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Cache-Control", "max-age=300")
+		if r.URL.Path == "/large" {
+			w.Write(bytes.Repeat([]byte{'x'}, MaxHTTPBodyLength+1))
+			return
+		}
+		w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	rootCA := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(rootCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	xTransport := NewXTransport()
+	xTransport.httpCache = NewHTTPCache()
+	xTransport.tlsClientCreds = DOHClientCreds{rootCA: rootCA}
+	xTransport.rebuildTransport()
+
+	t.Run("fresh hits keep the TLS state", func(t *testing.T) {
+		requests.Store(0)
+		u, _ := url.Parse(server.URL + "/fresh")
+		for range 2 {
+			_, _, tls, _, err := xTransport.GetSource(u, 5*time.Second)
+			if err != nil {
+				t.Fatalf("GetSource() error = %v", err)
+			}
+			if tls == nil {
+				t.Fatal("no TLS state was returned")
+			}
+		}
+		if got := requests.Load(); got != 1 {
+			t.Errorf("requests = %d, want 1", got)
+		}
+	})
+
+	t.Run("truncated bodies are not cached", func(t *testing.T) {
+		requests.Store(0)
+		u, _ := url.Parse(server.URL + "/large")
+		for range 2 {
+			if _, _, _, _, err := xTransport.GetSource(u, 5*time.Second); err != nil {
+				t.Fatalf("GetSource() error = %v", err)
+			}
+		}
+		if got := requests.Load(); got != 2 {
+			t.Errorf("requests = %d, want 2", got)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	IPOriginActionLog    = "log"
+	IPOriginActionReject = "reject"
+)
+
+// IPOrigin - Country and autonomous system an IP address belongs to
+type IPOrigin struct {
+	country string
+	asn     uint
+}
+
+// IPOriginDatabases - Country and ASN databases, in the MaxMind DB format
+type IPOriginDatabases struct {
+	countryDB *maxminddb.Reader
+	asnDB     *maxminddb.Reader
+}
+
+// OpenIPOriginDatabases - Opens the country and ASN databases, each of them being optional
+func OpenIPOriginDatabases(countryDBFile, asnDBFile string) (*IPOriginDatabases, error) {
+	databases := IPOriginDatabases{}
+	if len(countryDBFile) > 0 {
+		countryDB, err := maxminddb.Open(countryDBFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open the country database [%s]: %w", countryDBFile, err)
+		}
+		databases.countryDB = countryDB
+	}
+	if len(asnDBFile) > 0 {
+		asnDB, err := maxminddb.Open(asnDBFile)
+		if err != nil {
+			if databases.countryDB != nil {
+				databases.countryDB.Close()
+			}
+			return nil, fmt.Errorf("Unable to open the ASN database [%s]: %w", asnDBFile, err)
+		}
+		databases.asnDB = asnDB
+	}
+	return &databases, nil
+}
+
+// Lookup - Returns the country and autonomous system of an IP address; unknown values are left empty
+func (databases *IPOriginDatabases) Lookup(ip net.IP) (IPOrigin, error) {
+	var origin IPOrigin
+	if databases.countryDB != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := databases.countryDB.Lookup(ip, &record); err != nil {
+			return origin, err
+		}
+		origin.country = record.Country.ISOCode
+	}
+	if databases.asnDB != nil {
+		var record struct {
+			ASN uint `maxminddb:"autonomous_system_number"`
+		}
+		if err := databases.asnDB.Lookup(ip, &record); err != nil {
+			return origin, err
+		}
+		origin.asn = record.ASN
+	}
+	return origin, nil
+}
+
+// checkIPOrigin - Returns an error if an IP address is not in one of the expected countries and autonomous systems
+func checkIPOrigin(origin IPOrigin, expectedCountries []string, expectedASNs []uint) error {
+	if len(expectedCountries) > 0 && !slices.ContainsFunc(expectedCountries, func(country string) bool {
+		return len(origin.country) > 0 && strings.EqualFold(country, origin.country)
+	}) {
+		if len(origin.country) == 0 {
+			return fmt.Errorf("unknown country, expected one of %v", expectedCountries)
+		}
+		return fmt.Errorf("located in [%s], expected one of %v", origin.country, expectedCountries)
+	}
+	if len(expectedASNs) > 0 && !slices.Contains(expectedASNs, origin.asn) {
+		if origin.asn == 0 {
+			return fmt.Errorf("unknown autonomous system, expected one of %v", expectedASNs)
+		}
+		return fmt.Errorf("announced by AS%d, expected one of %v", origin.asn, expectedASNs)
+	}
+	return nil
+}
+
+// checkServerIPOrigin - Verifies that the IP addresses used to connect to a server are in the countries
+// and autonomous systems configured for that server. Mismatches are logged, or rejected with an error.
+func checkServerIPOrigin(proxy *Proxy, name string, stamp stamps.ServerStamp, serverInfo *ServerInfo) error {
+	settings := proxy.serverSettings[name]
+	if proxy.ipOriginDatabases == nil || (len(settings.ExpectedCountries) == 0 && len(settings.ExpectedASNs) == 0) {
+		return nil
+	}
+	var ips []net.IP
+	if stamp.Proto == stamps.StampProtoTypeDNSCrypt {
+		if serverInfo.UDPAddr != nil {
+			ips = []net.IP{serverInfo.UDPAddr.IP}
+		}
+	} else if serverInfo.URL != nil {
+		host, _ := ExtractHostAndPort(serverInfo.URL.Host, 443)
+		if ip := ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			ips, _, _ = proxy.xTransport.loadCachedIPs(host)
+		}
+	}
+	if len(ips) == 0 {
+		dlog.Debugf("[%s] No IP addresses to check the origin of", name)
+		return nil
+	}
+	for _, ip := range ips {
+		origin, err := proxy.ipOriginDatabases.Lookup(ip)
+		if err == nil {
+			err = checkIPOrigin(origin, settings.ExpectedCountries, settings.ExpectedASNs)
+		}
+		if err == nil {
+			continue
+		}
+		if proxy.ipOriginAction == IPOriginActionReject {
+			return fmt.Errorf("IP address [%s] of [%s] rejected: %v", ip, name, err)
+		}
+		dlog.Warnf("IP address [%s] of [%s]: %v", ip, name, err)
+	}
+	return nil
+}
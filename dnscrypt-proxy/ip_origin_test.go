@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckIPOrigin(t *testing.T) {
+	tests := []struct {
+		name      string
+		origin    IPOrigin
+		countries []string
+		asns      []uint
+		wantErr   bool
+	}{
+		{"no expectations", IPOrigin{country: "FR", asn: 64500}, nil, nil, false},
+		{"matching country", IPOrigin{country: "CA"}, []string{"US", "ca"}, nil, false},
+		{"other country", IPOrigin{country: "FR"}, []string{"US", "CA"}, nil, true},
+		{"unknown country", IPOrigin{}, []string{"US"}, nil, true},
+		{"matching ASN", IPOrigin{asn: 13335}, nil, []uint{13335}, false},
+		{"other ASN", IPOrigin{asn: 64500}, nil, []uint{13335}, true},
+		{"unknown ASN", IPOrigin{}, nil, []uint{13335}, true},
+		{"matching country, other ASN", IPOrigin{country: "US", asn: 64500}, []string{"US"}, []uint{13335}, true},
+		{"matching country and ASN", IPOrigin{country: "US", asn: 13335}, []string{"US"}, []uint{13335}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkIPOrigin(tt.origin, tt.countries, tt.asns)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkIPOrigin() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenIPOriginDatabasesMissingFile(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.mmdb")
+	if _, err := OpenIPOriginDatabases(missing, ""); err == nil {
+		t.Error("opening a missing country database should fail")
+	}
+	if _, err := OpenIPOriginDatabases("", missing); err == nil {
+		t.Error("opening a missing ASN database should fail")
+	}
+}
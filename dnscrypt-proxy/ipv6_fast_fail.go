@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	DefaultIPv6FastFailThreshold = 0
+	DefaultIPv6FastFailCooldown  = 5 * time.Minute
+)
+
+// IPv6FastFail - Temporarily stops IPv6 connection attempts after consecutive failures,
+// so that networks with broken IPv6 connectivity don't pay for a failed attempt on every connection
+type IPv6FastFail struct {
+	sync.Mutex
+	threshold           int
+	cooldown            time.Duration
+	consecutiveFailures int
+	suppressedUntil     time.Time
+}
+
+func NewIPv6FastFail(threshold int, cooldown time.Duration) *IPv6FastFail {
+	return &IPv6FastFail{threshold: threshold, cooldown: cooldown}
+}
+
+// Suppressed - Returns true if IPv6 connections should not be attempted
+func (fastFail *IPv6FastFail) Suppressed(now time.Time) bool {
+	if fastFail == nil || fastFail.threshold <= 0 {
+		return false
+	}
+	fastFail.Lock()
+	defer fastFail.Unlock()
+	return now.Before(fastFail.suppressedUntil)
+}
+
+// recordDialResult - Records the outcome of an IPv6 connection attempt, unless it failed because ctx was done,
+// for example because the query ran out of time, which says nothing about connectivity either
+func (fastFail *IPv6FastFail) recordDialResult(ctx context.Context, err error, now time.Time) {
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	fastFail.RecordResult(err, now)
+}
+
+// RecordResult - Records the outcome of an IPv6 connection attempt
+func (fastFail *IPv6FastFail) RecordResult(err error, now time.Time) {
+	if fastFail == nil || fastFail.threshold <= 0 {
+		return
+	}
+	// Canceled attempts, such as the losers of a race between address families, say nothing about connectivity
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	fastFail.Lock()
+	defer fastFail.Unlock()
+	if err == nil {
+		if fastFail.consecutiveFailures >= fastFail.threshold {
+			dlog.Notice("IPv6 connectivity is back")
+		}
+		fastFail.consecutiveFailures = 0
+		fastFail.suppressedUntil = time.Time{}
+		return
+	}
+	fastFail.consecutiveFailures++
+	if fastFail.consecutiveFailures >= fastFail.threshold && !now.Before(fastFail.suppressedUntil) {
+		fastFail.suppressedUntil = now.Add(fastFail.cooldown)
+		dlog.Noticef(
+			"%d consecutive IPv6 connection failures - Not trying IPv6 again for %v",
+			fastFail.consecutiveFailures,
+			fastFail.cooldown,
+		)
+	}
+}
+
+// filterIPv6 drops IPv6 addresses while IPv6 is suppressed, unless no other addresses are available
+func (fastFail *IPv6FastFail) filterIPv6(ips []net.IP, now time.Time) []net.IP {
+	if !fastFail.Suppressed(now) {
+		return ips
+	}
+	filtered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			filtered = append(filtered, ip)
+		}
+	}
+	if len(filtered) == 0 {
+		return ips
+	}
+	if len(filtered) < len(ips) {
+		dlog.Debug("Skipping IPv6 addresses after recent connection failures")
+	}
+	return filtered
+}
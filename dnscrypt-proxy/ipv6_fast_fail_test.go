@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+func TestIPv6FastFail(t *testing.T) {
+	fastFail := NewIPv6FastFail(3, time.Minute)
+	now := time.Now()
+	errUnreachable := errors.New("network is unreachable")
+
+	for range 2 {
+		fastFail.RecordResult(errUnreachable, now)
+	}
+	fastFail.RecordResult(context.Canceled, now)
+	if fastFail.Suppressed(now) {
+		t.Fatal("IPv6 should not be suppressed before the threshold is reached")
+	}
+	fastFail.RecordResult(errUnreachable, now)
+	if !fastFail.Suppressed(now) {
+		t.Fatal("IPv6 should be suppressed after 3 consecutive failures")
+	}
+
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}
+	if filtered := fastFail.filterIPv6(ips, now); len(filtered) != 1 || filtered[0].To4() == nil {
+		t.Errorf("filterIPv6() = %v, want only the IPv4 address", filtered)
+	}
+	ipv6Only := []net.IP{net.ParseIP("2001:db8::1")}
+	if filtered := fastFail.filterIPv6(ipv6Only, now); len(filtered) != 1 {
+		t.Errorf("filterIPv6() = %v, IPv6 addresses should be kept when there are no alternatives", filtered)
+	}
+
+	// After the cooldown, IPv6 is tried again, and a single failure suppresses it again
+	later := now.Add(2 * time.Minute)
+	if fastFail.Suppressed(later) {
+		t.Fatal("IPv6 should be tried again after the cooldown")
+	}
+	fastFail.RecordResult(errUnreachable, later)
+	if !fastFail.Suppressed(later) {
+		t.Fatal("IPv6 should be suppressed again after failing past the cooldown")
+	}
+
+	fastFail.RecordResult(nil, later)
+	if fastFail.Suppressed(later) {
+		t.Fatal("a successful connection should lift the suppression")
+	}
+}
+
+func TestIPv6FastFailDisabled(t *testing.T) {
+	fastFail := NewIPv6FastFail(0, time.Minute)
+	now := time.Now()
+	for range 10 {
+		fastFail.RecordResult(errors.New("network is unreachable"), now)
+	}
+	if fastFail.Suppressed(now) {
+		t.Error("IPv6 should never be suppressed when the threshold is 0")
+	}
+}
+
+type failingProxyDialer struct{}
+
+func (failingProxyDialer) Dial(network, address string) (net.Conn, error) {
+	return nil, errors.New("proxy unreachable")
+}
+
+func TestIPv6FastFailIgnoresUnrelatedFailures(t *testing.T) {
+	fastFail := NewIPv6FastFail(1, time.Minute)
+	now := time.Now()
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(-time.Second))
+	defer cancel()
+	fastFail.recordDialResult(ctx, context.DeadlineExceeded, now)
+	if fastFail.Suppressed(now) {
+		t.Error("failures caused by the query running out of time should not be counted")
+	}
+	fastFail.recordDialResult(context.Background(), context.DeadlineExceeded, now)
+	if !fastFail.Suppressed(now) {
+		t.Error("connection timeouts should be counted")
+	}
+
+	xTransport := NewXTransport()
+	xTransport.ipv6FastFail = NewIPv6FastFail(1, time.Minute)
+	var proxyDialer netproxy.Dialer = failingProxyDialer{}
+	xTransport.proxyDialer = &proxyDialer
+	xTransport.rebuildTransport()
+	xTransport.saveCachedIPs("ipv6.example.com", []net.IP{net.ParseIP("2001:db8::1")}, time.Hour)
+	if _, err := xTransport.transport.DialContext(context.Background(), "tcp", "ipv6.example.com:443"); err == nil {
+		t.Fatal("the connection through the proxy should fail")
+	}
+	if xTransport.ipv6FastFail.Suppressed(time.Now()) {
+		t.Error("failures through a proxy should not be counted")
+	}
+}
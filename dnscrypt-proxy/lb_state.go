@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/jedisct1/dlog"
+)
+
+// ServerLBState - What the load balancer learned about a server, kept across restarts
+type ServerLBState struct {
+	RTT           float64 `json:"rtt"`
+	TotalQueries  uint64  `json:"total_queries"`
+	FailedQueries uint64  `json:"failed_queries"`
+}
+
+// LBState - Content of the lb_state_file
+type LBState struct {
+	SavedAt time.Time                `json:"saved_at"`
+	Servers map[string]ServerLBState `json:"servers"`
+}
+
+// exportLBState returns the current latency and success statistics of the live servers
+func (serversInfo *ServersInfo) exportLBState() LBState {
+	state := LBState{SavedAt: time.Now(), Servers: make(map[string]ServerLBState)}
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	for _, servers := range [][]*ServerInfo{serversInfo.inner, serversInfo.fallback, serversInfo.routeOnly} {
+		for _, server := range servers {
+			rtt := server.rtt.Value()
+			if rtt <= 0 {
+				continue
+			}
+			state.Servers[server.Name] = ServerLBState{
+				RTT:           rtt,
+				TotalQueries:  server.totalQueries,
+				FailedQueries: server.failedQueries,
+			}
+		}
+	}
+	return state
+}
+
+// saveLBState writes the statistics of the live servers to the lb_state_file, if there is one
+func (serversInfo *ServersInfo) saveLBState() error {
+	if len(serversInfo.lbStateFile) == 0 {
+		return nil
+	}
+	state := serversInfo.exportLBState()
+	if len(state.Servers) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := safefile.WriteFile(serversInfo.lbStateFile, data, 0o644); err != nil {
+		return err
+	}
+	dlog.Debugf("Saved the load balancing state of %d servers to [%s]", len(state.Servers), serversInfo.lbStateFile)
+	return nil
+}
+
+// loadLBState reads the statistics saved by a previous run, unless they are older than maxAge.
+// They are applied to the servers as they become live.
+func (serversInfo *ServersInfo) loadLBState(maxAge time.Duration) error {
+	data, err := os.ReadFile(serversInfo.lbStateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state LBState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("Unable to parse [%s]: %w", serversInfo.lbStateFile, err)
+	}
+	if age := time.Since(state.SavedAt); maxAge > 0 && age > maxAge {
+		dlog.Noticef("Ignoring the load balancing state saved %v ago in [%s]", age.Truncate(time.Minute), serversInfo.lbStateFile)
+		return nil
+	}
+	serversInfo.Lock()
+	serversInfo.savedLBState = state.Servers
+	serversInfo.Unlock()
+	dlog.Noticef("Loaded the load balancing state of %d servers from [%s]", len(state.Servers), serversInfo.lbStateFile)
+	return nil
+}
+
+// restoreLBState applies the saved statistics of a server that was just added - serversInfo is assumed to be locked
+func (serversInfo *ServersInfo) restoreLBState(server *ServerInfo) {
+	saved, ok := serversInfo.savedLBState[server.Name]
+	if !ok {
+		return
+	}
+	delete(serversInfo.savedLBState, server.Name)
+	if saved.RTT > 0 {
+		server.rtt.Set(saved.RTT)
+	}
+	server.totalQueries = saved.TotalQueries
+	server.failedQueries = min(saved.FailedQueries, saved.TotalQueries)
+	dlog.Debugf("Restored the load balancing state of [%s] (rtt: %dms)", server.Name, int(saved.RTT))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/ewma"
+)
+
+func TestLBStateRoundTrip(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "lb-state.json")
+	serversInfo := NewServersInfo()
+	serversInfo.lbStateFile = stateFile
+	for name, rtt := range map[string]float64{"fast": 12, "slow": 340} {
+		server := &ServerInfo{Name: name, rtt: ewma.NewMovingAverage(RTTEwmaDecay), totalQueries: 100, failedQueries: 5}
+		server.rtt.Set(rtt)
+		serversInfo.inner = append(serversInfo.inner, server)
+	}
+	if err := serversInfo.saveLBState(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewServersInfo()
+	restarted.lbStateFile = stateFile
+	if err := restarted.loadLBState(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	server := &ServerInfo{Name: "slow", rtt: ewma.NewMovingAverage(RTTEwmaDecay)}
+	server.rtt.Set(50)
+	restarted.restoreLBState(server)
+	if rtt := server.rtt.Value(); rtt != 340 {
+		t.Errorf("rtt = %v, want the saved value", rtt)
+	}
+	if server.totalQueries != 100 || server.failedQueries != 5 {
+		t.Errorf("queries = %d/%d, want the saved counters", server.failedQueries, server.totalQueries)
+	}
+	if _, ok := restarted.savedLBState["slow"]; ok {
+		t.Error("saved state should only be applied once")
+	}
+	unknown := &ServerInfo{Name: "unknown", rtt: ewma.NewMovingAverage(RTTEwmaDecay)}
+	unknown.rtt.Set(50)
+	restarted.restoreLBState(unknown)
+	if rtt := unknown.rtt.Value(); rtt != 50 {
+		t.Errorf("rtt of a server without saved state = %v, want 50", rtt)
+	}
+}
+
+func TestLBStateIgnoresStaleData(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "lb-state.json")
+	saved := `{"saved_at":"` + time.Now().Add(-48*time.Hour).Format(time.RFC3339) + `","servers":{"old":{"rtt":10}}}`
+	if err := os.WriteFile(stateFile, []byte(saved), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	serversInfo := NewServersInfo()
+	serversInfo.lbStateFile = stateFile
+	if err := serversInfo.loadLBState(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(serversInfo.savedLBState) != 0 {
+		t.Errorf("state older than the maximum age should be discarded, got %v", serversInfo.savedLBState)
+	}
+
+	serversInfo.lbStateFile = filepath.Join(t.TempDir(), "missing.json")
+	if err := serversInfo.loadLBState(24 * time.Hour); err != nil {
+		t.Errorf("a missing state file should not be an error: %v", err)
+	}
+}
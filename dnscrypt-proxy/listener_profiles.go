@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"codeberg.org/miekg/dns"
+	"github.com/jedisct1/dlog"
+)
+
+// ListenerProfile - Policy applied to the queries received on a set of listen addresses
+type ListenerProfile struct {
+	name             string
+	serverNames      []string
+	blockedNamesFile string
+	blockedNames     *BlockedNames
+}
+
+// allowsServer returns true if queries of the profile can be sent to the given server
+func (profile *ListenerProfile) allowsServer(serverInfo *ServerInfo) bool {
+	if profile == nil || len(profile.serverNames) == 0 {
+		return true
+	}
+	return serverInfo != nil && includesName(profile.serverNames, serverInfo.Name)
+}
+
+// newListenerProfiles maps the listen addresses of each profile to that profile
+func newListenerProfiles(
+	listenAddresses []string,
+	profilesConfig map[string]ListenerProfileConfig,
+) (map[netip.AddrPort]*ListenerProfile, error) {
+	profiles := make(map[netip.AddrPort]*ListenerProfile)
+	for name, profileConfig := range profilesConfig {
+		profile := &ListenerProfile{
+			name:             name,
+			serverNames:      profileConfig.ServerNames,
+			blockedNamesFile: profileConfig.BlockedNamesFile,
+		}
+		for _, listenAddrStr := range profileConfig.ListenAddresses {
+			if !includesName(listenAddresses, listenAddrStr) {
+				return nil, fmt.Errorf("Listener profile [%s]: [%s] is not in listen_addresses", name, listenAddrStr)
+			}
+			listenAddr, err := net.ResolveUDPAddr("udp", listenAddrStr)
+			if err != nil {
+				return nil, fmt.Errorf("Listener profile [%s]: %v", name, err)
+			}
+			addrPort := listenAddr.AddrPort()
+			addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+			if other, ok := profiles[addrPort]; ok {
+				return nil, fmt.Errorf("[%s] is used by both the [%s] and [%s] listener profiles", listenAddrStr, other.name, name)
+			}
+			profiles[addrPort] = profile
+		}
+	}
+	return profiles, nil
+}
+
+// listenerProfile returns the profile of the listener a client is connected to, or nil if it doesn't have any.
+// Connections accepted by a listener bound to an unspecified address are matched by port.
+func (proxy *Proxy) listenerProfile(clientPc net.Conn) *ListenerProfile {
+	if len(proxy.listenerProfiles) == 0 || clientPc == nil {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(clientPc.LocalAddr().String())
+	if err != nil {
+		return nil
+	}
+	addr, port := addrPort.Addr().Unmap(), addrPort.Port()
+	for _, candidate := range []netip.Addr{addr, netip.IPv4Unspecified(), netip.IPv6Unspecified()} {
+		if profile, ok := proxy.listenerProfiles[netip.AddrPortFrom(candidate, port)]; ok {
+			return profile
+		}
+	}
+	return nil
+}
+
+// listenerProfilesBlockNames returns true if at least one listener profile has its own blocking rules
+func (proxy *Proxy) listenerProfilesBlockNames() bool {
+	for _, profile := range proxy.listenerProfiles {
+		if len(profile.blockedNamesFile) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// getServer returns the server to send a query to, among the servers of the listener profile if it restricts them
+func (proxy *Proxy) getServer(profile *ListenerProfile) *ServerInfo {
+	if profile == nil || len(profile.serverNames) == 0 {
+		return proxy.serversInfo.getOne()
+	}
+	return proxy.serversInfo.getOneOf(profile.serverNames)
+}
+
+// ---
+
+type PluginListenerProfile struct{}
+
+func (plugin *PluginListenerProfile) Name() string {
+	return "listener_profile"
+}
+
+func (plugin *PluginListenerProfile) Description() string {
+	return "Block DNS queries matching the name patterns of the profile of the listener they were received on"
+}
+
+func (plugin *PluginListenerProfile) Init(proxy *Proxy) error {
+	for _, profile := range proxy.listenerProfiles {
+		if len(profile.blockedNamesFile) == 0 || profile.blockedNames != nil {
+			continue
+		}
+		dlog.Noticef("Loading the set of blocking rules of the [%s] listener profile from [%s]", profile.name, profile.blockedNamesFile)
+		lines, err := ReadTextFile(profile.blockedNamesFile)
+		if err != nil {
+			return err
+		}
+		blockedNames := &BlockedNames{
+			allWeeklyRanges: proxy.allWeeklyRanges,
+			patternMatcher:  NewPatternMatcher(),
+			ipCryptConfig:   proxy.ipCryptConfig,
+		}
+		if err := new(PluginBlockName).loadRules(lines, blockedNames); err != nil {
+			return err
+		}
+		profile.blockedNames = blockedNames
+	}
+	return nil
+}
+
+func (plugin *PluginListenerProfile) Drop() error {
+	return nil
+}
+
+func (plugin *PluginListenerProfile) Reload() error {
+	return nil
+}
+
+func (plugin *PluginListenerProfile) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	profile := pluginsState.listenerProfile
+	if profile == nil || profile.blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
+		return nil
+	}
+	_, err := profile.blockedNames.check(pluginsState, pluginsState.qName, nil)
+	return err
+}
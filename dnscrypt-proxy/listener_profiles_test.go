@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+	"github.com/VividCortex/ewma"
+)
+
+func TestListenerProfiles(t *testing.T) {
+	listenAddresses := []string{"127.0.0.1:0", "[::]:5353"}
+	if _, err := newListenerProfiles(listenAddresses, map[string]ListenerProfileConfig{
+		"kids": {ListenAddresses: []string{"127.0.0.2:53"}},
+	}); err == nil {
+		t.Error("profiles should only use addresses from listen_addresses")
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	listenAddresses[0] = conn.LocalAddr().String()
+	profiles, err := newListenerProfiles(listenAddresses, map[string]ListenerProfileConfig{
+		"kids":  {ListenAddresses: []string{listenAddresses[0]}, ServerNames: []string{"family"}},
+		"guest": {ListenAddresses: []string{"[::]:5353"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy()
+	proxy.listenerProfiles = profiles
+	if profile := proxy.listenerProfile(conn); profile == nil || profile.name != "kids" {
+		t.Fatalf("the profile of the listener should be found, got %v", profile)
+	}
+	if profile := proxy.listenerProfile(nil); profile != nil {
+		t.Errorf("queries without a listener should not have a profile, got %v", profile)
+	}
+
+	newServer := func(name string) *ServerInfo {
+		return &ServerInfo{Name: name, rtt: ewma.NewMovingAverage(RTTEwmaDecay)}
+	}
+	proxy.serversInfo.lbStrategy = LBStrategyFirst{}
+	proxy.serversInfo.inner = []*ServerInfo{newServer("default"), newServer("family")}
+	profile := proxy.listenerProfile(conn)
+	if server := proxy.getServer(profile); server == nil || server.Name != "family" {
+		t.Errorf("the profile should only use its own servers, got %v", server)
+	}
+	if server := proxy.getServer(nil); server == nil || server.Name != "default" {
+		t.Errorf("queries without a profile should use all the servers, got %v", server)
+	}
+	if profile.allowsServer(proxy.serversInfo.inner[0]) {
+		t.Error("the profile should not allow servers it doesn't list")
+	}
+}
+
+func TestListenerProfilesCache(t *testing.T) {
+	answer := func(addr string) func(query []byte) []byte {
+		return func(query []byte) []byte {
+			msg := dns.Msg{Data: query}
+			if err := msg.Unpack(); err != nil {
+				return nil
+			}
+			resp := EmptyResponseFromMessage(&msg)
+			rr := new(dns.A)
+			rr.Hdr = dns.Header{Name: msg.Question[0].Header().Name, Class: dns.ClassINET, TTL: 600}
+			rr.A = rdata.A{Addr: netip.MustParseAddr(addr)}
+			resp.Answer = []dns.RR{rr}
+			if err := resp.Pack(); err != nil {
+				return nil
+			}
+			return resp.Data
+		}
+	}
+	proxy := newTestProxyWithDoHServers(t, newTestDoHServer(t, answer("192.0.2.1")), newTestDoHServer(t, answer("192.0.2.2")))
+	proxy.cacheSize = 16
+	proxy.cacheMaxTTL = 3600
+	proxy.pluginsGlobals.queryPlugins = &[]Plugin{&PluginCache{proxy: proxy}}
+	proxy.pluginsGlobals.responsePlugins = &[]Plugin{&PluginCacheResponse{}}
+
+	defaultConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer defaultConn.Close()
+	kidsConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kidsConn.Close()
+	listenAddresses := []string{defaultConn.LocalAddr().String(), kidsConn.LocalAddr().String()}
+	proxy.listenerProfiles, err = newListenerProfiles(listenAddresses, map[string]ListenerProfileConfig{
+		"kids": {ListenAddresses: []string{listenAddresses[1]}, ServerNames: []string{"second"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func(conn net.Conn) string {
+		query := dns.NewMsg("profile-cache.example.com.", dns.TypeA)
+		if err := query.Pack(); err != nil {
+			t.Fatal(err)
+		}
+		response := dns.Msg{Data: proxy.processIncomingQuery("test", "udp", query.Data, nil, conn, time.Now(), false)}
+		if err := response.Unpack(); err != nil || len(response.Answer) != 1 {
+			t.Fatalf("unexpected response: %v", err)
+		}
+		return response.Answer[0].(*dns.A).A.Addr.String()
+	}
+	// Each listener resolves twice, the second time from the cache
+	for range 2 {
+		if addr := resolve(defaultConn); addr != "192.0.2.1" {
+			t.Errorf("default listener answer = %s, want the one of the first server", addr)
+		}
+		if addr := resolve(kidsConn); addr != "192.0.2.2" {
+			t.Errorf("profile answer = %s, want the one of its own server", addr)
+		}
+	}
+}
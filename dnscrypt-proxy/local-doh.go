@@ -109,6 +109,9 @@ func (proxy *Proxy) localDoHListener(acceptPc *net.TCPListener) {
 	}
 	httpServer.SetKeepAlivesEnabled(true)
 	if err := httpServer.ServeTLS(acceptPc, proxy.localDoHCertFile, proxy.localDoHCertKeyFile); err != nil {
+		if proxy.isShuttingDown() {
+			return
+		}
 		dlog.Fatal(err)
 	}
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+const systemLoggerAppName = "dnscrypt-proxy"
+
+// teeLogToSystemLogger - Sends application logs to the system logger, in addition to the log file.
+// dlog only supports a single destination, so it writes to a pipe, whose lines are copied to both.
+// Messages logged right before the process exits, such as fatal errors, may not be copied.
+func teeLogToSystemLogger(logFile *os.File) error {
+	systemLogger, err := newSystemLogger(systemLoggerAppName)
+	if err != nil {
+		return err
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	dlog.SetFileDescriptor(writer)
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			line := scanner.Text()
+			logFile.WriteString(line + "\n")
+			systemLogger.writeString(parseLogLine(line))
+		}
+	}()
+	return nil
+}
+
+// parseLogLine - Extracts the severity and the message from a line written by dlog to a file
+func parseLogLine(line string) (dlog.Severity, string) {
+	// Lines look like "[2006-01-02 15:04:05] [NOTICE] message"
+	_, rest, found := strings.Cut(line, "] [")
+	if !found {
+		return dlog.SeverityNotice, line
+	}
+	name, message, found := strings.Cut(rest, "] ")
+	if !found {
+		return dlog.SeverityNotice, line
+	}
+	severity := slices.Index(dlog.SeverityName, name)
+	if severity < 0 {
+		return dlog.SeverityNotice, line
+	}
+	return dlog.Severity(severity), message
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jedisct1/dlog"
+)
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		line         string
+		wantSeverity dlog.Severity
+		wantMessage  string
+	}{
+		{"[2025-01-02 03:04:05] [WARNING] Something [odd] happened", dlog.SeverityWarning, "Something [odd] happened"},
+		{"[2025-01-02 03:04:05] [DEBUG] x", dlog.SeverityDebug, "x"},
+		{"[2025-01-02 03:04:05] [UNKNOWN] x", dlog.SeverityNotice, "[2025-01-02 03:04:05] [UNKNOWN] x"},
+		{"not a log line", dlog.SeverityNotice, "not a log line"},
+	}
+	for _, tt := range tests {
+		severity, message := parseLogLine(tt.line)
+		if severity != tt.wantSeverity || message != tt.wantMessage {
+			t.Errorf("parseLogLine(%q) = %v, %q, want %v, %q", tt.line, severity, message, tt.wantSeverity, tt.wantMessage)
+		}
+	}
+}
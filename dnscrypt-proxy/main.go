@@ -56,11 +56,15 @@ func main() {
 	flags.ListAll = flag.Bool("list-all", false, "print the complete list of available resolvers, ignoring filters")
 	flags.IncludeRelays = flag.Bool("include-relays", false, "include the list of available relays in the output of -list and -list-all")
 	flags.JSONOutput = flag.Bool("json", false, "output list as JSON")
+	flags.ListProto = flag.String("list-proto", "", "only list servers using these protocols (comma-separated: dnscrypt, doh, odoh)")
+	flags.ListProperties = flag.String("list-require", "", "only list servers with these properties (comma-separated: nolog, nofilter, dnssec)")
+	flags.ListName = flag.String("list-name", "", "only list servers whose name contains this string")
 	flags.Check = flag.Bool("check", false, "check the configuration file and exit")
 	flags.ConfigFile = flag.String("config", DefaultConfigFileName, "Path to the configuration file")
 	flags.Child = flag.Bool("child", false, "Invokes program as a child process")
 	flags.NetprobeTimeoutOverride = flag.Int("netprobe-timeout", 60, "Override the netprobe timeout")
 	flags.ShowCerts = flag.Bool("show-certs", false, "print DoH certificate chain hashes")
+	flags.Compare = flag.String("compare", "", "resolve a name through every server and compare the answers (string can be <name> or <name>,<type>)")
 
 	flag.Parse()
 
@@ -126,6 +130,7 @@ func main() {
 		go app.AppMain()
 		<-app.quit
 		dlog.Notice("Quit signal received...")
+		app.Stop(nil)
 	}
 }
 
@@ -153,9 +158,15 @@ func (app *App) AppMain() {
 }
 
 func (app *App) Stop(service service.Service) error {
+	if app.proxy != nil {
+		app.proxy.Shutdown(app.proxy.shutdownGracePeriod)
+	}
 	if app.proxy != nil && app.proxy.udpConnPool != nil {
 		app.proxy.udpConnPool.Close()
 	}
+	if app.proxy != nil && app.proxy.tcpConnPool != nil {
+		app.proxy.tcpConnPool.Close()
+	}
 	if err := PidFileRemove(); err != nil {
 		dlog.Warnf("Failed to remove the PID file: [%v]", err)
 	}
@@ -101,17 +101,22 @@ func (q *QueryLogEntry) EstimateMemoryUsage() int64 {
 }
 
 type resolverSnapshot struct {
-	name          string
-	proto         string
-	total         uint64
-	failed        uint64
-	success       float64
-	avgObservedMs float64
-	lastUpdate    time.Time
-	lastAction    time.Time
-	status        string
-	score         float64
-	ageSeconds    float64
+	name             string
+	proto            string
+	total            uint64
+	failed           uint64
+	success          float64
+	avgObservedMs    float64
+	lastUpdate       time.Time
+	lastAction       time.Time
+	status           string
+	score            float64
+	ageSeconds       float64
+	rcodes           RcodeCounters
+	rcodesWindow     RcodeCounters
+	malformed        uint64
+	contentType      uint64
+	questionMismatch uint64
 }
 
 // MonitoringUI - Handles the monitoring UI
@@ -224,6 +229,7 @@ func (ui *MonitoringUI) Start() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", ui.handleRoot)
 	mux.HandleFunc("/api/metrics", ui.handleMetrics)
+	mux.HandleFunc("/api/servers", ui.handleServers)
 	mux.HandleFunc("/api/ws", ui.handleWebSocket)
 	mux.HandleFunc("/static/monitoring.js", ui.handleStaticJS)
 	mux.HandleFunc("/static/", ui.handleStatic)
@@ -541,6 +547,74 @@ func (mc *MetricsCollector) generatePrometheusMetrics() string {
 	}
 	mc.serverMutex.RUnlock()
 
+	// Add per-server response code metrics
+	resolverSnapshots, _ := mc.collectResolverSnapshots()
+	result.WriteString("# HELP dnscrypt_proxy_server_responses_total Total responses per server and response code\n")
+	result.WriteString("# TYPE dnscrypt_proxy_server_responses_total counter\n")
+	for _, snapshot := range resolverSnapshots {
+		escapedServer := strings.ReplaceAll(strings.ReplaceAll(snapshot.name, "\\", "\\\\"), "\"", "\\\"")
+		writeRcodeCounters(&result, "dnscrypt_proxy_server_responses_total", escapedServer, &snapshot.rcodes)
+	}
+	result.WriteString(fmt.Sprintf("# HELP dnscrypt_proxy_server_responses_window Responses per server and response code over the last %s\n", RcodeStatsBucketDuration*RcodeStatsWindowBuckets))
+	result.WriteString("# TYPE dnscrypt_proxy_server_responses_window gauge\n")
+	for _, snapshot := range resolverSnapshots {
+		escapedServer := strings.ReplaceAll(strings.ReplaceAll(snapshot.name, "\\", "\\\\"), "\"", "\\\"")
+		writeRcodeCounters(&result, "dnscrypt_proxy_server_responses_window", escapedServer, &snapshot.rcodesWindow)
+	}
+	result.WriteString("# HELP dnscrypt_proxy_server_malformed_responses_total Total unparseable responses per server\n")
+	result.WriteString("# TYPE dnscrypt_proxy_server_malformed_responses_total counter\n")
+	for _, snapshot := range resolverSnapshots {
+		escapedServer := strings.ReplaceAll(strings.ReplaceAll(snapshot.name, "\\", "\\\\"), "\"", "\\\"")
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_server_malformed_responses_total{server=\"%s\"} %d\n", escapedServer, snapshot.malformed))
+	}
+	result.WriteString("# HELP dnscrypt_proxy_server_content_type_errors_total Total DoH responses rejected because of their Content-Type per server\n")
+	result.WriteString("# TYPE dnscrypt_proxy_server_content_type_errors_total counter\n")
+	for _, snapshot := range resolverSnapshots {
+		escapedServer := strings.ReplaceAll(strings.ReplaceAll(snapshot.name, "\\", "\\\\"), "\"", "\\\"")
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_server_content_type_errors_total{server=\"%s\"} %d\n", escapedServer, snapshot.contentType))
+	}
+	result.WriteString("# HELP dnscrypt_proxy_server_question_mismatches_total Total responses whose question didn't match the query per server\n")
+	result.WriteString("# TYPE dnscrypt_proxy_server_question_mismatches_total counter\n")
+	for _, snapshot := range resolverSnapshots {
+		escapedServer := strings.ReplaceAll(strings.ReplaceAll(snapshot.name, "\\", "\\\\"), "\"", "\\\"")
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_server_question_mismatches_total{server=\"%s\"} %d\n", escapedServer, snapshot.questionMismatch))
+	}
+
+	// Add certificate refresh metrics
+	if mc.proxy != nil {
+		writeCertRefreshMetrics(&result, mc.proxy.serversInfo.certRefreshSnapshot())
+	}
+
+	// Add DoH connection timing metrics
+	if mc.proxy != nil {
+		writeConnTimingMetrics(&result, mc.proxy.serversInfo.connTimingsSnapshot())
+	}
+
+	// Add TLS version and cipher suite metrics
+	if mc.proxy != nil {
+		result.WriteString("# HELP dnscrypt_proxy_server_tls_responses_total Total responses per server, TLS version and cipher suite\n")
+		result.WriteString("# TYPE dnscrypt_proxy_server_tls_responses_total counter\n")
+		for _, entry := range mc.proxy.serversInfo.tlsStatsSnapshot() {
+			escapedServer := strings.ReplaceAll(strings.ReplaceAll(entry.Server, "\\", "\\\\"), "\"", "\\\"")
+			result.WriteString(fmt.Sprintf("dnscrypt_proxy_server_tls_responses_total{server=\"%s\", version=\"%s\", cipher=\"%s\"} %d\n",
+				escapedServer, entry.Version, entry.CipherSuite, entry.Responses))
+		}
+	}
+
+	// Add query event socket metrics
+	if mc.proxy != nil && mc.proxy.queryEventSocket != nil {
+		result.WriteString("# HELP dnscrypt_proxy_query_events_dropped_total Query events dropped because a socket client was too slow\n")
+		result.WriteString("# TYPE dnscrypt_proxy_query_events_dropped_total counter\n")
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_query_events_dropped_total %d\n", mc.proxy.queryEventSocket.Dropped()))
+	}
+
+	// Add query log export metrics
+	if mc.proxy != nil && mc.proxy.queryLogExporter != nil {
+		result.WriteString("# HELP dnscrypt_proxy_query_log_export_dropped_total Query log events dropped because the remote collector was too slow or unreachable\n")
+		result.WriteString("# TYPE dnscrypt_proxy_query_log_export_dropped_total counter\n")
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_query_log_export_dropped_total %d\n", mc.proxy.queryLogExporter.Dropped()))
+	}
+
 	// Add query type metrics
 	mc.queryTypesMutex.RLock()
 	result.WriteString("# HELP dnscrypt_proxy_query_type_total Total queries per DNS record type\n")
@@ -659,16 +733,21 @@ func (mc *MetricsCollector) collectResolverSnapshots() ([]resolverSnapshot, map[
 		}
 
 		snapshot := resolverSnapshot{
-			name:       server.Name,
-			proto:      server.Proto.String(),
-			total:      total,
-			failed:     failed,
-			success:    successRate,
-			lastUpdate: lastUpdate,
-			lastAction: lastAction,
-			status:     status,
-			score:      score,
-			ageSeconds: ageSeconds,
+			name:             server.Name,
+			proto:            server.Proto.String(),
+			total:            total,
+			failed:           failed,
+			success:          successRate,
+			lastUpdate:       lastUpdate,
+			lastAction:       lastAction,
+			status:           status,
+			score:            score,
+			ageSeconds:       ageSeconds,
+			rcodes:           server.rcodeStats.total,
+			rcodesWindow:     server.rcodeStats.window(now),
+			malformed:        server.malformedResponses,
+			contentType:      server.contentTypeErrors,
+			questionMismatch: server.questionMismatches,
 		}
 
 		snapshots = append(snapshots, snapshot)
@@ -688,6 +767,82 @@ func (mc *MetricsCollector) collectResolverSnapshots() ([]resolverSnapshot, map[
 	return snapshots, index
 }
 
+// writeCertRefreshMetrics - Writes the certificate refresh Prometheus metrics
+func writeCertRefreshMetrics(result *strings.Builder, certRefreshStats map[string]CertRefreshStats) {
+	certRefreshServers := make([]string, 0, len(certRefreshStats))
+	for server := range certRefreshStats {
+		certRefreshServers = append(certRefreshServers, server)
+	}
+	sort.Strings(certRefreshServers)
+	result.WriteString("# HELP dnscrypt_proxy_cert_refresh_attempts_total Certificate refresh attempts per server\n")
+	result.WriteString("# TYPE dnscrypt_proxy_cert_refresh_attempts_total counter\n")
+	for _, server := range certRefreshServers {
+		escapedServer := strings.ReplaceAll(strings.ReplaceAll(server, "\\", "\\\\"), "\"", "\\\"")
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_cert_refresh_attempts_total{server=\"%s\"} %d\n", escapedServer, certRefreshStats[server].Attempts))
+	}
+	result.WriteString("# HELP dnscrypt_proxy_cert_refresh_successes_total Successful certificate refreshes per server\n")
+	result.WriteString("# TYPE dnscrypt_proxy_cert_refresh_successes_total counter\n")
+	for _, server := range certRefreshServers {
+		escapedServer := strings.ReplaceAll(strings.ReplaceAll(server, "\\", "\\\\"), "\"", "\\\"")
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_cert_refresh_successes_total{server=\"%s\"} %d\n", escapedServer, certRefreshStats[server].Successes))
+	}
+	result.WriteString("# HELP dnscrypt_proxy_cert_age_seconds Age of the DNSCrypt certificate in use per server\n")
+	result.WriteString("# TYPE dnscrypt_proxy_cert_age_seconds gauge\n")
+	now := time.Now()
+	for _, server := range certRefreshServers {
+		stats := certRefreshStats[server]
+		if certAge := stats.CertAge(now); certAge >= 0 {
+			escapedServer := strings.ReplaceAll(strings.ReplaceAll(server, "\\", "\\\\"), "\"", "\\\"")
+			result.WriteString(fmt.Sprintf("dnscrypt_proxy_cert_age_seconds{server=\"%s\"} %.0f\n", escapedServer, certAge.Seconds()))
+		}
+	}
+}
+
+// writeConnTimingMetrics - Writes the DoH connection timing Prometheus metrics
+func writeConnTimingMetrics(result *strings.Builder, connTimings map[string]ConnTimingStats) {
+	servers := make([]string, 0, len(connTimings))
+	for server := range connTimings {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	result.WriteString("# HELP dnscrypt_proxy_server_doh_connections_total Total DoH queries per server sent over new or reused connections\n")
+	result.WriteString("# TYPE dnscrypt_proxy_server_doh_connections_total counter\n")
+	for _, server := range servers {
+		escapedServer := strings.ReplaceAll(strings.ReplaceAll(server, "\\", "\\\\"), "\"", "\\\"")
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_server_doh_connections_total{server=\"%s\", reused=\"false\"} %d\n", escapedServer, connTimings[server].NewConnections))
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_server_doh_connections_total{server=\"%s\", reused=\"true\"} %d\n", escapedServer, connTimings[server].ReusedConnections))
+	}
+	result.WriteString("# HELP dnscrypt_proxy_server_doh_connection_setup_seconds_total Total time spent establishing new DoH connections per server\n")
+	result.WriteString("# TYPE dnscrypt_proxy_server_doh_connection_setup_seconds_total counter\n")
+	for _, server := range servers {
+		escapedServer := strings.ReplaceAll(strings.ReplaceAll(server, "\\", "\\\\"), "\"", "\\\"")
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_server_doh_connection_setup_seconds_total{server=\"%s\"} %.3f\n", escapedServer, connTimings[server].SetupTime.Seconds()))
+	}
+	result.WriteString("# HELP dnscrypt_proxy_server_doh_request_seconds_total Total time between getting a connection and receiving the response per server\n")
+	result.WriteString("# TYPE dnscrypt_proxy_server_doh_request_seconds_total counter\n")
+	for _, server := range servers {
+		escapedServer := strings.ReplaceAll(strings.ReplaceAll(server, "\\", "\\\\"), "\"", "\\\"")
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_server_doh_request_seconds_total{server=\"%s\", reused=\"false\"} %.3f\n", escapedServer, connTimings[server].NewRequestTime.Seconds()))
+		result.WriteString(fmt.Sprintf("dnscrypt_proxy_server_doh_request_seconds_total{server=\"%s\", reused=\"true\"} %.3f\n", escapedServer, connTimings[server].ReusedRequestTime.Seconds()))
+	}
+}
+
+// writeRcodeCounters - Writes one Prometheus sample per response code for a server
+func writeRcodeCounters(result *strings.Builder, metric string, escapedServer string, counters *RcodeCounters) {
+	for _, sample := range []struct {
+		rcode string
+		count uint64
+	}{
+		{"NOERROR", counters.Success},
+		{"NXDOMAIN", counters.NXDomain},
+		{"SERVFAIL", counters.ServFail},
+		{"REFUSED", counters.Refused},
+		{"OTHER", counters.Other},
+	} {
+		result.WriteString(fmt.Sprintf("%s{server=\"%s\", rcode=\"%s\"} %d\n", metric, escapedServer, sample.rcode, sample.count))
+	}
+}
+
 func (mc *MetricsCollector) collectCacheStats(cacheHitRatio float64, cacheHits, cacheMisses uint64) map[string]any {
 	stats := map[string]any{
 		"enabled":         false,
@@ -718,12 +873,48 @@ func (mc *MetricsCollector) collectCacheStats(cacheHitRatio float64, cacheHits,
 	return stats
 }
 
+func (mc *MetricsCollector) collectCertRefresh() []map[string]any {
+	if mc.proxy == nil {
+		return nil
+	}
+
+	certRefreshStats := mc.proxy.serversInfo.certRefreshSnapshot()
+	results := make([]map[string]any, 0, len(certRefreshStats))
+	now := time.Now()
+
+	for name, stats := range certRefreshStats {
+		entry := map[string]any{
+			"name":         name,
+			"attempts":     stats.Attempts,
+			"successes":    stats.Successes,
+			"success_rate": stats.SuccessRate(),
+			"last_attempt": stats.LastAttempt,
+
+			"consecutive_failures": stats.ConsecutiveFailures,
+			"excluded":             stats.Excluded,
+		}
+		if !stats.LastSuccess.IsZero() {
+			entry["last_success"] = stats.LastSuccess
+		}
+		if certAge := stats.CertAge(now); certAge >= 0 {
+			entry["cert_age_seconds"] = certAge.Seconds()
+		}
+		results = append(results, entry)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i]["name"].(string) < results[j]["name"].(string)
+	})
+
+	return results
+}
+
 func (mc *MetricsCollector) collectSourceRefresh() []map[string]any {
-	if mc.proxy == nil || len(mc.proxy.sources) == 0 {
+	if mc.proxy == nil || (len(mc.proxy.sources) == 0 && len(mc.proxy.disabledSources) == 0) {
 		return nil
 	}
 
-	results := make([]map[string]any, 0, len(mc.proxy.sources))
+	results := make([]map[string]any, 0, len(mc.proxy.sources)+len(mc.proxy.disabledSources))
 	now := time.Now()
 
 	for _, source := range mc.proxy.sources {
@@ -783,6 +974,9 @@ func (mc *MetricsCollector) collectSourceRefresh() []map[string]any {
 
 		results = append(results, entry)
 	}
+	for _, name := range mc.proxy.disabledSources {
+		results = append(results, map[string]any{"name": name, "status": "disabled"})
+	}
 
 	sort.Slice(results, func(i, j int) bool {
 		return results[i]["name"].(string) < results[j]["name"].(string)
@@ -941,13 +1135,18 @@ type queryTypeCount struct {
 	resolverHealth := make([]map[string]any, 0, len(resolverSnapshots))
 	for _, snapshot := range resolverSnapshots {
 		entry := map[string]any{
-			"name":           snapshot.name,
-			"proto":          snapshot.proto,
-			"status":         snapshot.status,
-			"success_rate":   snapshot.success,
-			"total_queries":  snapshot.total,
-			"failed_queries": snapshot.failed,
-			"score":          snapshot.score,
+			"name":              snapshot.name,
+			"proto":             snapshot.proto,
+			"status":            snapshot.status,
+			"success_rate":      snapshot.success,
+			"total_queries":     snapshot.total,
+			"failed_queries":    snapshot.failed,
+			"score":             snapshot.score,
+			"rcodes":            snapshot.rcodes,
+			"rcodes_window":     snapshot.rcodesWindow,
+			"malformed":         snapshot.malformed,
+			"content_type":      snapshot.contentType,
+			"question_mismatch": snapshot.questionMismatch,
 		}
 		if snapshot.avgObservedMs > 0 {
 			entry["avg_response_ms"] = snapshot.avgObservedMs
@@ -965,6 +1164,11 @@ type queryTypeCount struct {
 	}
 
 	sourceRefresh := mc.collectSourceRefresh()
+	certRefresh := mc.collectCertRefresh()
+	var tlsStats []TLSStatsEntry
+	if mc.proxy != nil {
+		tlsStats = mc.proxy.serversInfo.tlsStatsSnapshot()
+	}
 	generatedAt := time.Now().UTC()
 
 	// Return all metrics and cache the result
@@ -983,6 +1187,8 @@ type queryTypeCount struct {
 		"cache_stats":        cacheStats,
 		"resolver_health":    resolverHealth,
 		"sources":            sourceRefresh,
+		"cert_refresh":       certRefresh,
+		"tls":                tlsStats,
 		"generated_at":       generatedAt,
 	}
 
@@ -1111,6 +1317,30 @@ func (ui *MonitoringUI) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleServers - Handles the server status API endpoint
+func (ui *MonitoringUI) handleServers(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	setDynamicCacheHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if ui.metricsCollector.proxy == nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	jsonData, err := json.Marshal(ui.metricsCollector.proxy.serversInfo.status())
+	if err != nil {
+		dlog.Errorf("Error marshaling server status: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
 // handleWebSocket - Handles WebSocket connections
 func (ui *MonitoringUI) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers for WebSocket
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/jedisct1/dlog"
+)
+
+const NetProbeQueryTimeout = 1 * time.Second
+
+const (
+	NetprobeFailureActionContinue = "continue"
+	NetprobeFailureActionRetry    = "retry"
+	NetprobeFailureActionExit     = "exit"
+)
+
+var ErrNetProbeTimeout = errors.New("Timeout while waiting for network connectivity")
+
+// netProbeTimedOut applies netprobe_failure_action once the network is still not available after the timeout.
+// It returns true if connectivity should be tested again.
+func netProbeTimedOut(proxy *Proxy) (bool, error) {
+	switch proxy.netprobeFailureAction {
+	case NetprobeFailureActionRetry:
+		dlog.Warn("Network still not available -- waiting again")
+		return true, nil
+	case NetprobeFailureActionExit:
+		return false, ErrNetProbeTimeout
+	default:
+		dlog.Error(ErrNetProbeTimeout)
+		return false, nil
+	}
+}
+
+// netProbeQuery builds the A query sent by NetProbe when netprobe_query is set
+func netProbeQuery(name string) (*dns.Msg, error) {
+	msg := dns.NewMsg(fqdn(name), dns.TypeA)
+	if msg == nil {
+		return nil, errors.New("Invalid netprobe query")
+	}
+	msg.ID = dns.ID()
+	msg.RecursionDesired = true
+	if err := msg.Pack(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// netProbeExchange sends a probe query over a connected socket, and waits for a response to it.
+// Any response code is accepted, as the goal is only to check that the network is up.
+func netProbeExchange(pc net.Conn, name string) error {
+	query, err := netProbeQuery(name)
+	if err != nil {
+		return err
+	}
+	if err := pc.SetDeadline(time.Now().Add(NetProbeQueryTimeout)); err != nil {
+		return err
+	}
+	if _, err := pc.Write(query.Data); err != nil {
+		return err
+	}
+	buf := make([]byte, MaxDNSUDPPacketSize)
+	for {
+		length, err := pc.Read(buf)
+		if err != nil {
+			return err
+		}
+		response := buf[:length]
+		if len(response) >= MinDNSPacketSize && TransactionID(response) == query.ID && response[2]&0x80 == 0x80 {
+			return nil
+		}
+	}
+}
+
+// isNetProbeTimeout returns true if the probe already waited for a response before failing
+func isNetProbeTimeout(err error) bool {
+	var neterr net.Error
+	return errors.As(err, &neterr) && neterr.Timeout()
+}
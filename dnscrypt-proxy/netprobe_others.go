@@ -30,21 +30,32 @@ func NetProbe(proxy *Proxy, address string, timeout int) error {
 	} else {
 		timeout = Min(MaxTimeout, timeout)
 	}
-	for tries := timeout; tries > 0; tries-- {
+	for tries := timeout; ; tries-- {
+		if tries <= 0 {
+			if retry, err := netProbeTimedOut(proxy); !retry {
+				return err
+			}
+			tries = timeout
+		}
 		pc, err := net.DialTimeout("udp", remoteUDPAddr.String(), proxy.timeout)
+		if err == nil && len(proxy.netprobeQuery) > 0 {
+			if err = netProbeExchange(pc, proxy.netprobeQuery); err != nil {
+				pc.Close()
+			}
+		}
 		if err != nil {
 			if !retried {
 				retried = true
 				dlog.Notice("Network not available yet -- waiting...")
 			}
 			dlog.Debug(err)
-			time.Sleep(1 * time.Second)
+			if !isNetProbeTimeout(err) {
+				time.Sleep(1 * time.Second)
+			}
 			continue
 		}
 		pc.Close()
 		dlog.Notice("Network connectivity detected")
 		return nil
 	}
-	dlog.Error("Timeout while waiting for network connectivity")
-	return nil
 }
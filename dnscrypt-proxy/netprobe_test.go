@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestNetProbeExchange(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			length, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg := dns.Msg{Data: buf[:length]}
+			if err := msg.Unpack(); err != nil || len(msg.Question) != 1 {
+				continue
+			}
+			// A stray packet with another ID must be ignored
+			server.WriteTo([]byte{0xff, 0xff, 0x81, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, addr)
+			response := EmptyResponseFromMessage(&msg)
+			response.Rcode = dns.RcodeRefused
+			if err := response.Pack(); err == nil {
+				server.WriteTo(response.Data, addr)
+			}
+		}
+	}()
+
+	pc, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if err := netProbeExchange(pc, "."); err != nil {
+		t.Fatalf("netProbeExchange() error = %v", err)
+	}
+}
+
+func TestNetProbeExchangeTimeout(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	pc, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	err = netProbeExchange(pc, "example.com")
+	if err == nil || !isNetProbeTimeout(err) {
+		t.Fatalf("netProbeExchange() error = %v, want a timeout", err)
+	}
+}
+
+func TestNetProbeFailureAction(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// The network is down until a first query has been dropped, and up from then on
+	var up atomic.Bool
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			length, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg := dns.Msg{Data: buf[:length]}
+			if err := msg.Unpack(); err != nil || !up.Load() {
+				up.Store(true)
+				continue
+			}
+			response := EmptyResponseFromMessage(&msg)
+			if err := response.Pack(); err == nil {
+				server.WriteTo(response.Data, addr)
+			}
+		}
+	}()
+	newProxy := func(action string) *Proxy {
+		return &Proxy{timeout: time.Second, netprobeQuery: ".", netprobeFailureAction: action}
+	}
+
+	if err := NetProbe(newProxy(NetprobeFailureActionRetry), server.LocalAddr().String(), 1); err != nil {
+		t.Errorf("NetProbe() with the retry action = %v, want nil once the network is up", err)
+	}
+
+	up.Store(false)
+	if err := NetProbe(newProxy(NetprobeFailureActionContinue), server.LocalAddr().String(), 1); err != nil {
+		t.Errorf("NetProbe() with the continue action = %v, want nil", err)
+	}
+
+	up.Store(false)
+	if err := NetProbe(newProxy(NetprobeFailureActionExit), server.LocalAddr().String(), 1); !errors.Is(err, ErrNetProbeTimeout) {
+		t.Errorf("NetProbe() with the exit action = %v, want %v", err, ErrNetProbeTimeout)
+	}
+}
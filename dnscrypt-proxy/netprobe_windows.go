@@ -28,14 +28,24 @@ func NetProbe(proxy *Proxy, address string, timeout int) error {
 	} else {
 		timeout = Min(MaxTimeout, timeout)
 	}
-	for tries := timeout; tries > 0; tries-- {
+	for tries := timeout; ; tries-- {
+		if tries <= 0 {
+			if retry, err := netProbeTimedOut(proxy); !retry {
+				return err
+			}
+			tries = timeout
+		}
 		pc, err := net.DialTimeout("udp", remoteUDPAddr.String(), proxy.timeout)
 		if err == nil {
 			// Write at least 1 byte. This ensures that sockets are ready to use for writing.
 			// Windows specific: during the system startup, sockets can be created but the underlying buffers may not be
 			// set up yet. If this is the case Write fails with WSAENOBUFS: "An operation on a socket could not be
 			// performed because the system lacked sufficient buffer space or because a queue was full"
-			_, err = pc.Write([]byte{0})
+			if len(proxy.netprobeQuery) > 0 {
+				err = netProbeExchange(pc, proxy.netprobeQuery)
+			} else {
+				_, err = pc.Write([]byte{0})
+			}
 			if err != nil {
 				pc.Close()
 			}
@@ -46,13 +56,13 @@ func NetProbe(proxy *Proxy, address string, timeout int) error {
 				dlog.Notice("Network not available yet -- waiting...")
 			}
 			dlog.Debug(err)
-			time.Sleep(1 * time.Second)
+			if !isNetProbeTimeout(err) {
+				time.Sleep(1 * time.Second)
+			}
 			continue
 		}
 		pc.Close()
 		dlog.Notice("Network connectivity detected")
 		return nil
 	}
-	dlog.Error("Timeout while waiting for network connectivity")
-	return nil
 }
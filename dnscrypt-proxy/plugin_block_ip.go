@@ -12,7 +12,13 @@
 	"github.com/k-sone/critbitgo"
 )
 
+const (
+	BlockIPModeResponse = "response"
+	BlockIPModeRecords  = "records"
+)
+
 type PluginBlockIP struct {
+	mode            string
 	blockedPrefixes *iradix.Tree
 	blockedIPs      map[string]any
 	blockedNetworks *critbitgo.Net
@@ -39,6 +45,7 @@ func (plugin *PluginBlockIP) Description() string {
 
 func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 	plugin.configFile = proxy.blockIPFile
+	plugin.mode = proxy.blockIPMode
 	dlog.Noticef("Loading the set of IP blocking rules from [%s]", plugin.configFile)
 
 	lines, err := ReadTextFile(plugin.configFile)
@@ -151,6 +158,7 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 	}
 
 	reject, reason, ipStr := false, "", ""
+	kept, addresses := make([]dns.RR, 0, len(answers)), 0
 
 	// Use read lock for thread-safe access to configuration
 	plugin.rwLock.RLock()
@@ -160,49 +168,76 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 		header := answer.Header()
 		rrtype := dns.RRToType(answer)
 		if header.Class != dns.ClassINET || (rrtype != dns.TypeA && rrtype != dns.TypeAAAA) {
+			kept = append(kept, answer)
 			continue
 		}
+		answerIPStr := ""
 		if rrtype == dns.TypeA {
-			ipStr = answer.(*dns.A).A.Addr.String()
+			answerIPStr = answer.(*dns.A).A.Addr.String()
 		} else if rrtype == dns.TypeAAAA {
-			ipStr = answer.(*dns.AAAA).AAAA.Addr.String() // IPv4-mapped IPv6 addresses are converted to IPv4
+			answerIPStr = answer.(*dns.AAAA).AAAA.Addr.String() // IPv4-mapped IPv6 addresses are converted to IPv4
 		}
-		if _, found := plugin.blockedIPs[ipStr]; found {
-			reject, reason = true, ipStr
-			break
+		answerReason, blocked := plugin.blockedReason(answerIPStr)
+		if !blocked {
+			kept = append(kept, answer)
+			addresses++
+			continue
 		}
-		match, _, found := plugin.blockedPrefixes.Root().LongestPrefix([]byte(ipStr))
-		if found {
-			if len(match) == len(ipStr) || (ipStr[len(match)] == '.' || ipStr[len(match)] == ':') {
-				reject, reason = true, string(match)+"*"
-				break
-			}
+		if !reject {
+			reject, reason, ipStr = true, answerReason, answerIPStr
 		}
-		if plugin.blockedNetworks.Size() > 0 {
-			if ip := net.ParseIP(ipStr); ip != nil {
-				if route, _, _ := plugin.blockedNetworks.MatchIP(ip); route != nil {
-					reject, reason = true, route.String()
-					break
-				}
-			}
+		if plugin.mode != BlockIPModeRecords {
+			break
 		}
 	}
 
-	if reject {
+	if !reject {
+		return nil
+	}
+	if plugin.mode == BlockIPModeRecords {
+		if addresses > 0 {
+			msg.Answer = kept
+		} else {
+			// No addresses left - The response becomes NODATA
+			msg.Answer = nil
+			pluginsState.returnCode = PluginsReturnCodeReject
+		}
+	} else {
 		pluginsState.action = PluginsActionReject
 		pluginsState.returnCode = PluginsReturnCodeReject
-		if plugin.logger != nil {
-			qName := pluginsState.qName
-			clientIPStr, ok := ExtractClientIPStrEncrypted(pluginsState, plugin.ipCryptConfig)
-			if !ok {
-				// Ignore internal flow.
-				return nil
-			}
+	}
+	if plugin.logger != nil {
+		qName := pluginsState.qName
+		clientIPStr, ok := ExtractClientIPStrEncrypted(pluginsState, plugin.ipCryptConfig)
+		if !ok {
+			// Ignore internal flow.
+			return nil
+		}
 
-			if err := WritePluginLog(plugin.logger, plugin.format, clientIPStr, qName, reason, ipStr); err != nil {
-				return err
-			}
+		if err := WritePluginLog(plugin.logger, plugin.format, clientIPStr, qName, reason, ipStr); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+// blockedReason returns the rule matching an IP address, if the address is blocked - plugin.rwLock must be held
+func (plugin *PluginBlockIP) blockedReason(ipStr string) (string, bool) {
+	if _, found := plugin.blockedIPs[ipStr]; found {
+		return ipStr, true
+	}
+	match, _, found := plugin.blockedPrefixes.Root().LongestPrefix([]byte(ipStr))
+	if found {
+		if len(match) == len(ipStr) || (ipStr[len(match)] == '.' || ipStr[len(match)] == ':') {
+			return string(match) + "*", true
+		}
+	}
+	if plugin.blockedNetworks.Size() > 0 {
+		if ip := net.ParseIP(ipStr); ip != nil {
+			if route, _, _ := plugin.blockedNetworks.MatchIP(ip); route != nil {
+				return route.String(), true
+			}
+		}
+	}
+	return "", false
+}
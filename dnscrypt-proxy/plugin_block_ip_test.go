@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+func newBlockIPTestResponse(addrs ...string) *dns.Msg {
+	msg := dns.NewMsg("example.com.", dns.TypeA)
+	msg.Response = true
+	cname := new(dns.CNAME)
+	cname.Hdr = dns.Header{Name: "example.com.", Class: dns.ClassINET, TTL: 60}
+	cname.Target = "cdn.example.net."
+	msg.Answer = []dns.RR{cname}
+	for _, addr := range addrs {
+		ip := netip.MustParseAddr(addr)
+		if ip.Is4() {
+			rr := new(dns.A)
+			rr.Hdr = dns.Header{Name: "cdn.example.net.", Class: dns.ClassINET, TTL: 60}
+			rr.A = rdata.A{Addr: ip}
+			msg.Answer = append(msg.Answer, rr)
+		} else {
+			rr := new(dns.AAAA)
+			rr.Hdr = dns.Header{Name: "cdn.example.net.", Class: dns.ClassINET, TTL: 60}
+			rr.AAAA = rdata.AAAA{Addr: ip}
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	return msg
+}
+
+func TestBlockIPModes(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "blocked-ips.txt")
+	if err := os.WriteFile(rulesFile, []byte("192.0.2.1\n198.51.100.0/24\n2001:db8::/32\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		mode       string
+		addrs      []string
+		wantReject bool
+		wantAnswer int
+	}{
+		{"response mode, partially blocked", BlockIPModeResponse, []string{"192.0.2.1", "203.0.113.1"}, true, 3},
+		{"response mode, not blocked", BlockIPModeResponse, []string{"203.0.113.1"}, false, 2},
+		{"records mode, partially blocked", BlockIPModeRecords, []string{"192.0.2.1", "198.51.100.7", "203.0.113.1", "2001:db8::1"}, false, 2},
+		{"records mode, fully blocked", BlockIPModeRecords, []string{"198.51.100.7", "2001:db8::1"}, false, 0},
+		{"records mode, not blocked", BlockIPModeRecords, []string{"203.0.113.1", "2001:db9::1"}, false, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &PluginBlockIP{}
+			if err := plugin.Init(&Proxy{blockIPFile: rulesFile, blockIPMode: tt.mode}); err != nil {
+				t.Fatal(err)
+			}
+			msg := newBlockIPTestResponse(tt.addrs...)
+			pluginsState := PluginsState{sessionData: make(map[string]any), action: PluginsActionContinue}
+			if err := plugin.Eval(&pluginsState, msg); err != nil {
+				t.Fatal(err)
+			}
+			if rejected := pluginsState.action == PluginsActionReject; rejected != tt.wantReject {
+				t.Errorf("rejected = %v, want %v", rejected, tt.wantReject)
+			}
+			if len(msg.Answer) != tt.wantAnswer {
+				t.Errorf("%d answers left, want %d", len(msg.Answer), tt.wantAnswer)
+			}
+			for _, answer := range msg.Answer {
+				if a, ok := answer.(*dns.A); ok && !tt.wantReject && a.A.Addr.String() != "203.0.113.1" {
+					t.Errorf("blocked address [%s] was kept", a.A.Addr)
+				}
+			}
+			if tt.mode == BlockIPModeRecords && tt.wantAnswer == 0 && pluginsState.returnCode != PluginsReturnCodeReject {
+				t.Errorf("return code = %v, want PluginsReturnCodeReject", pluginsState.returnCode)
+			}
+		})
+	}
+}
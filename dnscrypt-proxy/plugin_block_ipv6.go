@@ -1,10 +1,6 @@
 package main
 
-import (
-	"strings"
-
-	"codeberg.org/miekg/dns"
-)
+import "codeberg.org/miekg/dns"
 
 type PluginBlockIPv6 struct{}
 
@@ -41,22 +37,16 @@ func (plugin *PluginBlockIPv6) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 	hinfo.Cpu = "AAAA queries have been locally blocked by dnscrypt-proxy"
 	hinfo.Os = "Set block_ipv6 to false to disable that feature"
 	synth.Answer = []dns.RR{hinfo}
-	qName := question.Header().Name
-	i := strings.Index(qName, ".")
-	parentZone := "."
-	if !(i < 0 || i+1 >= len(qName)) {
-		parentZone = qName[i+1:]
-	}
 	soa := new(dns.SOA)
-	soa.Mbox = "h.invalid."
-	soa.Ns = "a.root-servers.net."
+	soa.Mbox = DefaultNegativeSOARName
+	soa.Ns = DefaultNegativeSOAMName
 	soa.Serial = 1
 	soa.Refresh = 10000
 	soa.Minttl = 2400
 	soa.Expire = 604800
 	soa.Retry = 300
 	soa.Hdr = dns.Header{
-		Name: parentZone, Class: dns.ClassINET, TTL: 60,
+		Name: parentZone(question.Header().Name), Class: dns.ClassINET, TTL: 60,
 	}
 	synth.Ns = []dns.RR{soa}
 	pluginsState.synthResponse = synth
@@ -201,7 +201,8 @@ func (plugin *PluginBlockName) SetConfigWatcher(watcher *ConfigWatcher) {
 }
 
 func (plugin *PluginBlockName) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
-	if pluginsState.sessionData["whitelisted"] != nil {
+	// Clients of a client blocklist group are only checked against the rules of their group
+	if pluginsState.sessionData["whitelisted"] != nil || pluginsState.clientBlocklist != nil {
 		return nil
 	}
 
@@ -251,10 +252,7 @@ func (plugin *PluginBlockNameResponse) Eval(pluginsState *PluginsState, msg *dns
 		return nil
 	}
 
-	blockedNamesLock.RLock()
-	localBlockedNames := blockedNames
-	blockedNamesLock.RUnlock()
-
+	localBlockedNames := pluginsState.blockedNamesFor()
 	if localBlockedNames == nil {
 		return nil
 	}
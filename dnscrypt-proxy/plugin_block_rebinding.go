@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"codeberg.org/miekg/dns"
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	RebindingActionNXDomain = "nxdomain"
+	RebindingActionStrip    = "strip"
+	RebindingActionLog      = "log"
+)
+
+// Names under these suffixes are expected to resolve to private addresses
+var rebindingDefaultAllowedNames = []string{
+	"localhost",
+	"local",
+	"lan",
+	"home",
+	"home.arpa",
+	"internal",
+	"intranet",
+	"corp",
+	"private",
+	"in-addr.arpa",
+	"ip6.arpa",
+}
+
+type PluginBlockRebinding struct {
+	action       string
+	allowedNames []string
+	ranges       []netip.Prefix
+}
+
+func (plugin *PluginBlockRebinding) Name() string {
+	return "block_rebinding"
+}
+
+func (plugin *PluginBlockRebinding) Description() string {
+	return "Block responses mapping public names to private, loopback or link-local addresses."
+}
+
+func (plugin *PluginBlockRebinding) Init(proxy *Proxy) error {
+	plugin.action = proxy.rebindingAction
+	plugin.allowedNames = make([]string, 0, len(rebindingDefaultAllowedNames)+len(proxy.rebindingAllowedNames))
+	plugin.allowedNames = append(plugin.allowedNames, rebindingDefaultAllowedNames...)
+	for _, name := range proxy.rebindingAllowedNames {
+		name = strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")
+		if len(name) > 0 {
+			plugin.allowedNames = append(plugin.allowedNames, name)
+		}
+	}
+	plugin.ranges = nil
+	for _, rangeStr := range proxy.rebindingRanges {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(rangeStr))
+		if err != nil {
+			return fmt.Errorf("Invalid range in rebinding_ranges: [%s]", rangeStr)
+		}
+		plugin.ranges = append(plugin.ranges, prefix.Masked())
+	}
+	return nil
+}
+
+func (plugin *PluginBlockRebinding) Drop() error {
+	return nil
+}
+
+func (plugin *PluginBlockRebinding) Reload() error {
+	return nil
+}
+
+// isRebindingAddress returns true for addresses that a public name is not expected to resolve to
+func isRebindingAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified()
+}
+
+// isBlockedAddress returns true for rebinding addresses, and for addresses in the additional configured ranges
+func (plugin *PluginBlockRebinding) isBlockedAddress(addr netip.Addr) bool {
+	if isRebindingAddress(addr) {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range plugin.ranges {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedName returns true if a normalized name may legitimately resolve to private addresses
+func (plugin *PluginBlockRebinding) isAllowedName(qName string) bool {
+	if !strings.Contains(qName, ".") {
+		return true
+	}
+	for _, suffix := range plugin.allowedNames {
+		if qName == suffix || strings.HasSuffix(qName, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (plugin *PluginBlockRebinding) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.sessionData["whitelisted"] != nil || len(msg.Answer) == 0 {
+		return nil
+	}
+	if plugin.isAllowedName(pluginsState.qName) {
+		return nil
+	}
+
+	kept := make([]dns.RR, 0, len(msg.Answer))
+	var rebindingAddr netip.Addr
+	for _, answer := range msg.Answer {
+		var addr netip.Addr
+		switch rr := answer.(type) {
+		case *dns.A:
+			addr = rr.A.Addr
+		case *dns.AAAA:
+			addr = rr.AAAA.Addr
+		}
+		if answer.Header().Class == dns.ClassINET && addr.IsValid() && plugin.isBlockedAddress(addr) {
+			rebindingAddr = addr
+			continue
+		}
+		kept = append(kept, answer)
+	}
+	if !rebindingAddr.IsValid() {
+		return nil
+	}
+
+	switch plugin.action {
+	case RebindingActionLog:
+		dlog.Noticef("Possible DNS rebinding: [%s] resolves to [%s]", pluginsState.qName, rebindingAddr)
+	case RebindingActionStrip:
+		dlog.Infof("Removed private addresses from the response for [%s] (DNS rebinding protection)", pluginsState.qName)
+		msg.Answer = kept
+	default:
+		dlog.Infof("Blocked [%s] resolving to [%s] (DNS rebinding protection)", pluginsState.qName, rebindingAddr)
+		synth := EmptyResponseFromMessage(msg)
+		synth.Rcode = dns.RcodeNameError
+		pluginsState.synthResponse = synth
+		pluginsState.action = PluginsActionSynth
+		pluginsState.returnCode = PluginsReturnCodeReject
+	}
+	return nil
+}
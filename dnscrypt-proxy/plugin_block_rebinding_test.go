@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+func TestIsRebindingAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"127.0.0.1", true},
+		{"169.254.1.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:192.168.1.1", true},
+		{"::ffff:8.8.8.8", false},
+		{"8.8.8.8", false},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		if got := isRebindingAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isRebindingAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestBlockRebindingAllowedNames(t *testing.T) {
+	plugin := &PluginBlockRebinding{}
+	proxy := &Proxy{rebindingAllowedNames: []string{" Corp.Example.COM. ", ""}}
+	if err := plugin.Init(proxy); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"router", true},
+		{"localhost", true},
+		{"nas.lan", true},
+		{"printer.home.arpa", true},
+		{"1.1.168.192.in-addr.arpa", true},
+		{"corp.example.com", true},
+		{"intranet.corp.example.com", true},
+		{"example.com", false},
+		{"evilcorp.example.com", false},
+		{"notlan", true},
+		{"www.notlan.com", false},
+	}
+	for _, tt := range tests {
+		if got := plugin.isAllowedName(tt.name); got != tt.want {
+			t.Errorf("isAllowedName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBlockRebindingRanges(t *testing.T) {
+	plugin := &PluginBlockRebinding{}
+	if err := plugin.Init(&Proxy{rebindingRanges: []string{"100.64.0.0/10", " 2001:db8:1::/48 "}}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"100.64.1.1", true},
+		{"100.128.0.1", false},
+		{"::ffff:100.100.100.100", true},
+		{"2001:db8:1::53", true},
+		{"2001:db8:2::53", false},
+		{"10.0.0.1", true},
+		{"8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		if got := plugin.isBlockedAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isBlockedAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if err := new(PluginBlockRebinding).Init(&Proxy{rebindingRanges: []string{"100.64.0.0"}}); err == nil {
+		t.Error("invalid ranges should be rejected")
+	}
+}
+
+func newRebindingTestResponse(t *testing.T, qName string, addrs ...string) *dns.Msg {
+	t.Helper()
+	query := dns.NewMsg(qName, dns.TypeA)
+	msg := EmptyResponseFromMessage(query)
+	for _, addr := range addrs {
+		ip := netip.MustParseAddr(addr)
+		if ip.Is4() {
+			rr := new(dns.A)
+			rr.Hdr = dns.Header{Name: qName, Class: dns.ClassINET, TTL: 60}
+			rr.A = rdata.A{Addr: ip}
+			msg.Answer = append(msg.Answer, rr)
+		} else {
+			rr := new(dns.AAAA)
+			rr.Hdr = dns.Header{Name: qName, Class: dns.ClassINET, TTL: 60}
+			rr.AAAA = rdata.AAAA{Addr: ip}
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	return msg
+}
+
+func TestBlockRebindingEval(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      string
+		qName       string
+		addrs       []string
+		wantSynth   bool
+		wantAnswers int
+	}{
+		{name: "public addresses", action: RebindingActionNXDomain, qName: "example.com.", addrs: []string{"192.0.2.1"}, wantAnswers: 1},
+		{name: "nxdomain", action: RebindingActionNXDomain, qName: "example.com.", addrs: []string{"192.0.2.1", "10.0.0.1"}, wantSynth: true},
+		{name: "strip", action: RebindingActionStrip, qName: "example.com.", addrs: []string{"192.0.2.1", "10.0.0.1", "fe80::1"}, wantAnswers: 1},
+		{name: "log", action: RebindingActionLog, qName: "example.com.", addrs: []string{"127.0.0.1"}, wantAnswers: 1},
+		{name: "allowed name", action: RebindingActionNXDomain, qName: "nas.lan.", addrs: []string{"192.168.1.10"}, wantAnswers: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &PluginBlockRebinding{}
+			if err := plugin.Init(&Proxy{rebindingAction: tt.action}); err != nil {
+				t.Fatal(err)
+			}
+			msg := newRebindingTestResponse(t, tt.qName, tt.addrs...)
+			pluginsState := &PluginsState{
+				action:      PluginsActionContinue,
+				qName:       tt.qName[:len(tt.qName)-1],
+				sessionData: make(map[string]any),
+			}
+			if err := plugin.Eval(pluginsState, msg); err != nil {
+				t.Fatalf("Eval() error = %v", err)
+			}
+
+			synth := pluginsState.action == PluginsActionSynth
+			if synth != tt.wantSynth {
+				t.Fatalf("synth = %v, want %v", synth, tt.wantSynth)
+			}
+			if synth {
+				if pluginsState.synthResponse == nil || pluginsState.synthResponse.Rcode != dns.RcodeNameError {
+					t.Errorf("expected an NXDOMAIN response, got %v", pluginsState.synthResponse)
+				}
+				if pluginsState.returnCode != PluginsReturnCodeReject {
+					t.Errorf("returnCode = %v, want PluginsReturnCodeReject", pluginsState.returnCode)
+				}
+				return
+			}
+			if len(msg.Answer) != tt.wantAnswers {
+				t.Errorf("got %d answers, want %d", len(msg.Answer), tt.wantAnswers)
+			}
+		})
+	}
+}
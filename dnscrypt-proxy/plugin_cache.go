@@ -4,20 +4,33 @@
 	"crypto/sha512"
 	"encoding/binary"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"codeberg.org/miekg/dns"
+	"github.com/jedisct1/dlog"
 	"github.com/jedisct1/go-sieve-cache/pkg/sievecache"
 )
 
-const StaleResponseTTL = 30 * time.Second
+const (
+	StaleResponseTTL        = 30 * time.Second
+	MaxConcurrentPrefetches = 16
+)
 
 type CachedResponse struct {
 	expiration time.Time
+	ttl        time.Duration
 	msg        *dns.Msg
 }
 
+// CacheTTLClamp - TTL bounds applied to cached responses of a given type, instead of the global ones
+type CacheTTLClamp struct {
+	minTTL uint32
+	maxTTL uint32
+}
+
 type CachedResponses struct {
 	cache     *sievecache.ShardedSieveCache[[32]byte, CachedResponse]
 	cacheOnce sync.Once
@@ -25,6 +38,13 @@ type CachedResponses struct {
 
 var cachedResponses CachedResponses
 
+type CachePrefetches struct {
+	sync.Mutex
+	inFlight map[[32]byte]struct{}
+}
+
+var cachePrefetches = CachePrefetches{inFlight: make(map[[32]byte]struct{})}
+
 func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) [32]byte {
 	question := msg.Question[0]
 	h := sha512.New512_256()
@@ -32,21 +52,53 @@ func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) [32]byte {
 	binary.LittleEndian.PutUint16(tmp[0:2], dns.RRToType(question))
 	binary.LittleEndian.PutUint16(tmp[2:4], question.Header().Class)
 	if pluginsState.dnssec {
-		tmp[4] = 1
+		tmp[4] |= 1
+	}
+	if pluginsState.checkingDisabled {
+		tmp[4] |= 2
 	}
 	h.Write(tmp[:])
 	normalizedRawQName := []byte(question.Header().Name)
 	NormalizeRawQName(&normalizedRawQName)
 	h.Write(normalizedRawQName)
+	// Listener profiles restricted to some servers don't share their responses with other listeners
+	if profile := pluginsState.listenerProfile; profile != nil && len(profile.serverNames) > 0 {
+		h.Write([]byte{0})
+		h.Write([]byte(profile.name))
+	}
 	var sum [32]byte
 	h.Sum(sum[:0])
 
 	return sum
 }
 
+// restoreQNameCase rewrites the owner names matching the query name using the case of the client's query,
+// rather than the case of the query the response was cached for. Records are copied first, as they
+// can be shared with a cached response.
+func restoreQNameCase(msg *dns.Msg, qName string) {
+	for _, section := range []*[]dns.RR{&msg.Answer, &msg.Ns} {
+		copied := false
+		for i, rr := range *section {
+			name := rr.Header().Name
+			if name == qName || !strings.EqualFold(name, qName) {
+				continue
+			}
+			if !copied {
+				*section = slices.Clone(*section)
+				copied = true
+			}
+			rr = rr.Clone()
+			rr.Header().Name = qName
+			(*section)[i] = rr
+		}
+	}
+}
+
 // ---
 
-type PluginCache struct{}
+type PluginCache struct {
+	proxy *Proxy
+}
 
 func (plugin *PluginCache) Name() string {
 	return "cache"
@@ -57,6 +109,7 @@ func (plugin *PluginCache) Description() string {
 }
 
 func (plugin *PluginCache) Init(proxy *Proxy) error {
+	plugin.proxy = proxy
 	return nil
 }
 
@@ -84,22 +137,123 @@ func (plugin *PluginCache) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 	synth.ID = msg.ID
 	synth.Response = true
 	synth.Question = msg.Question
+	restoreQNameCase(synth, msg.Question[0].Header().Name)
 
-	if time.Now().After(expiration) {
-		expiration2 := time.Now().Add(StaleResponseTTL)
+	now := time.Now()
+	if now.After(expiration) {
+		expiration2 := now.Add(StaleResponseTTL)
 		updateTTL(synth, expiration2)
+		if plugin.shouldServeStale(expiration, now) {
+			dlog.Debugf("Upstream servers are slow, serving stale [%v] while refreshing it", msg.Question[0].Header().Name)
+			plugin.prefetch(pluginsState, cacheKey, msg)
+			plugin.proxy.pluginsGlobals.addNegativeSOA(synth, uint32(StaleResponseTTL/time.Second))
+			pluginsState.synthResponse = synth
+			pluginsState.action = PluginsActionSynth
+			pluginsState.cacheHit = true
+			return nil
+		}
 		pluginsState.sessionData["stale"] = synth
 		return nil
 	}
 
 	updateTTL(synth, expiration)
+	if plugin.shouldPrefetch(&cached, now) {
+		plugin.prefetch(pluginsState, cacheKey, msg)
+	}
 
+	plugin.proxy.pluginsGlobals.addNegativeSOA(synth, uint32(expiration.Sub(now)/time.Second))
 	pluginsState.synthResponse = synth
 	pluginsState.action = PluginsActionSynth
 	pluginsState.cacheHit = true
 	return nil
 }
 
+// shouldPrefetch checks if the remaining TTL of a cached response is below the prefetch threshold
+func (plugin *PluginCache) shouldPrefetch(cached *CachedResponse, now time.Time) bool {
+	remaining := cached.expiration.Sub(now)
+	if plugin.proxy.cachePrefetchRatio > 0 {
+		return remaining <= time.Duration(float64(cached.ttl)*plugin.proxy.cachePrefetchRatio)
+	}
+	if plugin.proxy.cachePrefetchThreshold > 0 {
+		return remaining <= plugin.proxy.cachePrefetchThreshold
+	}
+	return false
+}
+
+// shouldServeStale checks if a recently expired response should be served right away,
+// because even the fastest upstream server has been slow lately
+func (plugin *PluginCache) shouldServeStale(expiration time.Time, now time.Time) bool {
+	proxy := plugin.proxy
+	if proxy.cacheSlowUpstreamRTT <= 0 || now.Sub(expiration) > proxy.cacheSlowUpstreamMaxStale {
+		return false
+	}
+	rtt := proxy.serversInfo.lowestRTT()
+	return rtt >= 0 && time.Duration(rtt*float64(time.Millisecond)) >= proxy.cacheSlowUpstreamRTT
+}
+
+// prefetch refreshes a cached response in the background, at most once at a time for a given key.
+// The query is sent straight to an upstream server: it is not logged nor counted as a client query,
+// but the response plugins still apply, so that the cache only gets responses that clients could get.
+func (plugin *PluginCache) prefetch(pluginsState *PluginsState, cacheKey [32]byte, msg *dns.Msg) {
+	cachePrefetches.Lock()
+	if _, found := cachePrefetches.inFlight[cacheKey]; found || len(cachePrefetches.inFlight) >= MaxConcurrentPrefetches {
+		cachePrefetches.Unlock()
+		return
+	}
+	cachePrefetches.inFlight[cacheKey] = struct{}{}
+	cachePrefetches.Unlock()
+
+	prefetchMsg := &dns.Msg{}
+	prefetchMsg.ID = dns.ID()
+	prefetchMsg.RecursionDesired = true
+	prefetchMsg.CheckingDisabled = msg.CheckingDisabled
+	prefetchMsg.Question = []dns.RR{msg.Question[0].Clone()}
+	if msg.UDPSize > 0 {
+		prefetchMsg.UDPSize = msg.UDPSize
+		prefetchMsg.Security = msg.Security
+	}
+	// Keep the EDNS options set by the previous plugins, such as ECS, NSID and the stripped client options
+	for _, rr := range msg.Pseudo {
+		prefetchMsg.Pseudo = append(prefetchMsg.Pseudo, rr.Clone())
+	}
+	proxy := plugin.proxy
+	qName, dnssec, checkingDisabled := pluginsState.qName, pluginsState.dnssec, pluginsState.checkingDisabled
+	nsidRequested := pluginsState.nsidRequested
+	listenerProfile := pluginsState.listenerProfile
+
+	go func() {
+		defer func() {
+			cachePrefetches.Lock()
+			delete(cachePrefetches.inFlight, cacheKey)
+			cachePrefetches.Unlock()
+		}()
+		if err := prefetchMsg.Pack(); err != nil {
+			return
+		}
+		serverProto := proxy.xTransport.mainProto
+		prefetchState := NewPluginsState(proxy, "prefetch", nil, serverProto, time.Now())
+		prefetchState.qName = qName
+		prefetchState.dnssec = dnssec
+		prefetchState.checkingDisabled = checkingDisabled
+		prefetchState.listenerProfile = listenerProfile
+		prefetchState.nsidRequested = nsidRequested
+		serverInfo := proxy.serverFor(&prefetchState)
+		if serverInfo == nil {
+			return
+		}
+		prefetchState.setServer(serverInfo)
+		dlog.Debugf("Prefetching [%v] from [%v]", qName, serverInfo.Name)
+		response, err := handleDNSExchange(proxy, serverInfo, &prefetchState, prefetchMsg.Data, serverProto)
+		if err != nil {
+			dlog.Debugf("Prefetching [%v] failed: %v", qName, err)
+			return
+		}
+		if _, err := prefetchState.ApplyResponsePlugins(&proxy.pluginsGlobals, response); err != nil {
+			dlog.Debugf("Prefetched response for [%v] dropped: %v", qName, err)
+		}
+	}()
+}
+
 // ---
 
 type PluginCacheResponse struct{}
@@ -132,15 +286,24 @@ func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg
 		return nil
 	}
 	cacheKey := computeCacheKey(pluginsState, msg)
+	minTTL, maxTTL := pluginsState.cacheMinTTL, pluginsState.cacheMaxTTL
+	if clamp, ok := pluginsState.cacheTTLOverrides[dns.RRToType(msg.Question[0])]; ok {
+		minTTL, maxTTL = clamp.minTTL, clamp.maxTTL
+	}
 	ttl := getMinTTL(
 		msg,
-		pluginsState.cacheMinTTL,
-		pluginsState.cacheMaxTTL,
+		minTTL,
+		maxTTL,
 		pluginsState.cacheNegMinTTL,
 		pluginsState.cacheNegMaxTTL,
 	)
+	// Responses from less trusted servers can be kept for a shorter time
+	if serverMaxTTL, ok := pluginsState.serverCacheMaxTTLs[pluginsState.serverName]; ok {
+		ttl = min(ttl, time.Duration(serverMaxTTL)*time.Second)
+	}
 	cachedResponse := CachedResponse{
 		expiration: time.Now().Add(ttl),
+		ttl:        ttl,
 		msg:        msg.Copy(),
 	}
 	var cacheInitError error
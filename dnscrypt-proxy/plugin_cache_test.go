@@ -0,0 +1,433 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+	"github.com/BurntSushi/toml"
+	"github.com/VividCortex/ewma"
+)
+
+func TestComputeCacheKeyCheckingDisabled(t *testing.T) {
+	msg := dns.NewMsg("example.com.", dns.TypeA)
+
+	keyCDClear := computeCacheKey(&PluginsState{}, msg)
+	keyCDSet := computeCacheKey(&PluginsState{checkingDisabled: true}, msg)
+	keyDNSSEC := computeCacheKey(&PluginsState{dnssec: true}, msg)
+	keyDNSSECCDSet := computeCacheKey(&PluginsState{dnssec: true, checkingDisabled: true}, msg)
+
+	keys := map[[32]byte]string{}
+	for name, key := range map[string][32]byte{
+		"cd clear":        keyCDClear,
+		"cd set":          keyCDSet,
+		"dnssec":          keyDNSSEC,
+		"dnssec + cd set": keyDNSSECCDSet,
+	} {
+		if other, ok := keys[key]; ok {
+			t.Errorf("cache keys for %q and %q should differ", name, other)
+		}
+		keys[key] = name
+	}
+
+	if keyCDSet != computeCacheKey(&PluginsState{checkingDisabled: true}, msg) {
+		t.Error("cache key for the same query should be stable")
+	}
+}
+
+func TestApplyQueryPluginsCheckingDisabled(t *testing.T) {
+	tests := []struct {
+		name                 string
+		honorCDBit           bool
+		queryCD              bool
+		wantForwardedCD      bool
+		wantCheckingDisabled bool
+	}{
+		{
+			name:                 "honored, cd set",
+			honorCDBit:           true,
+			queryCD:              true,
+			wantForwardedCD:      true,
+			wantCheckingDisabled: true,
+		},
+		{
+			name:                 "honored, cd clear",
+			honorCDBit:           true,
+			queryCD:              false,
+			wantForwardedCD:      false,
+			wantCheckingDisabled: false,
+		},
+		{
+			name:                 "not honored, cd set",
+			honorCDBit:           false,
+			queryCD:              true,
+			wantForwardedCD:      false,
+			wantCheckingDisabled: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := dns.NewMsg("example.com.", dns.TypeA)
+			query.CheckingDisabled = tt.queryCD
+			if err := query.Pack(); err != nil {
+				t.Fatalf("Pack() error = %v", err)
+			}
+
+			pluginsGlobals := &PluginsGlobals{
+				queryPlugins:    &[]Plugin{},
+				responsePlugins: &[]Plugin{},
+				loggingPlugins:  &[]Plugin{},
+			}
+			pluginsState := &PluginsState{
+				action:      PluginsActionContinue,
+				honorCDBit:  tt.honorCDBit,
+				sessionData: make(map[string]any),
+			}
+
+			packet, err := pluginsState.ApplyQueryPlugins(pluginsGlobals, query.Data, nil)
+			if err != nil {
+				t.Fatalf("ApplyQueryPlugins() error = %v", err)
+			}
+			forwarded := dns.Msg{Data: packet}
+			if err := forwarded.Unpack(); err != nil {
+				t.Fatalf("Unpack() error = %v", err)
+			}
+			if forwarded.CheckingDisabled != tt.wantForwardedCD {
+				t.Errorf("forwarded CD = %v, want %v", forwarded.CheckingDisabled, tt.wantForwardedCD)
+			}
+			if pluginsState.checkingDisabled != tt.wantCheckingDisabled {
+				t.Errorf("pluginsState.checkingDisabled = %v, want %v", pluginsState.checkingDisabled, tt.wantCheckingDisabled)
+			}
+		})
+	}
+}
+
+func TestCacheMixedCaseQueries(t *testing.T) {
+	query := dns.NewMsg("Case.Example.COM.", dns.TypeA)
+	response := EmptyResponseFromMessage(query)
+	rr := new(dns.A)
+	rr.Hdr = dns.Header{Name: "Case.Example.COM.", Class: dns.ClassINET, TTL: 600}
+	rr.A = rdata.A{Addr: netip.MustParseAddr("192.0.2.1")}
+	response.Answer = []dns.RR{rr}
+	pluginsState := &PluginsState{cacheSize: 16, cacheMaxTTL: 3600, sessionData: make(map[string]any)}
+	if err := (&PluginCacheResponse{}).Eval(pluginsState, response); err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := &PluginCache{proxy: &Proxy{}}
+	for _, qName := range []string{"case.example.com.", "CASE.EXAMPLE.COM.", "Case.Example.COM."} {
+		query := dns.NewMsg(qName, dns.TypeA)
+		pluginsState := &PluginsState{sessionData: make(map[string]any)}
+		if err := plugin.Eval(pluginsState, query); err != nil {
+			t.Fatal(err)
+		}
+		synth := pluginsState.synthResponse
+		if synth == nil || len(synth.Answer) != 1 {
+			t.Fatalf("[%s] should be answered from the cache", qName)
+		}
+		if name := synth.Question[0].Header().Name; name != qName {
+			t.Errorf("question = [%s], want [%s]", name, qName)
+		}
+		if name := synth.Answer[0].Header().Name; name != qName {
+			t.Errorf("answer owner name = [%s], want [%s]", name, qName)
+		}
+	}
+
+	cached, _ := cachedResponses.cache.Get(computeCacheKey(pluginsState, query))
+	if name := cached.msg.Answer[0].Header().Name; name != "Case.Example.COM." {
+		t.Errorf("cached record was modified: [%s]", name)
+	}
+}
+
+func TestCacheTTLOverrides(t *testing.T) {
+	var config Config
+	if _, err := toml.Decode(
+		`cache_ttl_overrides = { A = { max_ttl = 60 }, MX = { min_ttl = 86400, max_ttl = 604800 } }`,
+		&config,
+	); err != nil {
+		t.Fatal(err)
+	}
+	clamps, err := parseCacheTTLOverrides(config.CacheTTLOverrides, 2400, 86400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minTTL, maxTTL := uint32(600), uint32(60)
+	if _, err := parseCacheTTLOverrides(map[string]TTLOverrideConfig{"A": {MinTTL: &minTTL, MaxTTL: &maxTTL}}, 0, 3600); err == nil {
+		t.Error("a minimum TTL above the maximum TTL should be rejected")
+	}
+	if _, err := parseCacheTTLOverrides(map[string]TTLOverrideConfig{"NOPE": {}}, 0, 60); err == nil {
+		t.Error("unknown record types should be rejected")
+	}
+
+	tests := []struct {
+		name    string
+		qType   uint16
+		ttl     uint32
+		wantTTL time.Duration
+	}{
+		{name: "A, max_ttl below the global min_ttl", qType: dns.TypeA, ttl: 3600, wantTTL: 60 * time.Second},
+		{name: "MX, min_ttl set", qType: dns.TypeMX, ttl: 300, wantTTL: 86400 * time.Second},
+		{name: "TXT, global bounds", qType: dns.TypeTXT, ttl: 300, wantTTL: 2400 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := dns.NewMsg("ttl-overrides.example.com.", tt.qType)
+			response := EmptyResponseFromMessage(query)
+			rr := dns.TypeToRR[tt.qType]()
+			*rr.Header() = dns.Header{Name: "ttl-overrides.example.com.", Class: dns.ClassINET, TTL: tt.ttl}
+			response.Answer = []dns.RR{rr}
+			pluginsState := &PluginsState{
+				cacheSize:         16,
+				cacheMinTTL:       2400,
+				cacheMaxTTL:       86400,
+				cacheTTLOverrides: clamps,
+			}
+			if err := (&PluginCacheResponse{}).Eval(pluginsState, response); err != nil {
+				t.Fatal(err)
+			}
+			cached, ok := cachedResponses.cache.Get(computeCacheKey(pluginsState, query))
+			if !ok {
+				t.Fatal("the response should have been cached")
+			}
+			if cached.ttl != tt.wantTTL {
+				t.Errorf("cached TTL = %v, want %v", cached.ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestCacheServerMaxTTL(t *testing.T) {
+	serverCacheMaxTTLs := map[string]uint32{"untrusted": 300}
+	tests := []struct {
+		serverName string
+		wantTTL    time.Duration
+	}{
+		{serverName: "untrusted", wantTTL: 300 * time.Second},
+		{serverName: "trusted", wantTTL: 3600 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			qName := tt.serverName + ".server-max-ttl.example.com."
+			query := dns.NewMsg(qName, dns.TypeA)
+			response := EmptyResponseFromMessage(query)
+			rr := new(dns.A)
+			rr.Hdr = dns.Header{Name: qName, Class: dns.ClassINET, TTL: 3600}
+			rr.A = rdata.A{Addr: netip.MustParseAddr("192.0.2.1")}
+			response.Answer = []dns.RR{rr}
+			pluginsState := &PluginsState{
+				cacheSize:          16,
+				cacheMaxTTL:        86400,
+				serverName:         tt.serverName,
+				serverCacheMaxTTLs: serverCacheMaxTTLs,
+			}
+			if err := (&PluginCacheResponse{}).Eval(pluginsState, response); err != nil {
+				t.Fatal(err)
+			}
+			cached, ok := cachedResponses.cache.Get(computeCacheKey(pluginsState, query))
+			if !ok {
+				t.Fatal("the response should have been cached")
+			}
+			if cached.ttl != tt.wantTTL {
+				t.Errorf("cached TTL = %v, want %v", cached.ttl, tt.wantTTL)
+			}
+			if ttl := response.Answer[0].Header().TTL; time.Duration(ttl)*time.Second > tt.wantTTL {
+				t.Errorf("response TTL = %d, want at most %v", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestCacheServeStaleOnSlowUpstream(t *testing.T) {
+	proxy := &Proxy{
+		serversInfo:               NewServersInfo(),
+		cacheSlowUpstreamRTT:      500 * time.Millisecond,
+		cacheSlowUpstreamMaxStale: time.Minute,
+	}
+	server := &ServerInfo{Name: "server"}
+	server.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+	server.rtt.Set(100)
+	proxy.serversInfo.inner = []*ServerInfo{server}
+	plugin := &PluginCache{proxy: proxy}
+
+	now := time.Now()
+	expired := now.Add(-10 * time.Second)
+	if plugin.shouldServeStale(expired, now) {
+		t.Error("stale responses should not be served while upstream servers are fast")
+	}
+
+	server.rtt.Set(800)
+	if !plugin.shouldServeStale(expired, now) {
+		t.Error("a recently expired response should be served while upstream servers are slow")
+	}
+	if plugin.shouldServeStale(now.Add(-2*time.Minute), now) {
+		t.Error("responses expired for longer than the max staleness should not be served")
+	}
+
+	proxy.cacheSlowUpstreamRTT = 0
+	if plugin.shouldServeStale(expired, now) {
+		t.Error("stale responses should not be served when the option is disabled")
+	}
+}
+
+func TestCacheShouldPrefetch(t *testing.T) {
+	proxy := &Proxy{}
+	plugin := &PluginCache{proxy: proxy}
+	now := time.Now()
+	cached := func(ttl, remaining time.Duration) *CachedResponse {
+		return &CachedResponse{expiration: now.Add(remaining), ttl: ttl}
+	}
+
+	if plugin.shouldPrefetch(cached(100*time.Second, time.Second), now) {
+		t.Error("responses should not be prefetched when the option is disabled")
+	}
+
+	proxy.cachePrefetchThreshold = 10 * time.Second
+	if plugin.shouldPrefetch(cached(100*time.Second, 20*time.Second), now) {
+		t.Error("a response above the threshold should not be prefetched")
+	}
+	if !plugin.shouldPrefetch(cached(100*time.Second, 10*time.Second), now) {
+		t.Error("a response at the threshold should be prefetched")
+	}
+
+	proxy.cachePrefetchRatio = 0.5
+	if plugin.shouldPrefetch(cached(100*time.Second, 60*time.Second), now) {
+		t.Error("a response above the ratio should not be prefetched")
+	}
+	if !plugin.shouldPrefetch(cached(100*time.Second, 20*time.Second), now) {
+		t.Error("the ratio should be used instead of the threshold")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	var requests atomic.Int32
+	qNames := make(chan string, 2)
+	release := make(chan struct{})
+	server := newTestDoHServer(t, func(query []byte) []byte {
+		requests.Add(1)
+		msg := dns.Msg{Data: query}
+		if err := msg.Unpack(); err == nil {
+			qNames <- msg.Question[0].Header().Name
+		}
+		<-release
+		return validDoHResponse(query)
+	})
+	proxy := newTestProxyWithDoHServers(t, server)
+	proxy.cacheSize = 16
+	proxy.cacheMaxTTL = 3600
+	proxy.pluginsGlobals.responsePlugins = &[]Plugin{&PluginCacheResponse{}}
+
+	qName := "prefetch.example.com."
+	query := dns.NewMsg(qName, dns.TypeA)
+	response := EmptyResponseFromMessage(query)
+	rr := new(dns.A)
+	rr.Hdr = dns.Header{Name: qName, Class: dns.ClassINET, TTL: 600}
+	rr.A = rdata.A{Addr: netip.MustParseAddr("198.51.100.1")}
+	response.Answer = []dns.RR{rr}
+	pluginsState := &PluginsState{qName: qName, cacheSize: 16, cacheMaxTTL: 3600, sessionData: make(map[string]any)}
+	if err := (&PluginCacheResponse{}).Eval(pluginsState, response); err != nil {
+		t.Fatal(err)
+	}
+	cacheKey := computeCacheKey(pluginsState, query)
+
+	plugin := &PluginCache{proxy: proxy}
+	plugin.prefetch(pluginsState, cacheKey, query)
+	plugin.prefetch(pluginsState, cacheKey, query)
+	query.Question[0].Header().Name = "other.example.com."
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cachePrefetches.Lock()
+		_, inFlight := cachePrefetches.inFlight[cacheKey]
+		cachePrefetches.Unlock()
+		if !inFlight {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the prefetch didn't complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+	if name := <-qNames; name != qName {
+		t.Errorf("prefetched [%s], want [%s]", name, qName)
+	}
+	cached, ok := cachedResponses.cache.Get(cacheKey)
+	if !ok {
+		t.Fatal("the response should still be cached")
+	}
+	if addr := cached.msg.Answer[0].(*dns.A).A.Addr.String(); addr != "192.0.2.1" {
+		t.Errorf("cached answer = %s, want the prefetched one", addr)
+	}
+	if cached.ttl != 60*time.Second {
+		t.Errorf("cached TTL = %v, want %v", cached.ttl, 60*time.Second)
+	}
+}
+
+func TestCachePrefetchEDNSOptions(t *testing.T) {
+	options := make(chan []uint16, 2)
+	server := newTestDoHServer(t, func(query []byte) []byte {
+		msg := dns.Msg{Data: query}
+		if err := msg.Unpack(); err == nil {
+			var codes []uint16
+			for _, rr := range msg.Pseudo {
+				if code, ok := ednsOptionCode(rr); ok && code != dns.CodePADDING {
+					codes = append(codes, code)
+				}
+			}
+			options <- codes
+		}
+		return validDoHResponse(query)
+	})
+	proxy := newTestProxyWithDoHServers(t, server)
+	proxy.cacheSize = 16
+	proxy.cacheMaxTTL = 3600
+	proxy.cachePrefetchThreshold = time.Hour
+	stripPlugin := &PluginStripEDNSOptions{}
+	if err := stripPlugin.Init(&Proxy{stripClientEDNSOptions: []uint16{dns.CodeCOOKIE}}); err != nil {
+		t.Fatal(err)
+	}
+	proxy.pluginsGlobals.queryPlugins = &[]Plugin{
+		stripPlugin,
+		newECSTestPlugin(t, ECSModeFirst, "192.0.2.0/24"),
+		&PluginNSID{},
+		&PluginCache{proxy: proxy},
+	}
+	proxy.pluginsGlobals.responsePlugins = &[]Plugin{&PluginCacheResponse{}}
+
+	// The cache is shared with previous runs of the test
+	qName := fmt.Sprintf("prefetch-options-%d.example.com.", time.Now().UnixNano())
+	resolve := func() {
+		query := dns.NewMsg(qName, dns.TypeA)
+		query.UDPSize = 1232
+		query.Pseudo = []dns.RR{&dns.COOKIE{Cookie: "0123456789abcdef"}}
+		if err := query.Pack(); err != nil {
+			t.Fatal(err)
+		}
+		if response := proxy.processIncomingQuery("test", "udp", query.Data, nil, nil, time.Now(), false); len(response) == 0 {
+			t.Fatal("no response")
+		}
+	}
+	// The second query is answered from the cache, and refreshes the response in the background
+	resolve()
+	resolve()
+	for i, name := range []string{"query", "prefetch"} {
+		select {
+		case codes := <-options:
+			if !slices.Equal(codes, []uint16{dns.CodeSUBNET, dns.CodeNSID}) {
+				t.Errorf("%s %d: EDNS options = %v, want the ECS and NSID ones only", name, i, codes)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s was sent", name)
+		}
+	}
+}
@@ -32,6 +32,9 @@ type PluginCloak struct {
 	patternMatcher *PatternMatcher
 	ttl            uint32
 	createPTR      bool
+	cnameMode      bool
+	resolveTarget  func(target string, qtype uint16) (*dns.Msg, error)
+	proxy          *Proxy
 
 	// Hot-reloading support
 	configFile     string
@@ -58,6 +61,9 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 
 	plugin.ttl = proxy.cloakTTL
 	plugin.createPTR = proxy.cloakedPTR
+	plugin.cnameMode = proxy.cloakCNAME
+	plugin.proxy = proxy
+	plugin.resolveTarget = plugin.resolveThroughProxy
 	plugin.patternMatcher = NewPatternMatcher()
 
 	if err := plugin.loadRules(lines, plugin.patternMatcher); err != nil {
@@ -246,6 +252,14 @@ func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 		return nil
 	}
 	cloakedName := xcloakedName.(*CloakedName)
+	if plugin.cnameMode && !cloakedName.isIP && qtype != dns.TypePTR {
+		target := cloakedName.target
+		plugin.RUnlock()
+		pluginsState.synthResponse = plugin.synthCNAME(pluginsState, msg, qname, target, qtype)
+		pluginsState.action = PluginsActionSynth
+		pluginsState.returnCode = PluginsReturnCodeCloak
+		return nil
+	}
 	ttl, expired := plugin.ttl, false
 	var lastUpdate *time.Time
 	switch qtype {
@@ -335,3 +349,74 @@ func(i, j int) { synth.Answer[i], synth.Answer[j] = synth.Answer[j], synth.Answe
 	pluginsState.returnCode = PluginsReturnCodeCloak
 	return nil
 }
+
+// synthCNAME builds a response with a CNAME to the target, followed by the
+// records of the target resolved through the encrypted servers
+func (plugin *PluginCloak) synthCNAME(
+	pluginsState *PluginsState,
+	msg *dns.Msg,
+	qname string,
+	target string,
+	qtype uint16,
+) *dns.Msg {
+	synth := EmptyResponseFromMessage(msg)
+	rr := new(dns.CNAME)
+	rr.Hdr = dns.Header{Name: qname, Class: dns.ClassINET, TTL: plugin.ttl}
+	rr.CNAME = rdata.CNAME{Target: strings.TrimSuffix(target, ".") + "."}
+	synth.Answer = []dns.RR{rr}
+
+	if pluginsState.clientProto == "cloak" {
+		// The target is itself a cloaked name - don't follow chains to avoid loops
+		return synth
+	}
+	resp, err := plugin.resolveTarget(target, qtype)
+	if err != nil {
+		dlog.Debugf("Unable to resolve cloaking target [%s]: %v", target, err)
+		synth.Rcode = dns.RcodeServerFailure
+		return synth
+	}
+	synth.Rcode = resp.Rcode
+	for _, answer := range resp.Answer {
+		if answer.Header().Class != dns.ClassINET {
+			continue
+		}
+		synth.Answer = append(synth.Answer, answer)
+	}
+	return synth
+}
+
+// resolveThroughProxy resolves a cloaking target using the regular query path
+func (plugin *PluginCloak) resolveThroughProxy(target string, qtype uint16) (*dns.Msg, error) {
+	query := dns.NewMsg(target, qtype)
+	if query == nil {
+		return nil, fmt.Errorf("Unable to build a query for [%s]", target)
+	}
+	query.ID = dns.ID()
+	query.RecursionDesired = true
+	if err := query.Pack(); err != nil {
+		return nil, err
+	}
+
+	if !plugin.proxy.clientsCountInc() {
+		return nil, errors.New("Too many concurrent connections to resolve cloaking targets")
+	}
+	respPacket := plugin.proxy.processIncomingQuery(
+		"cloak",
+		plugin.proxy.xTransport.mainProto,
+		query.Data,
+		nil,
+		nil,
+		time.Now(),
+		false,
+	)
+	plugin.proxy.clientsCountDec()
+
+	if len(respPacket) == 0 {
+		return nil, errors.New("Empty response to the cloaking target query")
+	}
+	resp := &dns.Msg{Data: respPacket}
+	if err := resp.Unpack(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
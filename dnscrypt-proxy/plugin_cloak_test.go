@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+func newCNAMECloakPlugin(t *testing.T, rules string) *PluginCloak {
+	t.Helper()
+	plugin := &PluginCloak{ttl: 600, cnameMode: true, patternMatcher: NewPatternMatcher()}
+	if err := plugin.loadRules(rules, plugin.patternMatcher); err != nil {
+		t.Fatalf("loadRules() error = %v", err)
+	}
+	return plugin
+}
+
+func evalCloak(t *testing.T, plugin *PluginCloak, clientProto string, qname string, qtype uint16) *PluginsState {
+	t.Helper()
+	msg := dns.NewMsg(qname+".", qtype)
+	pluginsState := &PluginsState{
+		action:      PluginsActionContinue,
+		clientProto: clientProto,
+		qName:       qname,
+	}
+	if err := plugin.Eval(pluginsState, msg); err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+	return pluginsState
+}
+
+func TestCloakCNAME(t *testing.T) {
+	plugin := newCNAMECloakPlugin(t, "home.lan myrouter.dyndns.net\n")
+
+	var resolved []string
+	plugin.resolveTarget = func(target string, qtype uint16) (*dns.Msg, error) {
+		resolved = append(resolved, target)
+		resp := new(dns.Msg)
+		rr := new(dns.A)
+		rr.Hdr = dns.Header{Name: "myrouter.dyndns.net.", Class: dns.ClassINET, TTL: 300}
+		rr.A = rdata.A{Addr: netip.MustParseAddr("203.0.113.7")}
+		resp.Answer = []dns.RR{rr}
+		return resp, nil
+	}
+
+	pluginsState := evalCloak(t, plugin, "udp", "home.lan", dns.TypeA)
+	if pluginsState.action != PluginsActionSynth {
+		t.Fatalf("action = %v, want PluginsActionSynth", pluginsState.action)
+	}
+	synth := pluginsState.synthResponse
+	if synth.Rcode != dns.RcodeSuccess {
+		t.Errorf("Rcode = %d, want NOERROR", synth.Rcode)
+	}
+	if len(synth.Answer) != 2 {
+		t.Fatalf("got %d answers, want 2", len(synth.Answer))
+	}
+	cname, ok := synth.Answer[0].(*dns.CNAME)
+	if !ok {
+		t.Fatalf("first answer = %v, want a CNAME", synth.Answer[0])
+	}
+	if cname.Hdr.Name != "home.lan." || cname.Target != "myrouter.dyndns.net." || cname.Hdr.TTL != 600 {
+		t.Errorf("unexpected CNAME record: %v", cname)
+	}
+	a, ok := synth.Answer[1].(*dns.A)
+	if !ok || a.Addr != netip.MustParseAddr("203.0.113.7") {
+		t.Errorf("second answer = %v, want the address of the target", synth.Answer[1])
+	}
+	if len(resolved) != 1 || resolved[0] != "myrouter.dyndns.net" {
+		t.Errorf("resolved targets = %v, want [myrouter.dyndns.net]", resolved)
+	}
+}
+
+func TestCloakCNAMEResolutionFailure(t *testing.T) {
+	plugin := newCNAMECloakPlugin(t, "home.lan myrouter.dyndns.net\n")
+
+	tests := []struct {
+		name      string
+		resolve   func(target string, qtype uint16) (*dns.Msg, error)
+		wantRcode uint16
+	}{
+		{
+			name: "resolution error",
+			resolve: func(target string, qtype uint16) (*dns.Msg, error) {
+				return nil, errors.New("no servers available")
+			},
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name: "target doesn't exist",
+			resolve: func(target string, qtype uint16) (*dns.Msg, error) {
+				resp := new(dns.Msg)
+				resp.Rcode = dns.RcodeNameError
+				return resp, nil
+			},
+			wantRcode: dns.RcodeNameError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin.resolveTarget = tt.resolve
+			pluginsState := evalCloak(t, plugin, "udp", "home.lan", dns.TypeAAAA)
+			if pluginsState.action != PluginsActionSynth {
+				t.Fatalf("action = %v, want PluginsActionSynth", pluginsState.action)
+			}
+			synth := pluginsState.synthResponse
+			if synth.Rcode != tt.wantRcode {
+				t.Errorf("Rcode = %d, want %d", synth.Rcode, tt.wantRcode)
+			}
+			if len(synth.Answer) != 1 {
+				t.Fatalf("got %d answers, want only the CNAME", len(synth.Answer))
+			}
+			if _, ok := synth.Answer[0].(*dns.CNAME); !ok {
+				t.Errorf("answer = %v, want a CNAME", synth.Answer[0])
+			}
+		})
+	}
+}
+
+func TestCloakCNAMEDoesNotFollowChains(t *testing.T) {
+	plugin := newCNAMECloakPlugin(t, "home.lan myrouter.dyndns.net\n")
+	plugin.resolveTarget = func(target string, qtype uint16) (*dns.Msg, error) {
+		t.Fatalf("target %q shouldn't be resolved for a cloaking subquery", target)
+		return nil, nil
+	}
+
+	pluginsState := evalCloak(t, plugin, "cloak", "home.lan", dns.TypeA)
+	if synth := pluginsState.synthResponse; synth == nil || len(synth.Answer) != 1 {
+		t.Fatalf("expected a response with only the CNAME, got %v", synth)
+	}
+}
+
+func TestCloakCNAMEKeepsIPRules(t *testing.T) {
+	plugin := newCNAMECloakPlugin(t, "router.lan 192.168.1.1\n")
+	plugin.resolveTarget = func(target string, qtype uint16) (*dns.Msg, error) {
+		t.Fatalf("target %q shouldn't be resolved for an IP rule", target)
+		return nil, nil
+	}
+
+	pluginsState := evalCloak(t, plugin, "udp", "router.lan", dns.TypeA)
+	synth := pluginsState.synthResponse
+	if synth == nil || len(synth.Answer) != 1 {
+		t.Fatalf("expected a single A record, got %v", synth)
+	}
+	if a, ok := synth.Answer[0].(*dns.A); !ok || a.Addr != netip.MustParseAddr("192.168.1.1") {
+		t.Errorf("answer = %v, want 192.168.1.1", synth.Answer[0])
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"hash/fnv"
 	"math/rand"
 	"net"
 	"net/netip"
@@ -9,8 +10,15 @@
 	"github.com/jedisct1/dlog"
 )
 
+const (
+	ECSModeRandom    = "random"
+	ECSModeFirst     = "first"
+	ECSModePerDomain = "per-domain"
+)
+
 type PluginECS struct {
 	nets []*net.IPNet
+	mode string
 }
 
 func (plugin *PluginECS) Name() string {
@@ -23,7 +31,8 @@ func (plugin *PluginECS) Description() string {
 
 func (plugin *PluginECS) Init(proxy *Proxy) error {
 	plugin.nets = proxy.ednsClientSubnets
-	dlog.Notice("ECS plugin enabled")
+	plugin.mode = proxy.ednsClientSubnetMode
+	dlog.Noticef("ECS plugin enabled (mode: %s)", plugin.mode)
 	return nil
 }
 
@@ -35,6 +44,21 @@ func (plugin *PluginECS) Reload() error {
 	return nil
 }
 
+// selectNet returns the network to send for a query: always the first one, a random one for every query,
+// or the same one for all the queries for a given name, so that responses for that name remain consistent
+func (plugin *PluginECS) selectNet(qName string) *net.IPNet {
+	switch plugin.mode {
+	case ECSModeFirst:
+		return plugin.nets[0]
+	case ECSModePerDomain:
+		h := fnv.New32a()
+		h.Write([]byte(qName))
+		return plugin.nets[h.Sum32()%uint32(len(plugin.nets))]
+	default:
+		return plugin.nets[rand.Intn(len(plugin.nets))]
+	}
+}
+
 func (plugin *PluginECS) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	// Check if SUBNET already exists in Pseudo section
 	for _, rr := range msg.Pseudo {
@@ -49,7 +73,7 @@ func (plugin *PluginECS) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	}
 
 	// Create SUBNET option
-	ipnet := plugin.nets[rand.Intn(len(plugin.nets))]
+	ipnet := plugin.selectNet(pluginsState.qName)
 	bits, totalSize := ipnet.Mask.Size()
 
 	var family uint16
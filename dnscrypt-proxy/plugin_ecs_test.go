@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+func newECSTestPlugin(t *testing.T, mode string, cidrs ...string) *PluginECS {
+	t.Helper()
+	proxy := &Proxy{ednsClientSubnetMode: mode}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.ednsClientSubnets = append(proxy.ednsClientSubnets, ipnet)
+	}
+	plugin := new(PluginECS)
+	if err := plugin.Init(proxy); err != nil {
+		t.Fatal(err)
+	}
+	return plugin
+}
+
+// ecsSubnetSent returns the subnet added to a query for a name
+func ecsSubnetSent(t *testing.T, plugin *PluginECS, qName string) string {
+	t.Helper()
+	msg := dns.NewMsg(fqdn(qName), dns.TypeA)
+	pluginsState := &PluginsState{qName: qName, maxPayloadSize: 1232}
+	if err := plugin.Eval(pluginsState, msg); err != nil {
+		t.Fatal(err)
+	}
+	for _, rr := range msg.Pseudo {
+		if subnet, ok := rr.(*dns.SUBNET); ok {
+			return (&net.IPNet{IP: subnet.Address.AsSlice(), Mask: net.CIDRMask(int(subnet.Netmask), subnet.Address.BitLen())}).String()
+		}
+	}
+	t.Fatal("no subnet was added to the query")
+	return ""
+}
+
+func TestECSModeFirst(t *testing.T) {
+	plugin := newECSTestPlugin(t, ECSModeFirst, "192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32")
+	for _, qName := range []string{"example.com", "example.net", "example.org", "example.com"} {
+		if got := ecsSubnetSent(t, plugin, qName); got != "192.0.2.0/24" {
+			t.Errorf("subnet for [%s] = %s, want the first one", qName, got)
+		}
+	}
+}
+
+func TestECSModeRandom(t *testing.T) {
+	plugin := newECSTestPlugin(t, ECSModeRandom, "192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32")
+	seen := make(map[string]bool)
+	for range 200 {
+		seen[ecsSubnetSent(t, plugin, "example.com")] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("random mode sent %v for the same name, want all the subnets", seen)
+	}
+}
+
+func TestECSModePerDomain(t *testing.T) {
+	plugin := newECSTestPlugin(t, ECSModePerDomain, "192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32")
+	seen := make(map[string]bool)
+	for i := range 50 {
+		qName := fmt.Sprintf("host%d.example.com", i)
+		first := ecsSubnetSent(t, plugin, qName)
+		for range 5 {
+			if got := ecsSubnetSent(t, plugin, qName); got != first {
+				t.Fatalf("subnet for [%s] changed from %s to %s", qName, first, got)
+			}
+		}
+		seen[first] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("per-domain mode sent %v for all names, want them spread across subnets", seen)
+	}
+}
+
+func TestECSKeepsClientSubnet(t *testing.T) {
+	plugin := newECSTestPlugin(t, ECSModeFirst, "192.0.2.0/24")
+	msg := dns.NewMsg("example.com.", dns.TypeA)
+	msg.Pseudo = append(msg.Pseudo, &dns.SUBNET{Family: 1, Netmask: 24})
+	if err := plugin.Eval(&PluginsState{qName: "example.com"}, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Pseudo) != 1 {
+		t.Errorf("a subnet sent by the client should be kept as-is, got %d options", len(msg.Pseudo))
+	}
+}
@@ -375,7 +375,7 @@ func (plugin *PluginForward) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 		tries--
 		dlog.Debugf("Forwarding [%s] to [%s]", qName, server)
 		client := dns.Client{}
-		ctx, cancel := context.WithTimeout(context.Background(), pluginsState.timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), pluginsState.upstreamTimeout(pluginsState.timeout))
 
 		// Create a clean copy of the message without Extra section for forwarding
 		forwardMsg := msg.Copy()
@@ -30,9 +30,8 @@ func (plugin *PluginGetSetPayloadSize) Eval(pluginsState *PluginsState, msg *dns
 	// In v2, EDNS0 info is directly on msg
 	dnssec := msg.Security
 	if msg.UDPSize > 0 {
-		pluginsState.maxUnencryptedUDPSafePayloadSize = int(msg.UDPSize)
 		pluginsState.originalMaxPayloadSize = Max(
-			pluginsState.maxUnencryptedUDPSafePayloadSize-ResponseOverhead,
+			int(msg.UDPSize)-ResponseOverhead,
 			pluginsState.originalMaxPayloadSize,
 		)
 	}
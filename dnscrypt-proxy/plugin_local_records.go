@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+
+	"codeberg.org/miekg/dns"
+)
+
+// PluginLocalRecords - Answers queries for some names with records from the configuration, instead of the upstream servers
+type PluginLocalRecords struct {
+	records map[string][]dns.RR
+}
+
+func (plugin *PluginLocalRecords) Name() string {
+	return "local_records"
+}
+
+func (plugin *PluginLocalRecords) Description() string {
+	return "Answer queries for some names with configured records"
+}
+
+func (plugin *PluginLocalRecords) Init(proxy *Proxy) error {
+	records, err := parseLocalRecords(proxy.localRecords)
+	if err != nil {
+		return err
+	}
+	plugin.records = records
+	return nil
+}
+
+func (plugin *PluginLocalRecords) Drop() error {
+	return nil
+}
+
+func (plugin *PluginLocalRecords) Reload() error {
+	return nil
+}
+
+func (plugin *PluginLocalRecords) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	records, ok := plugin.records[pluginsState.qName]
+	if !ok {
+		return nil
+	}
+	question := msg.Question[0]
+	if question.Header().Class != dns.ClassINET {
+		return nil
+	}
+	qtype := dns.RRToType(question)
+	synth := EmptyResponseFromMessage(msg)
+	synth.Answer = localRecordsAnswer(records, qtype, question.Header().Name)
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	return nil
+}
+
+// localRecordsAnswer returns the records of a name matching a query type, or its CNAME record if there is one.
+// The answer is empty (NODATA) if the name has no records of that type.
+func localRecordsAnswer(records []dns.RR, qtype uint16, qName string) []dns.RR {
+	answer := []dns.RR{}
+	var cname dns.RR
+	for _, rr := range records {
+		rrType := dns.RRToType(rr)
+		if rrType == dns.TypeCNAME {
+			cname = rr
+		}
+		if rrType == qtype || qtype == dns.TypeANY {
+			answer = append(answer, rr)
+		}
+	}
+	if len(answer) == 0 && cname != nil {
+		answer = append(answer, cname)
+	}
+	for i, rr := range answer {
+		// Records are copied so that the name in the answer keeps the case of the question
+		answer[i] = rr.Clone()
+		answer[i].Header().Name = qName
+	}
+	return answer
+}
+
+// parseLocalRecords parses records in the zone file format, and groups them by normalized name
+func parseLocalRecords(lines []string) (map[string][]dns.RR, error) {
+	records := make(map[string][]dns.RR)
+	for _, line := range lines {
+		rr, err := dns.New(line)
+		if err != nil || rr == nil {
+			return nil, fmt.Errorf("Invalid local record [%s]: %v", line, err)
+		}
+		if rr.Header().Class != dns.ClassINET {
+			return nil, fmt.Errorf("Invalid local record [%s]: only the IN class is supported", line)
+		}
+		rrType := dns.RRToType(rr)
+		if rrType == dns.TypeOPT || rrType == dns.TypeANY {
+			return nil, fmt.Errorf("Invalid local record [%s]: unsupported type", line)
+		}
+		name, err := NormalizeQName(rr.Header().Name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid local record [%s]: %w", line, err)
+		}
+		for _, other := range records[name] {
+			if rrType == dns.TypeCNAME || dns.RRToType(other) == dns.TypeCNAME {
+				return nil, fmt.Errorf("Invalid local record [%s]: a CNAME record cannot coexist with other records for [%s]", line, name)
+			}
+		}
+		records[name] = append(records[name], rr)
+	}
+	return records, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestLocalRecords(t *testing.T) {
+	for _, records := range [][]string{
+		{"printer.lan. IN A not-an-address"},
+		{"printer.lan. CH TXT \"chaos\""},
+		{"alias.lan. CNAME printer.lan.", "alias.lan. A 192.0.2.1"},
+	} {
+		if _, err := parseLocalRecords(records); err == nil {
+			t.Errorf("%v should be rejected", records)
+		}
+	}
+
+	proxy := &Proxy{localRecords: []string{
+		"Printer.LAN. 300 IN A 192.0.2.20",
+		"printer.lan. 300 IN A 192.0.2.21",
+		"printer.lan. 60 IN TXT \"local override\"",
+		"alias.lan. CNAME printer.lan.",
+	}}
+	plugin := &PluginLocalRecords{}
+	if err := plugin.Init(proxy); err != nil {
+		t.Fatal(err)
+	}
+
+	eval := func(qname string, qtype uint16) *PluginsState {
+		msg := dns.NewMsg(qname, qtype)
+		normalized, _ := NormalizeQName(qname)
+		pluginsState := &PluginsState{action: PluginsActionContinue, qName: normalized}
+		if err := plugin.Eval(pluginsState, msg); err != nil {
+			t.Fatal(err)
+		}
+		return pluginsState
+	}
+
+	pluginsState := eval("printer.Lan.", dns.TypeA)
+	if pluginsState.action != PluginsActionSynth || len(pluginsState.synthResponse.Answer) != 2 {
+		t.Fatalf("both A records should be returned, got %v", pluginsState.synthResponse)
+	}
+	for _, rr := range pluginsState.synthResponse.Answer {
+		if rr.Header().Name != "printer.Lan." || rr.Header().TTL != 300 {
+			t.Errorf("unexpected record: %v", rr)
+		}
+	}
+	if answer := eval("printer.lan.", dns.TypeTXT).synthResponse.Answer; len(answer) != 1 || answer[0].Header().TTL != 60 {
+		t.Errorf("the TXT record should be returned with its own TTL, got %v", answer)
+	}
+	if pluginsState := eval("printer.lan.", dns.TypeAAAA); pluginsState.action != PluginsActionSynth ||
+		len(pluginsState.synthResponse.Answer) != 0 || pluginsState.synthResponse.Rcode != dns.RcodeSuccess {
+		t.Errorf("names without records of the requested type should get an empty response, got %v", pluginsState.synthResponse)
+	}
+	if answer := eval("alias.lan.", dns.TypeA).synthResponse.Answer; len(answer) != 1 || dns.RRToType(answer[0]) != dns.TypeCNAME {
+		t.Errorf("the CNAME record should be returned, got %v", answer)
+	}
+	if pluginsState := eval("other.lan.", dns.TypeA); pluginsState.action != PluginsActionContinue {
+		t.Error("names without records should be forwarded")
+	}
+	if plugin.records["printer.lan"][0].Header().Name != "Printer.LAN." {
+		t.Error("the configured records should not be modified")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/hex"
+
+	"codeberg.org/miekg/dns"
+	"github.com/jedisct1/dlog"
+)
+
+type PluginNSID struct{}
+
+func (plugin *PluginNSID) Name() string {
+	return "nsid"
+}
+
+func (plugin *PluginNSID) Description() string {
+	return "Ask upstream servers to identify the node answering queries."
+}
+
+func (plugin *PluginNSID) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginNSID) Drop() error {
+	return nil
+}
+
+func (plugin *PluginNSID) Reload() error {
+	return nil
+}
+
+func (plugin *PluginNSID) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	pluginsState.nsidRequested = true
+	for _, rr := range msg.Pseudo {
+		if _, ok := rr.(*dns.NSID); ok {
+			return nil
+		}
+	}
+	if msg.UDPSize == 0 {
+		msg.UDPSize = uint16(pluginsState.maxPayloadSize)
+	}
+	msg.Pseudo = append(msg.Pseudo, &dns.NSID{})
+	return nil
+}
+
+// responseNSID returns the node identifier found in a response, as text if it is printable, or in hex otherwise
+func responseNSID(msg *dns.Msg) string {
+	for _, rr := range msg.Pseudo {
+		nsid, ok := rr.(*dns.NSID)
+		if !ok || len(nsid.Nsid) == 0 {
+			continue
+		}
+		bin, err := hex.DecodeString(nsid.Nsid)
+		if err != nil {
+			return nsid.Nsid
+		}
+		for _, c := range bin {
+			if c < 0x20 || c > 0x7e {
+				return nsid.Nsid
+			}
+		}
+		return string(bin)
+	}
+	return ""
+}
+
+// recordNSID keeps the node identifier of a response, before EDNS options are removed from it
+func (pluginsState *PluginsState) recordNSID(msg *dns.Msg) {
+	if !pluginsState.nsidRequested {
+		return
+	}
+	if pluginsState.nsid = responseNSID(msg); len(pluginsState.nsid) > 0 {
+		dlog.Debugf("[%s] was answered by node [%s] of [%s]", pluginsState.qName, pluginsState.nsid, pluginsState.serverName)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestPluginNSID(t *testing.T) {
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	pluginsState := &PluginsState{maxPayloadSize: 1232, qName: "example.com"}
+	if err := (&PluginNSID{}).Eval(pluginsState, query); err != nil {
+		t.Fatal(err)
+	}
+	if len(query.Pseudo) != 1 || query.UDPSize == 0 {
+		t.Fatalf("the query should have an NSID option, got %v", query.Pseudo)
+	}
+	if _, ok := query.Pseudo[0].(*dns.NSID); !ok {
+		t.Fatalf("unexpected option: %v", query.Pseudo[0])
+	}
+
+	response := EmptyResponseFromMessage(query)
+	response.UDPSize = 1232
+	response.Pseudo = []dns.RR{&dns.NSID{Nsid: hex.EncodeToString([]byte("fra1-node3"))}}
+	if err := response.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	pluginsGlobals := &PluginsGlobals{responsePlugins: &[]Plugin{}}
+	packet, err := pluginsState.ApplyResponsePlugins(pluginsGlobals, response.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pluginsState.nsid != "fra1-node3" {
+		t.Errorf("nsid = %q, want fra1-node3", pluginsState.nsid)
+	}
+	forwarded := dns.Msg{Data: packet}
+	if err := forwarded.Unpack(); err != nil {
+		t.Fatal(err)
+	}
+	if len(forwarded.Pseudo) != 0 {
+		t.Errorf("the NSID option should not be sent to the client, got %v", forwarded.Pseudo)
+	}
+
+	binary := &dns.Msg{Pseudo: []dns.RR{&dns.NSID{Nsid: "00ff10"}}}
+	if nsid := responseNSID(binary); nsid != "00ff10" {
+		t.Errorf("non-printable identifiers should be kept in hex, got %q", nsid)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"codeberg.org/miekg/dns"
+)
+
+// Reverse zones of private (RFC 1918), unique local (RFC 4193), link-local and loopback addresses
+var privatePTRZones = func() []string {
+	zones := []string{
+		"10.in-addr.arpa",
+		"168.192.in-addr.arpa",
+		"254.169.in-addr.arpa",
+		"c.f.ip6.arpa",
+		"d.f.ip6.arpa",
+		"8.e.f.ip6.arpa",
+		"9.e.f.ip6.arpa",
+		"a.e.f.ip6.arpa",
+		"b.e.f.ip6.arpa",
+	}
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, strconv.Itoa(i)+".172.in-addr.arpa")
+	}
+	return append(zones, loopbackPTRZones...)
+}()
+
+var loopbackPTRZones = []string{
+	"127.in-addr.arpa",
+	"1." + strings.Repeat("0.", 31) + "ip6.arpa",
+}
+
+type PluginPrivatePTR struct {
+	name string
+	ttl  uint32
+}
+
+func (plugin *PluginPrivatePTR) Name() string {
+	return "private_ptr"
+}
+
+func (plugin *PluginPrivatePTR) Description() string {
+	return "Answer reverse lookups for private addresses locally"
+}
+
+func (plugin *PluginPrivatePTR) Init(proxy *Proxy) error {
+	if len(proxy.privatePTRName) > 0 {
+		name, err := NormalizeQName(proxy.privatePTRName)
+		if err != nil {
+			return fmt.Errorf("Invalid private_ptr_name [%s]: %w", proxy.privatePTRName, err)
+		}
+		plugin.name = fqdn(name)
+	}
+	plugin.ttl = proxy.cloakTTL
+	return nil
+}
+
+func (plugin *PluginPrivatePTR) Drop() error {
+	return nil
+}
+
+func (plugin *PluginPrivatePTR) Reload() error {
+	return nil
+}
+
+func (plugin *PluginPrivatePTR) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	question := msg.Question[0]
+	if dns.RRToType(question) != dns.TypePTR || question.Header().Class != dns.ClassINET {
+		return nil
+	}
+	qName := pluginsState.qName
+	if !inZones(qName, privatePTRZones) {
+		return nil
+	}
+	synth := EmptyResponseFromMessage(msg)
+	name := plugin.name
+	if inZones(qName, loopbackPTRZones) {
+		name = "localhost."
+	}
+	if len(name) > 0 && isAddressPTRName(qName) {
+		rr := new(dns.PTR)
+		rr.Hdr = dns.Header{Name: question.Header().Name, Class: dns.ClassINET, TTL: plugin.ttl}
+		rr.Ptr = name
+		synth.Answer = []dns.RR{rr}
+	} else {
+		synth.Rcode = dns.RcodeNameError
+	}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	return nil
+}
+
+// inZones returns true if a normalized name is one of the zones, or a subdomain of one of them
+func inZones(qName string, zones []string) bool {
+	for _, zone := range zones {
+		if qName == zone || strings.HasSuffix(qName, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAddressPTRName returns true if a reverse name maps a complete IPv4 or IPv6 address, and not a network
+func isAddressPTRName(qName string) bool {
+	labels := strings.Count(qName, ".") + 1
+	if strings.HasSuffix(qName, ".in-addr.arpa") {
+		return labels == 4+2
+	}
+	return strings.HasSuffix(qName, ".ip6.arpa") && labels == 32+2
+}
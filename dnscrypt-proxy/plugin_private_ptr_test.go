@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestPrivatePTR(t *testing.T) {
+	tests := []struct {
+		name      string
+		ptrName   string
+		qname     string
+		qtype     uint16
+		wantSynth bool
+		wantRcode uint16
+		wantPTR   string
+	}{
+		{name: "rfc1918", qname: "1.1.168.192.in-addr.arpa.", qtype: dns.TypePTR, wantSynth: true, wantRcode: dns.RcodeNameError},
+		{name: "172.16/12", qname: "1.0.20.172.in-addr.arpa.", qtype: dns.TypePTR, wantSynth: true, wantRcode: dns.RcodeNameError},
+		{name: "outside 172.16/12", qname: "1.0.32.172.in-addr.arpa.", qtype: dns.TypePTR},
+		{name: "public", qname: "8.8.8.8.in-addr.arpa.", qtype: dns.TypePTR},
+		{name: "not ptr", qname: "1.0.0.10.in-addr.arpa.", qtype: dns.TypeTXT},
+		{
+			name: "ula", qname: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.",
+			qtype: dns.TypePTR, wantSynth: true, wantRcode: dns.RcodeNameError,
+		},
+		{name: "configured name", ptrName: "Private.LAN", qname: "1.0.0.10.in-addr.arpa.", qtype: dns.TypePTR, wantSynth: true, wantPTR: "private.lan."},
+		{name: "network with configured name", ptrName: "private.lan", qname: "0.10.in-addr.arpa.", qtype: dns.TypePTR, wantSynth: true, wantRcode: dns.RcodeNameError},
+		{name: "loopback", qname: "1.0.0.127.in-addr.arpa.", qtype: dns.TypePTR, wantSynth: true, wantPTR: "localhost."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &PluginPrivatePTR{}
+			if err := plugin.Init(&Proxy{privatePTRName: tt.ptrName, cloakTTL: 600}); err != nil {
+				t.Fatal(err)
+			}
+			msg := dns.NewMsg(tt.qname, tt.qtype)
+			normalized, _ := NormalizeQName(tt.qname)
+			pluginsState := &PluginsState{action: PluginsActionContinue, qName: normalized}
+			if err := plugin.Eval(pluginsState, msg); err != nil {
+				t.Fatal(err)
+			}
+			synth := pluginsState.synthResponse
+			if (synth != nil) != tt.wantSynth {
+				t.Fatalf("synthesized = %v, want %v", synth != nil, tt.wantSynth)
+			}
+			if synth == nil {
+				return
+			}
+			if synth.Rcode != tt.wantRcode {
+				t.Errorf("rcode = %d, want %d", synth.Rcode, tt.wantRcode)
+			}
+			var ptr string
+			if len(synth.Answer) == 1 {
+				ptr = synth.Answer[0].(*dns.PTR).Ptr
+			}
+			if ptr != tt.wantPTR {
+				t.Errorf("PTR = %q, want %q", ptr, tt.wantPTR)
+			}
+		})
+	}
+}
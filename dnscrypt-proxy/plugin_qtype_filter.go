@@ -0,0 +1,63 @@
+package main
+
+import (
+	"codeberg.org/miekg/dns"
+	"github.com/jedisct1/dlog"
+)
+
+// PluginQTypeFilter - Refuses queries for record types that are not allowed to be forwarded,
+// such as the NULL type, that is commonly used to tunnel data over DNS
+type PluginQTypeFilter struct {
+	allowedQTypes map[uint16]struct{}
+	blockedQTypes map[uint16]struct{}
+}
+
+func (plugin *PluginQTypeFilter) Name() string {
+	return "qtype_filter"
+}
+
+func (plugin *PluginQTypeFilter) Description() string {
+	return "Refuse queries for record types that are not allowed."
+}
+
+func (plugin *PluginQTypeFilter) Init(proxy *Proxy) error {
+	plugin.allowedQTypes = proxy.allowedQTypes
+	plugin.blockedQTypes = proxy.blockedQTypes
+	return nil
+}
+
+func (plugin *PluginQTypeFilter) Drop() error {
+	return nil
+}
+
+func (plugin *PluginQTypeFilter) Reload() error {
+	return nil
+}
+
+// allowed - Returns true if the type is in the allowlist, when there is one, and not in the denylist
+func (plugin *PluginQTypeFilter) allowed(qType uint16) bool {
+	if len(plugin.allowedQTypes) > 0 {
+		if _, ok := plugin.allowedQTypes[qType]; !ok {
+			return false
+		}
+	}
+	_, blocked := plugin.blockedQTypes[qType]
+	return !blocked
+}
+
+func (plugin *PluginQTypeFilter) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	qType := dns.RRToType(msg.Question[0])
+	if plugin.allowed(qType) {
+		return nil
+	}
+	dlog.Debugf("[%s] refused: type %d is not allowed", pluginsState.qName, qType)
+	synth := EmptyResponseFromMessage(msg)
+	synth.Rcode = dns.RcodeRefused
+	if synth.UDPSize > 0 {
+		synth.Pseudo = append(synth.Pseudo, &dns.EDE{InfoCode: dns.ExtendedErrorProhibited})
+	}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeReject
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestPluginQTypeFilter(t *testing.T) {
+	blocked, err := parseQTypes("blocked_qtypes", []string{"null", "TYPE65280"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, err := parseQTypes("allowed_qtypes", []string{"A", "AAAA", "MX", "NULL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := blocked[65280]; !ok {
+		t.Error("types given by number should be parsed")
+	}
+	if _, err := parseQTypes("blocked_qtypes", []string{"NOTATYPE"}); err == nil {
+		t.Error("unknown types should be rejected")
+	}
+
+	tests := []struct {
+		name       string
+		allowed    map[uint16]struct{}
+		blocked    map[uint16]struct{}
+		qType      uint16
+		wantRefuse bool
+	}{
+		{name: "blocked NULL", blocked: blocked, qType: dns.TypeNULL, wantRefuse: true},
+		{name: "A with a denylist", blocked: blocked, qType: dns.TypeA, wantRefuse: false},
+		{name: "MX with an allowlist", allowed: allowed, qType: dns.TypeMX, wantRefuse: false},
+		{name: "TXT with an allowlist", allowed: allowed, qType: dns.TypeTXT, wantRefuse: true},
+		{name: "denylist wins", allowed: allowed, blocked: blocked, qType: dns.TypeNULL, wantRefuse: true},
+		{name: "AAAA with both", allowed: allowed, blocked: blocked, qType: dns.TypeAAAA, wantRefuse: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &PluginQTypeFilter{allowedQTypes: tt.allowed, blockedQTypes: tt.blocked}
+			msg := dns.NewMsg("example.com.", tt.qType)
+			pluginsState := &PluginsState{action: PluginsActionContinue, qName: "example.com"}
+			if err := plugin.Eval(pluginsState, msg); err != nil {
+				t.Fatal(err)
+			}
+			refused := pluginsState.synthResponse != nil && pluginsState.synthResponse.Rcode == dns.RcodeRefused
+			if refused != tt.wantRefuse {
+				t.Fatalf("refused = %v, want %v", refused, tt.wantRefuse)
+			}
+			if refused && (pluginsState.action != PluginsActionSynth || pluginsState.returnCode != PluginsReturnCodeReject) {
+				t.Errorf("action = %v, returnCode = %v", pluginsState.action, pluginsState.returnCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"codeberg.org/miekg/dns"
+	"github.com/jedisct1/dlog"
+)
+
+// Number of events queued per client before new events are dropped
+const QueryEventSocketQueueSize = 1024
+
+type queryEventClient struct {
+	conn   net.Conn
+	events chan []byte
+}
+
+// QueryEventSocket - Streams query events as newline-delimited JSON to the clients connected to a Unix socket
+type QueryEventSocket struct {
+	sync.Mutex
+	listener net.Listener
+	clients  map[*queryEventClient]struct{}
+	dropped  atomic.Uint64
+}
+
+func NewQueryEventSocket(path string) (*QueryEventSocket, error) {
+	if _, err := os.Stat(path); err == nil {
+		// Remove a stale socket left by a previous instance
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	eventSocket := &QueryEventSocket{
+		listener: listener,
+		clients:  make(map[*queryEventClient]struct{}),
+	}
+	go eventSocket.acceptLoop()
+	return eventSocket, nil
+}
+
+func (eventSocket *QueryEventSocket) acceptLoop() {
+	for {
+		conn, err := eventSocket.listener.Accept()
+		if err != nil {
+			return
+		}
+		client := &queryEventClient{conn: conn, events: make(chan []byte, QueryEventSocketQueueSize)}
+		eventSocket.Lock()
+		eventSocket.clients[client] = struct{}{}
+		eventSocket.Unlock()
+		dlog.Debug("Query event socket: client connected")
+		go eventSocket.writeLoop(client)
+	}
+}
+
+func (eventSocket *QueryEventSocket) writeLoop(client *queryEventClient) {
+	defer func() {
+		eventSocket.Lock()
+		delete(eventSocket.clients, client)
+		eventSocket.Unlock()
+		client.conn.Close()
+		dlog.Debug("Query event socket: client disconnected")
+	}()
+	for line := range client.events {
+		if _, err := client.conn.Write(line); err != nil {
+			return
+		}
+	}
+}
+
+// Publish - Sends an event to every client, dropping it for clients that are not keeping up
+func (eventSocket *QueryEventSocket) Publish(event *QueryLogEvent) {
+	eventSocket.Lock()
+	defer eventSocket.Unlock()
+	if len(eventSocket.clients) == 0 {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	for client := range eventSocket.clients {
+		select {
+		case client.events <- line:
+		default:
+			eventSocket.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped - Returns the number of events that were dropped because a client was too slow
+func (eventSocket *QueryEventSocket) Dropped() uint64 {
+	return eventSocket.dropped.Load()
+}
+
+// Close - Stops accepting clients, and disconnects the current ones
+func (eventSocket *QueryEventSocket) Close() {
+	eventSocket.listener.Close()
+	eventSocket.Lock()
+	for client := range eventSocket.clients {
+		close(client.events)
+		client.conn.Close()
+		delete(eventSocket.clients, client)
+	}
+	eventSocket.Unlock()
+}
+
+type PluginQueryEventSocket struct {
+	eventSocket   *QueryEventSocket
+	ipCryptConfig *IPCryptConfig
+}
+
+func (plugin *PluginQueryEventSocket) Name() string {
+	return "query_event_socket"
+}
+
+func (plugin *PluginQueryEventSocket) Description() string {
+	return "Stream query events to a Unix socket."
+}
+
+func (plugin *PluginQueryEventSocket) Init(proxy *Proxy) error {
+	eventSocket, err := NewQueryEventSocket(proxy.queryEventSocketPath)
+	if err != nil {
+		return err
+	}
+	plugin.eventSocket = eventSocket
+	plugin.ipCryptConfig = proxy.ipCryptConfig
+	proxy.queryEventSocket = eventSocket
+	dlog.Noticef("Streaming query events to [%s]", proxy.queryEventSocketPath)
+	return nil
+}
+
+func (plugin *PluginQueryEventSocket) Drop() error {
+	plugin.eventSocket.Close()
+	return nil
+}
+
+func (plugin *PluginQueryEventSocket) Reload() error {
+	return nil
+}
+
+func (plugin *PluginQueryEventSocket) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	event, ok := newQueryLogEvent(pluginsState, msg, plugin.ipCryptConfig)
+	if !ok {
+		return nil
+	}
+	plugin.eventSocket.Publish(&event)
+	return nil
+}
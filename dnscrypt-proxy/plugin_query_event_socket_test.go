@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestQueryEventSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "qevents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.sock")
+
+	plugin := &PluginQueryEventSocket{}
+	if err := plugin.Init(&Proxy{queryEventSocketPath: path}); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	defer plugin.Drop()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Wait for the client to be registered
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		plugin.eventSocket.Lock()
+		registered := len(plugin.eventSocket.clients) > 0
+		plugin.eventSocket.Unlock()
+		if registered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var clientAddr net.Addr = &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5353}
+	pluginsState := &PluginsState{
+		clientProto: "udp",
+		clientAddr:  &clientAddr,
+		qName:       "example.com",
+		serverName:  "resolver",
+		returnCode:  PluginsReturnCodePass,
+		timeout:     time.Second,
+	}
+	if err := plugin.Eval(pluginsState, dns.NewMsg("example.com.", dns.TypeAAAA)); err != nil {
+		t.Fatalf("Eval() error = %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("no event received: %v", err)
+	}
+	var event QueryLogEvent
+	if err := json.Unmarshal(line, &event); err != nil {
+		t.Fatalf("invalid event %q: %v", line, err)
+	}
+	if event.QName != "example.com" || event.QType != "AAAA" || event.ClientIP != "192.0.2.10" ||
+		event.Server != "resolver" || event.ReturnCode != "PASS" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+}
+
+func TestQueryEventSocketDropsWhenFull(t *testing.T) {
+	eventSocket := &QueryEventSocket{clients: make(map[*queryEventClient]struct{})}
+	client := &queryEventClient{events: make(chan []byte, 2)}
+	eventSocket.clients[client] = struct{}{}
+
+	for range 5 {
+		eventSocket.Publish(&QueryLogEvent{QName: "example.com"})
+	}
+	if len(client.events) != 2 {
+		t.Errorf("queued events = %d, want 2", len(client.events))
+	}
+	if dropped := eventSocket.Dropped(); dropped != 3 {
+		t.Errorf("dropped = %d, want 3", dropped)
+	}
+}
@@ -5,6 +5,7 @@
 	"fmt"
 	"io"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"codeberg.org/miekg/dns"
@@ -16,6 +17,10 @@ type PluginQueryLog struct {
 	format        string
 	ignoredQtypes []string
 	ipCryptConfig *IPCryptConfig
+	sampleRate    uint64
+	notableOnly   bool
+	sampleCounter atomic.Uint64
+	upstreamIP    bool
 }
 
 func (plugin *PluginQueryLog) Name() string {
@@ -31,6 +36,9 @@ func (plugin *PluginQueryLog) Init(proxy *Proxy) error {
 	plugin.format = proxy.queryLogFormat
 	plugin.ignoredQtypes = proxy.queryLogIgnoredQtypes
 	plugin.ipCryptConfig = proxy.ipCryptConfig
+	plugin.sampleRate = max(1, proxy.queryLogSampleRate)
+	plugin.notableOnly = proxy.queryLogNotableOnly
+	plugin.upstreamIP = proxy.queryLogUpstreamIP
 
 	return nil
 }
@@ -43,25 +51,33 @@ func (plugin *PluginQueryLog) Reload() error {
 	return nil
 }
 
-func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
-	clientIPStr, ok := ExtractClientIPStrEncrypted(pluginsState, plugin.ipCryptConfig)
+// QueryLogEvent - A query, as written to the query log and sent to the query event socket
+type QueryLogEvent struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client"`
+	QName      string    `json:"qname"`
+	QType      string    `json:"qtype"`
+	ReturnCode string    `json:"decision"`
+	Cached     bool      `json:"cached"`
+	DurationMs int64     `json:"rtt_ms"`
+	Server     string    `json:"server"`
+	Relay      string    `json:"relay"`
+	UpstreamIP string    `json:"upstream_ip,omitempty"`
+	NSID       string    `json:"nsid,omitempty"`
+}
+
+// newQueryLogEvent returns the event for a query, or false for internal queries that are not logged
+func newQueryLogEvent(pluginsState *PluginsState, msg *dns.Msg, ipCryptConfig *IPCryptConfig) (QueryLogEvent, bool) {
+	clientIPStr, ok := ExtractClientIPStrEncrypted(pluginsState, ipCryptConfig)
 	if !ok {
 		// Ignore internal flow.
-		return nil
+		return QueryLogEvent{}, false
 	}
 	question := msg.Question[0]
 	qType, ok := dns.TypeToString[dns.RRToType(question)]
 	if !ok {
 		qType = fmt.Sprintf("%d", dns.RRToType(question))
 	}
-	if len(plugin.ignoredQtypes) > 0 {
-		for _, ignoredQtype := range plugin.ignoredQtypes {
-			if strings.EqualFold(ignoredQtype, qType) {
-				return nil
-			}
-		}
-	}
-	qName := pluginsState.qName
 
 	if pluginsState.cacheHit {
 		pluginsState.serverName = "-"
@@ -95,30 +111,67 @@ func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) err
 		relayName = "-"
 	}
 
+	return QueryLogEvent{
+		Time:       time.Now(),
+		ClientIP:   clientIPStr,
+		QName:      pluginsState.qName,
+		QType:      qType,
+		ReturnCode: returnCode,
+		Cached:     pluginsState.cacheHit,
+		DurationMs: int64(requestDuration / time.Millisecond),
+		Server:     pluginsState.serverName,
+		Relay:      relayName,
+		UpstreamIP: pluginsState.upstreamIP,
+		NSID:       pluginsState.nsid,
+	}, true
+}
+
+func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	event, ok := newQueryLogEvent(pluginsState, msg, plugin.ipCryptConfig)
+	if !ok {
+		return nil
+	}
+	if len(plugin.ignoredQtypes) > 0 {
+		for _, ignoredQtype := range plugin.ignoredQtypes {
+			if strings.EqualFold(ignoredQtype, event.QType) {
+				return nil
+			}
+		}
+	}
+
+	if !plugin.sampled(pluginsState.returnCode) {
+		return nil
+	}
+
 	var line string
 	if plugin.format == "tsv" {
-		now := time.Now()
-		year, month, day := now.Date()
-		hour, minute, second := now.Clock()
+		year, month, day := event.Time.Date()
+		hour, minute, second := event.Time.Clock()
 		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
 		line = fmt.Sprintf(
 			"%s\t%s\t%s\t%s\t%s\t%dms\t%s\t%s\n",
 			tsStr,
-			clientIPStr,
-			StringQuote(qName),
-			qType,
-			returnCode,
-			requestDuration/time.Millisecond,
-			StringQuote(pluginsState.serverName),
-			StringQuote(relayName),
+			event.ClientIP,
+			StringQuote(event.QName),
+			event.QType,
+			event.ReturnCode,
+			event.DurationMs,
+			StringQuote(event.Server),
+			StringQuote(event.Relay),
 		)
+		if plugin.upstreamIP {
+			line = strings.TrimSuffix(line, "\n") + "\t" + upstreamIPOrDash(event.UpstreamIP) + "\n"
+		}
 	} else if plugin.format == "ltsv" {
 		cached := 0
-		if pluginsState.cacheHit {
+		if event.Cached {
 			cached = 1
 		}
 		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s\treturn:%s\tcached:%d\tduration:%d\tserver:%s\trelay:%s\n",
-			time.Now().Unix(), clientIPStr, StringQuote(qName), qType, returnCode, cached, requestDuration/time.Millisecond, StringQuote(pluginsState.serverName), StringQuote(relayName))
+			event.Time.Unix(), event.ClientIP, StringQuote(event.QName), event.QType, event.ReturnCode, cached, event.DurationMs, StringQuote(event.Server), StringQuote(event.Relay))
+		if plugin.upstreamIP {
+			line = strings.TrimSuffix(line, "\n") + "\tupstream_ip:" + upstreamIPOrDash(event.UpstreamIP) + "\n"
+		}
 	} else {
 		dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 	}
@@ -129,3 +182,38 @@ func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) err
 
 	return nil
 }
+
+func upstreamIPOrDash(upstreamIP string) string {
+	if upstreamIP == "" {
+		return "-"
+	}
+	return upstreamIP
+}
+
+// isNotableReturnCode returns true for queries that were blocked or that failed
+func isNotableReturnCode(returnCode PluginsReturnCode) bool {
+	switch returnCode {
+	case PluginsReturnCodeDrop,
+		PluginsReturnCodeReject,
+		PluginsReturnCodeParseError,
+		PluginsReturnCodeResponseError,
+		PluginsReturnCodeServFail,
+		PluginsReturnCodeNetworkError,
+		PluginsReturnCodeServerTimeout,
+		PluginsReturnCodeNotReady:
+		return true
+	}
+	return false
+}
+
+// sampled checks if a query should be logged: blocked and failed queries always are,
+// other queries are skipped if notable_only is set, or logged once every sample_rate queries
+func (plugin *PluginQueryLog) sampled(returnCode PluginsReturnCode) bool {
+	if isNotableReturnCode(returnCode) {
+		return true
+	}
+	if plugin.notableOnly {
+		return false
+	}
+	return plugin.sampleRate <= 1 || plugin.sampleCounter.Add(1)%plugin.sampleRate == 0
+}
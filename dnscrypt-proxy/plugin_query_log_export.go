@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	// Number of events waiting to be exported before new events are dropped
+	QueryLogExportQueueSize = 4096
+
+	DefaultQueryLogExportBatchSize     = 100
+	DefaultQueryLogExportFlushInterval = 5 * time.Second
+	QueryLogExportTimeout              = 10 * time.Second
+
+	// Facility local0, severity informational
+	queryLogExportSyslogPriority = 16*8 + 6
+)
+
+// QueryLogExporter - Ships query events to a remote collector, as batches of JSON events sent over HTTP,
+// or as syslog messages sent over UDP. Events are dropped when the collector doesn't keep up.
+type QueryLogExporter struct {
+	sync.Mutex
+	url           *url.URL
+	xTransport    *XTransport
+	udpConn       net.Conn
+	hostname      string
+	batchSize     int
+	flushInterval time.Duration
+	events        chan QueryLogEvent
+	done          chan struct{}
+	closed        bool
+	dropped       atomic.Uint64
+}
+
+func NewQueryLogExporter(
+	remoteURL string,
+	xTransport *XTransport,
+	batchSize int,
+	flushInterval time.Duration,
+) (*QueryLogExporter, error) {
+	parsedURL, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	exporter := &QueryLogExporter{
+		url:           parsedURL,
+		xTransport:    xTransport,
+		batchSize:     max(1, batchSize),
+		flushInterval: flushInterval,
+		events:        make(chan QueryLogEvent, QueryLogExportQueueSize),
+		done:          make(chan struct{}),
+	}
+	if exporter.flushInterval <= 0 {
+		exporter.flushInterval = DefaultQueryLogExportFlushInterval
+	}
+	switch strings.ToLower(parsedURL.Scheme) {
+	case "http", "https":
+		if xTransport == nil {
+			return nil, errors.New("No transport to export query logs over HTTP")
+		}
+	case "udp":
+		if len(parsedURL.Port()) == 0 {
+			parsedURL.Host = net.JoinHostPort(parsedURL.Hostname(), "514")
+		}
+		if exporter.udpConn, err = net.Dial("udp", parsedURL.Host); err != nil {
+			return nil, err
+		}
+		if exporter.hostname, err = os.Hostname(); err != nil || len(exporter.hostname) == 0 {
+			exporter.hostname = "-"
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported scheme for the query log export URL: [%s]", parsedURL.Scheme)
+	}
+	go exporter.sendLoop()
+	return exporter, nil
+}
+
+// Publish - Queues an event, dropping it if the queue is full
+func (exporter *QueryLogExporter) Publish(event *QueryLogEvent) {
+	exporter.Lock()
+	defer exporter.Unlock()
+	if exporter.closed {
+		return
+	}
+	select {
+	case exporter.events <- *event:
+	default:
+		exporter.dropped.Add(1)
+	}
+}
+
+// Dropped - Returns the number of events that were dropped because the collector was too slow or unreachable
+func (exporter *QueryLogExporter) Dropped() uint64 {
+	return exporter.dropped.Load()
+}
+
+// Close - Sends the queued events, and stops the exporter
+func (exporter *QueryLogExporter) Close() {
+	exporter.Lock()
+	if exporter.closed {
+		exporter.Unlock()
+		return
+	}
+	exporter.closed = true
+	close(exporter.events)
+	exporter.Unlock()
+	<-exporter.done
+	if exporter.udpConn != nil {
+		exporter.udpConn.Close()
+	}
+}
+
+func (exporter *QueryLogExporter) sendLoop() {
+	defer close(exporter.done)
+	if exporter.udpConn != nil {
+		for event := range exporter.events {
+			exporter.sendSyslog(&event)
+		}
+		return
+	}
+	ticker := time.NewTicker(exporter.flushInterval)
+	defer ticker.Stop()
+	batch := make([]QueryLogEvent, 0, exporter.batchSize)
+	for {
+		select {
+		case event, ok := <-exporter.events:
+			if !ok {
+				exporter.sendBatch(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) < exporter.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		exporter.sendBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+func (exporter *QueryLogExporter) sendBatch(batch []QueryLogEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		exporter.dropped.Add(uint64(len(batch)))
+		return
+	}
+	_, statusCode, _, _, err := exporter.xTransport.Post(exporter.url, "", "application/json", &body, QueryLogExportTimeout)
+	if err == nil && (statusCode < 200 || statusCode > 299) {
+		err = fmt.Errorf("HTTP status code %d", statusCode)
+	}
+	if err != nil {
+		exporter.dropped.Add(uint64(len(batch)))
+		dlog.Debugf("Unable to export %d query log events to [%s]: %v", len(batch), exporter.url.Host, err)
+	}
+}
+
+func (exporter *QueryLogExporter) sendSyslog(event *QueryLogEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		exporter.dropped.Add(1)
+		return
+	}
+	message := fmt.Sprintf("<%d>1 %s %s dnscrypt-proxy - - - %s",
+		queryLogExportSyslogPriority, event.Time.UTC().Format(time.RFC3339), exporter.hostname, line)
+	if _, err := exporter.udpConn.Write([]byte(message)); err != nil {
+		exporter.dropped.Add(1)
+		dlog.Debugf("Unable to export a query log event to [%s]: %v", exporter.url.Host, err)
+	}
+}
+
+type PluginQueryLogExport struct {
+	exporter      *QueryLogExporter
+	ignoredQtypes []string
+	ipCryptConfig *IPCryptConfig
+}
+
+func (plugin *PluginQueryLogExport) Name() string {
+	return "query_log_export"
+}
+
+func (plugin *PluginQueryLogExport) Description() string {
+	return "Export DNS queries to a remote collector."
+}
+
+func (plugin *PluginQueryLogExport) Init(proxy *Proxy) error {
+	exporter, err := NewQueryLogExporter(
+		proxy.queryLogRemote,
+		proxy.xTransport,
+		proxy.queryLogRemoteBatchSize,
+		proxy.queryLogRemoteFlushInterval,
+	)
+	if err != nil {
+		return err
+	}
+	plugin.exporter = exporter
+	plugin.ignoredQtypes = proxy.queryLogIgnoredQtypes
+	plugin.ipCryptConfig = proxy.ipCryptConfig
+	proxy.queryLogExporter = exporter
+	dlog.Noticef("Exporting query logs to [%s]", exporter.url.Host)
+	return nil
+}
+
+func (plugin *PluginQueryLogExport) Drop() error {
+	plugin.exporter.Close()
+	return nil
+}
+
+func (plugin *PluginQueryLogExport) Reload() error {
+	return nil
+}
+
+func (plugin *PluginQueryLogExport) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	event, ok := newQueryLogEvent(pluginsState, msg, plugin.ipCryptConfig)
+	if !ok {
+		return nil
+	}
+	for _, ignoredQtype := range plugin.ignoredQtypes {
+		if strings.EqualFold(ignoredQtype, event.QType) {
+			return nil
+		}
+	}
+	plugin.exporter.Publish(&event)
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLogExportHTTP(t *testing.T) {
+	batches := make(chan []QueryLogEvent, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []QueryLogEvent
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		batches <- batch
+	}))
+	t.Cleanup(collector.Close)
+
+	xTransport := NewXTransport()
+	xTransport.rebuildTransport()
+	exporter, err := NewQueryLogExporter(collector.URL, xTransport, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, qName := range []string{"a.example", "b.example", "c.example"} {
+		exporter.Publish(&QueryLogEvent{QName: qName})
+	}
+	select {
+	case batch := <-batches:
+		if len(batch) != 2 || batch[0].QName != "a.example" || batch[1].QName != "b.example" {
+			t.Errorf("first batch = %+v, want the first two events", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a full batch should be sent without waiting for the flush interval")
+	}
+
+	// Closing the exporter sends the remaining events
+	exporter.Close()
+	select {
+	case batch := <-batches:
+		if len(batch) != 1 || batch[0].QName != "c.example" {
+			t.Errorf("last batch = %+v, want the third event", batch)
+		}
+	default:
+		t.Error("remaining events should be sent when the exporter is closed")
+	}
+	exporter.Publish(&QueryLogEvent{QName: "d.example"})
+	if dropped := exporter.Dropped(); dropped != 0 {
+		t.Errorf("%d events dropped, want 0", dropped)
+	}
+}
+
+func TestQueryLogExportSyslog(t *testing.T) {
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { collector.Close() })
+
+	exporter, err := NewQueryLogExporter("udp://"+collector.LocalAddr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Close()
+	exporter.Publish(&QueryLogEvent{Time: time.Now(), QName: "example.com", ReturnCode: "PASS"})
+
+	collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet := make([]byte, 4096)
+	n, err := collector.Read(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := string(packet[:n])
+	if !strings.HasPrefix(message, "<134>1 ") || !strings.Contains(message, " dnscrypt-proxy - - - {") {
+		t.Errorf("unexpected syslog message: %q", message)
+	}
+	if !strings.Contains(message, `"qname":"example.com"`) {
+		t.Errorf("syslog message should include the event: %q", message)
+	}
+}
+
+func TestQueryLogExportUnsupportedScheme(t *testing.T) {
+	if _, err := NewQueryLogExporter("tcp://127.0.0.1:514", nil, 1, time.Second); err == nil {
+		t.Error("unsupported schemes should be rejected")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestQueryLogSampling(t *testing.T) {
+	countLogged := func(plugin *PluginQueryLog, returnCode PluginsReturnCode, queries int) int {
+		logged := 0
+		for range queries {
+			if plugin.sampled(returnCode) {
+				logged++
+			}
+		}
+		return logged
+	}
+
+	plugin := &PluginQueryLog{sampleRate: 1}
+	if logged := countLogged(plugin, PluginsReturnCodePass, 10); logged != 10 {
+		t.Errorf("without sampling, %d queries out of 10 were logged", logged)
+	}
+
+	plugin = &PluginQueryLog{sampleRate: 5}
+	if logged := countLogged(plugin, PluginsReturnCodePass, 100); logged != 20 {
+		t.Errorf("with a sample rate of 5, %d queries out of 100 were logged, want 20", logged)
+	}
+	if logged := countLogged(plugin, PluginsReturnCodeReject, 10); logged != 10 {
+		t.Errorf("blocked queries should always be logged, got %d out of 10", logged)
+	}
+
+	plugin = &PluginQueryLog{sampleRate: 1, notableOnly: true}
+	if logged := countLogged(plugin, PluginsReturnCodeForward, 10); logged != 0 {
+		t.Errorf("only notable queries should be logged, got %d", logged)
+	}
+	if logged := countLogged(plugin, PluginsReturnCodeServerTimeout, 10); logged != 10 {
+		t.Errorf("failed queries should be logged, got %d out of 10", logged)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+	"github.com/jedisct1/dlog"
+)
+
+type PluginSelfName struct {
+	name      string
+	ttl       uint32
+	addresses []netip.Addr
+}
+
+func (plugin *PluginSelfName) Name() string {
+	return "self_name"
+}
+
+func (plugin *PluginSelfName) Description() string {
+	return "Resolve a name to the addresses the proxy listens to"
+}
+
+func (plugin *PluginSelfName) Init(proxy *Proxy) error {
+	name, err := NormalizeQName(proxy.selfName)
+	if err != nil {
+		return fmt.Errorf("Invalid self_name [%s]: %w", proxy.selfName, err)
+	}
+	plugin.name = name
+	plugin.ttl = proxy.cloakTTL
+	plugin.addresses = selfAddresses(proxy.listenAddresses, net.InterfaceAddrs)
+	if len(plugin.addresses) == 0 {
+		dlog.Warnf("No addresses to answer [%s] with", plugin.name)
+	}
+	return nil
+}
+
+func (plugin *PluginSelfName) Drop() error {
+	return nil
+}
+
+func (plugin *PluginSelfName) Reload() error {
+	return nil
+}
+
+func (plugin *PluginSelfName) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.qName != plugin.name {
+		return nil
+	}
+	question := msg.Question[0]
+	if question.Header().Class != dns.ClassINET {
+		return nil
+	}
+	qtype := dns.RRToType(question)
+	synth := EmptyResponseFromMessage(msg)
+	synth.Answer = []dns.RR{}
+	for _, addr := range plugin.addresses {
+		hdr := dns.Header{Name: question.Header().Name, Class: dns.ClassINET, TTL: plugin.ttl}
+		if qtype == dns.TypeA && addr.Is4() {
+			synth.Answer = append(synth.Answer, &dns.A{Hdr: hdr, A: rdata.A{Addr: addr}})
+		} else if qtype == dns.TypeAAAA && addr.Is6() {
+			synth.Answer = append(synth.Answer, &dns.AAAA{Hdr: hdr, AAAA: rdata.AAAA{Addr: addr}})
+		}
+	}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	return nil
+}
+
+// selfAddresses - Returns the IP addresses of the listen addresses.
+// Wildcard addresses are replaced with the addresses of the local interfaces, except loopback and link-local ones.
+func selfAddresses(listenAddresses []string, interfaceAddrs func() ([]net.Addr, error)) []netip.Addr {
+	var addresses []netip.Addr
+	add := func(addr netip.Addr) {
+		addr = addr.Unmap()
+		for _, found := range addresses {
+			if found == addr {
+				return
+			}
+		}
+		addresses = append(addresses, addr)
+	}
+	for _, listenAddress := range listenAddresses {
+		addrPort, err := netip.ParseAddrPort(listenAddress)
+		if err != nil {
+			dlog.Warnf("Unable to parse the listen address [%s]: %v", listenAddress, err)
+			continue
+		}
+		addr := addrPort.Addr()
+		if !addr.IsUnspecified() {
+			add(addr)
+			continue
+		}
+		ifAddrs, err := interfaceAddrs()
+		if err != nil {
+			dlog.Warnf("Unable to list the local addresses: %v", err)
+			continue
+		}
+		for _, ifAddr := range ifAddrs {
+			ipNet, ok := ifAddr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ifIP, ok := netip.AddrFromSlice(ipNet.IP)
+			if !ok || ifIP.IsLoopback() || ifIP.IsLinkLocalUnicast() {
+				continue
+			}
+			ifIP = ifIP.Unmap()
+			// "0.0.0.0" only accepts IPv4 connections, "[::]" accepts both
+			if addr.Is4() && !ifIP.Is4() {
+				continue
+			}
+			add(ifIP)
+		}
+	}
+	return addresses
+}
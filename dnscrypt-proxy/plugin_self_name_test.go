@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestSelfAddresses(t *testing.T) {
+	interfaceAddrs := func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("192.168.1.2"), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(64, 128)},
+		}, nil
+	}
+
+	tests := []struct {
+		name            string
+		listenAddresses []string
+		want            []string
+	}{
+		{name: "specific", listenAddresses: []string{"127.0.0.1:53", "[::1]:53"}, want: []string{"127.0.0.1", "::1"}},
+		{name: "ipv4 wildcard", listenAddresses: []string{"0.0.0.0:53"}, want: []string{"192.168.1.2"}},
+		{name: "ipv6 wildcard", listenAddresses: []string{"[::]:53"}, want: []string{"192.168.1.2", "2001:db8::2"}},
+		{name: "duplicates", listenAddresses: []string{"192.168.1.2:53", "0.0.0.0:5353"}, want: []string{"192.168.1.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, addr := range selfAddresses(tt.listenAddresses, interfaceAddrs) {
+				got = append(got, addr.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selfAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelfName(t *testing.T) {
+	proxy := &Proxy{selfName: "DNS.local.", cloakTTL: 600, listenAddresses: []string{"192.0.2.53:53", "[2001:db8::53]:53"}}
+	plugin := &PluginSelfName{}
+	if err := plugin.Init(proxy); err != nil {
+		t.Fatal(err)
+	}
+
+	eval := func(qname string, qtype uint16) *PluginsState {
+		msg := dns.NewMsg(qname, qtype)
+		normalized, _ := NormalizeQName(qname)
+		pluginsState := &PluginsState{action: PluginsActionContinue, qName: normalized}
+		if err := plugin.Eval(pluginsState, msg); err != nil {
+			t.Fatal(err)
+		}
+		return pluginsState
+	}
+
+	pluginsState := eval("dns.LOCAL.", dns.TypeA)
+	if pluginsState.action != PluginsActionSynth {
+		t.Fatalf("action = %v, want PluginsActionSynth", pluginsState.action)
+	}
+	answer := pluginsState.synthResponse.Answer
+	if len(answer) != 1 || answer[0].(*dns.A).A.Addr != netip.MustParseAddr("192.0.2.53") || answer[0].Header().TTL != 600 {
+		t.Errorf("A answer = %v, want 192.0.2.53", answer)
+	}
+
+	answer = eval("dns.local.", dns.TypeAAAA).synthResponse.Answer
+	if len(answer) != 1 || answer[0].(*dns.AAAA).AAAA.Addr != netip.MustParseAddr("2001:db8::53") {
+		t.Errorf("AAAA answer = %v, want 2001:db8::53", answer)
+	}
+
+	pluginsState = eval("dns.local.", dns.TypeMX)
+	if pluginsState.action != PluginsActionSynth || len(pluginsState.synthResponse.Answer) != 0 || pluginsState.synthResponse.Rcode != dns.RcodeSuccess {
+		t.Error("other types should get an empty response")
+	}
+
+	if pluginsState = eval("example.com.", dns.TypeA); pluginsState.action != PluginsActionContinue {
+		t.Error("other names should not be answered")
+	}
+}
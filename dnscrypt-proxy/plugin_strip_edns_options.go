@@ -0,0 +1,80 @@
+package main
+
+import (
+	"codeberg.org/miekg/dns"
+	"github.com/jedisct1/dlog"
+)
+
+type PluginStripEDNSOptions struct {
+	strip   map[uint16]struct{}
+	forward map[uint16]struct{}
+}
+
+func (plugin *PluginStripEDNSOptions) Name() string {
+	return "strip_edns_options"
+}
+
+func (plugin *PluginStripEDNSOptions) Description() string {
+	return "Remove EDNS options sent by clients before queries are forwarded."
+}
+
+func (plugin *PluginStripEDNSOptions) Init(proxy *Proxy) error {
+	plugin.strip = make(map[uint16]struct{}, len(proxy.stripClientEDNSOptions))
+	for _, code := range proxy.stripClientEDNSOptions {
+		plugin.strip[code] = struct{}{}
+	}
+	if len(proxy.forwardClientEDNSOptions) != 0 {
+		plugin.forward = make(map[uint16]struct{}, len(proxy.forwardClientEDNSOptions))
+		for _, code := range proxy.forwardClientEDNSOptions {
+			plugin.forward[code] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (plugin *PluginStripEDNSOptions) Drop() error {
+	return nil
+}
+
+func (plugin *PluginStripEDNSOptions) Reload() error {
+	return nil
+}
+
+// ednsOptionCode returns the option code of an EDNS option from the pseudo section
+func ednsOptionCode(rr dns.RR) (uint16, bool) {
+	option, ok := rr.(dns.EDNS0)
+	if !ok {
+		return 0, false
+	}
+	if unknown, ok := option.(*dns.ERFC3597); ok {
+		return unknown.EDNS0Code, true
+	}
+	return dns.RRToCode(option), true
+}
+
+func (plugin *PluginStripEDNSOptions) isStripped(code uint16) bool {
+	if _, ok := plugin.strip[code]; ok {
+		return true
+	}
+	if plugin.forward != nil {
+		_, ok := plugin.forward[code]
+		return !ok
+	}
+	return false
+}
+
+func (plugin *PluginStripEDNSOptions) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Pseudo) == 0 {
+		return nil
+	}
+	kept := msg.Pseudo[:0]
+	for _, rr := range msg.Pseudo {
+		if code, ok := ednsOptionCode(rr); ok && plugin.isStripped(code) {
+			dlog.Debugf("Removed EDNS option %d from the query for [%s]", code, pluginsState.qName)
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	msg.Pseudo = kept
+	return nil
+}
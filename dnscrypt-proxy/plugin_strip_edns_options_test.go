@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestStripEDNSOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		strip     []uint16
+		forward   []uint16
+		wantCodes []uint16
+	}{
+		{name: "strip cookie", strip: []uint16{dns.CodeCOOKIE}, wantCodes: []uint16{dns.CodeNSID, 65001}},
+		{name: "strip local option", strip: []uint16{65001}, wantCodes: []uint16{dns.CodeCOOKIE, dns.CodeNSID}},
+		{name: "forward only", forward: []uint16{dns.CodeNSID}, wantCodes: []uint16{dns.CodeNSID}},
+		{name: "strip and forward", strip: []uint16{dns.CodeCOOKIE}, forward: []uint16{dns.CodeNSID}, wantCodes: []uint16{dns.CodeNSID}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := dns.NewMsg("example.com.", dns.TypeA)
+			query.UDPSize = 1232
+			query.Pseudo = []dns.RR{
+				&dns.COOKIE{Cookie: "0123456789abcdef"},
+				&dns.NSID{},
+				&dns.ERFC3597{EDNS0Code: 65001, Code: "abcd"},
+			}
+			if err := query.Pack(); err != nil {
+				t.Fatalf("Pack() error = %v", err)
+			}
+
+			plugin := &PluginStripEDNSOptions{}
+			proxy := &Proxy{stripClientEDNSOptions: tt.strip, forwardClientEDNSOptions: tt.forward}
+			if err := plugin.Init(proxy); err != nil {
+				t.Fatal(err)
+			}
+			pluginsGlobals := &PluginsGlobals{
+				queryPlugins:    &[]Plugin{plugin},
+				responsePlugins: &[]Plugin{},
+				loggingPlugins:  &[]Plugin{},
+			}
+			pluginsState := &PluginsState{
+				action:      PluginsActionContinue,
+				sessionData: make(map[string]any),
+			}
+			packet, err := pluginsState.ApplyQueryPlugins(pluginsGlobals, query.Data, nil)
+			if err != nil {
+				t.Fatalf("ApplyQueryPlugins() error = %v", err)
+			}
+
+			msg := dns.Msg{Data: packet}
+			if err := msg.Unpack(); err != nil {
+				t.Fatalf("Unpack() error = %v", err)
+			}
+			var codes []uint16
+			for _, rr := range msg.Pseudo {
+				if code, ok := ednsOptionCode(rr); ok {
+					codes = append(codes, code)
+				}
+			}
+			if len(codes) != len(tt.wantCodes) {
+				t.Fatalf("options = %v, want %v", codes, tt.wantCodes)
+			}
+			for i := range codes {
+				if codes[i] != tt.wantCodes[i] {
+					t.Errorf("options = %v, want %v", codes, tt.wantCodes)
+					break
+				}
+			}
+			if msg.UDPSize == 0 {
+				t.Error("the OPT record should be kept")
+			}
+		})
+	}
+}
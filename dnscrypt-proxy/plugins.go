@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -29,6 +31,9 @@ type PluginsGlobals struct {
 	refusedCodeInResponses bool
 	respondWithIPv4        net.IP
 	respondWithIPv6        net.IP
+	negativeSOA            bool
+	negativeSOAMName       string
+	negativeSOARName       string
 }
 
 type PluginsReturnCode int
@@ -68,9 +73,13 @@ type PluginsGlobals struct {
 type PluginsState struct {
 	requestStart                     time.Time
 	requestEnd                       time.Time
+	deadline                         time.Time
 	clientProto                      string
 	serverName                       string
 	relayName                        string
+	upstreamIP                       string
+	nsidRequested                    bool
+	nsid                             string
 	serverProto                      string
 	qName                            string
 	clientAddr                       *net.Addr
@@ -90,13 +99,29 @@ type PluginsState struct {
 	cacheNegMaxTTL                   uint32
 	cacheNegMinTTL                   uint32
 	cacheMinTTL                      uint32
+	cacheTTLOverrides                map[uint16]CacheTTLClamp
+	serverCacheMaxTTLs               map[string]uint32
 	cacheHit                         bool
 	dnssec                           bool
+	honorCDBit                       bool
+	checkingDisabled                 bool
+	tcpKeepalive                     bool // Set when a TCP client sent the edns-tcp-keepalive option
+	listenerProfile                  *ListenerProfile
+	queryRoute                       *QueryRoute      // Set once a server was picked for a routed name
+	clientBlocklist                  *ClientBlocklist // Replaces the [blocked_names] rules for the client, if set
+	maxQNameLength                   int
+	maxQNameLabels                   int
+	fanoutCtx                        context.Context // Cancelled once another server of a fanout answered, nil otherwise
+	deferLogging                     bool            // Set while the query is sent as part of a fanout
+	loggingDeferred                  bool
 }
 
 func (proxy *Proxy) InitPluginsGlobals() error {
 	queryPlugins := &[]Plugin{}
 
+	if len(proxy.allowedQTypes) != 0 || len(proxy.blockedQTypes) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginQTypeFilter)))
+	}
 	if proxy.captivePortalMap != nil {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCaptivePortal)))
 	}
@@ -106,15 +131,34 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.allowNameFile) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginAllowName)))
 	}
+	if len(proxy.selfName) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginSelfName)))
+	}
+	if len(proxy.localRecords) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginLocalRecords)))
+	}
 
 	*queryPlugins = append(*queryPlugins, Plugin(new(PluginFirefox)))
 
+	if len(proxy.stripClientEDNSOptions) != 0 || len(proxy.forwardClientEDNSOptions) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginStripEDNSOptions)))
+	}
+
 	if len(proxy.ednsClientSubnets) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginECS)))
 	}
+	if proxy.nsid {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginNSID)))
+	}
 	if len(proxy.blockNameFile) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockName)))
 	}
+	if len(proxy.clientBlocklists) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginClientBlocklist)))
+	}
+	if proxy.listenerProfilesBlockNames() {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginListenerProfile)))
+	}
 	if proxy.pluginBlockIPv6 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockIPv6)))
 	}
@@ -128,6 +172,9 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.forwardFile) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginForward)))
 	}
+	if proxy.pluginPrivatePTR {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginPrivatePTR)))
+	}
 	if proxy.pluginBlockUnqualified {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockUnqualified)))
 	}
@@ -142,12 +189,15 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.allowedIPFile) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginAllowedIP)))
 	}
-	if len(proxy.blockNameFile) != 0 {
+	if len(proxy.blockNameFile) != 0 || len(proxy.clientBlocklists) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockNameResponse)))
 	}
 	if len(proxy.blockIPFile) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockIP)))
 	}
+	if proxy.pluginBlockRebinding {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockRebinding)))
+	}
 	if len(proxy.dns64Resolvers) != 0 || len(proxy.dns64Prefixes) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginDNS64)))
 	}
@@ -159,6 +209,12 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.queryLogFile) != 0 {
 		*loggingPlugins = append(*loggingPlugins, Plugin(new(PluginQueryLog)))
 	}
+	if len(proxy.queryLogRemote) != 0 {
+		*loggingPlugins = append(*loggingPlugins, Plugin(new(PluginQueryLogExport)))
+	}
+	if len(proxy.queryEventSocketPath) != 0 {
+		*loggingPlugins = append(*loggingPlugins, Plugin(new(PluginQueryEventSocket)))
+	}
 
 	for _, plugin := range *queryPlugins {
 		if err := plugin.Init(proxy); err != nil {
@@ -181,10 +237,42 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	proxy.pluginsGlobals.loggingPlugins = loggingPlugins
 
 	parseBlockedQueryResponse(proxy.blockedQueryResponse, &proxy.pluginsGlobals)
+	proxy.pluginsGlobals.negativeSOA = proxy.negativeSOA
+	proxy.pluginsGlobals.negativeSOAMName = proxy.negativeSOAMName
+	proxy.pluginsGlobals.negativeSOARName = proxy.negativeSOARName
 
 	return nil
 }
 
+// addNegativeSOA - Adds a SOA record to the authority section of a NXDOMAIN or NODATA response that doesn't have one,
+// so that downstream caches know for how long the response can be cached
+func (pluginsGlobals *PluginsGlobals) addNegativeSOA(msg *dns.Msg, ttl uint32) {
+	if !pluginsGlobals.negativeSOA || len(msg.Question) == 0 {
+		return
+	}
+	if msg.Rcode != dns.RcodeNameError && (msg.Rcode != dns.RcodeSuccess || len(msg.Answer) > 0) {
+		return
+	}
+	for _, rr := range msg.Ns {
+		if dns.RRToType(rr) == dns.TypeSOA {
+			return
+		}
+	}
+	soa := new(dns.SOA)
+	soa.Ns = pluginsGlobals.negativeSOAMName
+	soa.Mbox = pluginsGlobals.negativeSOARName
+	soa.Serial = 1
+	soa.Refresh = 10000
+	soa.Retry = 300
+	soa.Expire = 604800
+	soa.Minttl = ttl
+	soa.Hdr = dns.Header{
+		Name: parentZone(msg.Question[0].Header().Name), Class: dns.ClassINET, TTL: ttl,
+	}
+	// The authority section is copied first, as it can be shared with a cached response
+	msg.Ns = append(slices.Clone(msg.Ns), soa)
+}
+
 // blockedQueryResponse can be 'refused', 'hinfo' or IP responses 'a:IPv4,aaaa:IPv6
 func parseBlockedQueryResponse(blockedResponse string, pluginsGlobals *PluginsGlobals) {
 	blockedResponse = StringStripSpaces(strings.ToLower(blockedResponse))
@@ -249,18 +337,29 @@ func NewPluginsState(
 	serverProto string,
 	start time.Time,
 ) PluginsState {
+	var deadline time.Time
+	if proxy.queryDeadline > 0 {
+		deadline = start.Add(proxy.queryDeadline)
+	}
 	return PluginsState{
+		deadline:                         deadline,
 		action:                           PluginsActionContinue,
 		returnCode:                       PluginsReturnCodePass,
 		maxPayloadSize:                   MaxDNSUDPPacketSize - ResponseOverhead,
 		clientProto:                      clientProto,
 		clientAddr:                       clientAddr,
+		clientBlocklist:                  proxy.clientBlocklist(clientAddr),
 		cacheSize:                        proxy.cacheSize,
 		cacheNegMinTTL:                   proxy.cacheNegMinTTL,
 		cacheNegMaxTTL:                   proxy.cacheNegMaxTTL,
 		cacheMinTTL:                      proxy.cacheMinTTL,
 		cacheMaxTTL:                      proxy.cacheMaxTTL,
+		cacheTTLOverrides:                proxy.cacheTTLOverrides,
+		serverCacheMaxTTLs:               proxy.serverCacheMaxTTLs,
 		rejectTTL:                        proxy.rejectTTL,
+		honorCDBit:                       proxy.honorCDBit,
+		maxQNameLength:                   proxy.maxQNameLength,
+		maxQNameLabels:                   proxy.maxQNameLabels,
 		questionMsg:                      nil,
 		qName:                            "",
 		serverName:                       "-",
@@ -273,6 +372,50 @@ func NewPluginsState(
 	}
 }
 
+// upstreamTimeout caps a timeout so that upstream work doesn't last beyond the query deadline
+func (pluginsState *PluginsState) upstreamTimeout(timeout time.Duration) time.Duration {
+	if pluginsState.deadline.IsZero() {
+		return timeout
+	}
+	return min(timeout, time.Until(pluginsState.deadline))
+}
+
+// setServer records the server, and the relay if any, that a query is sent to
+func (pluginsState *PluginsState) setServer(serverInfo *ServerInfo) {
+	pluginsState.serverName = serverInfo.Name
+	pluginsState.relayName = ""
+	if serverInfo.Relay != nil {
+		pluginsState.relayName = serverInfo.Relay.Name
+	}
+}
+
+// deadlineExceeded returns true if the query deadline has been reached
+func (pluginsState *PluginsState) deadlineExceeded() bool {
+	return !pluginsState.deadline.IsZero() && !time.Now().Before(pluginsState.deadline)
+}
+
+// setUpstreamAddr records the IP address of the upstream server a query was sent to, from a host:port address
+func (pluginsState *PluginsState) setUpstreamAddr(addr string) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		pluginsState.upstreamIP = host
+	}
+}
+
+// qNameWithinLimits checks a normalized query name against max_qname_length and max_qname_labels
+func (pluginsState *PluginsState) qNameWithinLimits(qName string) bool {
+	if pluginsState.maxQNameLength > 0 && len(qName) > pluginsState.maxQNameLength {
+		dlog.Noticef("Refusing query for a name of %d bytes (max: %d)", len(qName), pluginsState.maxQNameLength)
+		return false
+	}
+	if pluginsState.maxQNameLabels > 0 && qName != "." {
+		if labels := strings.Count(qName, ".") + 1; labels > pluginsState.maxQNameLabels {
+			dlog.Noticef("Refusing query for a name with %d labels (max: %d)", labels, pluginsState.maxQNameLabels)
+			return false
+		}
+	}
+	return true
+}
+
 func (pluginsState *PluginsState) ApplyQueryPlugins(
 	pluginsGlobals *PluginsGlobals,
 	packet []byte,
@@ -292,6 +435,24 @@ func (pluginsState *PluginsState) ApplyQueryPlugins(
 	dlog.Debugf("Handling query for [%v]", qName)
 	pluginsState.qName = qName
 	pluginsState.questionMsg = &msg
+	// Plugins can change the payload size of the query sent upstream, but not what the client can receive
+	pluginsState.maxUnencryptedUDPSafePayloadSize = clientUDPPayloadSize(&msg)
+	if !pluginsState.qNameWithinLimits(qName) {
+		synth := EmptyResponseFromMessage(&msg)
+		synth.Rcode = dns.RcodeRefused
+		pluginsState.synthResponse = synth
+		pluginsState.action = PluginsActionReject
+		pluginsState.returnCode = PluginsReturnCodeReject
+		return packet, nil
+	}
+	if pluginsState.honorCDBit {
+		pluginsState.checkingDisabled = msg.CheckingDisabled
+	} else {
+		msg.CheckingDisabled = false
+	}
+	if removeTCPKeepalive(&msg) {
+		pluginsState.tcpKeepalive = pluginsState.clientProto == "tcp"
+	}
 	if len(*pluginsGlobals.queryPlugins) > 0 {
 		pluginsGlobals.RLock()
 		for _, plugin := range *pluginsGlobals.queryPlugins {
@@ -317,6 +478,9 @@ func (pluginsState *PluginsState) ApplyQueryPlugins(
 		}
 		pluginsGlobals.RUnlock()
 	}
+	if pluginsState.synthResponse != nil {
+		pluginsGlobals.addNegativeSOA(pluginsState.synthResponse, pluginsState.rejectTTL)
+	}
 	if err := msg.Pack(); err != nil {
 		return packet, err
 	}
@@ -355,6 +519,7 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(
 	default:
 		pluginsState.returnCode = PluginsReturnCodeResponseError
 	}
+	pluginsState.recordNSID(&msg)
 	removeEDNS0Options(&msg)
 	if len(*pluginsGlobals.responsePlugins) > 0 {
 		pluginsGlobals.RLock()
@@ -381,6 +546,9 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(
 		}
 		pluginsGlobals.RUnlock()
 	}
+	if pluginsState.synthResponse != nil {
+		pluginsGlobals.addNegativeSOA(pluginsState.synthResponse, pluginsState.rejectTTL)
+	}
 	if err := msg.Pack(); err != nil {
 		return packet, err
 	}
@@ -388,6 +556,11 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(
 }
 
 func (pluginsState *PluginsState) ApplyLoggingPlugins(pluginsGlobals *PluginsGlobals) error {
+	if pluginsState.deferLogging {
+		// Only the outcome of the whole fanout is logged
+		pluginsState.loggingDeferred = true
+		return nil
+	}
 	if len(*pluginsGlobals.loggingPlugins) == 0 {
 		return nil
 	}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+func TestApplyQueryPluginsQNameLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		qName      string
+		maxLength  int
+		maxLabels  int
+		wantRefuse bool
+	}{
+		{name: "no limits", qName: "a.b.c.d.example.com.", wantRefuse: false},
+		{name: "within limits", qName: "www.example.com.", maxLength: 15, maxLabels: 3, wantRefuse: false},
+		{name: "too long", qName: "www.example.com.", maxLength: 14, wantRefuse: true},
+		{name: "too many labels", qName: "a.www.example.com.", maxLabels: 3, wantRefuse: true},
+		{name: "root", qName: ".", maxLength: 1, maxLabels: 1, wantRefuse: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := dns.NewMsg(tt.qName, dns.TypeA)
+			if err := query.Pack(); err != nil {
+				t.Fatalf("Pack() error = %v", err)
+			}
+
+			pluginsGlobals := &PluginsGlobals{
+				queryPlugins:    &[]Plugin{},
+				responsePlugins: &[]Plugin{},
+				loggingPlugins:  &[]Plugin{},
+			}
+			pluginsState := &PluginsState{
+				action:         PluginsActionContinue,
+				maxQNameLength: tt.maxLength,
+				maxQNameLabels: tt.maxLabels,
+				sessionData:    make(map[string]any),
+			}
+
+			if _, err := pluginsState.ApplyQueryPlugins(pluginsGlobals, query.Data, nil); err != nil {
+				t.Fatalf("ApplyQueryPlugins() error = %v", err)
+			}
+			refused := pluginsState.action == PluginsActionReject
+			if refused != tt.wantRefuse {
+				t.Fatalf("refused = %v, want %v", refused, tt.wantRefuse)
+			}
+			if !refused {
+				return
+			}
+			if pluginsState.synthResponse == nil || pluginsState.synthResponse.Rcode != dns.RcodeRefused {
+				t.Errorf("expected a REFUSED response, got %v", pluginsState.synthResponse)
+			}
+			if pluginsState.returnCode != PluginsReturnCodeReject {
+				t.Errorf("returnCode = %v, want PluginsReturnCodeReject", pluginsState.returnCode)
+			}
+		})
+	}
+}
+
+func TestNegativeResponseSOA(t *testing.T) {
+	pluginsGlobals := &PluginsGlobals{
+		queryPlugins:     &[]Plugin{new(PluginBlockUnqualified)},
+		responsePlugins:  &[]Plugin{},
+		loggingPlugins:   &[]Plugin{},
+		negativeSOA:      true,
+		negativeSOAMName: "ns.example.net.",
+		negativeSOARName: "hostmaster.example.net.",
+	}
+	checkSOA := func(t *testing.T, msg *dns.Msg, wantZone string, wantTTL uint32) {
+		t.Helper()
+		if len(msg.Ns) != 1 {
+			t.Fatalf("authority section = %v, want a single SOA", msg.Ns)
+		}
+		soa, ok := msg.Ns[0].(*dns.SOA)
+		if !ok {
+			t.Fatalf("authority section = %v, want a SOA", msg.Ns)
+		}
+		if soa.Hdr.Name != wantZone || soa.Ns != "ns.example.net." || soa.Mbox != "hostmaster.example.net." {
+			t.Errorf("SOA = %v, want zone %s with the configured names", soa, wantZone)
+		}
+		if soa.Hdr.TTL != wantTTL || soa.Minttl != wantTTL {
+			t.Errorf("SOA TTL = %d, minimum = %d, want %d", soa.Hdr.TTL, soa.Minttl, wantTTL)
+		}
+	}
+
+	t.Run("NXDOMAIN", func(t *testing.T) {
+		query := dns.NewMsg("unqualified.", dns.TypeA)
+		if err := query.Pack(); err != nil {
+			t.Fatal(err)
+		}
+		pluginsState := &PluginsState{
+			action:      PluginsActionContinue,
+			rejectTTL:   600,
+			sessionData: make(map[string]any),
+		}
+		if _, err := pluginsState.ApplyQueryPlugins(pluginsGlobals, query.Data, nil); err != nil {
+			t.Fatal(err)
+		}
+		if pluginsState.synthResponse == nil || pluginsState.synthResponse.Rcode != dns.RcodeNameError {
+			t.Fatalf("expected a NXDOMAIN response, got %v", pluginsState.synthResponse)
+		}
+		checkSOA(t, pluginsState.synthResponse, ".", 600)
+	})
+
+	t.Run("NODATA", func(t *testing.T) {
+		response := EmptyResponseFromMessage(dns.NewMsg("www.example.com.", dns.TypeMX))
+		pluginsGlobals.addNegativeSOA(response, 120)
+		checkSOA(t, response, "example.com.", 120)
+		pluginsGlobals.addNegativeSOA(response, 60)
+		checkSOA(t, response, "example.com.", 120)
+	})
+
+	t.Run("positive answer", func(t *testing.T) {
+		response := EmptyResponseFromMessage(dns.NewMsg("www.example.com.", dns.TypeA))
+		rr := new(dns.A)
+		rr.Hdr = dns.Header{Name: "www.example.com.", Class: dns.ClassINET, TTL: 60}
+		rr.A = rdata.A{Addr: netip.MustParseAddr("192.0.2.1")}
+		response.Answer = []dns.RR{rr}
+		pluginsGlobals.addNegativeSOA(response, 120)
+		if len(response.Ns) != 0 {
+			t.Errorf("positive answers should not get a SOA, got %v", response.Ns)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		response := EmptyResponseFromMessage(dns.NewMsg("www.example.com.", dns.TypeMX))
+		(&PluginsGlobals{}).addNegativeSOA(response, 120)
+		if len(response.Ns) != 0 {
+			t.Errorf("no SOA should be added when negative_soa is disabled, got %v", response.Ns)
+		}
+	})
+}
@@ -4,7 +4,10 @@
 	"context"
 	crypto_rand "crypto/rand"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"runtime"
 	"strings"
@@ -28,15 +31,30 @@ type Proxy struct {
 	dns64Prefixes                 []string
 	serversBlockingFragments      []string
 	ednsClientSubnets             []*net.IPNet
+	ednsClientSubnetMode          string
+	stripClientEDNSOptions        []uint16
+	forwardClientEDNSOptions      []uint16
 	queryLogIgnoredQtypes         []string
+	queryLogSampleRate            uint64
+	queryLogNotableOnly           bool
+	queryLogUpstreamIP            bool
 	localDoHListeners             []*net.TCPListener
 	queryMeta                     []string
 	enableHotReload               bool
 	udpListeners                  []*net.UDPConn
 	sources                       []*Source
+	disabledSources               []string
 	tcpListeners                  []*net.TCPListener
 	registeredRelays              []RegisteredServer
 	listenAddresses               []string
+	listenReuseAddr               bool
+	listenReusePort               bool
+	listenUDPRcvBuf               int
+	listenUDPSndBuf               int
+	tcpClientKeepalive            time.Duration
+	listenerProfiles              map[netip.AddrPort]*ListenerProfile
+	clientBlocklists              []*ClientBlocklist
+	queryRoutes                   []QueryRoute
 	localDoHListenAddresses       []string
 	monitoringUI                  MonitoringUIConfig
 	monitoringInstance            *MonitoringUI
@@ -58,6 +76,7 @@ type Proxy struct {
 	allowedIPLogFile              string
 	queryLogFormat                string
 	blockIPFile                   string
+	blockIPMode                   string
 	allowNameFile                 string
 	allowNameFormat               string
 	allowNameLogFile              string
@@ -65,18 +84,32 @@ type Proxy struct {
 	blockNameFormat               string
 	blockNameFile                 string
 	queryLogFile                  string
+	queryEventSocketPath          string
+	queryEventSocket              *QueryEventSocket
+	queryLogRemote                string
+	queryLogRemoteBatchSize       int
+	queryLogRemoteFlushInterval   time.Duration
+	queryLogExporter              *QueryLogExporter
 	blockedQueryResponse          string
+	negativeSOA                   bool
+	negativeSOAMName              string
+	negativeSOARName              string
+	allowedQTypes                 map[uint16]struct{}
+	blockedQTypes                 map[uint16]struct{}
 	userName                      string
 	nxLogFile                     string
 	proxySecretKey                [32]byte
 	proxyPublicKey                [32]byte
 	ServerNames                   []string
 	DisabledServerNames           []string
+	FallbackServerNames           []string
+	emergencyResolver             *stamps.ServerStamp
 	requiredProps                 stamps.ServerInformalProperties
 	certRefreshDelayAfterFailure  time.Duration
 	timeout                       time.Duration
 	certRefreshDelay              time.Duration
 	certRefreshConcurrency        int
+	certRefreshMaxFailures        int
 	cacheSize                     int
 	logMaxBackups                 int
 	logMaxAge                     int
@@ -87,19 +120,68 @@ type Proxy struct {
 	clientsCount                  uint32
 	maxClients                    uint32
 	timeoutLoadReduction          float64
+	certTimestampTolerance        time.Duration
+	certTimestampGrace            bool
+	clockSynchronized             atomic.Bool
+	clockSyncMinTime              time.Time
+	clockSyncTimeout              time.Duration
+	cachePrefetchThreshold        time.Duration
+	cachePrefetchRatio            float64
+	cacheSlowUpstreamRTT          time.Duration
+	cacheSlowUpstreamMaxStale     time.Duration
+	rotateAnswers                 bool
+	answersRotation               atomic.Uint32
+	cacheTTLOverrides             map[uint16]CacheTTLClamp
+	serverSettings                map[string]ServerSettingsConfig
+	serverProxies                 map[string]HostProxy
+	serverCacheMaxTTLs            map[string]uint32
+	serverAcceptHeaders           map[string]string
+	serverURITemplates            map[string]*DoHURITemplate
+	fanout                        int
+	fanoutRequireNoLog            bool
+	quorumServers                 int
+	quorumMinAgree                int
+	quorumNames                   []string
+	crossCheckDomains             []string
+	crossCheckAction              string
+	ipOriginDatabases             *IPOriginDatabases
+	ipOriginAction                string
+	queryDeadline                 time.Duration
+	onMalformedResponse           string
+	dnscryptTruncatedResponse     string
+	onQuestionMismatch            string
+	onCaseMismatch                string
 	cacheMinTTL                   uint32
 	cacheNegMaxTTL                uint32
 	cloakTTL                      uint32
+	selfName                      string
+	localRecords                  []string
 	cloakedPTR                    bool
+	cloakCNAME                    bool
+	maxQNameLength                int
+	maxQNameLabels                int
 	cache                         bool
 	pluginBlockIPv6               bool
+	nsid                          bool
 	ephemeralKeys                 bool
 	pluginBlockUnqualified        bool
 	showCerts                     bool
+	compareJSON                   bool
+	compareQuery                  string
+	netprobeQuery                 string
+	netprobeFailureAction         string
 	certIgnoreTimestamp           bool
 	skipAnonIncompatibleResolvers bool
 	anonDirectCertFallback        bool
+	relaysWithoutBodyHash         []string
 	pluginBlockUndelegated        bool
+	pluginPrivatePTR              bool
+	privatePTRName                string
+	pluginBlockRebinding          bool
+	rebindingAction               string
+	rebindingAllowedNames         []string
+	rebindingRanges               []string
+	honorCDBit                    bool
 	child                         bool
 	SourceIPv4                    bool
 	SourceIPv6                    bool
@@ -107,8 +189,14 @@ type Proxy struct {
 	SourceDoH                     bool
 	SourceODoH                    bool
 	listenersMu                   sync.Mutex
+	acceptingUDPListeners         []*net.UDPConn
+	acceptingTCPListeners         []*net.TCPListener
+	idleTCPConns                  map[net.Conn]struct{}
+	shuttingDown                  atomic.Bool
+	shutdownGracePeriod           time.Duration
 	ipCryptConfig                 *IPCryptConfig
 	udpConnPool                   *UDPConnPool
+	tcpConnPool                   *TCPConnPool
 }
 
 func (proxy *Proxy) registerUDPListener(conn *net.UDPConn) {
@@ -129,6 +217,27 @@ func (proxy *Proxy) registerLocalDoHListener(listener *net.TCPListener) {
 	proxy.listenersMu.Unlock()
 }
 
+// tcpConnIdle - Registers a client connection waiting for another query, unless the proxy is shutting down
+func (proxy *Proxy) tcpConnIdle(conn net.Conn) bool {
+	proxy.listenersMu.Lock()
+	defer proxy.listenersMu.Unlock()
+	if proxy.isShuttingDown() {
+		return false
+	}
+	if proxy.idleTCPConns == nil {
+		proxy.idleTCPConns = make(map[net.Conn]struct{})
+	}
+	proxy.idleTCPConns[conn] = struct{}{}
+	return true
+}
+
+// tcpConnBusy - Unregisters a client connection that is no longer waiting for a query
+func (proxy *Proxy) tcpConnBusy(conn net.Conn) {
+	proxy.listenersMu.Lock()
+	delete(proxy.idleTCPConns, conn)
+	proxy.listenersMu.Unlock()
+}
+
 func (proxy *Proxy) addDNSListener(listenAddrStr string) {
 	udp := "udp"
 	tcp := "tcp"
@@ -266,6 +375,13 @@ func (proxy *Proxy) StartProxy() {
 	}
 	curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
 
+	if len(proxy.compareQuery) > 0 {
+		if err := proxy.compareServers(proxy.compareQuery, proxy.compareJSON); err != nil {
+			dlog.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	// Initialize and start the monitoring UI if enabled
 	if proxy.monitoringUI.Enabled {
 		dlog.Noticef("Initializing monitoring UI")
@@ -294,6 +410,7 @@ func (proxy *Proxy) StartProxy() {
 	}
 	proxy.xTransport.internalResolverReady = false
 	proxy.xTransport.internalResolvers = proxy.listenAddresses
+	proxy.waitForClockSync()
 	liveServers, err := proxy.serversInfo.refresh(proxy)
 	if liveServers > 0 {
 		proxy.certIgnoreTimestamp = false
@@ -320,11 +437,11 @@ func (proxy *Proxy) StartProxy() {
 			runtime.GC()
 		}
 	}()
-	if len(proxy.serversInfo.registeredServers) > 0 {
+	if len(proxy.serversInfo.registeredServers) > 0 || proxy.emergencyResolver != nil {
 		go func() {
 			for {
 				delay := proxy.certRefreshDelay
-				if liveServers == 0 {
+				if liveServers == 0 || proxy.inClockSyncGrace(time.Now()) {
 					delay = proxy.certRefreshDelayAfterFailure
 				}
 				clocksmith.Sleep(delay)
@@ -332,6 +449,9 @@ func (proxy *Proxy) StartProxy() {
 				if liveServers > 0 {
 					proxy.certIgnoreTimestamp = false
 				}
+				if err := proxy.serversInfo.saveLBState(); err != nil {
+					dlog.Warnf("Unable to save the load balancing state: %v", err)
+				}
 				runtime.GC()
 			}
 		}()
@@ -340,6 +460,10 @@ func (proxy *Proxy) StartProxy() {
 
 func (proxy *Proxy) updateRegisteredServers() error {
 	for _, source := range proxy.sources {
+		if source.isEmpty() {
+			// The source couldn't be retrieved yet, and will be retried by the prefetcher
+			continue
+		}
 		registeredServers, err := source.Parse()
 		if err != nil {
 			if len(registeredServers) == 0 {
@@ -355,7 +479,9 @@ func (proxy *Proxy) updateRegisteredServers() error {
 		}
 		for _, registeredServer := range registeredServers {
 			if registeredServer.stamp.Proto != stamps.StampProtoTypeDNSCryptRelay &&
-				registeredServer.stamp.Proto != stamps.StampProtoTypeODoHRelay {
+				registeredServer.stamp.Proto != stamps.StampProtoTypeODoHRelay &&
+				!includesName(proxy.FallbackServerNames, registeredServer.name) &&
+				!proxy.isRouteOnlyServer(registeredServer.name) {
 				if len(proxy.ServerNames) > 0 {
 					if !includesName(proxy.ServerNames, registeredServer.name) {
 						continue
@@ -435,11 +561,14 @@ func (proxy *Proxy) updateRegisteredServers() error {
 }
 
 func (proxy *Proxy) udpListener(clientPc *net.UDPConn) {
-	defer clientPc.Close()
 	for {
 		buffer := make([]byte, MaxDNSPacketSize-1)
 		length, clientAddr, err := clientPc.ReadFrom(buffer)
 		if err != nil {
+			// When shutting down, the socket is closed after responses to in-flight queries have been sent
+			if !proxy.isShuttingDown() {
+				clientPc.Close()
+			}
 			return
 		}
 		packet := buffer[:length]
@@ -469,6 +598,9 @@ func (proxy *Proxy) tcpListener(acceptPc *net.TCPListener) {
 	for {
 		clientPc, err := acceptPc.Accept()
 		if err != nil {
+			if proxy.isShuttingDown() {
+				return
+			}
 			continue
 		}
 		if !proxy.clientsCountInc() {
@@ -484,13 +616,27 @@ func (proxy *Proxy) tcpListener(acceptPc *net.TCPListener) {
 			if err := clientPc.SetDeadline(time.Now().Add(dynamicTimeout)); err != nil {
 				return
 			}
-			start := time.Now()
-			packet, err := ReadPrefixed(&clientPc)
-			if err != nil {
-				return
+			for {
+				start := time.Now()
+				packet, err := ReadPrefixed(&clientPc)
+				proxy.tcpConnBusy(clientPc)
+				if err != nil {
+					return
+				}
+				clientAddr := clientPc.RemoteAddr()
+				proxy.processIncomingQuery("tcp", "tcp", packet, &clientAddr, clientPc, start, false)
+				if proxy.tcpClientKeepalive <= 0 || proxy.isShuttingDown() {
+					return
+				}
+				// Keep the connection open for another query, for the advertised keepalive timeout
+				idleTimeout := proxy.tcpClientKeepalive + proxy.getDynamicTimeout()
+				if err := clientPc.SetDeadline(time.Now().Add(idleTimeout)); err != nil {
+					return
+				}
+				if !proxy.tcpConnIdle(clientPc) {
+					return
+				}
 			}
-			clientAddr := clientPc.RemoteAddr()
-			proxy.processIncomingQuery("tcp", "tcp", packet, &clientAddr, clientPc, start, false)
 		}()
 	}
 }
@@ -512,9 +658,30 @@ func (proxy *Proxy) udpListenerFromAddr(listenAddr *net.UDPAddr) error {
 	}
 	proxy.registerUDPListener(clientPc.(*net.UDPConn))
 	dlog.Noticef("Now listening to %v [UDP]", listenAddr)
+	proxy.logUDPBufferSizes(clientPc.(*net.UDPConn))
 	return nil
 }
 
+// logUDPBufferSizes - Logs the buffer sizes of a UDP listener if they were configured, as the system may clamp them
+func (proxy *Proxy) logUDPBufferSizes(conn *net.UDPConn) {
+	if proxy.listenUDPRcvBuf <= 0 && proxy.listenUDPSndBuf <= 0 {
+		return
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	rcvBuf, sndBuf, err := socketBufferSizes(rawConn)
+	if err != nil {
+		dlog.Warnf("Unable to check the buffer sizes of %v: %v", conn.LocalAddr(), err)
+		return
+	}
+	dlog.Noticef("UDP buffer sizes for %v: receive %d bytes, send %d bytes", conn.LocalAddr(), rcvBuf, sndBuf)
+	if rcvBuf < proxy.listenUDPRcvBuf || sndBuf < proxy.listenUDPSndBuf {
+		dlog.Warnf("The system limited the buffer sizes of %v, below the configured sizes", conn.LocalAddr())
+	}
+}
+
 func (proxy *Proxy) tcpListenerFromAddr(listenAddr *net.TCPAddr) error {
 	listenConfig, err := proxy.tcpListenerConfig()
 	if err != nil {
@@ -556,17 +723,22 @@ func (proxy *Proxy) localDoHListenerFromAddr(listenAddr *net.TCPAddr) error {
 }
 
 func (proxy *Proxy) startAcceptingClients() {
+	proxy.listenersMu.Lock()
+	defer proxy.listenersMu.Unlock()
 	for _, clientPc := range proxy.udpListeners {
 		go proxy.udpListener(clientPc)
 	}
+	proxy.acceptingUDPListeners = append(proxy.acceptingUDPListeners, proxy.udpListeners...)
 	proxy.udpListeners = nil
 	for _, acceptPc := range proxy.tcpListeners {
 		go proxy.tcpListener(acceptPc)
 	}
+	proxy.acceptingTCPListeners = append(proxy.acceptingTCPListeners, proxy.tcpListeners...)
 	proxy.tcpListeners = nil
 	for _, acceptPc := range proxy.localDoHListeners {
 		go proxy.localDoHListener(acceptPc)
 	}
+	proxy.acceptingTCPListeners = append(proxy.acceptingTCPListeners, proxy.localDoHListeners...)
 	proxy.localDoHListeners = nil
 }
 
@@ -580,20 +752,29 @@ func (proxy *Proxy) prepareForRelay(ip net.IP, port int, encryptedQuery *[]byte)
 	*encryptedQuery = relayedQuery
 }
 
+// interruptOnDone - Makes pending reads and writes on a connection fail as soon as ctx is done, so that a query
+// that is part of a fanout stops waiting once another server answered. The returned function must be called
+// before the connection is reused, and returns false if the connection was interrupted.
+func interruptOnDone(ctx context.Context, conn net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+}
+
 func (proxy *Proxy) exchangeWithUDPServer(
+	ctx context.Context,
 	serverInfo *ServerInfo,
 	sharedKey *[32]byte,
 	encryptedQuery []byte,
 	clientNonce []byte,
+	timeout time.Duration,
 ) ([]byte, error) {
 	upstreamAddr := serverInfo.UDPAddr
 	if serverInfo.Relay != nil && serverInfo.Relay.Dnscrypt != nil {
 		upstreamAddr = serverInfo.Relay.Dnscrypt.RelayUDPAddr
 	}
 
-	proxyDialer := proxy.xTransport.proxyDialer
+	proxyDialer := proxy.xTransport.proxyDialerFor(serverInfo.UDPAddr.IP.String())
 	if proxyDialer != nil {
-		return proxy.exchangeWithUDPServerViaProxy(serverInfo, sharedKey, encryptedQuery, clientNonce, upstreamAddr, proxyDialer)
+		return proxy.exchangeWithUDPServerViaProxy(ctx, serverInfo, sharedKey, encryptedQuery, clientNonce, upstreamAddr, proxyDialer, timeout)
 	}
 
 	pc, err := proxy.udpConnPool.Get(upstreamAddr)
@@ -601,7 +782,7 @@ func (proxy *Proxy) exchangeWithUDPServer(
 		return nil, err
 	}
 
-	if err := pc.SetDeadline(time.Now().Add(serverInfo.Timeout)); err != nil {
+	if err := pc.SetDeadline(time.Now().Add(timeout)); err != nil {
 		proxy.udpConnPool.Discard(pc)
 		return nil, err
 	}
@@ -613,10 +794,11 @@ func (proxy *Proxy) exchangeWithUDPServer(
 
 	encryptedResponse := make([]byte, MaxDNSPacketSize)
 	var readErr error
-	for tries := 2; tries > 0; tries-- {
+	stop := interruptOnDone(ctx, pc)
+	for tries := 2; tries > 0 && ctx.Err() == nil; tries-- {
 		if _, err := pc.Write(query); err != nil {
-			proxy.udpConnPool.Discard(pc)
-			return nil, err
+			readErr = err
+			break
 		}
 		length, err := pc.Read(encryptedResponse)
 		if err == nil {
@@ -628,23 +810,28 @@ func (proxy *Proxy) exchangeWithUDPServer(
 		dlog.Debugf("[%v] Retry on timeout", serverInfo.Name)
 	}
 
-	if readErr != nil {
+	if interrupted := !stop(); interrupted || readErr != nil {
 		proxy.udpConnPool.Discard(pc)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, readErr
 	}
 
 	proxy.udpConnPool.Put(upstreamAddr, pc)
 
-	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+	return proxy.decryptUDPResponse(serverInfo, sharedKey, encryptedResponse, clientNonce)
 }
 
 func (proxy *Proxy) exchangeWithUDPServerViaProxy(
+	ctx context.Context,
 	serverInfo *ServerInfo,
 	sharedKey *[32]byte,
 	encryptedQuery []byte,
 	clientNonce []byte,
 	upstreamAddr *net.UDPAddr,
 	proxyDialer *netproxy.Dialer,
+	timeout time.Duration,
 ) ([]byte, error) {
 	pc, err := (*proxyDialer).Dial("udp", upstreamAddr.String())
 	if err != nil {
@@ -652,12 +839,13 @@ func (proxy *Proxy) exchangeWithUDPServerViaProxy(
 	}
 	defer pc.Close()
 
-	if err := pc.SetDeadline(time.Now().Add(serverInfo.Timeout)); err != nil {
+	if err := pc.SetDeadline(time.Now().Add(timeout)); err != nil {
 		return nil, err
 	}
 	if serverInfo.Relay != nil && serverInfo.Relay.Dnscrypt != nil {
 		proxy.prepareForRelay(serverInfo.UDPAddr.IP, serverInfo.UDPAddr.Port, &encryptedQuery)
 	}
+	defer interruptOnDone(ctx, pc)()
 	encryptedResponse := make([]byte, MaxDNSPacketSize)
 	for tries := 2; tries > 0; tries-- {
 		if _, err := pc.Write(encryptedQuery); err != nil {
@@ -668,54 +856,123 @@ func (proxy *Proxy) exchangeWithUDPServerViaProxy(
 			encryptedResponse = encryptedResponse[:length]
 			break
 		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		dlog.Debugf("[%v] Retry on timeout", serverInfo.Name)
 	}
-	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+	return proxy.decryptUDPResponse(serverInfo, sharedKey, encryptedResponse, clientNonce)
+}
+
+// decryptUDPResponse - Decrypts a response received over UDP. Responses that were cut short by a middlebox or by a relay
+// cannot be decrypted, and are reported as ErrUndecryptableUDPResponse so that the query can be retried over TCP.
+func (proxy *Proxy) decryptUDPResponse(
+	serverInfo *ServerInfo,
+	sharedKey *[32]byte,
+	encryptedResponse []byte,
+	clientNonce []byte,
+) ([]byte, error) {
+	response, err := proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+	if err != nil {
+		return nil, fmt.Errorf("%w (%d bytes): %v", ErrUndecryptableUDPResponse, len(encryptedResponse), err)
+	}
+	return response, nil
 }
 
 func (proxy *Proxy) exchangeWithTCPServer(
+	ctx context.Context,
 	serverInfo *ServerInfo,
 	sharedKey *[32]byte,
 	encryptedQuery []byte,
 	clientNonce []byte,
+	timeout time.Duration,
 ) ([]byte, error) {
 	upstreamAddr := serverInfo.TCPAddr
 	if serverInfo.Relay != nil && serverInfo.Relay.Dnscrypt != nil {
 		upstreamAddr = serverInfo.Relay.Dnscrypt.RelayTCPAddr
 	}
-	var err error
+	upstreamAddrStr := upstreamAddr.String()
+	deadline := time.Now().Add(timeout)
+	if serverInfo.Relay != nil && serverInfo.Relay.Dnscrypt != nil {
+		proxy.prepareForRelay(serverInfo.TCPAddr.IP, serverInfo.TCPAddr.Port, &encryptedQuery)
+	}
+	encryptedQuery, err := PrefixWithSize(encryptedQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connections to a relay are not pooled, since the pool doesn't know which server they are relayed to
+	pool := proxy.tcpConnPool
+	if serverInfo.Relay != nil {
+		pool = nil
+	}
+
+	// Try an idle connection first; the server may have closed it in the meantime
+	if pool != nil {
+		if pc := pool.Get(upstreamAddrStr); pc != nil {
+			stop := interruptOnDone(ctx, pc)
+			encryptedResponse, err := exchangeOverTCPConn(pc, encryptedQuery, deadline)
+			if stop() && err == nil {
+				pool.Put(upstreamAddrStr, pc)
+				return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+			}
+			pc.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			dlog.Debugf("Pooled TCP connection to [%s] failed, using a new connection: %v", upstreamAddrStr, err)
+		}
+	}
+
 	var pc net.Conn
-	proxyDialer := proxy.xTransport.proxyDialer
+	proxyDialer := proxy.xTransport.proxyDialerFor(serverInfo.TCPAddr.IP.String())
 	if proxyDialer == nil {
-		pc, err = net.DialTimeout("tcp", upstreamAddr.String(), serverInfo.Timeout)
+		dialer := &net.Dialer{Timeout: time.Until(deadline)}
+		pc, err = dialer.DialContext(ctx, "tcp", upstreamAddrStr)
+		if err == nil {
+			setTCPNoDelay(pc, proxy.xTransport.tcpNoDelay)
+		}
 	} else {
-		pc, err = (*proxyDialer).Dial("tcp", upstreamAddr.String())
+		pc, err = (*proxyDialer).Dial("tcp", upstreamAddrStr)
 	}
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
-	defer pc.Close()
-	if err := pc.SetDeadline(time.Now().Add(serverInfo.Timeout)); err != nil {
+	stop := interruptOnDone(ctx, pc)
+	encryptedResponse, err := exchangeOverTCPConn(pc, encryptedQuery, deadline)
+	if interrupted := !stop(); interrupted || err != nil {
+		pc.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
-	if serverInfo.Relay != nil && serverInfo.Relay.Dnscrypt != nil {
-		proxy.prepareForRelay(serverInfo.TCPAddr.IP, serverInfo.TCPAddr.Port, &encryptedQuery)
-	}
-	encryptedQuery, err = PrefixWithSize(encryptedQuery)
-	if err != nil {
-		return nil, err
+	if pool != nil {
+		pool.Put(upstreamAddrStr, pc)
+	} else {
+		pc.Close()
 	}
-	if _, err := pc.Write(encryptedQuery); err != nil {
+	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+}
+
+// exchangeOverTCPConn sends a size-prefixed query and reads the size-prefixed response
+func exchangeOverTCPConn(pc net.Conn, prefixedQuery []byte, deadline time.Time) ([]byte, error) {
+	if err := pc.SetDeadline(deadline); err != nil {
 		return nil, err
 	}
-	encryptedResponse, err := ReadPrefixed(&pc)
-	if err != nil {
+	if _, err := pc.Write(prefixedQuery); err != nil {
 		return nil, err
 	}
-	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+	return ReadPrefixed(&pc)
 }
 
 func (proxy *Proxy) clientsCountInc() bool {
+	if proxy.isShuttingDown() {
+		return false
+	}
 	for {
 		count := atomic.LoadUint32(&proxy.clientsCount)
 		if count >= proxy.maxClients {
@@ -788,6 +1045,7 @@ func (proxy *Proxy) processIncomingQuery(
 
 	// Initialize plugin state
 	pluginsState := NewPluginsState(proxy, clientProto, clientAddr, serverProto, start)
+	pluginsState.listenerProfile = proxy.listenerProfile(clientPc)
 
 	var serverInfo *ServerInfo
 	var serverName string = "-"
@@ -799,7 +1057,7 @@ func (proxy *Proxy) processIncomingQuery(
 		func() (*ServerInfo, bool) {
 			// Only get server info once when actually needed
 			if serverInfo == nil {
-				serverInfo = proxy.serversInfo.getOne()
+				serverInfo = proxy.serverFor(&pluginsState)
 				if serverInfo != nil {
 					serverName = serverInfo.Name
 				}
@@ -850,7 +1108,7 @@ func() (*ServerInfo, bool) {
 	// Note: if serverInfo is still nil here, we need to get it
 	if len(response) == 0 {
 		if serverInfo == nil {
-			serverInfo = proxy.serversInfo.getOne()
+			serverInfo = proxy.serverFor(&pluginsState)
 			if serverInfo != nil {
 				serverName = serverInfo.Name
 			}
@@ -861,25 +1119,81 @@ func() (*ServerInfo, bool) {
 				pluginsState.relayName = serverInfo.Relay.Name
 			}
 
-			exchangeResponse, err := handleDNSExchange(proxy, serverInfo, &pluginsState, query, serverProto)
+			// Queries restricted to some servers by a route or a listener profile are not sent to other servers at the same time
+			var exchangeResponse []byte
+			multiServer := !pluginsState.restrictsServers()
+			if multiServer && proxy.quorumServers > 1 && proxy.requiresQuorum(pluginsState.qName) {
+				serverInfo, exchangeResponse, err = proxy.quorumExchange(serverInfo, &pluginsState, query, serverProto)
+				serverName = serverInfo.Name
+			} else if multiServer && inZones(pluginsState.qName, proxy.crossCheckDomains) {
+				serverInfo, exchangeResponse, err = proxy.crossCheckExchange(serverInfo, &pluginsState, query, serverProto)
+				serverName = serverInfo.Name
+			} else if multiServer && proxy.fanout > 1 {
+				serverInfo, exchangeResponse, err = proxy.fanoutExchange(serverInfo, &pluginsState, query, serverProto)
+				serverName = serverInfo.Name
+			} else {
+				exchangeResponse, err = handleDNSExchange(proxy, serverInfo, &pluginsState, query, serverProto)
+			}
+
+			// Retry with another server if the response couldn't be parsed or was for another question
+			if (errors.Is(err, ErrMalformedResponse) && proxy.onMalformedResponse == OnMalformedResponseRetry) ||
+				(errors.Is(err, ErrQuestionMismatch) && proxy.onQuestionMismatch == OnQuestionMismatchRetry) {
+				if otherServerInfo := proxy.serversInfo.getOther(serverInfo); otherServerInfo != nil && pluginsState.allowsServer(otherServerInfo) {
+					dlog.Infof("Retrying the query with [%v]", otherServerInfo.Name)
+					proxy.serversInfo.updateServerStats(serverName, false)
+					serverInfo, serverName = otherServerInfo, otherServerInfo.Name
+					pluginsState.serverName = serverName
+					pluginsState.relayName = ""
+					if serverInfo.Relay != nil {
+						pluginsState.relayName = serverInfo.Relay.Name
+					}
+					exchangeResponse, err = handleDNSExchange(proxy, serverInfo, &pluginsState, query, serverProto)
+				}
+			}
 
 			// Update server statistics for WP2 strategy
 			success := (err == nil && exchangeResponse != nil)
 			proxy.serversInfo.updateServerStats(serverName, success)
 
-			if err != nil || exchangeResponse == nil {
+			if errors.Is(err, ErrMalformedResponse) && proxy.onMalformedResponse == OnMalformedResponseDrop {
+				pluginsState.returnCode = PluginsReturnCodeParseError
+				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
 				return response
 			}
+			if errors.Is(err, ErrMalformedResponse) || errors.Is(err, ErrQuestionMismatch) ||
+				errors.Is(err, ErrQuorumNotReached) || errors.Is(err, ErrCrossCheckMismatch) {
+				// Answer with SERVFAIL rather than leaving the client without a response
+				reason := "Malformed response from the upstream server"
+				if errors.Is(err, ErrQuestionMismatch) {
+					reason = "Response from the upstream server doesn't match the question"
+				} else if errors.Is(err, ErrQuorumNotReached) || errors.Is(err, ErrCrossCheckMismatch) {
+					reason = err.Error()
+				}
+				response = malformedResponseServFail(&pluginsState, reason)
+				pluginsState.returnCode = PluginsReturnCodeServFail
+				serverInfo = nil
+			} else {
+				if err != nil && pluginsState.deadlineExceeded() {
+					// The failure was already logged; the client still gets an answer before it retransmits
+					response = deadlineExceededServFail(&pluginsState)
+					sendResponse(proxy, &pluginsState, response, clientProto, clientAddr, clientPc)
+					return response
+				}
+				if err != nil || exchangeResponse == nil {
+					return response
+				}
 
-			response = exchangeResponse
+				response = exchangeResponse
+				proxy.serversInfo.updateServerRcodeStats(serverName, Rcode(response))
 
-			// Process the response through plugins
-			processedResponse, err := processPlugins(proxy, &pluginsState, query, serverInfo, response)
-			if err != nil {
-				return response
-			}
+				// Process the response through plugins
+				processedResponse, err := processPlugins(proxy, &pluginsState, query, serverInfo, response)
+				if err != nil {
+					return response
+				}
 
-			response = processedResponse
+				response = processedResponse
+			}
 		}
 	}
 
@@ -897,6 +1211,11 @@ func() (*ServerInfo, bool) {
 		return response
 	}
 
+	// Responses are rotated here, so that cached and fresh responses get the same treatment
+	if proxy.rotateAnswers {
+		response = rotateAnswers(response, proxy.answersRotation.Add(1))
+	}
+
 	// Send the response back to the client
 	sendResponse(proxy, &pluginsState, response, clientProto, clientAddr, clientPc)
 
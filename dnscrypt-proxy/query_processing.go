@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"math"
 	"math/rand"
 	"net"
+	"slices"
+	"strings"
 	"time"
 
 	"codeberg.org/miekg/dns"
@@ -11,6 +16,38 @@
 	stamps "github.com/jedisct1/go-dnsstamps"
 )
 
+const (
+	OnMalformedResponseDrop     = "drop"
+	OnMalformedResponseServFail = "servfail"
+	OnMalformedResponseRetry    = "retry"
+)
+
+const (
+	DNSCryptTruncatedResponseTCP    = "tcp"
+	DNSCryptTruncatedResponseClient = "client"
+)
+
+const (
+	OnQuestionMismatchServFail = "servfail"
+	OnQuestionMismatchRetry    = "retry"
+	OnQuestionMismatchIgnore   = "ignore"
+)
+
+const (
+	OnCaseMismatchNormalize = "normalize"
+	OnCaseMismatchAccept    = "accept"
+	OnCaseMismatchReject    = "reject"
+)
+
+// ErrMalformedResponse - An upstream server returned a response that couldn't be parsed
+var ErrMalformedResponse = errors.New("Malformed response")
+
+// ErrUndecryptableUDPResponse - A DNSCrypt server returned a UDP response that couldn't be decrypted, possibly because it was truncated
+var ErrUndecryptableUDPResponse = errors.New("Undecryptable UDP response")
+
+// ErrQuestionMismatch - An upstream server returned a response to a different question than the one that was sent
+var ErrQuestionMismatch = errors.New("Response question mismatch")
+
 // validateQuery - Performs basic validation on the incoming query
 func validateQuery(query []byte) bool {
 	if len(query) < MinDNSPacketSize {
@@ -39,6 +76,9 @@ func processDNSCryptQuery(
 	query []byte,
 	serverProto string,
 ) ([]byte, error) {
+	if serverProto == "udp" && serverInfo.forceTCP {
+		serverProto = "tcp"
+	}
 	sharedKey, encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, serverProto)
 	if err != nil && serverProto == "udp" {
 		dlog.Debug("Unable to pad for UDP, re-encrypting query for TCP")
@@ -56,13 +96,26 @@ func processDNSCryptQuery(
 	var response []byte
 
 	if serverProto == "udp" {
-		response, err = proxy.exchangeWithUDPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
-		retryOverTCP := false
+		// Queries larger than this are likely to be fragmented
+		largeQuery := len(encryptedQuery) > MaxDNSUDPSafePacketSize
+		response, err = proxy.exchangeWithUDPServer(pluginsState.exchangeContext(), serverInfo, sharedKey, encryptedQuery, clientNonce, pluginsState.upstreamTimeout(serverInfo.Timeout))
+		retryOverTCP, timedOut := false, false
 		if err == nil && len(response) >= MinDNSPacketSize && response[2]&0x02 == 0x02 {
+			if proxy.dnscryptTruncatedResponse == DNSCryptTruncatedResponseClient {
+				dlog.Debugf("[%v] Forwarding a truncated response to the client", serverInfo.Name)
+			} else {
+				dlog.Debugf("[%v] Retry over TCP after a truncated UDP response", serverInfo.Name)
+				retryOverTCP = true
+			}
+		} else if errors.Is(err, ErrUndecryptableUDPResponse) {
+			dlog.Debugf("[%v] Retry over TCP after an undecryptable UDP response: %v", serverInfo.Name, err)
 			retryOverTCP = true
 		} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 			dlog.Debugf("[%v] Retry over TCP after UDP timeouts", serverInfo.Name)
-			retryOverTCP = true
+			retryOverTCP, timedOut = true, true
+		}
+		if largeQuery && err == nil {
+			serverInfo.noticeLargeUDPQuery(false)
 		}
 		if retryOverTCP {
 			serverProto = "tcp"
@@ -73,10 +126,27 @@ func processDNSCryptQuery(
 				serverInfo.noticeFailure(proxy)
 				return nil, err
 			}
-			response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
+			response, err = proxy.exchangeWithTCPServer(pluginsState.exchangeContext(), serverInfo, sharedKey, encryptedQuery, clientNonce, pluginsState.upstreamTimeout(serverInfo.Timeout))
+			if largeQuery && timedOut && err == nil {
+				serverInfo.noticeLargeUDPQuery(true)
+			}
 		}
 	} else {
-		response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
+		response, err = proxy.exchangeWithTCPServer(pluginsState.exchangeContext(), serverInfo, sharedKey, encryptedQuery, clientNonce, pluginsState.upstreamTimeout(serverInfo.Timeout))
+	}
+	if errors.Is(err, context.Canceled) {
+		// Another server of a fanout answered first
+		return nil, err
+	}
+
+	udpAddr, tcpAddr := serverInfo.UDPAddr, serverInfo.TCPAddr
+	if serverInfo.Relay != nil && serverInfo.Relay.Dnscrypt != nil {
+		udpAddr, tcpAddr = serverInfo.Relay.Dnscrypt.RelayUDPAddr, serverInfo.Relay.Dnscrypt.RelayTCPAddr
+	}
+	if serverProto == "udp" && udpAddr != nil {
+		pluginsState.upstreamIP = udpAddr.IP.String()
+	} else if serverProto == "tcp" && tcpAddr != nil {
+		pluginsState.upstreamIP = tcpAddr.IP.String()
 	}
 
 	// Check for stale response if there was an error
@@ -112,11 +182,23 @@ func processDoHQuery(
 	tid := TransactionID(query)
 	SetTransactionID(query, 0)
 	serverInfo.noticeBegin(proxy)
-	serverResponse, _, tls, _, err := proxy.xTransport.DoHQuery(serverInfo.useGet, serverInfo.URL, query, proxy.timeout)
+	var upstreamAddr string
+	var connTiming ConnTiming
+	ctx := withConnTiming(withUpstreamAddr(pluginsState.exchangeContext(), &upstreamAddr), &connTiming)
+	ctx = withURITemplate(withAcceptHeader(ctx, serverInfo.acceptHeader), serverInfo.uriTemplate)
+	serverResponse, _, tls, rtt, err := proxy.xTransport.DoHQuery(
+		ctx, serverInfo.useGet, serverInfo.URL, query, pluginsState.upstreamTimeout(serverInfo.Timeout))
 	SetTransactionID(query, tid)
+	pluginsState.setUpstreamAddr(upstreamAddr)
+	if errors.Is(err, context.Canceled) {
+		// Another server of a fanout answered first
+		return nil, err
+	}
 
 	// A response was received, and the TLS handshake was complete.
 	if err == nil && tls != nil && tls.HandshakeComplete {
+		proxy.serversInfo.recordTLSState(serverInfo.Name, tls)
+		proxy.serversInfo.recordConnTiming(serverInfo.Name, &connTiming, rtt)
 		// Restore the original transaction ID
 		response := serverResponse
 		if len(response) >= MinDNSPacketSize {
@@ -126,6 +208,9 @@ func processDoHQuery(
 	}
 
 	serverInfo.noticeFailure(proxy)
+	if errors.Is(err, ErrUnexpectedContentType) {
+		proxy.serversInfo.countContentTypeError(serverInfo.Name)
+	}
 
 	// Attempt to serve a stale response as a fallback.
 	if stale, ok := pluginsState.sessionData["stale"]; ok {
@@ -164,14 +249,26 @@ func processODoHQuery(
 	}
 
 	targetURL := serverInfo.URL
+	bodyHash := true
 	if serverInfo.Relay != nil && serverInfo.Relay.ODoH != nil {
 		targetURL = serverInfo.Relay.ODoH.URL
+		bodyHash = !serverInfo.Relay.ODoH.NoBodyHash
 	}
 
-	responseBody, responseCode, _, _, err := proxy.xTransport.ObliviousDoHQuery(
-		serverInfo.useGet, targetURL, odohQuery.odohMessage, proxy.timeout)
+	var upstreamAddr string
+	var connTiming ConnTiming
+	responseBody, responseCode, tls, rtt, err := proxy.xTransport.ObliviousDoHQuery(
+		withConnTiming(withUpstreamAddr(pluginsState.exchangeContext(), &upstreamAddr), &connTiming),
+		serverInfo.useGet, targetURL, odohQuery.odohMessage, pluginsState.upstreamTimeout(proxy.timeout), bodyHash)
+	pluginsState.setUpstreamAddr(upstreamAddr)
+	if errors.Is(err, context.Canceled) {
+		// Another server of a fanout answered first
+		return nil, err
+	}
 
 	if err == nil && len(responseBody) > 0 && responseCode == 200 {
+		proxy.serversInfo.recordTLSState(serverInfo.Name, tls)
+		proxy.serversInfo.recordConnTiming(serverInfo.Name, &connTiming, rtt)
 		response, err := odohQuery.decryptResponse(responseBody)
 		if err != nil {
 			dlog.Warnf("Failed to decrypt response from [%v]", serverInfo.Name)
@@ -203,6 +300,9 @@ func processODoHQuery(
 		}
 	} else {
 		dlog.Warnf("Failed to receive successful response from [%v]", serverInfo.Name)
+		if errors.Is(err, ErrUnexpectedContentType) {
+			proxy.serversInfo.countContentTypeError(serverInfo.Name)
+		}
 	}
 
 	pluginsState.returnCode = PluginsReturnCodeNetworkError
@@ -223,6 +323,13 @@ func handleDNSExchange(
 	var err error
 	var response []byte
 
+	if pluginsState.upstreamTimeout(proxy.timeout) <= 0 {
+		dlog.Debugf("Query deadline exceeded before sending the query to [%v]", serverInfo.Name)
+		pluginsState.returnCode = PluginsReturnCodeServerTimeout
+		pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+		return nil, errors.New("Query deadline exceeded")
+	}
+
 	if serverInfo.Proto == stamps.StampProtoTypeDNSCrypt {
 		response, err = processDNSCryptQuery(proxy, serverInfo, pluginsState, query, serverProto)
 	} else if serverInfo.Proto == stamps.StampProtoTypeDoH {
@@ -237,16 +344,117 @@ func handleDNSExchange(
 		return nil, err
 	}
 
-	if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
-		pluginsState.returnCode = PluginsReturnCodeParseError
-		pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+	if !isParseableResponse(response) {
+		dlog.Infof("Malformed response received from [%v]", serverInfo.Name)
 		serverInfo.noticeFailure(proxy)
-		return nil, err
+		proxy.serversInfo.countMalformedResponse(serverInfo.Name)
+		return nil, ErrMalformedResponse
+	}
+
+	if proxy.onQuestionMismatch != OnQuestionMismatchIgnore && !hasMatchingQuestion(query, response) {
+		dlog.Warnf("Response from [%v] doesn't match the question that was sent", serverInfo.Name)
+		serverInfo.noticeFailure(proxy)
+		proxy.serversInfo.countQuestionMismatch(serverInfo.Name)
+		return nil, ErrQuestionMismatch
+	}
+
+	if proxy.onCaseMismatch != OnCaseMismatchAccept {
+		if normalized, mismatch := restoreResponseCase(query, response); mismatch {
+			if proxy.onCaseMismatch == OnCaseMismatchReject {
+				dlog.Infof("Response from [%v] doesn't preserve the case of the query name", serverInfo.Name)
+				serverInfo.noticeFailure(proxy)
+				proxy.serversInfo.countQuestionMismatch(serverInfo.Name)
+				return nil, ErrQuestionMismatch
+			}
+			dlog.Debugf("Restoring the case of the query name in the response from [%v]", serverInfo.Name)
+			response = normalized
+		}
 	}
 
 	return response, nil
 }
 
+// restoreResponseCase - Rewrites the question and the matching owner names of a response using the case of the query name.
+// mismatch is false if the response already used the same case, or if its question is for a different name.
+func restoreResponseCase(query []byte, response []byte) (normalized []byte, mismatch bool) {
+	queryMsg := dns.Msg{Data: query}
+	if err := queryMsg.Unpack(); err != nil || len(queryMsg.Question) != 1 {
+		return response, false
+	}
+	responseMsg := dns.Msg{Data: slices.Clone(response)}
+	if err := responseMsg.Unpack(); err != nil || len(responseMsg.Question) != 1 {
+		return response, false
+	}
+	qName, responseQName := queryMsg.Question[0].Header().Name, responseMsg.Question[0].Header().Name
+	if qName == responseQName || !strings.EqualFold(qName, responseQName) {
+		return response, false
+	}
+	responseMsg.Question[0].Header().Name = qName
+	restoreQNameCase(&responseMsg, qName)
+	if err := responseMsg.Pack(); err != nil {
+		return response, true
+	}
+	return responseMsg.Data, true
+}
+
+// hasMatchingQuestion - Checks that the question section of a response has the name, type and class of the query.
+// Responses without a question section are only accepted along with an error code.
+func hasMatchingQuestion(query []byte, response []byte) bool {
+	queryMsg := dns.Msg{Data: query}
+	if err := queryMsg.Unpack(); err != nil || len(queryMsg.Question) != 1 {
+		return true
+	}
+	responseMsg := dns.Msg{Data: response}
+	if err := responseMsg.Unpack(); err != nil {
+		// Truncated response, that was already validated
+		return true
+	}
+	if len(responseMsg.Question) == 0 {
+		return responseMsg.Rcode != dns.RcodeSuccess
+	}
+	if len(responseMsg.Question) != 1 {
+		return false
+	}
+	question, responseQuestion := queryMsg.Question[0], responseMsg.Question[0]
+	return strings.EqualFold(question.Header().Name, responseQuestion.Header().Name) &&
+		dns.RRToType(question) == dns.RRToType(responseQuestion) &&
+		question.Header().Class == responseQuestion.Header().Class
+}
+
+// isParseableResponse - Checks that a response from a server is a valid DNS message
+func isParseableResponse(response []byte) bool {
+	if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
+		return false
+	}
+	msg := dns.Msg{Data: response}
+	if err := msg.Unpack(); err != nil {
+		return HasTCFlag(response)
+	}
+	return true
+}
+
+// malformedResponseServFail - Returns the SERVFAIL response sent when no server returned a valid response
+func malformedResponseServFail(pluginsState *PluginsState, reason string) []byte {
+	return serverFailureResponse(pluginsState, dns.ExtendedErrorInvalidData, reason)
+}
+
+// deadlineExceededServFail - Returns the SERVFAIL response sent when no server answered before the query deadline
+func deadlineExceededServFail(pluginsState *PluginsState) []byte {
+	return serverFailureResponse(pluginsState, dns.ExtendedErrorNoReachableAuthority, "Query deadline exceeded")
+}
+
+// serverFailureResponse - Returns a packed SERVFAIL response to the client's query, with an Extended DNS Error
+func serverFailureResponse(pluginsState *PluginsState, infoCode uint16, reason string) []byte {
+	if pluginsState.questionMsg == nil {
+		return nil
+	}
+	synth := ServerFailureResponseFromMessage(pluginsState.questionMsg, infoCode, reason)
+	if err := synth.Pack(); err != nil {
+		return nil
+	}
+	return synth.Data
+}
+
 // processPlugins - Processes plugins for both query and response
 func processPlugins(
 	proxy *Proxy,
@@ -331,6 +539,12 @@ func sendResponse(
 			proxy.questionSizeEstimator.adjust(ResponseOverhead + len(response))
 		}
 	} else if clientProto == "tcp" {
+		if pluginsState.tcpKeepalive && proxy.tcpClientKeepalive > 0 {
+			timeout := uint16(min(proxy.tcpClientKeepalive/(100*time.Millisecond), math.MaxUint16))
+			if keepaliveResponse, err := addTCPKeepalive(response, timeout); err == nil {
+				response = keepaliveResponse
+			}
+		}
 		response, err = PrefixWithSize(response)
 		if err != nil {
 			pluginsState.returnCode = PluginsReturnCodeParseError
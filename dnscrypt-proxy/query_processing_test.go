@@ -0,0 +1,907 @@
+package main
+
+import (
+	"context"
+	crypto_rand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+	"github.com/VividCortex/ewma"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// malformedDNSPacket claims to contain 5 questions but has none
+var malformedDNSPacket = []byte{0x00, 0x00, 0x81, 0x80, 0x00, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xde, 0xad}
+
+func TestMalformedUpstreamResponse(t *testing.T) {
+	garbage := newTestDoHServer(t, func(query []byte) []byte { return malformedDNSPacket })
+	valid := newTestDoHServer(t, validDoHResponse)
+
+	tests := []struct {
+		name                string
+		onMalformedResponse string
+		wantRcode           uint8
+		wantAnswers         int
+	}{
+		{
+			name:                "servfail",
+			onMalformedResponse: OnMalformedResponseServFail,
+			wantRcode:           dns.RcodeServerFailure,
+			wantAnswers:         0,
+		},
+		{
+			name:                "retry",
+			onMalformedResponse: OnMalformedResponseRetry,
+			wantRcode:           dns.RcodeSuccess,
+			wantAnswers:         1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxyWithDoHServers(t, garbage, valid)
+			proxy.onMalformedResponse = tt.onMalformedResponse
+
+			query := dns.NewMsg("example.com.", dns.TypeA)
+			query.ID = 0x1234
+			query.UDPSize = 1232
+			if err := query.Pack(); err != nil {
+				t.Fatalf("Pack() error = %v", err)
+			}
+
+			response := proxy.processIncomingQuery("test", "udp", query.Data, nil, nil, time.Now(), false)
+			if len(response) == 0 {
+				t.Fatal("no response was returned")
+			}
+			msg := dns.Msg{Data: response}
+			if err := msg.Unpack(); err != nil {
+				t.Fatalf("Unpack() error = %v", err)
+			}
+			if msg.ID != query.ID {
+				t.Errorf("ID = %#x, want %#x", msg.ID, query.ID)
+			}
+			if Rcode(response) != tt.wantRcode {
+				t.Errorf("Rcode = %d, want %d", Rcode(response), tt.wantRcode)
+			}
+			if len(msg.Answer) != tt.wantAnswers {
+				t.Errorf("got %d answers, want %d", len(msg.Answer), tt.wantAnswers)
+			}
+			if tt.wantRcode == dns.RcodeServerFailure {
+				found := false
+				for _, rr := range msg.Pseudo {
+					if ede, ok := rr.(*dns.EDE); ok && ede.InfoCode == dns.ExtendedErrorInvalidData {
+						found = true
+					}
+				}
+				if !found {
+					t.Error("SERVFAIL response should include an Invalid Data EDE")
+				}
+			}
+			if malformed := proxy.serversInfo.inner[0].malformedResponses; malformed != 1 {
+				t.Errorf("malformed responses for the first server = %d, want 1", malformed)
+			}
+			if malformed := proxy.serversInfo.inner[1].malformedResponses; malformed != 0 {
+				t.Errorf("malformed responses for the second server = %d, want 0", malformed)
+			}
+		})
+	}
+}
+
+func TestMalformedUpstreamResponseDropped(t *testing.T) {
+	garbage := newTestDoHServer(t, func(query []byte) []byte { return malformedDNSPacket })
+	proxy := newTestProxyWithDoHServers(t, garbage)
+	proxy.onMalformedResponse = OnMalformedResponseDrop
+
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatalf("Pack() error = %v", err)
+	}
+	if response := proxy.processIncomingQuery("test", "udp", query.Data, nil, nil, time.Now(), false); len(response) != 0 {
+		t.Errorf("got a %d byte response, want none", len(response))
+	}
+	if malformed := proxy.serversInfo.inner[0].malformedResponses; malformed != 1 {
+		t.Errorf("malformed responses = %d, want 1", malformed)
+	}
+}
+
+func TestQuestionMismatchResponse(t *testing.T) {
+	spoofed := newTestDoHServer(t, func(query []byte) []byte {
+		msg := dns.Msg{Data: query}
+		if err := msg.Unpack(); err != nil {
+			return nil
+		}
+		spoofedQuery := dns.NewMsg("attacker.example.", dns.TypeA)
+		spoofedQuery.ID = msg.ID
+		if err := spoofedQuery.Pack(); err != nil {
+			return nil
+		}
+		return validDoHResponse(spoofedQuery.Data)
+	})
+	valid := newTestDoHServer(t, validDoHResponse)
+
+	tests := []struct {
+		name               string
+		onQuestionMismatch string
+		wantRcode          uint8
+		wantMismatches     uint64
+	}{
+		{name: "servfail", onQuestionMismatch: OnQuestionMismatchServFail, wantRcode: dns.RcodeServerFailure, wantMismatches: 1},
+		{name: "retry", onQuestionMismatch: OnQuestionMismatchRetry, wantRcode: dns.RcodeSuccess, wantMismatches: 1},
+		{name: "ignore", onQuestionMismatch: OnQuestionMismatchIgnore, wantRcode: dns.RcodeSuccess, wantMismatches: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxyWithDoHServers(t, spoofed, valid)
+			proxy.onQuestionMismatch = tt.onQuestionMismatch
+
+			query := dns.NewMsg("Example.com.", dns.TypeA)
+			query.UDPSize = 1232
+			if err := query.Pack(); err != nil {
+				t.Fatalf("Pack() error = %v", err)
+			}
+
+			response := proxy.processIncomingQuery("test", "udp", query.Data, nil, nil, time.Now(), false)
+			if len(response) == 0 {
+				t.Fatal("no response was returned")
+			}
+			if Rcode(response) != tt.wantRcode {
+				t.Errorf("Rcode = %d, want %d", Rcode(response), tt.wantRcode)
+			}
+			if mismatches := proxy.serversInfo.inner[0].questionMismatches; mismatches != tt.wantMismatches {
+				t.Errorf("question mismatches for the first server = %d, want %d", mismatches, tt.wantMismatches)
+			}
+			if mismatches := proxy.serversInfo.inner[1].questionMismatches; mismatches != 0 {
+				t.Errorf("question mismatches for the second server = %d, want 0", mismatches)
+			}
+		})
+	}
+}
+
+func TestCaseMismatchResponse(t *testing.T) {
+	lowercasing := newTestDoHServer(t, func(query []byte) []byte {
+		msg := dns.Msg{Data: query}
+		if err := msg.Unpack(); err != nil {
+			return nil
+		}
+		lowercased := dns.NewMsg(strings.ToLower(msg.Question[0].Header().Name), dns.TypeA)
+		lowercased.ID = msg.ID
+		if err := lowercased.Pack(); err != nil {
+			return nil
+		}
+		return validDoHResponse(lowercased.Data)
+	})
+
+	tests := []struct {
+		name           string
+		onCaseMismatch string
+		wantRcode      uint8
+		wantName       string
+	}{
+		{name: "normalize", onCaseMismatch: OnCaseMismatchNormalize, wantRcode: dns.RcodeSuccess, wantName: "ExAmple.com."},
+		{name: "accept", onCaseMismatch: OnCaseMismatchAccept, wantRcode: dns.RcodeSuccess, wantName: "example.com."},
+		{name: "reject", onCaseMismatch: OnCaseMismatchReject, wantRcode: dns.RcodeServerFailure, wantName: "ExAmple.com."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxyWithDoHServers(t, lowercasing)
+			proxy.onQuestionMismatch = OnQuestionMismatchServFail
+			proxy.onCaseMismatch = tt.onCaseMismatch
+
+			query := dns.NewMsg("ExAmple.com.", dns.TypeA)
+			query.UDPSize = 1232
+			if err := query.Pack(); err != nil {
+				t.Fatalf("Pack() error = %v", err)
+			}
+
+			response := proxy.processIncomingQuery("test", "udp", query.Data, nil, nil, time.Now(), false)
+			msg := dns.Msg{Data: response}
+			if err := msg.Unpack(); err != nil {
+				t.Fatalf("Unpack() error = %v", err)
+			}
+			if Rcode(response) != tt.wantRcode {
+				t.Errorf("Rcode = %d, want %d", Rcode(response), tt.wantRcode)
+			}
+			if name := msg.Question[0].Header().Name; name != tt.wantName {
+				t.Errorf("question name = %q, want %q", name, tt.wantName)
+			}
+			for _, rr := range msg.Answer {
+				if name := rr.Header().Name; name != tt.wantName {
+					t.Errorf("answer name = %q, want %q", name, tt.wantName)
+				}
+			}
+		})
+	}
+}
+
+func TestHasMatchingQuestion(t *testing.T) {
+	pack := func(msg *dns.Msg) []byte {
+		if err := msg.Pack(); err != nil {
+			t.Fatalf("Pack() error = %v", err)
+		}
+		return msg.Data
+	}
+	query := pack(dns.NewMsg("example.com.", dns.TypeA))
+
+	refused := dns.NewMsg("example.com.", dns.TypeA)
+	refused.Question = nil
+	refused.Response = true
+	refused.Rcode = dns.RcodeRefused
+	noQuestion := dns.NewMsg("example.com.", dns.TypeA)
+	noQuestion.Question = nil
+	noQuestion.Response = true
+
+	tests := []struct {
+		name     string
+		response []byte
+		want     bool
+	}{
+		{name: "same question", response: validDoHResponse(query), want: true},
+		{name: "different case", response: validDoHResponse(pack(dns.NewMsg("EXAMPLE.com.", dns.TypeA))), want: true},
+		{name: "different name", response: validDoHResponse(pack(dns.NewMsg("example.net.", dns.TypeA))), want: false},
+		{name: "different type", response: pack(dns.NewMsg("example.com.", dns.TypeAAAA)), want: false},
+		{name: "error without question", response: pack(refused), want: true},
+		{name: "answer without question", response: pack(noQuestion), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasMatchingQuestion(query, tt.response); got != tt.want {
+				t.Errorf("hasMatchingQuestion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoHQueryOversizedResponse(t *testing.T) {
+	oversized := newTestDoHServer(t, func(query []byte) []byte {
+		return append(validDoHResponse(query), make([]byte, MaxDoHResponseLength)...)
+	})
+	valid := newTestDoHServer(t, validDoHResponse)
+	proxy := newTestProxyWithDoHServers(t, oversized, valid)
+
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	for i, serverInfo := range proxy.serversInfo.inner {
+		response, _, _, _, err := proxy.xTransport.DoHQuery(context.Background(), false, serverInfo.URL, query.Data, proxy.timeout)
+		if i == 0 {
+			if !errors.Is(err, ErrDoHResponseTooLarge) {
+				t.Errorf("oversized response: err = %v, want ErrDoHResponseTooLarge", err)
+			}
+			if response != nil {
+				t.Error("no response should be returned when it is oversized")
+			}
+		} else if err != nil || !isParseableResponse(response) {
+			t.Errorf("valid response: err = %v", err)
+		}
+	}
+}
+
+func TestIsParseableResponse(t *testing.T) {
+	if isParseableResponse(malformedDNSPacket) {
+		t.Error("malformed packet should not be parseable")
+	}
+	if isParseableResponse([]byte{0x00, 0x01}) {
+		t.Error("short packet should not be parseable")
+	}
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	if !isParseableResponse(validDoHResponse(query.Data)) {
+		t.Error("valid response should be parseable")
+	}
+}
+
+func TestDoHQueryUnexpectedContentType(t *testing.T) {
+	errorPage := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>Service unavailable</body></html>"))
+	}))
+	t.Cleanup(errorPage.Close)
+	valid := newTestDoHServer(t, validDoHResponse)
+
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	query.ID = 0xcafe
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		proxy := newTestProxyWithDoHServers(t, errorPage, valid)
+		pluginsState := NewPluginsState(proxy, "udp", nil, "udp", time.Now())
+		response, err := processDoHQuery(proxy, proxy.serversInfo.inner[0], &pluginsState, query.Data)
+		if !errors.Is(err, ErrUnexpectedContentType) {
+			t.Errorf("err = %v, want ErrUnexpectedContentType", err)
+		}
+		if response != nil {
+			t.Error("no response should be returned when the Content-Type is unexpected")
+		}
+		if count := proxy.serversInfo.inner[0].contentTypeErrors; count != 1 {
+			t.Errorf("Content-Type errors for the first server = %d, want 1", count)
+		}
+
+		response, err = processDoHQuery(proxy, proxy.serversInfo.inner[1], &pluginsState, query.Data)
+		if err != nil || !isParseableResponse(response) {
+			t.Errorf("valid response: err = %v", err)
+		}
+		if count := proxy.serversInfo.inner[1].contentTypeErrors; count != 0 {
+			t.Errorf("Content-Type errors for the second server = %d, want 0", count)
+		}
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		proxy := newTestProxyWithDoHServers(t, errorPage)
+		proxy.xTransport.dohContentTypeCheck = DoHContentTypeCheckWarn
+		response, _, _, _, err := proxy.xTransport.DoHQuery(context.Background(), false, proxy.serversInfo.inner[0].URL, query.Data, proxy.timeout)
+		if err != nil || len(response) == 0 {
+			t.Errorf("response should be returned in warn mode, got %q, %v", response, err)
+		}
+	})
+}
+
+func TestDoHQueryOverHTTP1(t *testing.T) {
+	var protoMajor atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protoMajor.Store(int32(r.ProtoMajor))
+		query, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(validDoHResponse(query))
+	}))
+	server.EnableHTTP2 = false
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	proxy := newTestProxyWithDoHServers(t, server)
+
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	response, _, tls, _, err := proxy.xTransport.DoHQuery(context.Background(), false, proxy.serversInfo.inner[0].URL, query.Data, proxy.timeout)
+	if err != nil || !isParseableResponse(response) {
+		t.Fatalf("DoH query to an HTTP/1.1 server failed: %v", err)
+	}
+	if got := protoMajor.Load(); got != 1 {
+		t.Errorf("request was sent over HTTP/%d, want HTTP/1", got)
+	}
+	if tls == nil || tls.NegotiatedProtocol == "h2" {
+		t.Error("HTTP/2 should not have been negotiated")
+	}
+}
+
+func TestDoHQueryUpstreamIP(t *testing.T) {
+	server := newTestDoHServer(t, validDoHResponse)
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dedupWindow := range []time.Duration{0, time.Second} {
+		proxy := newTestProxyWithDoHServers(t, server)
+		proxy.xTransport.dohDedupWindow = dedupWindow
+		pluginsState := NewPluginsState(proxy, "udp", nil, "udp", time.Now())
+		if _, err := processDoHQuery(proxy, proxy.serversInfo.inner[0], &pluginsState, query.Data); err != nil {
+			t.Fatal(err)
+		}
+		if pluginsState.upstreamIP != "127.0.0.1" {
+			t.Errorf("dedup window %v: upstream IP = %q, want 127.0.0.1", dedupWindow, pluginsState.upstreamIP)
+		}
+	}
+}
+
+func TestDoHQueryAcceptHeader(t *testing.T) {
+	accepted := make(chan string, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		accepted <- r.Header.Get("Accept")
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(validDoHResponse(query))
+	}))
+	t.Cleanup(server.Close)
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+
+	const custom = "application/dns-message, application/dns-udpwireformat"
+	for _, acceptHeader := range []string{"", custom} {
+		proxy := newTestProxyWithDoHServers(t, server)
+		proxy.serversInfo.inner[0].acceptHeader = acceptHeader
+		pluginsState := NewPluginsState(proxy, "udp", nil, "udp", time.Now())
+		if _, err := processDoHQuery(proxy, proxy.serversInfo.inner[0], &pluginsState, query.Data); err != nil {
+			t.Fatal(err)
+		}
+		want := acceptHeader
+		if len(want) == 0 {
+			want = "application/dns-message"
+		}
+		if got := <-accepted; got != want {
+			t.Errorf("Accept = %q, want %q", got, want)
+		}
+	}
+
+	empty := " "
+	proxy := NewProxy()
+	config := &Config{ServerSettings: map[string]ServerSettingsConfig{"example": {AcceptHeader: &empty}}}
+	if err := configureServerSettings(proxy, config); err == nil {
+		t.Error("an empty accept_header should be rejected")
+	}
+}
+
+func TestDNSCryptQueryForceTCP(t *testing.T) {
+	for _, forceTCP := range []bool{false, true} {
+		t.Run(fmt.Sprintf("force_tcp=%v", forceTCP), func(t *testing.T) {
+			udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { udpConn.Close() })
+			tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { tcpListener.Close() })
+
+			// Queries are not answered, only the protocol they were received over matters
+			udpReceived, tcpAccepted := make(chan struct{}, 1), make(chan struct{}, 1)
+			go func() {
+				if _, _, err := udpConn.ReadFrom(make([]byte, MaxDNSUDPPacketSize)); err == nil {
+					udpReceived <- struct{}{}
+				}
+			}()
+			go func() {
+				if conn, err := tcpListener.Accept(); err == nil {
+					tcpAccepted <- struct{}{}
+					conn.Close()
+				}
+			}()
+
+			proxy := newTestProxyWithDoHServers(t)
+			serverInfo := &ServerInfo{
+				Name:     "dnscrypt",
+				Proto:    stamps.StampProtoTypeDNSCrypt,
+				UDPAddr:  udpConn.LocalAddr().(*net.UDPAddr),
+				TCPAddr:  tcpListener.Addr().(*net.TCPAddr),
+				Timeout:  200 * time.Millisecond,
+				forceTCP: forceTCP,
+			}
+			serverInfo.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+			query := dns.NewMsg("example.com.", dns.TypeA)
+			if err := query.Pack(); err != nil {
+				t.Fatal(err)
+			}
+			pluginsState := NewPluginsState(proxy, "udp", nil, "udp", time.Now())
+			processDNSCryptQuery(proxy, serverInfo, &pluginsState, query.Data, "udp")
+
+			select {
+			case <-tcpAccepted:
+			default:
+				t.Error("the query should have been sent over TCP")
+			}
+			select {
+			case <-udpReceived:
+				if forceTCP {
+					t.Error("no query should be sent over UDP when force_tcp is set")
+				}
+			default:
+				if !forceTCP {
+					t.Error("the query should have been sent over UDP first")
+				}
+			}
+		})
+	}
+}
+
+// dnscryptTestExchange decrypts a query sent to a test DNSCrypt server, and returns the response to it encrypted
+func dnscryptTestExchange(sharedKey *[32]byte, encryptedQuery []byte, respond func(query []byte) []byte) []byte {
+	if len(encryptedQuery) < QueryOverhead {
+		return nil
+	}
+	var nonce [24]byte
+	copy(nonce[:], encryptedQuery[ClientMagicLen+PublicKeySize:ClientMagicLen+PublicKeySize+HalfNonceSize])
+	padded, ok := secretbox.Open(nil, encryptedQuery[ClientMagicLen+PublicKeySize+HalfNonceSize:], &nonce, sharedKey)
+	if !ok {
+		return nil
+	}
+	query, err := unpad(padded)
+	if err != nil {
+		return nil
+	}
+	response := respond(query)
+	if _, err := crypto_rand.Read(nonce[HalfNonceSize:]); err != nil {
+		return nil
+	}
+	encrypted := append(ServerMagic[:], nonce[:]...)
+	return secretbox.Seal(encrypted, pad(response, len(response)+1), &nonce, sharedKey)
+}
+
+func TestDNSCryptTruncatedUDPResponse(t *testing.T) {
+	truncated := func(query []byte) []byte {
+		response := validDoHResponse(query)
+		response[2] |= 0x02
+		return response
+	}
+	for _, tc := range []struct {
+		name          string
+		action        string
+		udpResponse   func(sharedKey *[32]byte, encryptedQuery []byte) []byte
+		wantTCP       bool
+		wantTruncated bool
+	}{
+		{
+			name:   "truncated response retried over TCP",
+			action: DNSCryptTruncatedResponseTCP,
+			udpResponse: func(sharedKey *[32]byte, encryptedQuery []byte) []byte {
+				return dnscryptTestExchange(sharedKey, encryptedQuery, truncated)
+			},
+			wantTCP: true,
+		},
+		{
+			name:   "truncated response forwarded to the client",
+			action: DNSCryptTruncatedResponseClient,
+			udpResponse: func(sharedKey *[32]byte, encryptedQuery []byte) []byte {
+				return dnscryptTestExchange(sharedKey, encryptedQuery, truncated)
+			},
+			wantTruncated: true,
+		},
+		{
+			name:   "response cut short retried over TCP",
+			action: DNSCryptTruncatedResponseClient,
+			udpResponse: func(sharedKey *[32]byte, encryptedQuery []byte) []byte {
+				response := dnscryptTestExchange(sharedKey, encryptedQuery, validDoHResponse)
+				return response[:len(response)-8]
+			},
+			wantTCP: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sharedKey [32]byte
+			if _, err := crypto_rand.Read(sharedKey[:]); err != nil {
+				t.Fatal(err)
+			}
+			udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { udpConn.Close() })
+			tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { tcpListener.Close() })
+
+			go func() {
+				buf := make([]byte, MaxDNSUDPPacketSize)
+				for {
+					length, addr, err := udpConn.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					udpConn.WriteTo(tc.udpResponse(&sharedKey, buf[:length]), addr)
+				}
+			}()
+			var tcpQueries atomic.Int32
+			go func() {
+				for {
+					conn, err := tcpListener.Accept()
+					if err != nil {
+						return
+					}
+					tcpQueries.Add(1)
+					go func() {
+						defer conn.Close()
+						encryptedQuery, err := ReadPrefixed(&conn)
+						if err != nil {
+							return
+						}
+						response, err := PrefixWithSize(dnscryptTestExchange(&sharedKey, encryptedQuery, validDoHResponse))
+						if err != nil {
+							return
+						}
+						conn.Write(response)
+					}()
+				}
+			}()
+
+			proxy := newTestProxyWithDoHServers(t)
+			proxy.dnscryptTruncatedResponse = tc.action
+			serverInfo := &ServerInfo{
+				Name:               "dnscrypt",
+				Proto:              stamps.StampProtoTypeDNSCrypt,
+				CryptoConstruction: XSalsa20Poly1305,
+				SharedKey:          sharedKey,
+				UDPAddr:            udpConn.LocalAddr().(*net.UDPAddr),
+				TCPAddr:            tcpListener.Addr().(*net.TCPAddr),
+				Timeout:            time.Second,
+			}
+			serverInfo.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+			query := dns.NewMsg("example.com.", dns.TypeA)
+			if err := query.Pack(); err != nil {
+				t.Fatal(err)
+			}
+			pluginsState := NewPluginsState(proxy, "udp", nil, "udp", time.Now())
+			response, err := processDNSCryptQuery(proxy, serverInfo, &pluginsState, query.Data, "udp")
+			if err != nil {
+				t.Fatalf("processDNSCryptQuery() failed: %v", err)
+			}
+			if got := response[2]&0x02 == 0x02; got != tc.wantTruncated {
+				t.Errorf("truncated response = %v, want %v", got, tc.wantTruncated)
+			}
+			if got := tcpQueries.Load() > 0; got != tc.wantTCP {
+				t.Errorf("query sent over TCP = %v, want %v", got, tc.wantTCP)
+			}
+		})
+	}
+}
+
+func TestTCPClientKeepalive(t *testing.T) {
+	proxy := newTestProxyWithDoHServers(t, newTestDoHServer(t, validDoHResponse))
+	proxy.tcpClientKeepalive = 2 * time.Second
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.tcpListener(listener)
+	t.Cleanup(func() { listener.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	exchange := func(name string, keepalive bool) *dns.Msg {
+		t.Helper()
+		query := dns.NewMsg(name, dns.TypeA)
+		if keepalive {
+			query.UDPSize = 1232
+			query.Pseudo = append(query.Pseudo, &dns.TCPKEEPALIVE{})
+		}
+		if err := query.Pack(); err != nil {
+			t.Fatal(err)
+		}
+		prefixed, err := PrefixWithSize(query.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(prefixed); err != nil {
+			t.Fatal(err)
+		}
+		packet, err := ReadPrefixed(&conn)
+		if err != nil {
+			t.Fatalf("no response to [%s] on the same connection: %v", name, err)
+		}
+		response := dns.Msg{Data: packet}
+		if err := response.Unpack(); err != nil {
+			t.Fatal(err)
+		}
+		return &response
+	}
+	keepaliveTimeout := func(msg *dns.Msg) int {
+		for _, rr := range msg.Pseudo {
+			if option, ok := rr.(*dns.TCPKEEPALIVE); ok {
+				return int(option.Timeout)
+			}
+		}
+		return -1
+	}
+
+	if timeout := keepaliveTimeout(exchange("example.com.", true)); timeout != 20 {
+		t.Errorf("the keepalive timeout should be advertised in units of 100ms, got %d", timeout)
+	}
+	if timeout := keepaliveTimeout(exchange("example.net.", false)); timeout != -1 {
+		t.Errorf("the keepalive option should only be sent to clients that asked for it, got %d", timeout)
+	}
+}
+
+func TestLargeDoHResponseToUDPClient(t *testing.T) {
+	largeResponse := func(query []byte) []byte {
+		msg := dns.Msg{Data: query}
+		if err := msg.Unpack(); err != nil {
+			return nil
+		}
+		resp := EmptyResponseFromMessage(&msg)
+		for i := range 100 {
+			rr := new(dns.A)
+			rr.Hdr = dns.Header{Name: msg.Question[0].Header().Name, Class: dns.ClassINET, TTL: 60}
+			rr.A = rdata.A{Addr: netip.AddrFrom4([4]byte{192, 0, 2, byte(i)})}
+			resp.Answer = append(resp.Answer, rr)
+		}
+		if err := resp.Pack(); err != nil {
+			return nil
+		}
+		return resp.Data
+	}
+	server := newTestDoHServer(t, largeResponse)
+
+	tests := []struct {
+		name          string
+		udpSize       uint16
+		wantTruncated bool
+	}{
+		{name: "no EDNS", udpSize: 0, wantTruncated: true},
+		{name: "small buffer", udpSize: 1232, wantTruncated: true},
+		{name: "large buffer", udpSize: 4096, wantTruncated: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxyWithDoHServers(t, server)
+			// Plugins increase the payload size of the query sent upstream, but responses must still fit the client buffer
+			proxy.pluginsGlobals.queryPlugins = &[]Plugin{new(PluginNSID), new(PluginGetSetPayloadSize)}
+			proxy.questionSizeEstimator = NewQuestionSizeEstimator()
+
+			listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			query := dns.NewMsg("example.com.", dns.TypeA)
+			query.UDPSize = tt.udpSize
+			if err := query.Pack(); err != nil {
+				t.Fatal(err)
+			}
+			var clientAddr net.Addr = client.LocalAddr()
+			proxy.processIncomingQuery("udp", "udp", query.Data, &clientAddr, listener, time.Now(), false)
+
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			packet := make([]byte, 65536)
+			n, err := client.Read(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if HasTCFlag(packet[:n]) != tt.wantTruncated {
+				t.Errorf("TC = %v, want %v (%d bytes)", HasTCFlag(packet[:n]), tt.wantTruncated, n)
+			}
+			if n > max(int(tt.udpSize), 512) {
+				t.Errorf("a %d bytes response was sent to a client with a %d bytes buffer", n, tt.udpSize)
+			}
+			msg := dns.Msg{Data: packet[:n]}
+			if err := msg.Unpack(); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantTruncated && len(msg.Answer) != 100 {
+				t.Errorf("got %d answers, want 100", len(msg.Answer))
+			}
+		})
+	}
+}
+
+func TestRotateAnswers(t *testing.T) {
+	addrs := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	var requests atomic.Int32
+	server := newTestDoHServer(t, func(query []byte) []byte {
+		requests.Add(1)
+		msg := dns.Msg{Data: query}
+		if err := msg.Unpack(); err != nil {
+			return nil
+		}
+		resp := EmptyResponseFromMessage(&msg)
+		cname := new(dns.CNAME)
+		cname.Hdr = dns.Header{Name: msg.Question[0].Header().Name, Class: dns.ClassINET, TTL: 600}
+		cname.CNAME = rdata.CNAME{Target: "target.example.com."}
+		resp.Answer = []dns.RR{cname}
+		for _, addr := range addrs {
+			rr := new(dns.A)
+			rr.Hdr = dns.Header{Name: "target.example.com.", Class: dns.ClassINET, TTL: 600}
+			rr.A = rdata.A{Addr: netip.MustParseAddr(addr)}
+			resp.Answer = append(resp.Answer, rr)
+		}
+		if err := resp.Pack(); err != nil {
+			return nil
+		}
+		return resp.Data
+	})
+
+	tests := []struct {
+		name         string
+		qName        string
+		cache        bool
+		wantRequests int32
+	}{
+		{name: "upstream responses", qName: "rotate.example.com.", wantRequests: 3},
+		{name: "cached responses", qName: "rotate-cached.example.com.", cache: true, wantRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			proxy := newTestProxyWithDoHServers(t, server)
+			proxy.rotateAnswers = true
+			if tt.cache {
+				proxy.cacheSize = 16
+				proxy.cacheMaxTTL = 3600
+				proxy.pluginsGlobals.queryPlugins = &[]Plugin{&PluginCache{proxy: proxy}}
+				proxy.pluginsGlobals.responsePlugins = &[]Plugin{&PluginCacheResponse{}}
+			}
+
+			firsts := make(map[string]bool)
+			for range len(addrs) {
+				query := dns.NewMsg(tt.qName, dns.TypeA)
+				if err := query.Pack(); err != nil {
+					t.Fatal(err)
+				}
+				msg := dns.Msg{Data: proxy.processIncomingQuery("test", "tcp", query.Data, nil, nil, time.Now(), false)}
+				if err := msg.Unpack(); err != nil {
+					t.Fatalf("Unpack() error = %v", err)
+				}
+				if len(msg.Answer) != len(addrs)+1 {
+					t.Fatalf("got %d records, want %d", len(msg.Answer), len(addrs)+1)
+				}
+				if dns.RRToType(msg.Answer[0]) != dns.TypeCNAME {
+					t.Error("the CNAME record should stay first")
+				}
+				firsts[msg.Answer[1].(*dns.A).A.Addr.String()] = true
+			}
+			if len(firsts) != len(addrs) {
+				t.Errorf("every address should come first once, got %v", firsts)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("upstream requests = %d, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestQueryDeadlineServFail(t *testing.T) {
+	slow := newTestDoHServer(t, func(query []byte) []byte {
+		time.Sleep(500 * time.Millisecond)
+		return validDoHResponse(query)
+	})
+	proxy := newTestProxyWithDoHServers(t, slow)
+	proxy.queryDeadline = 100 * time.Millisecond
+
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	query.UDPSize = 1232
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	response := proxy.processIncomingQuery("test", "udp", query.Data, nil, nil, start, false)
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("the response took %v, beyond the query deadline", elapsed)
+	}
+	msg := dns.Msg{Data: response}
+	if err := msg.Unpack(); err != nil {
+		t.Fatalf("no valid response was returned: %v", err)
+	}
+	if msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Rcode = %d, want SERVFAIL", msg.Rcode)
+	}
+	found := false
+	for _, rr := range msg.Pseudo {
+		if ede, ok := rr.(*dns.EDE); ok && ede.InfoCode == dns.ExtendedErrorNoReachableAuthority {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("SERVFAIL response should include a No Reachable Authority EDE")
+	}
+}
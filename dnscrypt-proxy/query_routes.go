@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// QueryRoute - Servers that the queries for names within a zone are sent to
+type QueryRoute struct {
+	zone        string
+	serverNames []string
+}
+
+// newQueryRoutes parses the query routes, and sorts them so that the most specific zones come first
+func newQueryRoutes(routesConfig map[string][]string) ([]QueryRoute, error) {
+	routes := make([]QueryRoute, 0, len(routesConfig))
+	for pattern, serverNames := range routesConfig {
+		zone := strings.TrimPrefix(strings.TrimSpace(pattern), "*.")
+		zone, err := NormalizeQName(zone)
+		if err != nil || zone == "." || strings.Contains(zone, "*") {
+			return nil, fmt.Errorf("Invalid query route pattern: [%s]", pattern)
+		}
+		if len(serverNames) == 0 {
+			return nil, fmt.Errorf("Query route [%s] has no servers", pattern)
+		}
+		for _, route := range routes {
+			if route.zone == zone {
+				return nil, fmt.Errorf("Duplicate query route for [%s]", zone)
+			}
+		}
+		routes = append(routes, QueryRoute{zone: zone, serverNames: serverNames})
+	}
+	slices.SortFunc(routes, func(a, b QueryRoute) int {
+		if labels := strings.Count(b.zone, ".") - strings.Count(a.zone, "."); labels != 0 {
+			return labels
+		}
+		return strings.Compare(a.zone, b.zone)
+	})
+	return routes, nil
+}
+
+// queryRoute returns the most specific route for a name, or nil if the name isn't routed
+func (proxy *Proxy) queryRoute(qName string) *QueryRoute {
+	for i := range proxy.queryRoutes {
+		if inZones(qName, []string{proxy.queryRoutes[i].zone}) {
+			return &proxy.queryRoutes[i]
+		}
+	}
+	return nil
+}
+
+// isRouteOnlyServer returns true if a server is listed in a query route, but not in server_names.
+// Such servers are only used for the names of their routes.
+func (proxy *Proxy) isRouteOnlyServer(name string) bool {
+	if includesName(proxy.ServerNames, name) {
+		return false
+	}
+	for _, route := range proxy.queryRoutes {
+		if includesName(route.serverNames, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeServerNames returns the names of the servers listed in query routes
+func (proxy *Proxy) routeServerNames() []string {
+	var names []string
+	for _, route := range proxy.queryRoutes {
+		names = append(names, route.serverNames...)
+	}
+	return names
+}
+
+// serverFor returns the server to send a query to. Routed names are only sent to the servers of their route,
+// and other queries to the servers of the listener profile, if it restricts them.
+func (proxy *Proxy) serverFor(pluginsState *PluginsState) *ServerInfo {
+	if route := proxy.queryRoute(pluginsState.qName); route != nil {
+		pluginsState.queryRoute = route
+		return proxy.serversInfo.getOneOf(route.serverNames)
+	}
+	return proxy.getServer(pluginsState.listenerProfile)
+}
+
+// restrictsServers returns true if a query can only be sent to some of the servers
+func (pluginsState *PluginsState) restrictsServers() bool {
+	return pluginsState.queryRoute != nil ||
+		(pluginsState.listenerProfile != nil && len(pluginsState.listenerProfile.serverNames) > 0)
+}
+
+// allowsServer returns true if a query can be sent to the given server
+func (pluginsState *PluginsState) allowsServer(serverInfo *ServerInfo) bool {
+	if route := pluginsState.queryRoute; route != nil {
+		return serverInfo != nil && includesName(route.serverNames, serverInfo.Name)
+	}
+	return pluginsState.listenerProfile.allowsServer(serverInfo)
+}
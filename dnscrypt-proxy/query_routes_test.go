@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/VividCortex/ewma"
+)
+
+func TestQueryRoutes(t *testing.T) {
+	for _, pattern := range []string{"", "*", "corp.*.example"} {
+		if _, err := newQueryRoutes(map[string][]string{pattern: {"corp"}}); err == nil {
+			t.Errorf("pattern [%s] should be rejected", pattern)
+		}
+	}
+	if _, err := newQueryRoutes(map[string][]string{"corp.example": nil}); err == nil {
+		t.Error("routes without servers should be rejected")
+	}
+	if _, err := newQueryRoutes(map[string][]string{"*.corp.example": {"a"}, "Corp.Example.": {"b"}}); err == nil {
+		t.Error("duplicate routes should be rejected")
+	}
+
+	routes, err := newQueryRoutes(map[string][]string{
+		"*.example.com":      {"public-a", "public-b"},
+		"*.corp.example.com": {"corp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy()
+	proxy.queryRoutes = routes
+	for qName, want := range map[string]string{
+		"corp.example.com":       "corp.example.com",
+		"www.corp.example.com":   "corp.example.com",
+		"www.example.com":        "example.com",
+		"notcorp.example.com":    "example.com",
+		"www.example.org":        "",
+		"example.com.example.io": "",
+	} {
+		route := proxy.queryRoute(qName)
+		if (route == nil && len(want) > 0) || (route != nil && route.zone != want) {
+			t.Errorf("[%s] should be routed to [%s], got %v", qName, want, route)
+		}
+	}
+
+	newServer := func(name string) *ServerInfo {
+		return &ServerInfo{Name: name, rtt: ewma.NewMovingAverage(RTTEwmaDecay)}
+	}
+	proxy.serversInfo.lbStrategy = LBStrategyFirst{}
+	proxy.serversInfo.inner = []*ServerInfo{newServer("default"), newServer("public-b"), newServer("corp")}
+
+	pluginsState := PluginsState{qName: "intranet.corp.example.com"}
+	if server := proxy.serverFor(&pluginsState); server == nil || server.Name != "corp" {
+		t.Errorf("routed names should only use the servers of their route, got %v", server)
+	}
+	if !pluginsState.restrictsServers() || pluginsState.allowsServer(proxy.serversInfo.inner[0]) {
+		t.Error("routed queries should not be sent to other servers")
+	}
+	pluginsState = PluginsState{qName: "www.example.com"}
+	if server := proxy.serverFor(&pluginsState); server == nil || server.Name != "public-b" {
+		t.Errorf("the live servers of a route should be used, got %v", server)
+	}
+	pluginsState = PluginsState{qName: "www.example.org"}
+	if server := proxy.serverFor(&pluginsState); server == nil || server.Name != "default" {
+		t.Errorf("names without a route should use all the servers, got %v", server)
+	}
+	if pluginsState.restrictsServers() || !pluginsState.allowsServer(proxy.serversInfo.inner[2]) {
+		t.Error("queries without a route or a profile should not be restricted")
+	}
+}
+
+func TestRouteOnlyServers(t *testing.T) {
+	var privateQueries atomic.Int32
+	public := newTestDoHServer(t, validDoHResponse)
+	private := newTestDoHServer(t, func(query []byte) []byte {
+		privateQueries.Add(1)
+		return validDoHResponse(query)
+	})
+	proxy := newTestProxyWithDoHServers(t, public, private)
+	proxy.ServerNames = []string{"first"}
+	routes, err := newQueryRoutes(map[string][]string{"corp.example": {"second"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.queryRoutes = routes
+	if proxy.isRouteOnlyServer("first") || !proxy.isRouteOnlyServer("second") {
+		t.Fatal("only the servers listed in routes but not in server_names should be route-only")
+	}
+	proxy.serversInfo.routeOnly = proxy.serversInfo.inner[1:]
+	proxy.serversInfo.inner = proxy.serversInfo.inner[:1]
+	proxy.serversInfo.lbExplorationRate = 1
+	proxy.fanout = 2
+
+	if server := proxy.serversInfo.getOther(proxy.serversInfo.inner[0]); server != nil {
+		t.Errorf("retries should not use route-only servers, got [%s]", server.Name)
+	}
+	for _, server := range proxy.serversInfo.getFanout(nil, 2, false) {
+		if server.Name == "second" {
+			t.Error("fanout should not use route-only servers")
+		}
+	}
+	for i := range 20 {
+		query := dns.NewMsg(fmt.Sprintf("www%d.example.com.", i), dns.TypeA)
+		if err := query.Pack(); err != nil {
+			t.Fatal(err)
+		}
+		if response := proxy.processIncomingQuery("test", "udp", query.Data, nil, nil, time.Now(), false); len(response) == 0 {
+			t.Fatal("unrouted queries should be answered by the other servers")
+		}
+	}
+	if n := privateQueries.Load(); n != 0 {
+		t.Errorf("a route-only server received %d unrouted queries", n)
+	}
+
+	query := dns.NewMsg("intranet.corp.example.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	if response := proxy.processIncomingQuery("test", "udp", query.Data, nil, nil, time.Now(), false); len(response) == 0 {
+		t.Fatal("routed queries should be answered by the route-only server")
+	}
+	if n := privateQueries.Load(); n != 1 {
+		t.Errorf("the route-only server received %d routed queries, want 1", n)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+const (
+	RcodeStatsBucketDuration = time.Minute
+	RcodeStatsWindowBuckets  = 5
+)
+
+// RcodeCounters - Response code counters for an upstream server
+type RcodeCounters struct {
+	Success  uint64 `json:"success"`
+	NXDomain uint64 `json:"nxdomain"`
+	ServFail uint64 `json:"servfail"`
+	Refused  uint64 `json:"refused"`
+	Other    uint64 `json:"other"`
+}
+
+func (counters *RcodeCounters) add(rcode uint8) {
+	switch rcode {
+	case dns.RcodeSuccess:
+		counters.Success++
+	case dns.RcodeNameError:
+		counters.NXDomain++
+	case dns.RcodeServerFailure:
+		counters.ServFail++
+	case dns.RcodeRefused:
+		counters.Refused++
+	default:
+		counters.Other++
+	}
+}
+
+func (counters *RcodeCounters) merge(other *RcodeCounters) {
+	counters.Success += other.Success
+	counters.NXDomain += other.NXDomain
+	counters.ServFail += other.ServFail
+	counters.Refused += other.Refused
+	counters.Other += other.Other
+}
+
+// Total - Returns the number of responses accounted for
+func (counters *RcodeCounters) Total() uint64 {
+	return counters.Success + counters.NXDomain + counters.ServFail + counters.Refused + counters.Other
+}
+
+type rcodeStatsBucket struct {
+	slot     int64
+	counters RcodeCounters
+}
+
+// RcodeStats - Lifetime and rolling window response code counters
+type RcodeStats struct {
+	total   RcodeCounters
+	buckets [RcodeStatsWindowBuckets]rcodeStatsBucket
+}
+
+func rcodeStatsSlot(now time.Time) int64 {
+	return now.UnixNano() / int64(RcodeStatsBucketDuration)
+}
+
+// record accounts for a response code; the caller must hold the serversInfo lock
+func (stats *RcodeStats) record(rcode uint8, now time.Time) {
+	stats.total.add(rcode)
+	slot := rcodeStatsSlot(now)
+	bucket := &stats.buckets[slot%RcodeStatsWindowBuckets]
+	if bucket.slot != slot {
+		*bucket = rcodeStatsBucket{slot: slot}
+	}
+	bucket.counters.add(rcode)
+}
+
+// window returns the counters for the last RcodeStatsWindowBuckets buckets
+func (stats *RcodeStats) window(now time.Time) RcodeCounters {
+	var counters RcodeCounters
+	slot := rcodeStatsSlot(now)
+	for i := range stats.buckets {
+		bucket := &stats.buckets[i]
+		if bucket.slot > slot-RcodeStatsWindowBuckets && bucket.slot <= slot {
+			counters.merge(&bucket.counters)
+		}
+	}
+	return counters
+}
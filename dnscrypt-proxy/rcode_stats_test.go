@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/VividCortex/ewma"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+func TestRcodeStatsWindow(t *testing.T) {
+	start := time.Unix(0, 0).Add(1000 * RcodeStatsBucketDuration)
+	var stats RcodeStats
+	stats.record(dns.RcodeSuccess, start)
+	stats.record(dns.RcodeNameError, start.Add(RcodeStatsBucketDuration/2))
+	stats.record(dns.RcodeServerFailure, start.Add(RcodeStatsBucketDuration))
+	if counters := stats.window(start.Add(RcodeStatsBucketDuration)); counters != (RcodeCounters{Success: 1, NXDomain: 1, ServFail: 1}) {
+		t.Errorf("window = %+v, want all the responses", counters)
+	}
+
+	// The first bucket is reused once the window has moved past it
+	end := start.Add(RcodeStatsWindowBuckets * RcodeStatsBucketDuration)
+	stats.record(dns.RcodeRefused, end)
+	if counters := stats.window(end); counters != (RcodeCounters{ServFail: 1, Refused: 1}) {
+		t.Errorf("window after rollover = %+v, want the responses of the last %d buckets", counters, RcodeStatsWindowBuckets)
+	}
+	if counters := stats.window(end.Add(RcodeStatsBucketDuration)); counters != (RcodeCounters{Refused: 1}) {
+		t.Errorf("window = %+v, want the last response only", counters)
+	}
+	if counters := stats.window(end.Add(RcodeStatsWindowBuckets * RcodeStatsBucketDuration)); counters.Total() != 0 {
+		t.Errorf("window without recent responses = %+v, want no responses", counters)
+	}
+	if stats.total != (RcodeCounters{Success: 1, NXDomain: 1, ServFail: 1, Refused: 1}) {
+		t.Errorf("lifetime counters = %+v, want all the responses", stats.total)
+	}
+}
+
+func TestRcodeStatsMonitoring(t *testing.T) {
+	proxy := NewProxy()
+	server := &ServerInfo{Name: `resolver"1`, Proto: stamps.StampProtoTypeDoH, rtt: ewma.NewMovingAverage(RTTEwmaDecay)}
+	now := time.Now()
+	server.rcodeStats.record(dns.RcodeNameError, now.Add(-time.Hour))
+	server.rcodeStats.record(dns.RcodeNameError, now)
+	server.rcodeStats.record(dns.RcodeSuccess, now)
+	server.rcodeStats.record(dns.RcodeBadVers, now)
+	proxy.serversInfo.inner = []*ServerInfo{server}
+	proxy.monitoringUI.PrometheusEnabled = true
+	metricsCollector := NewMonitoringUI(proxy).metricsCollector
+
+	prometheus := metricsCollector.generatePrometheusMetrics()
+	for _, sample := range []string{
+		`dnscrypt_proxy_server_responses_total{server="resolver\"1", rcode="NOERROR"} 1`,
+		`dnscrypt_proxy_server_responses_total{server="resolver\"1", rcode="NXDOMAIN"} 2`,
+		`dnscrypt_proxy_server_responses_total{server="resolver\"1", rcode="SERVFAIL"} 0`,
+		`dnscrypt_proxy_server_responses_total{server="resolver\"1", rcode="OTHER"} 1`,
+		`dnscrypt_proxy_server_responses_window{server="resolver\"1", rcode="NXDOMAIN"} 1`,
+	} {
+		if !strings.Contains(prometheus, sample+"\n") {
+			t.Errorf("missing Prometheus sample: %s", sample)
+		}
+	}
+
+	encoded, err := json.Marshal(metricsCollector.GetMetrics()["resolver_health"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resolvers []struct {
+		Name         string        `json:"name"`
+		Rcodes       RcodeCounters `json:"rcodes"`
+		RcodesWindow RcodeCounters `json:"rcodes_window"`
+	}
+	if err := json.Unmarshal(encoded, &resolvers); err != nil {
+		t.Fatal(err)
+	}
+	if len(resolvers) != 1 || resolvers[0].Name != server.Name {
+		t.Fatalf("unexpected resolvers: %s", encoded)
+	}
+	if resolvers[0].Rcodes != (RcodeCounters{Success: 1, NXDomain: 2, Other: 1}) {
+		t.Errorf("rcodes = %+v", resolvers[0].Rcodes)
+	}
+	if resolvers[0].RcodesWindow != (RcodeCounters{Success: 1, NXDomain: 1, Other: 1}) {
+		t.Errorf("rcodes_window = %+v", resolvers[0].RcodesWindow)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+// ServerListFilter - Restricts the servers and relays printed by -list and -list-all
+type ServerListFilter struct {
+	protos   []stamps.StampProtoType
+	nolog    bool
+	nofilter bool
+	dnssec   bool
+	name     string
+}
+
+// NewServerListFilter - Parses comma-separated protocols (dnscrypt, doh, odoh) and properties (nolog, nofilter, dnssec),
+// as well as a substring servers names must contain. Empty values don't filter anything.
+func NewServerListFilter(protos string, properties string, name string) (ServerListFilter, error) {
+	filter := ServerListFilter{name: strings.ToLower(name)}
+	for proto := range strings.SplitSeq(protos, ",") {
+		switch strings.ToLower(strings.TrimSpace(proto)) {
+		case "":
+		case "dnscrypt":
+			filter.protos = append(filter.protos, stamps.StampProtoTypeDNSCrypt, stamps.StampProtoTypeDNSCryptRelay)
+		case "doh":
+			filter.protos = append(filter.protos, stamps.StampProtoTypeDoH)
+		case "odoh":
+			filter.protos = append(filter.protos, stamps.StampProtoTypeODoHTarget, stamps.StampProtoTypeODoHRelay)
+		default:
+			return filter, fmt.Errorf("Unsupported protocol in the server list filter: [%s]", proto)
+		}
+	}
+	for property := range strings.SplitSeq(properties, ",") {
+		switch strings.ToLower(strings.TrimSpace(property)) {
+		case "":
+		case "nolog":
+			filter.nolog = true
+		case "nofilter":
+			filter.nofilter = true
+		case "dnssec":
+			filter.dnssec = true
+		default:
+			return filter, fmt.Errorf("Unsupported property in the server list filter: [%s]", property)
+		}
+	}
+	return filter, nil
+}
+
+// matches - Returns true if a server or relay with the given name, protocol and properties should be listed
+func (filter *ServerListFilter) matches(name string, proto stamps.StampProtoType, nolog, nofilter, dnssec bool) bool {
+	if len(filter.protos) > 0 && !slices.Contains(filter.protos, proto) {
+		return false
+	}
+	if (filter.nolog && !nolog) || (filter.nofilter && !nofilter) || (filter.dnssec && !dnssec) {
+		return false
+	}
+	return strings.Contains(strings.ToLower(name), filter.name)
+}
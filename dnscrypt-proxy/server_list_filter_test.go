@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+func TestServerListFilter(t *testing.T) {
+	if _, err := NewServerListFilter("doh,quic", "", ""); err == nil {
+		t.Error("unsupported protocols should be rejected")
+	}
+	if _, err := NewServerListFilter("", "nolog,fast", ""); err == nil {
+		t.Error("unsupported properties should be rejected")
+	}
+
+	tests := []struct {
+		name       string
+		protos     string
+		properties string
+		nameFilter string
+		server     string
+		proto      stamps.StampProtoType
+		dnssec     bool
+		want       bool
+	}{
+		{name: "no filter", server: "example", proto: stamps.StampProtoTypeDoH, want: true},
+		{name: "proto match", protos: "dnscrypt, odoh", server: "example", proto: stamps.StampProtoTypeDNSCrypt, want: true},
+		{name: "relay proto match", protos: "odoh", server: "example", proto: stamps.StampProtoTypeODoHRelay, want: true},
+		{name: "proto mismatch", protos: "DNSCrypt", server: "example", proto: stamps.StampProtoTypeDoH, want: false},
+		{name: "property match", properties: "nolog,dnssec", server: "example", proto: stamps.StampProtoTypeDoH, dnssec: true, want: true},
+		{name: "property mismatch", properties: "dnssec", server: "example", proto: stamps.StampProtoTypeDoH, want: false},
+		{name: "name match", nameFilter: "Ample", server: "example-ipv6", proto: stamps.StampProtoTypeDoH, want: true},
+		{name: "name mismatch", nameFilter: "other", server: "example", proto: stamps.StampProtoTypeDoH, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewServerListFilter(tt.protos, tt.properties, tt.nameFilter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filter.matches(tt.server, tt.proto, true, false, tt.dnssec); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	ServerStatusLive    = "live"
+	ServerStatusDown    = "down"
+	ServerStatusPending = "pending"
+)
+
+// ServerStatus - Whether a configured server can currently be used, and why not if it can't
+type ServerStatus struct {
+	Name        string     `json:"name"`
+	Proto       string     `json:"proto"`
+	Status      string     `json:"status"`
+	Reason      string     `json:"reason,omitempty"`
+	Fallback    bool       `json:"fallback,omitempty"`
+	RouteOnly   bool       `json:"route_only,omitempty"`
+	RateCapped  bool       `json:"rate_capped,omitempty"`
+	RTT         int        `json:"rtt_ms,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// ServersStatus - Live and down servers among the configured ones
+type ServersStatus struct {
+	Configured      int            `json:"configured"`
+	Live            int            `json:"live"`
+	Down            int            `json:"down"`
+	Pending         int            `json:"pending"`
+	FallbackMode    bool           `json:"fallback_mode"`
+	EmergencyActive bool           `json:"emergency_active"`
+	Servers         []ServerStatus `json:"servers"`
+}
+
+// status returns the status of every registered server. Servers are live when they are among the servers queries
+// can be sent to, down when their certificate or their connectivity couldn't be checked, and pending until the
+// first check.
+func (serversInfo *ServersInfo) status() ServersStatus {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+
+	live := make(map[string]*ServerInfo)
+	for _, server := range serversInfo.inner {
+		live[server.Name] = server
+	}
+	fallback := make(map[string]*ServerInfo)
+	for _, server := range serversInfo.fallback {
+		fallback[server.Name] = server
+	}
+	routeOnly := make(map[string]*ServerInfo)
+	for _, server := range serversInfo.routeOnly {
+		routeOnly[server.Name] = server
+	}
+	result := ServersStatus{
+		Configured:      len(serversInfo.registeredServers),
+		FallbackMode:    serversInfo.fallbackMode,
+		EmergencyActive: serversInfo.emergency != nil,
+		Servers:         make([]ServerStatus, 0, len(serversInfo.registeredServers)),
+	}
+	for _, registeredServer := range serversInfo.registeredServers {
+		entry := ServerStatus{Name: registeredServer.name, Proto: registeredServer.stamp.Proto.String()}
+		stats, hasStats := serversInfo.certRefreshStats[registeredServer.name]
+		if hasStats && !stats.LastSuccess.IsZero() {
+			lastSuccess := stats.LastSuccess
+			entry.LastSuccess = &lastSuccess
+		}
+		server, isLive := live[registeredServer.name]
+		if !isLive {
+			server, entry.Fallback = fallback[registeredServer.name]
+			isLive = entry.Fallback
+		}
+		if !isLive {
+			server, entry.RouteOnly = routeOnly[registeredServer.name]
+			isLive = entry.RouteOnly
+		}
+		switch {
+		case isLive:
+			entry.Status = ServerStatusLive
+			entry.RateCapped = server.rateCapped
+			entry.RTT = max(0, int(server.rtt.Value()))
+			if hasStats && stats.ConsecutiveFailures > 0 {
+				entry.Reason = fmt.Sprintf("last %d certificate refreshes failed: %s", stats.ConsecutiveFailures, stats.LastError)
+			}
+		case !hasStats || stats.Attempts == 0:
+			entry.Status = ServerStatusPending
+			entry.Reason = "not checked yet"
+		case stats.Excluded:
+			entry.Status = ServerStatusDown
+			entry.Reason = fmt.Sprintf("excluded after %d consecutive certificate refresh failures: %s",
+				stats.ConsecutiveFailures, stats.LastError)
+		case stats.ConsecutiveFailures > 0:
+			entry.Status = ServerStatusDown
+			entry.Reason = stats.LastError
+		default:
+			entry.Status = ServerStatusDown
+			entry.Reason = "not in the live servers"
+		}
+		switch entry.Status {
+		case ServerStatusLive:
+			result.Live++
+		case ServerStatusDown:
+			result.Down++
+		default:
+			result.Pending++
+		}
+		result.Servers = append(result.Servers, entry)
+	}
+	sort.Slice(result.Servers, func(i, j int) bool {
+		return result.Servers[i].Name < result.Servers[j].Name
+	})
+	return result
+}
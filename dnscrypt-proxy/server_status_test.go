@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/ewma"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+func TestServersStatus(t *testing.T) {
+	serversInfo := NewServersInfo()
+	for _, name := range []string{"live", "fallback", "failing", "excluded", "pending", "route-only"} {
+		serversInfo.registerServer(name, stamps.ServerStamp{Proto: stamps.StampProtoTypeDNSCrypt})
+	}
+	newServer := func(name string) *ServerInfo {
+		server := &ServerInfo{Name: name}
+		server.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+		server.rtt.Set(42)
+		return server
+	}
+	serversInfo.inner = []*ServerInfo{newServer("live"), newServer("excluded")}
+	serversInfo.fallback = []*ServerInfo{newServer("fallback")}
+	serversInfo.routeOnly = []*ServerInfo{newServer("route-only")}
+	refreshErr := errors.New("certificate expired")
+	serversInfo.recordCertRefresh("live", time.Now(), nil)
+	serversInfo.recordCertRefresh("fallback", time.Now(), nil)
+	serversInfo.recordCertRefresh("route-only", time.Now(), nil)
+	serversInfo.recordCertRefresh("failing", time.Time{}, refreshErr)
+	for range 3 {
+		serversInfo.recordCertRefresh("excluded", time.Time{}, refreshErr)
+	}
+	serversInfo.excludeServer("excluded", 3)
+
+	status := serversInfo.status()
+	if status.Configured != 6 || status.Live != 3 || status.Down != 2 || status.Pending != 1 {
+		t.Fatalf("configured/live/down/pending = %d/%d/%d/%d, want 6/3/2/1",
+			status.Configured, status.Live, status.Down, status.Pending)
+	}
+	want := map[string]struct {
+		status string
+		reason string
+	}{
+		"live":       {ServerStatusLive, ""},
+		"fallback":   {ServerStatusLive, ""},
+		"failing":    {ServerStatusDown, "certificate expired"},
+		"excluded":   {ServerStatusDown, "excluded after 3 consecutive certificate refresh failures: certificate expired"},
+		"pending":    {ServerStatusPending, "not checked yet"},
+		"route-only": {ServerStatusLive, ""},
+	}
+	for _, server := range status.Servers {
+		if server.Status != want[server.Name].status || server.Reason != want[server.Name].reason {
+			t.Errorf("[%s] status = %q (%q), want %q (%q)",
+				server.Name, server.Status, server.Reason, want[server.Name].status, want[server.Name].reason)
+		}
+	}
+	if server := status.Servers[2]; server.Name != "fallback" || !server.Fallback || server.RTT != 42 {
+		t.Errorf("unexpected fallback server status: %+v", server)
+	}
+	if server := status.Servers[5]; server.Name != "route-only" || !server.RouteOnly || server.Fallback {
+		t.Errorf("unexpected route-only server status: %+v", server)
+	}
+}
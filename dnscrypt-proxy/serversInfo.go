@@ -1,6 +1,8 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	crypto_rand "crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
@@ -14,6 +16,7 @@
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"codeberg.org/miekg/dns"
@@ -25,7 +28,8 @@
 )
 
 const (
-	RTTEwmaDecay = 10.0
+	RTTEwmaDecay          = 10.0
+	EmergencyResolverName = "emergency-resolver"
 )
 
 type RegisteredServer struct {
@@ -61,14 +65,29 @@ type ServerInfo struct {
 	SharedKey          [32]byte
 	MagicQuery         [8]byte
 	knownBugs          ServerBugs
+	fragmentation      *FragmentationDiagnostic // Nil if fragments are already known to be blocked
 	Proto              stamps.StampProtoType
 	useGet             bool
+	forceTCP           bool            // Never query this DNSCrypt server over UDP
+	noLog              bool            // The stamp of the server has the nolog property
+	acceptHeader       string          // Overrides the Accept header of DoH queries, if not empty
+	uriTemplate        *DoHURITemplate // Expanded to get the URL of DoH queries, if not nil
 	odohTargetConfigs  []ODoHTargetConfig
 
 	// WP2 strategy fields
 	totalQueries   uint64    // Total queries sent to this server
 	failedQueries  uint64    // Failed queries count
 	lastUpdateTime time.Time // Last time metrics were updated
+	warmupUntil    time.Time // Latency samples are ignored until then, see lb_warmup_grace
+
+	certNotBefore      time.Time  // Start of the validity period of the DNSCrypt certificate
+	rcodeStats         RcodeStats // Upstream response codes, for monitoring
+	malformedResponses uint64     // Unparseable responses, for monitoring
+	contentTypeErrors  uint64     // DoH responses rejected because of their Content-Type, for monitoring
+	questionMismatches uint64     // Responses to another question than the query, for monitoring
+
+	rateLimiter *TokenBucket // Enforces max_qps, nil if unlimited
+	rateCapped  bool         // Set while the server is over its max_qps limit
 }
 
 type LBStrategy interface {
@@ -149,7 +168,8 @@ type DNSCryptRelay struct {
 }
 
 type ODoHRelay struct {
-	URL *url.URL
+	URL        *url.URL
+	NoBodyHash bool
 }
 
 type Relay struct {
@@ -162,10 +182,21 @@ type Relay struct {
 type ServersInfo struct {
 	sync.RWMutex
 	inner             []*ServerInfo
+	fallback          []*ServerInfo
+	routeOnly         []*ServerInfo // Only used for the names of the query routes they are listed in
+	fallbackMode      bool
+	emergency         *ServerInfo
 	registeredServers []RegisteredServer
 	registeredRelays  []RegisteredServer
 	lbStrategy        LBStrategy
 	lbEstimator       bool
+	lbExplorationRate float64
+	lbStateFile       string
+	lbWarmupGrace     time.Duration
+	savedLBState      map[string]ServerLBState // Saved by a previous run, until the servers are live
+	certRefreshStats  map[string]*CertRefreshStats
+	tlsStats          TLSStats
+	connTimings       ConnTimings
 }
 
 func NewServersInfo() ServersInfo {
@@ -174,6 +205,7 @@ func NewServersInfo() ServersInfo {
 		lbEstimator:       true,
 		registeredServers: make([]RegisteredServer, 0),
 		registeredRelays:  make([]RegisteredServer, 0),
+		certRefreshStats:  make(map[string]*CertRefreshStats),
 	}
 }
 
@@ -204,9 +236,17 @@ func (serversInfo *ServersInfo) registerRelay(name string, stamp stamps.ServerSt
 }
 
 func (serversInfo *ServersInfo) refreshServer(proxy *Proxy, name string, stamp stamps.ServerStamp) error {
+	// Fallback servers are kept apart, so that they are not picked as long as a primary server is live,
+	// and so are the servers that are only used for query routes
+	servers := &serversInfo.inner
+	if includesName(proxy.FallbackServerNames, name) {
+		servers = &serversInfo.fallback
+	} else if proxy.isRouteOnlyServer(name) {
+		servers = &serversInfo.routeOnly
+	}
 	serversInfo.RLock()
 	isNew := true
-	for _, oldServer := range serversInfo.inner {
+	for _, oldServer := range *servers {
 		if oldServer.Name == name {
 			isNew = false
 			break
@@ -214,19 +254,45 @@ func (serversInfo *ServersInfo) refreshServer(proxy *Proxy, name string, stamp s
 	}
 	serversInfo.RUnlock()
 	newServer, err := fetchServerInfo(proxy, name, stamp, isNew)
+	// Only DNSCrypt servers have certificates to refresh
+	wasExcluded := false
+	if stamp.Proto == stamps.StampProtoTypeDNSCrypt {
+		var consecutiveFailures int
+		consecutiveFailures, wasExcluded = serversInfo.recordCertRefresh(name, newServer.certNotBefore, err)
+		if err != nil && proxy.certRefreshMaxFailures > 0 && consecutiveFailures >= proxy.certRefreshMaxFailures {
+			serversInfo.excludeServer(name, consecutiveFailures)
+		}
+	}
 	if err != nil {
 		return err
 	}
+	if wasExcluded {
+		dlog.Noticef("[%s] certificate refreshed - server is live again", name)
+	}
 	if name != newServer.Name {
 		dlog.Fatalf("[%s] != [%s]", name, newServer.Name)
 	}
 	newServer.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
 	newServer.rtt.Set(float64(newServer.initialRtt))
+	if settings, ok := proxy.serverSettings[name]; ok && settings.MaxQPS > 0 {
+		newServer.rateLimiter = NewTokenBucket(settings.MaxQPS, max(1.0, settings.MaxQPS))
+	}
 	isNew = true
 	serversInfo.Lock()
-	for i, oldServer := range serversInfo.inner {
+	for i, oldServer := range *servers {
 		if oldServer.Name == name {
-			serversInfo.inner[i] = &newServer
+			newServer.rcodeStats = oldServer.rcodeStats
+			newServer.malformedResponses = oldServer.malformedResponses
+			newServer.contentTypeErrors = oldServer.contentTypeErrors
+			newServer.questionMismatches = oldServer.questionMismatches
+			newServer.warmupUntil = oldServer.warmupUntil
+			if oldServer.fragmentation != nil && newServer.fragmentation != nil {
+				newServer.fragmentation = oldServer.fragmentation
+			}
+			if oldServer.rateLimiter != nil && newServer.rateLimiter != nil {
+				newServer.rateLimiter = oldServer.rateLimiter
+			}
+			(*servers)[i] = &newServer
 			isNew = false
 			break
 		}
@@ -234,7 +300,11 @@ func (serversInfo *ServersInfo) refreshServer(proxy *Proxy, name string, stamp s
 	serversInfo.Unlock()
 	if isNew {
 		serversInfo.Lock()
-		serversInfo.inner = append(serversInfo.inner, &newServer)
+		if serversInfo.lbWarmupGrace > 0 {
+			newServer.warmupUntil = time.Now().Add(serversInfo.lbWarmupGrace)
+		}
+		serversInfo.restoreLBState(&newServer)
+		*servers = append(*servers, &newServer)
 		serversInfo.Unlock()
 		proxy.serversInfo.registerServer(name, stamp)
 	}
@@ -255,12 +325,17 @@ func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
 	})
 	countChannel := make(chan struct{}, proxy.certRefreshConcurrency)
 	errorChannel := make(chan error, serversCount)
+	var liveRouteOnlyServers atomic.Int32
 	for i := range registeredServers {
 		countChannel <- struct{}{}
 		go func(registeredServer *RegisteredServer) {
 			err := serversInfo.refreshServer(proxy, registeredServer.name, registeredServer.stamp)
 			if err == nil {
-				proxy.xTransport.internalResolverReady = true
+				if proxy.isRouteOnlyServer(registeredServer.name) {
+					liveRouteOnlyServers.Add(1)
+				} else {
+					proxy.xTransport.internalResolverReady = true
+				}
 			}
 			errorChannel <- err
 			<-countChannel
@@ -274,6 +349,8 @@ func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
 			liveServers++
 		}
 	}
+	// Servers only used for query routes can't answer the other queries
+	liveServers -= int(liveRouteOnlyServers.Load())
 	if liveServers > 0 {
 		err = nil
 	}
@@ -281,6 +358,12 @@ func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
 	sort.SliceStable(serversInfo.inner, func(i, j int) bool {
 		return serversInfo.inner[i].initialRtt < serversInfo.inner[j].initialRtt
 	})
+	sort.SliceStable(serversInfo.fallback, func(i, j int) bool {
+		return serversInfo.fallback[i].initialRtt < serversInfo.fallback[j].initialRtt
+	})
+	sort.SliceStable(serversInfo.routeOnly, func(i, j int) bool {
+		return serversInfo.routeOnly[i].initialRtt < serversInfo.routeOnly[j].initialRtt
+	})
 	inner := serversInfo.inner
 	innerLen := len(inner)
 	if innerLen > 1 {
@@ -292,10 +375,49 @@ func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
 	if innerLen > 0 {
 		dlog.Noticef("Server with the lowest initial latency: %s (rtt: %dms), live servers: %d", inner[0].Name, inner[0].initialRtt, innerLen)
 	}
+	if fallbackLen := len(serversInfo.fallback); fallbackLen > 0 {
+		dlog.Noticef("Live fallback servers: %d", fallbackLen)
+	}
+	if routeOnlyLen := len(serversInfo.routeOnly); routeOnlyLen > 0 {
+		dlog.Noticef("Live servers only used for query routes: %d", routeOnlyLen)
+	}
 	serversInfo.Unlock()
+	if proxy.emergencyResolver != nil {
+		serversInfo.refreshEmergency(proxy, liveServers)
+	}
 	return liveServers, err
 }
 
+// refreshEmergency - Activates the emergency resolver when no other servers are live, and drops it as soon as one is.
+// The emergency resolver is never contacted as long as other servers work.
+func (serversInfo *ServersInfo) refreshEmergency(proxy *Proxy, liveServers int) {
+	if liveServers > 0 {
+		serversInfo.Lock()
+		wasActive := serversInfo.emergency != nil
+		serversInfo.emergency = nil
+		serversInfo.Unlock()
+		if wasActive {
+			dlog.Notice("Servers are live again - The emergency resolver is not used any more")
+		}
+		return
+	}
+	newServer, err := fetchServerInfo(proxy, EmergencyResolverName, *proxy.emergencyResolver, true)
+	if err != nil {
+		dlog.Criticalf("No servers are live, and the emergency resolver is not reachable either: [%v]", err)
+		return
+	}
+	newServer.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+	newServer.rtt.Set(float64(newServer.initialRtt))
+	serversInfo.Lock()
+	wasActive := serversInfo.emergency != nil
+	serversInfo.emergency = &newServer
+	serversInfo.Unlock()
+	proxy.xTransport.internalResolverReady = true
+	if !wasActive {
+		dlog.Criticalf("No servers are live - All queries are now sent to the emergency resolver [%s]", newServer.HostName)
+	}
+}
+
 func (serversInfo *ServersInfo) estimatorUpdate(currentActive int) {
 	// serversInfo.RWMutex is assumed to be Locked
 	serversCount := len(serversInfo.inner)
@@ -346,8 +468,13 @@ func (serversInfo *ServersInfo) getOne() *ServerInfo {
 	serversInfo.Lock()
 	serversCount := len(serversInfo.inner)
 	if serversCount <= 0 {
+		serverInfo := serversInfo.getFallbackCandidate()
 		serversInfo.Unlock()
-		return nil
+		return serverInfo
+	}
+	if serversInfo.fallbackMode {
+		dlog.Noticef("[%s] is live again - Leaving fallback mode", serversInfo.inner[0].Name)
+		serversInfo.fallbackMode = false
 	}
 
 	var candidate int
@@ -361,8 +488,17 @@ func (serversInfo *ServersInfo) getOne() *ServerInfo {
 			serversInfo.estimatorUpdate(candidate)
 		}
 	}
+	candidate = serversInfo.explore(candidate, serversCount)
 
 	serverInfo := serversInfo.inner[candidate]
+	if !serversInfo.allowQuery(serverInfo) {
+		serverInfo = serversInfo.getSpilloverCandidate(serverInfo)
+		if serverInfo == nil {
+			dlog.Warn("All the servers reached their max_qps limit")
+			serversInfo.Unlock()
+			return nil
+		}
+	}
 	dlog.Debugf("Using candidate [%s] RTT: %d Score: %.3f",
 		serverInfo.Name,
 		int(serverInfo.rtt.Value()),
@@ -372,6 +508,168 @@ func (serversInfo *ServersInfo) getOne() *ServerInfo {
 	return serverInfo
 }
 
+// explore replaces the selected candidate with another random server for a lb_exploration_rate fraction
+// of the queries, so that traffic is spread and the RTT of other servers stays up to date
+func (serversInfo *ServersInfo) explore(candidate int, serversCount int) int {
+	if serversInfo.lbExplorationRate <= 0 || serversCount < 2 || rand.Float64() >= serversInfo.lbExplorationRate {
+		return candidate
+	}
+	other := rand.Intn(serversCount - 1)
+	if other >= candidate {
+		other++
+	}
+	dlog.Debugf("Exploring [%s] instead of [%s]", serversInfo.inner[other].Name, serversInfo.inner[candidate].Name)
+	return other
+}
+
+// getFallbackCandidate returns the fallback server with the lowest latency that is under its max_qps limit,
+// entering fallback mode if needed; serversInfo must be locked
+func (serversInfo *ServersInfo) getFallbackCandidate() *ServerInfo {
+	if len(serversInfo.fallback) == 0 {
+		return serversInfo.emergency
+	}
+	if !serversInfo.fallbackMode {
+		dlog.Warn("No primary servers are live - Entering fallback mode")
+		serversInfo.fallbackMode = true
+	}
+	candidates := slices.Clone(serversInfo.fallback)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rtt.Value() < candidates[j].rtt.Value()
+	})
+	for _, server := range candidates {
+		if serversInfo.allowQuery(server) {
+			dlog.Debugf("Using fallback server [%s] RTT: %d", server.Name, int(server.rtt.Value()))
+			return server
+		}
+	}
+	dlog.Warn("All the fallback servers reached their max_qps limit")
+	return nil
+}
+
+// lowestRTT returns the lowest average RTT of the servers, in milliseconds, or -1 if there are no live servers
+func (serversInfo *ServersInfo) lowestRTT() float64 {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	servers := serversInfo.inner
+	if len(servers) == 0 {
+		servers = serversInfo.fallback
+	}
+	lowest := -1.0
+	for _, server := range servers {
+		if rtt := server.rtt.Value(); rtt > 0 && (lowest < 0 || rtt < lowest) {
+			lowest = rtt
+		}
+	}
+	return lowest
+}
+
+// getOneOf returns a live server among the given names, including the servers only used for query routes, and
+// fallback servers if none of the other servers matches, or nil if none of them is live
+func (serversInfo *ServersInfo) getOneOf(names []string) *ServerInfo {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+	var candidates []*ServerInfo
+	for _, servers := range [][]*ServerInfo{slices.Concat(serversInfo.inner, serversInfo.routeOnly), serversInfo.fallback} {
+		for _, server := range servers {
+			if includesName(names, server.Name) {
+				candidates = append(candidates, server)
+			}
+		}
+		if len(candidates) > 0 {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	first := serversInfo.lbStrategy.getCandidate(len(candidates))
+	for i := range candidates {
+		server := candidates[(first+i)%len(candidates)]
+		if serversInfo.allowQuery(server) {
+			return server
+		}
+	}
+	return nil
+}
+
+// getOther returns a server other than excluded, to retry a query that failed
+func (serversInfo *ServersInfo) getOther(excluded *ServerInfo) *ServerInfo {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+	if len(serversInfo.inner) == 0 {
+		for _, server := range serversInfo.fallback {
+			if server != excluded && serversInfo.allowQuery(server) {
+				return server
+			}
+		}
+		return nil
+	}
+	return serversInfo.getSpilloverCandidate(excluded)
+}
+
+// getFanout returns up to count servers other than excluded, by decreasing score, to send the same query to
+func (serversInfo *ServersInfo) getFanout(excluded *ServerInfo, count int, noLogOnly bool) []*ServerInfo {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+	candidates := make([]*ServerInfo, 0, len(serversInfo.inner))
+	for _, server := range serversInfo.inner {
+		if server != excluded && (server.noLog || !noLogOnly) {
+			candidates = append(candidates, server)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return serversInfo.calculateServerScore(candidates[i]) > serversInfo.calculateServerScore(candidates[j])
+	})
+	servers := make([]*ServerInfo, 0, count)
+	for _, server := range candidates {
+		if len(servers) >= count {
+			break
+		}
+		if serversInfo.allowQuery(server) {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// allowQuery enforces max_qps for a server; serversInfo must be locked
+func (serversInfo *ServersInfo) allowQuery(server *ServerInfo) bool {
+	if server.rateLimiter == nil {
+		return true
+	}
+	if !server.rateLimiter.Allow() {
+		if !server.rateCapped {
+			dlog.Noticef("[%s] reached its max_qps limit (%v) - Sending excess queries to other servers", server.Name, server.rateLimiter.rate)
+			server.rateCapped = true
+		}
+		return false
+	}
+	if server.rateCapped {
+		dlog.Infof("[%s] is back under its max_qps limit", server.Name)
+		server.rateCapped = false
+	}
+	return true
+}
+
+// getSpilloverCandidate returns the best-scoring server other than excluded that is under its max_qps limit
+func (serversInfo *ServersInfo) getSpilloverCandidate(excluded *ServerInfo) *ServerInfo {
+	candidates := make([]*ServerInfo, 0, len(serversInfo.inner)-1)
+	for _, server := range serversInfo.inner {
+		if server != excluded {
+			candidates = append(candidates, server)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return serversInfo.calculateServerScore(candidates[i]) > serversInfo.calculateServerScore(candidates[j])
+	})
+	for _, server := range candidates {
+		if serversInfo.allowQuery(server) {
+			return server
+		}
+	}
+	return nil
+}
+
 // getWeightedCandidate implements the WP2 algorithm
 func (serversInfo *ServersInfo) getWeightedCandidate(serversCount int) int {
 	if serversCount <= 1 {
@@ -441,11 +739,12 @@ func (serversInfo *ServersInfo) updateServerStats(serverName string, success boo
 
 	for _, server := range serversInfo.inner {
 		if server.Name == serverName {
+			now := time.Now()
 			server.totalQueries++
-			if !success {
+			if !success && !server.warmingUp(now) {
 				server.failedQueries++
 			}
-			server.lastUpdateTime = time.Now()
+			server.lastUpdateTime = now
 
 			// Reset counters periodically to prevent overflow and adapt to changes
 			if server.totalQueries > 10000 {
@@ -457,6 +756,58 @@ func (serversInfo *ServersInfo) updateServerStats(serverName string, success boo
 	}
 }
 
+// updateServerRcodeStats records the response code returned by an upstream server
+func (serversInfo *ServersInfo) updateServerRcodeStats(serverName string, rcode uint8) {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+
+	for _, server := range serversInfo.inner {
+		if server.Name == serverName {
+			server.rcodeStats.record(rcode, time.Now())
+			break
+		}
+	}
+}
+
+// countMalformedResponse records an unparseable response returned by an upstream server
+func (serversInfo *ServersInfo) countMalformedResponse(serverName string) {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+
+	for _, server := range serversInfo.inner {
+		if server.Name == serverName {
+			server.malformedResponses++
+			break
+		}
+	}
+}
+
+// countContentTypeError records a DoH response rejected because of an unexpected Content-Type
+func (serversInfo *ServersInfo) countContentTypeError(serverName string) {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+
+	for _, server := range serversInfo.inner {
+		if server.Name == serverName {
+			server.contentTypeErrors++
+			break
+		}
+	}
+}
+
+// countQuestionMismatch records a response whose question section didn't match the query
+func (serversInfo *ServersInfo) countQuestionMismatch(serverName string) {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+
+	for _, server := range serversInfo.inner {
+		if server.Name == serverName {
+			server.questionMismatches++
+			break
+		}
+	}
+}
+
 // logWP2Stats logs WP2 performance statistics for debugging
 func (serversInfo *ServersInfo) logWP2Stats() {
 	if _, isWP2 := serversInfo.lbStrategy.(LBStrategyWP2); !isWP2 {
@@ -479,15 +830,80 @@ func (serversInfo *ServersInfo) logWP2Stats() {
 	}
 }
 
+// serverResolutionOrder returns the resolution strategies configured for the host name of a server, if any.
+// A per-server resolution_order takes precedence over a per-server ignore_system_dns.
+func serverResolutionOrder(settings ServerSettingsConfig) []string {
+	if len(settings.ResolutionOrder) > 0 {
+		return settings.ResolutionOrder
+	}
+	if settings.IgnoreSystemDNS == nil {
+		return nil
+	}
+	if *settings.IgnoreSystemDNS {
+		return []string{ResolutionStrategyInternal, ResolutionStrategyBootstrap, ResolutionStrategySystem}
+	}
+	return []string{ResolutionStrategySystem, ResolutionStrategyBootstrap}
+}
+
+// dohServerTimeout returns the timeout of queries to a DoH server, that covers the connect and response timeouts
+// configured for that server, if any
+func dohServerTimeout(proxy *Proxy, settings ServerSettingsConfig) (HostTimeout, time.Duration) {
+	hostTimeout := HostTimeout{
+		connect:  time.Duration(settings.ConnectTimeout) * time.Millisecond,
+		response: time.Duration(settings.ResponseTimeout) * time.Millisecond,
+	}
+	if hostTimeout.connect <= 0 && hostTimeout.response <= 0 {
+		return hostTimeout, proxy.timeout
+	}
+	return hostTimeout, max(proxy.timeout, cmp.Or(hostTimeout.connect, proxy.timeout)+cmp.Or(hostTimeout.response, proxy.timeout))
+}
+
 func fetchServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	if stamp.Proto == stamps.StampProtoTypeDoH || stamp.Proto == stamps.StampProtoTypeODoHTarget {
+		host, _ := ExtractHostAndPort(stamp.ProviderName, 443)
+		if order := serverResolutionOrder(proxy.serverSettings[name]); len(order) > 0 {
+			proxy.xTransport.setHostResolutionOrder(host, order)
+		}
+		if policy := proxy.serverSettings[name].SessionResumption; len(policy) > 0 {
+			proxy.xTransport.setHostSessionResumption(host, policy)
+		}
+	}
+	if stamp.Proto == stamps.StampProtoTypeDoH {
+		if hostTimeout, _ := dohServerTimeout(proxy, proxy.serverSettings[name]); hostTimeout != (HostTimeout{}) {
+			host, _ := ExtractHostAndPort(stamp.ProviderName, 443)
+			proxy.xTransport.setHostTimeout(host, hostTimeout)
+		}
+	}
+	if hostProxy, ok := proxy.serverProxies[name]; ok {
+		hostAndPort := stamp.ProviderName
+		if stamp.Proto == stamps.StampProtoTypeDNSCrypt {
+			hostAndPort = stamp.ServerAddrStr
+		}
+		host, _ := ExtractHostAndPort(hostAndPort, 443)
+		proxy.xTransport.setHostProxy(host, hostProxy)
+	}
+	var serverInfo ServerInfo
+	var err error
 	if stamp.Proto == stamps.StampProtoTypeDNSCrypt {
-		return fetchDNSCryptServerInfo(proxy, name, stamp, isNew)
+		serverInfo, err = fetchDNSCryptServerInfo(proxy, name, stamp, isNew)
 	} else if stamp.Proto == stamps.StampProtoTypeDoH {
-		return fetchDoHServerInfo(proxy, name, stamp, isNew)
+		serverInfo, err = fetchDoHServerInfo(proxy, name, stamp, isNew)
 	} else if stamp.Proto == stamps.StampProtoTypeODoHTarget {
-		return fetchODoHTargetInfo(proxy, name, stamp, isNew)
+		serverInfo, err = fetchODoHTargetInfo(proxy, name, stamp, isNew)
+	} else {
+		return ServerInfo{}, fmt.Errorf("Unsupported protocol for [%s]: [%s]", name, stamp.Proto.String())
+	}
+	if err == nil {
+		if err := checkServerIPOrigin(proxy, name, stamp, &serverInfo); err != nil {
+			return ServerInfo{}, err
+		}
+		serverInfo.noLog = stamp.Props&stamps.ServerInformalPropertyNoLog != 0
+		serverInfo.acceptHeader = proxy.serverAcceptHeaders[name]
+		if serverInfo.Proto == stamps.StampProtoTypeDoH {
+			serverInfo.uriTemplate = proxy.serverURITemplates[name]
+		}
 	}
-	return ServerInfo{}, fmt.Errorf("Unsupported protocol for [%s]: [%s]", name, stamp.Proto.String())
+	return serverInfo, err
 }
 
 func findFarthestRoute(proxy *Proxy, name string, relayStamps []stamps.ServerStamp) *stamps.ServerStamp {
@@ -692,8 +1108,13 @@ func route(proxy *Proxy, name string, serverProto stamps.StampProtoType) (*Relay
 			}
 		}
 		dlog.Noticef("Anonymizing queries for [%v] via [%v]", name, relayName)
+		noBodyHash := slices.Contains(proxy.relaysWithoutBodyHash, relayName)
+		if noBodyHash {
+			dlog.Infof("Not sending body_hash to relay [%v]", relayName)
+		}
 		return &Relay{Proto: stamps.StampProtoTypeODoHRelay, ODoH: &ODoHRelay{
-			URL: relayURLforTarget,
+			URL:        relayURLforTarget,
+			NoBodyHash: noBodyHash,
 		}, Name: relayName}, nil
 	}
 	return nil, fmt.Errorf("Invalid relay set for server [%v]", name)
@@ -721,10 +1142,19 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 	if relay != nil {
 		dnscryptRelay = relay.Dnscrypt
 	}
+	forceTCP := proxy.serverSettings[name].ForceTCP
+	// Like with the global proxy, servers reached through a proxy are only queried over TCP
+	if host, _ := ExtractHostAndPort(stamp.ServerAddrStr, stamps.DefaultPort); proxy.xTransport.proxyDialerFor(host) != nil {
+		forceTCP = true
+	}
+	proto := proxy.xTransport.mainProto
+	if forceTCP {
+		proto = "tcp"
+	}
 	certInfo, rtt, fragmentsBlocked, err := FetchCurrentDNSCryptCert(
 		proxy,
 		&name,
-		proxy.xTransport.mainProto,
+		proto,
 		stamp.ServerPk,
 		stamp.ServerAddrStr,
 		stamp.ProviderName,
@@ -747,6 +1177,11 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 	if err != nil {
 		return ServerInfo{}, err
 	}
+	// Adding a relayed server to fragments_blocked would make it non-anonymous, so it is not suggested
+	var fragmentation *FragmentationDiagnostic
+	if !knownBugs.fragmentsBlocked && relay == nil {
+		fragmentation = &FragmentationDiagnostic{}
+	}
 	remoteUDPAddr, err := net.ResolveUDPAddr("udp", stamp.ServerAddrStr)
 	if err != nil {
 		return ServerInfo{}, err
@@ -760,7 +1195,7 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 		query := plainNXTestPacket(0xcafe)
 		msg, _, _, err := DNSExchange(
 			proxy,
-			proxy.xTransport.mainProto,
+			proto,
 			query,
 			stamp.ServerAddrStr,
 			dnscryptRelay,
@@ -809,6 +1244,9 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 		Relay:              relay,
 		initialRtt:         rtt,
 		knownBugs:          knownBugs,
+		fragmentation:      fragmentation,
+		forceTCP:           forceTCP,
+		certNotBefore:      certInfo.NotBefore,
 	}, nil
 }
 
@@ -878,17 +1316,19 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 		Host:   stamp.ProviderName,
 		Path:   stamp.Path,
 	}
+	ctx := withURITemplate(withAcceptHeader(context.Background(), proxy.serverAcceptHeaders[name]), proxy.serverURITemplates[name])
+	_, timeout := dohServerTimeout(proxy, proxy.serverSettings[name])
 	body := dohTestPacket(0xcafe)
 	useGet := false
-	if _, _, _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout); err != nil {
+	if _, _, _, _, err := proxy.xTransport.DoHQuery(ctx, useGet, url, body, timeout); err != nil {
 		useGet = true
-		if _, _, _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout); err != nil {
+		if _, _, _, _, err := proxy.xTransport.DoHQuery(ctx, useGet, url, body, timeout); err != nil {
 			return ServerInfo{}, err
 		}
 		dlog.Debugf("Server [%s] doesn't appear to support POST; falling back to GET requests", name)
 	}
 	body = dohNXTestPacket(0xcafe)
-	serverResponse, _, tls, rtt, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout)
+	serverResponse, _, tls, rtt, err := proxy.xTransport.DoHQuery(ctx, useGet, url, body, timeout)
 	if err != nil {
 		dlog.Infof("[%s] [%s]: %v", name, url, err)
 		return ServerInfo{}, err
@@ -953,7 +1393,7 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 	return ServerInfo{
 		Proto:      stamps.StampProtoTypeDoH,
 		Name:       name,
-		Timeout:    proxy.timeout,
+		Timeout:    timeout,
 		URL:        url,
 		HostName:   stamp.ProviderName,
 		initialRtt: xrtt,
@@ -1018,6 +1458,7 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 	})
 	for _, odohTargetConfig := range odohTargetConfigs {
 		url := relay.ODoH.URL
+		bodyHash := !relay.ODoH.NoBodyHash
 
 		query := dohTestPacket(0xcafe)
 		odohQuery, err := odohTargetConfig.encryptQuery(query)
@@ -1026,9 +1467,9 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 		}
 
 		useGet := false
-		if _, _, _, _, err := proxy.xTransport.ObliviousDoHQuery(useGet, url, odohQuery.odohMessage, proxy.timeout); err != nil {
+		if _, _, _, _, err := proxy.xTransport.ObliviousDoHQuery(context.Background(), useGet, url, odohQuery.odohMessage, proxy.timeout, bodyHash); err != nil {
 			useGet = true
-			if _, _, _, _, err := proxy.xTransport.ObliviousDoHQuery(useGet, url, odohQuery.odohMessage, proxy.timeout); err != nil {
+			if _, _, _, _, err := proxy.xTransport.ObliviousDoHQuery(context.Background(), useGet, url, odohQuery.odohMessage, proxy.timeout, bodyHash); err != nil {
 				continue
 			}
 			dlog.Debugf("Server [%s] doesn't appear to support POST; falling back to GET requests", name)
@@ -1041,10 +1482,12 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 		}
 
 		responseBody, responseCode, tls, rtt, err := proxy.xTransport.ObliviousDoHQuery(
+			context.Background(),
 			useGet,
 			url,
 			odohQuery.odohMessage,
 			proxy.timeout,
+			bodyHash,
 		)
 		if err != nil {
 			continue
@@ -1159,7 +1602,9 @@ func fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, is
 
 func (serverInfo *ServerInfo) noticeFailure(proxy *Proxy) {
 	proxy.serversInfo.Lock()
-	serverInfo.rtt.Add(float64(proxy.timeout.Nanoseconds() / 1000000))
+	if !serverInfo.warmingUp(time.Now()) {
+		serverInfo.rtt.Add(float64(proxy.timeout.Nanoseconds() / 1000000))
+	}
 	proxy.serversInfo.Unlock()
 }
 
@@ -1174,8 +1619,14 @@ func (serverInfo *ServerInfo) noticeSuccess(proxy *Proxy) {
 	proxy.serversInfo.Lock()
 	elapsed := now.Sub(serverInfo.lastActionTS)
 	elapsedMs := elapsed.Nanoseconds() / 1000000
-	if elapsedMs > 0 && elapsed < proxy.timeout {
+	if elapsedMs > 0 && elapsed < proxy.timeout && !serverInfo.warmingUp(now) {
 		serverInfo.rtt.Add(float64(elapsedMs))
 	}
 	proxy.serversInfo.Unlock()
 }
+
+// warmingUp - Returns true while the first queries to a server, that include connection and handshake delays,
+// shouldn't be used to estimate its latency
+func (serverInfo *ServerInfo) warmingUp(now time.Time) bool {
+	return now.Before(serverInfo.warmupUntil)
+}
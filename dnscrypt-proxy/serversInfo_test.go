@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/ewma"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+func TestLBExplorationRate(t *testing.T) {
+	serversInfo := NewServersInfo()
+	serversInfo.lbStrategy = LBStrategyFirst{}
+	serversInfo.lbEstimator = false
+	for i := range 4 {
+		server := &ServerInfo{Name: fmt.Sprintf("server-%d", i)}
+		server.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+		server.rtt.Set(float64(10 * (i + 1)))
+		serversInfo.inner = append(serversInfo.inner, server)
+	}
+
+	countExplored := func(queries int) (int, map[string]int) {
+		explored, uses := 0, make(map[string]int)
+		for range queries {
+			server := serversInfo.getOne()
+			uses[server.Name]++
+			if server.Name != "server-0" {
+				explored++
+			}
+		}
+		return explored, uses
+	}
+
+	if explored, _ := countExplored(1000); explored != 0 {
+		t.Errorf("without exploration, %d queries out of 1000 didn't use the fastest server", explored)
+	}
+
+	serversInfo.lbExplorationRate = 0.1
+	const queries = 20000
+	explored, uses := countExplored(queries)
+	if fraction := float64(explored) / queries; fraction < 0.08 || fraction > 0.12 {
+		t.Errorf("explored fraction = %.3f, want about 0.1", fraction)
+	}
+	for i := 1; i < 4; i++ {
+		if name := fmt.Sprintf("server-%d", i); uses[name] == 0 {
+			t.Errorf("[%s] was never explored", name)
+		}
+	}
+}
+
+func TestLBWarmupGrace(t *testing.T) {
+	proxy := NewProxy()
+	proxy.timeout = 5 * time.Second
+	server := &ServerInfo{Name: "warming-up", warmupUntil: time.Now().Add(time.Minute)}
+	server.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+	server.rtt.Set(50)
+	proxy.serversInfo.inner = []*ServerInfo{server}
+
+	server.lastActionTS = time.Now().Add(-2 * time.Second)
+	server.noticeSuccess(proxy)
+	server.noticeFailure(proxy)
+	proxy.serversInfo.updateServerStats(server.Name, false)
+	if rtt := server.rtt.Value(); rtt != 50 {
+		t.Errorf("rtt = %v during the warmup grace, want 50", rtt)
+	}
+	if server.failedQueries != 0 {
+		t.Errorf("failed queries = %d during the warmup grace, want 0", server.failedQueries)
+	}
+
+	server.warmupUntil = time.Time{}
+	server.noticeFailure(proxy)
+	proxy.serversInfo.updateServerStats(server.Name, false)
+	if rtt := server.rtt.Value(); rtt <= 50 {
+		t.Errorf("rtt = %v after the warmup grace, failures should be accounted for", rtt)
+	}
+	if server.failedQueries != 1 {
+		t.Errorf("failed queries = %d after the warmup grace, want 1", server.failedQueries)
+	}
+}
+
+func TestFallbackServers(t *testing.T) {
+	newServer := func(name string, rtt int) *ServerInfo {
+		server := &ServerInfo{Name: name}
+		server.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+		server.rtt.Set(float64(rtt))
+		return server
+	}
+
+	serversInfo := NewServersInfo()
+	serversInfo.lbStrategy = LBStrategyFirst{}
+	serversInfo.lbEstimator = false
+	primary := newServer("primary", 50)
+	serversInfo.inner = []*ServerInfo{primary}
+	serversInfo.fallback = []*ServerInfo{newServer("slow-fallback", 100), newServer("fast-fallback", 10)}
+
+	if server := serversInfo.getOne(); server != primary || serversInfo.fallbackMode {
+		t.Fatalf("the primary server should be used while it is live, got %v", server)
+	}
+
+	// With fallback servers, the last primary server can be excluded
+	if !serversInfo.excludeServer("primary", 3) {
+		t.Fatal("the primary server should have been excluded")
+	}
+	server := serversInfo.getOne()
+	if server == nil || server.Name != "fast-fallback" || !serversInfo.fallbackMode {
+		t.Fatalf("the fastest fallback server should be used, got %v", server)
+	}
+	if other := serversInfo.getOther(server); other == nil || other.Name != "slow-fallback" {
+		t.Errorf("retries should use another fallback server, got %v", other)
+	}
+
+	// Without primary servers, the last fallback server is kept
+	if !serversInfo.excludeServer("fast-fallback", 3) {
+		t.Fatal("a fallback server should be excluded while another one is live")
+	}
+	if serversInfo.excludeServer("slow-fallback", 3) {
+		t.Error("the last fallback server should not be excluded")
+	}
+	if server := serversInfo.getOne(); server == nil || server.Name != "slow-fallback" {
+		t.Fatalf("the last fallback server should still be used, got %v", server)
+	}
+
+	serversInfo.inner = []*ServerInfo{primary}
+	if server := serversInfo.getOne(); server != primary || serversInfo.fallbackMode {
+		t.Errorf("fallback mode should be left once a primary server is live, got %v", server)
+	}
+}
+
+func TestEmergencyResolver(t *testing.T) {
+	serversInfo := NewServersInfo()
+	serversInfo.lbStrategy = LBStrategyFirst{}
+	serversInfo.lbEstimator = false
+	if server := serversInfo.getOne(); server != nil {
+		t.Fatalf("no server should be used without an emergency resolver, got %v", server)
+	}
+
+	emergency := &ServerInfo{Name: EmergencyResolverName}
+	serversInfo.emergency = emergency
+	if server := serversInfo.getOne(); server != emergency {
+		t.Fatalf("the emergency resolver should be used when no other servers are live, got %v", server)
+	}
+
+	fallback := &ServerInfo{Name: "fallback", rtt: ewma.NewMovingAverage(RTTEwmaDecay)}
+	serversInfo.fallback = []*ServerInfo{fallback}
+	if server := serversInfo.getOne(); server != fallback {
+		t.Errorf("fallback servers should be preferred over the emergency resolver, got %v", server)
+	}
+
+	serversInfo.fallback = nil
+	serversInfo.refreshEmergency(&Proxy{}, 1)
+	if serversInfo.emergency != nil {
+		t.Fatal("the emergency resolver should be dropped once other servers are live")
+	}
+	if server := serversInfo.getOne(); server != nil {
+		t.Errorf("the emergency resolver should not be used any more, got %v", server)
+	}
+}
+
+func TestODoHRelayNoBodyHash(t *testing.T) {
+	var withBodyHash atomic.Bool
+	relayServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		withBodyHash.Store(r.URL.Query().Has("body_hash"))
+		w.Header().Set("Content-Type", "application/oblivious-dns-message")
+		w.Write([]byte{0})
+	}))
+	t.Cleanup(relayServer.Close)
+	relayHost := strings.TrimPrefix(relayServer.URL, "https://")
+
+	proxy := NewProxy()
+	proxy.timeout = 5 * time.Second
+	proxy.xTransport = NewXTransport()
+	proxy.xTransport.rebuildTransport()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(relayServer.Certificate())
+	proxy.xTransport.transport.TLSClientConfig.RootCAs = rootCAs
+	proxy.relaysWithoutBodyHash = []string{"relay-without-hash"}
+	for _, relayName := range []string{"relay-with-hash", "relay-without-hash"} {
+		proxy.serversInfo.registeredRelays = append(proxy.serversInfo.registeredRelays, RegisteredServer{
+			name:  relayName,
+			stamp: stamps.ServerStamp{Proto: stamps.StampProtoTypeODoHRelay, ProviderName: relayHost, Path: "/" + relayName},
+		})
+	}
+	proxy.serversInfo.registeredServers = []RegisteredServer{{
+		name:  "target",
+		stamp: stamps.ServerStamp{Proto: stamps.StampProtoTypeODoHTarget, ProviderName: "target.example", Path: "/dns-query"},
+	}}
+
+	for _, tt := range []struct {
+		relayName    string
+		wantBodyHash bool
+	}{
+		{"relay-with-hash", true},
+		{"relay-without-hash", false},
+	} {
+		proxy.routes = &map[string][]string{"target": {tt.relayName}}
+		relay, err := route(proxy, "target", stamps.StampProtoTypeODoHTarget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if relay.ODoH.NoBodyHash == tt.wantBodyHash {
+			t.Errorf("[%s]: NoBodyHash = %v", tt.relayName, relay.ODoH.NoBodyHash)
+		}
+		if _, _, _, _, err := proxy.xTransport.ObliviousDoHQuery(
+			context.Background(), false, relay.ODoH.URL, []byte("query"), proxy.timeout, !relay.ODoH.NoBodyHash,
+		); err != nil {
+			t.Fatal(err)
+		}
+		if withBodyHash.Load() != tt.wantBodyHash {
+			t.Errorf("[%s]: body_hash sent = %v, want %v", tt.relayName, withBodyHash.Load(), tt.wantBodyHash)
+		}
+	}
+}
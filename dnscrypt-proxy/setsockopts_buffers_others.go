@@ -0,0 +1,12 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func socketBufferSizes(rawConn syscall.RawConn) (int, int, error) {
+	return 0, 0, errors.New("Socket buffer sizes are not available on this platform")
+}
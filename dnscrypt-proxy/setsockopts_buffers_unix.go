@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketBufferSizes returns the receive and send buffer sizes of a socket, as reported by the kernel
+func socketBufferSizes(rawConn syscall.RawConn) (rcvBuf int, sndBuf int, err error) {
+	controlErr := rawConn.Control(func(fd uintptr) {
+		if rcvBuf, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF); err != nil {
+			return
+		}
+		sndBuf, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	})
+	if controlErr != nil {
+		return 0, 0, controlErr
+	}
+	return rcvBuf, sndBuf, err
+}
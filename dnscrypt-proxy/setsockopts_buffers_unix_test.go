@@ -0,0 +1,35 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestListenUDPBufferSizes(t *testing.T) {
+	proxy := NewProxy()
+	proxy.listenUDPRcvBuf = 65536
+	proxy.listenUDPSndBuf = 32768
+	listenConfig, err := proxy.udpListenerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rawConn, err := conn.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcvBuf, sndBuf, err := socketBufferSizes(rawConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcvBuf < proxy.listenUDPRcvBuf || sndBuf < proxy.listenUDPSndBuf {
+		t.Errorf("buffer sizes = %d/%d, want at least %d/%d", rcvBuf, sndBuf, proxy.listenUDPRcvBuf, proxy.listenUDPSndBuf)
+	}
+}
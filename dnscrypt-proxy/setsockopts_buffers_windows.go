@@ -0,0 +1,21 @@
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// socketBufferSizes returns the receive and send buffer sizes of a socket, as reported by the kernel
+func socketBufferSizes(rawConn syscall.RawConn) (rcvBuf int, sndBuf int, err error) {
+	controlErr := rawConn.Control(func(fd uintptr) {
+		if rcvBuf, err = windows.GetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_RCVBUF); err != nil {
+			return
+		}
+		sndBuf, err = windows.GetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_SNDBUF)
+	})
+	if controlErr != nil {
+		return 0, 0, controlErr
+	}
+	return rcvBuf, sndBuf, err
+}
@@ -8,7 +8,9 @@
 func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
 	return &net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
+			var reuseErr error
 			_ = c.Control(func(fd uintptr) {
+				reuseErr = proxy.setReuseOptions(fd)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_FREEBIND, 1)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_DF, 0)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, 0x70)
@@ -21,8 +23,17 @@ func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
 				)
 				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, 4096)
 				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUFFORCE, 4096)
+				// Configured sizes are also applied without privileges, within the limits set by the system
+				if proxy.listenUDPRcvBuf > 0 &&
+					syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, proxy.listenUDPRcvBuf) != nil {
+					_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, proxy.listenUDPRcvBuf)
+				}
+				if proxy.listenUDPSndBuf > 0 &&
+					syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUFFORCE, proxy.listenUDPSndBuf) != nil {
+					_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, proxy.listenUDPSndBuf)
+				}
 			})
-			return nil
+			return reuseErr
 		},
 	}, nil
 }
@@ -30,13 +41,15 @@ func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
 func (proxy *Proxy) tcpListenerConfig() (*net.ListenConfig, error) {
 	return &net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
+			var reuseErr error
 			_ = c.Control(func(fd uintptr) {
+				reuseErr = proxy.setReuseOptions(fd)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_FREEBIND, 1)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, 0x70)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, 0x70)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_QUICKACK, 1)
 			})
-			return nil
+			return reuseErr
 		},
 	}, nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"net"
 	"syscall"
 )
@@ -8,15 +9,17 @@
 func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
 	return &net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
+			var reuseErr error
 			_ = c.Control(func(fd uintptr) {
+				reuseErr = proxy.setReuseOptions(fd)
 				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDANY, 1)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_DF, 0)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, 0x70)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, 0x70)
-				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096)
-				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, 4096)
+				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, cmp.Or(proxy.listenUDPRcvBuf, 4096))
+				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, cmp.Or(proxy.listenUDPSndBuf, 4096))
 			})
-			return nil
+			return reuseErr
 		},
 	}, nil
 }
@@ -24,12 +27,14 @@ func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
 func (proxy *Proxy) tcpListenerConfig() (*net.ListenConfig, error) {
 	return &net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
+			var reuseErr error
 			_ = c.Control(func(fd uintptr) {
+				reuseErr = proxy.setReuseOptions(fd)
 				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDANY, 1)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, 0x70)
 				_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, 0x70)
 			})
-			return nil
+			return reuseErr
 		},
 	}, nil
 }
@@ -0,0 +1,5 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package main
+
+const reuseOptionsSupported = false
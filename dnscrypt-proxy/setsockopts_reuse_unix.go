@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const reuseOptionsSupported = true
+
+// setReuseOptions - Sets SO_REUSEADDR and SO_REUSEPORT on a listening socket if they were enabled, so that another
+// instance can bind to the same address while this one is still running
+func (proxy *Proxy) setReuseOptions(fd uintptr) error {
+	if proxy.listenReuseAddr {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return fmt.Errorf("Unable to set SO_REUSEADDR: %w", err)
+		}
+	}
+	if proxy.listenReusePort {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return fmt.Errorf("Unable to set SO_REUSEPORT: %w", err)
+		}
+	}
+	return nil
+}
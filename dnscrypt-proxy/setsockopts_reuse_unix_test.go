@@ -0,0 +1,43 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	proxy := NewProxy()
+	listenConfig, err := proxy.udpListenerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := listenConfig.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	addr := first.LocalAddr().String()
+	if conn, err := listenConfig.ListenPacket(context.Background(), "udp4", addr); err == nil {
+		conn.Close()
+		t.Fatal("binding to an address in use should fail without listen_reuse_port")
+	}
+
+	first.Close()
+	proxy.listenReusePort = true
+	listenConfig, err = proxy.udpListenerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err = listenConfig.ListenPacket(context.Background(), "udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := listenConfig.ListenPacket(context.Background(), "udp4", addr)
+	if err != nil {
+		t.Fatalf("a second instance should be able to bind with listen_reuse_port: %v", err)
+	}
+	second.Close()
+}
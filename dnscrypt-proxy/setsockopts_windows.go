@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"net"
 	"syscall"
 )
@@ -15,8 +16,8 @@ func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
 			_ = c.Control(func(fd uintptr) {
 				_ = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TOS, 0x70)
 				_ = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, IPV6_TCLASS, 0x70)
-				_ = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096)
-				_ = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, 4096)
+				_ = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, cmp.Or(proxy.listenUDPRcvBuf, 4096))
+				_ = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, cmp.Or(proxy.listenUDPSndBuf, 4096))
 			})
 			return nil
 		},
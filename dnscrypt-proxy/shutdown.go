@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	DefaultShutdownGracePeriod = 5 * time.Second
+	shutdownPollInterval       = 10 * time.Millisecond
+)
+
+// Shutdown - Stops accepting new queries, and waits for at most gracePeriod for in-flight queries to complete
+func (proxy *Proxy) Shutdown(gracePeriod time.Duration) {
+	if !proxy.shuttingDown.CompareAndSwap(false, true) {
+		return
+	}
+	proxy.listenersMu.Lock()
+	udpListeners, tcpListeners := proxy.acceptingUDPListeners, proxy.acceptingTCPListeners
+	proxy.listenersMu.Unlock()
+
+	// UDP sockets are also used to send responses, so they are only closed after in-flight queries are drained
+	for _, clientPc := range udpListeners {
+		clientPc.SetReadDeadline(time.Now())
+	}
+	for _, acceptPc := range tcpListeners {
+		acceptPc.Close()
+	}
+
+	// Connections waiting for another query are closed right away, and are not counted as in-flight queries
+	proxy.listenersMu.Lock()
+	for conn := range proxy.idleTCPConns {
+		conn.SetReadDeadline(time.Now())
+	}
+	inFlight := atomic.LoadUint32(&proxy.clientsCount) - uint32(len(proxy.idleTCPConns))
+	proxy.listenersMu.Unlock()
+	remaining := inFlight
+	if inFlight > 0 {
+		dlog.Noticef("Waiting for %d in-flight queries to complete", inFlight)
+		deadline := time.Now().Add(gracePeriod)
+		for remaining > 0 && time.Now().Before(deadline) {
+			time.Sleep(shutdownPollInterval)
+			remaining = atomic.LoadUint32(&proxy.clientsCount)
+		}
+	}
+	for _, clientPc := range udpListeners {
+		clientPc.Close()
+	}
+	if proxy.queryEventSocket != nil {
+		proxy.queryEventSocket.Close()
+	}
+	if proxy.queryLogExporter != nil {
+		proxy.queryLogExporter.Close()
+	}
+	if err := proxy.serversInfo.saveLBState(); err != nil {
+		dlog.Warnf("Unable to save the load balancing state: %v", err)
+	}
+	if inFlight > 0 {
+		dlog.Noticef("%d in-flight queries completed, %d terminated", inFlight-min(remaining, inFlight), remaining)
+	}
+}
+
+// isShuttingDown - Returns true once the proxy has stopped accepting queries
+func (proxy *Proxy) isShuttingDown() bool {
+	return proxy.shuttingDown.Load()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+func newShutdownTestProxy(t *testing.T) (*Proxy, *net.UDPConn, *net.TCPListener) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy()
+	proxy.maxClients = 10
+	proxy.acceptingUDPListeners = []*net.UDPConn{udpConn}
+	proxy.acceptingTCPListeners = []*net.TCPListener{tcpListener}
+	return proxy, udpConn, tcpListener
+}
+
+func TestShutdownDrainsInFlightQueries(t *testing.T) {
+	proxy, udpConn, tcpListener := newShutdownTestProxy(t)
+	if !proxy.clientsCountInc() {
+		t.Fatal("clientsCountInc() should succeed before shutting down")
+	}
+
+	// The UDP socket must remain usable to respond to the in-flight query
+	responded := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, err := udpConn.WriteTo([]byte{0}, udpConn.LocalAddr())
+		proxy.clientsCountDec()
+		responded <- err
+	}()
+
+	start := time.Now()
+	proxy.Shutdown(5 * time.Second)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown() took %v, it should return once in-flight queries are done", elapsed)
+	}
+	if err := <-responded; err != nil {
+		t.Errorf("unable to respond during the grace period: %v", err)
+	}
+	if proxy.clientsCountInc() {
+		t.Error("no new queries should be accepted after shutting down")
+	}
+	if _, err := tcpListener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("TCP listener should be closed, got %v", err)
+	}
+	if _, _, err := udpConn.ReadFrom(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("UDP socket should be closed, got %v", err)
+	}
+}
+
+func TestShutdownGracePeriodExpires(t *testing.T) {
+	proxy, _, _ := newShutdownTestProxy(t)
+	if !proxy.clientsCountInc() {
+		t.Fatal("clientsCountInc() should succeed before shutting down")
+	}
+	start := time.Now()
+	proxy.Shutdown(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Shutdown() took %v, want about the grace period", elapsed)
+	}
+}
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	proxy := newTestProxyWithDoHServers(t, newTestDoHServer(t, validDoHResponse))
+	proxy.tcpClientKeepalive = 10 * time.Second
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.acceptingTCPListeners = []*net.TCPListener{listener}
+	go proxy.tcpListener(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	query := dns.NewMsg("idle.example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	prefixed, err := PrefixWithSize(query.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(prefixed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPrefixed(&conn); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	proxy.Shutdown(5 * time.Second)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown() took %v, it should not wait for idle connections", elapsed)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("the idle connection should be closed, got %v", err)
+	}
+}
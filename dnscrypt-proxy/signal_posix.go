@@ -12,14 +12,19 @@
 
 const HasSIGHUP = true
 
-// setupSignalHandler sets up a SIGHUP handler to manually trigger reloads
+// setupSignalHandler sets up a SIGHUP handler to manually trigger reloads,
+// and a SIGUSR1 handler to log a diagnostics report
 func setupSignalHandler(proxy *Proxy, plugins []Plugin) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGHUP)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGUSR1)
 
 	go func() {
 		for {
 			sig := <-sigChan
+			if sig == syscall.SIGUSR1 {
+				proxy.logDiagnostics()
+				continue
+			}
 			if sig == syscall.SIGHUP {
 				dlog.Notice("Received SIGHUP signal, reloading configurations")
 
@@ -157,7 +157,7 @@ func (source *Source) parseURLs(urls []string) {
 }
 
 func fetchFromURL(xTransport *XTransport, u *url.URL) ([]byte, error) {
-	bin, _, _, _, err := xTransport.GetWithCompression(u, "", DefaultTimeout)
+	bin, _, _, _, err := xTransport.GetSource(u, DefaultTimeout)
 	return bin, err
 }
 
@@ -280,6 +280,13 @@ func PrefetchSources(xTransport *XTransport, sources []*Source) time.Duration {
 	return interval
 }
 
+// isEmpty returns true if neither the source nor a cached copy of it could be loaded yet
+func (source *Source) isEmpty() bool {
+	source.RLock()
+	defer source.RUnlock()
+	return len(source.bin) == 0
+}
+
 func (source *Source) Parse() ([]RegisteredServer, error) {
 	if source.format == SourceFormatV2 {
 		return source.parseV2()
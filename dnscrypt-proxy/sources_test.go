@@ -15,6 +15,7 @@
 
 	"github.com/hectane/go-acl"
 	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
 	"github.com/jedisct1/go-minisign"
 	"github.com/powerman/check"
 )
@@ -499,4 +500,30 @@ func TestPrefetchSources(t *testing.T) {
 	}
 }
 
+func TestDisabledSource(t *testing.T) {
+	stamp := stamps.ServerStamp{Proto: stamps.StampProtoTypeDoH, ProviderName: "dns.example", Path: "/dns-query"}
+	disabled := false
+	config := newConfig()
+	config.ServerNames = []string{"static"}
+	config.StaticsConfig = map[string]StaticConfig{"static": {Stamp: stamp.String()}}
+	// A source that would fail to load, since it has neither a cache file nor a key
+	config.SourcesConfig = map[string]SourceConfig{"disabled": {Enabled: &disabled}}
+
+	proxy := NewProxy()
+	if err := config.loadSources(proxy); err != nil {
+		t.Fatalf("a disabled source should not be loaded: %v", err)
+	}
+	if len(proxy.sources) != 0 || len(proxy.disabledSources) != 1 || proxy.disabledSources[0] != "disabled" {
+		t.Errorf("the source should be listed as disabled, got %v and %v", proxy.sources, proxy.disabledSources)
+	}
+	if len(proxy.registeredServers) != 1 || proxy.registeredServers[0].name != "static" {
+		t.Errorf("a disabled source should contribute no servers, got %v", proxy.registeredServers)
+	}
+
+	config.SourcesConfig = map[string]SourceConfig{"enabled": {}}
+	if err := config.loadSources(NewProxy()); err == nil {
+		t.Error("sources should be enabled by default")
+	}
+}
+
 func TestMain(m *testing.M) { check.TestMain(m) }
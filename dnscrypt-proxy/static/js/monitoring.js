@@ -228,6 +228,25 @@ function safeUpdateDashboard(data) {
             cell.textContent = 'No source activity recorded yet';
         }
 
+        // Update certificate refresh table
+        const certRefreshTable = document.getElementById('cert-refresh-table').getElementsByTagName('tbody')[0];
+        certRefreshTable.innerHTML = '';
+        if (data.cert_refresh && Array.isArray(data.cert_refresh) && data.cert_refresh.length > 0) {
+            data.cert_refresh.forEach(server => {
+                const row = certRefreshTable.insertRow();
+                row.insertCell(0).textContent = server.name || '-';
+                row.insertCell(1).textContent = formatNumber(server.attempts);
+                row.insertCell(2).textContent = formatPercent(server.success_rate);
+                row.insertCell(3).textContent = formatTimestamp(server.last_success);
+                row.insertCell(4).textContent = formatAge(server.cert_age_seconds);
+            });
+        } else {
+            const row = certRefreshTable.insertRow();
+            const cell = row.insertCell(0);
+            cell.colSpan = 5;
+            cell.textContent = 'No certificate refresh recorded yet';
+        }
+
         // Update recent queries table
         const queriesTable = document.getElementById('queries-table').getElementsByTagName('tbody')[0];
         let queriesToShow = lastRecentQueries;
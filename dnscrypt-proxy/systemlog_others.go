@@ -0,0 +1,34 @@
+//go:build !windows
+
+package main
+
+import (
+	gsyslog "github.com/hashicorp/go-syslog"
+	"github.com/jedisct1/dlog"
+)
+
+var severityToSyslogPriority = map[dlog.Severity]gsyslog.Priority{
+	dlog.SeverityDebug:    gsyslog.LOG_DEBUG,
+	dlog.SeverityInfo:     gsyslog.LOG_INFO,
+	dlog.SeverityNotice:   gsyslog.LOG_NOTICE,
+	dlog.SeverityWarning:  gsyslog.LOG_WARNING,
+	dlog.SeverityError:    gsyslog.LOG_ERR,
+	dlog.SeverityCritical: gsyslog.LOG_CRIT,
+	dlog.SeverityFatal:    gsyslog.LOG_ALERT,
+}
+
+type systemLogger struct {
+	inner gsyslog.Syslogger
+}
+
+func newSystemLogger(appName string) (*systemLogger, error) {
+	inner, err := gsyslog.NewLogger(gsyslog.LOG_INFO, "DAEMON", appName)
+	if err != nil {
+		return nil, err
+	}
+	return &systemLogger{inner: inner}, nil
+}
+
+func (systemLogger *systemLogger) writeString(severity dlog.Severity, message string) {
+	systemLogger.inner.WriteLevel(severityToSyslogPriority[severity], []byte(message))
+}
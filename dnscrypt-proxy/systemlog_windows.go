@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/jedisct1/dlog"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+type systemLogger struct {
+	inner *eventlog.Log
+}
+
+func newSystemLogger(appName string) (*systemLogger, error) {
+	inner, err := eventlog.Open(appName)
+	if err != nil {
+		return nil, err
+	}
+	return &systemLogger{inner: inner}, nil
+}
+
+func (systemLogger *systemLogger) writeString(severity dlog.Severity, message string) {
+	switch {
+	case severity >= dlog.SeverityError:
+		systemLogger.inner.Error(uint32(severity), message)
+	case severity == dlog.SeverityWarning:
+		systemLogger.inner.Warning(uint32(severity), message)
+	default:
+		systemLogger.inner.Info(uint32(severity), message)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	DefaultTCPPoolIdleTimeout = 30 * time.Second
+	TCPPoolCleanupInterval    = 10 * time.Second
+)
+
+type pooledTCPConn struct {
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+// TCPConnPool - Idle TCP connections to upstream servers, reused across queries
+type TCPConnPool struct {
+	sync.Mutex
+	conns           map[string][]*pooledTCPConn
+	maxConnsPerAddr int
+	maxIdleTime     time.Duration
+	closed          bool
+	stopOnce        sync.Once
+	stopCh          chan struct{}
+}
+
+// NewTCPConnPool - Creates a pool keeping up to maxConnsPerAddr idle connections per address
+func NewTCPConnPool(maxConnsPerAddr int, maxIdleTime time.Duration) *TCPConnPool {
+	pool := &TCPConnPool{
+		conns:           make(map[string][]*pooledTCPConn),
+		maxConnsPerAddr: maxConnsPerAddr,
+		maxIdleTime:     maxIdleTime,
+		stopCh:          make(chan struct{}),
+	}
+	go pool.cleanupLoop()
+	return pool
+}
+
+func (p *TCPConnPool) cleanupLoop() {
+	ticker := time.NewTicker(min(TCPPoolCleanupInterval, p.maxIdleTime))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.cleanupStale(time.Now())
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+func (p *TCPConnPool) cleanupStale(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	for addr, conns := range p.conns {
+		var active []*pooledTCPConn
+		for _, pc := range conns {
+			if now.Sub(pc.lastUsed) > p.maxIdleTime {
+				pc.conn.Close()
+				dlog.Debugf("TCP pool: closed idle connection to %s", addr)
+			} else {
+				active = append(active, pc)
+			}
+		}
+		if len(active) == 0 {
+			delete(p.conns, addr)
+		} else {
+			p.conns[addr] = active
+		}
+	}
+}
+
+// Get - Returns the most recently used idle connection to addr, or nil if there is none
+func (p *TCPConnPool) Get(addr string) net.Conn {
+	now := time.Now()
+	p.Lock()
+	defer p.Unlock()
+	conns := p.conns[addr]
+	for len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if now.Sub(pc.lastUsed) > p.maxIdleTime {
+			pc.conn.Close()
+			continue
+		}
+		p.conns[addr] = conns
+		return pc.conn
+	}
+	delete(p.conns, addr)
+	return nil
+}
+
+// Put - Returns a connection to the pool after a complete exchange, or closes it if the pool is full
+func (p *TCPConnPool) Put(addr string, conn net.Conn) {
+	p.Lock()
+	conns := p.conns[addr]
+	if p.closed || len(conns) >= p.maxConnsPerAddr {
+		p.Unlock()
+		conn.Close()
+		return
+	}
+	p.conns[addr] = append(conns, &pooledTCPConn{conn: conn, lastUsed: time.Now()})
+	p.Unlock()
+}
+
+// Close - Closes all the idle connections and stops the cleanup goroutine
+func (p *TCPConnPool) Close() {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	for addr, conns := range p.conns {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+		delete(p.conns, addr)
+	}
+	dlog.Debug("TCP connection pool closed")
+}
+
+// Stats - Returns the number of idle connections and of addresses they are connected to
+func (p *TCPConnPool) Stats() (totalConns int, addrCount int) {
+	p.Lock()
+	defer p.Unlock()
+	addrCount = len(p.conns)
+	for _, conns := range p.conns {
+		totalConns += len(conns)
+	}
+	return
+}
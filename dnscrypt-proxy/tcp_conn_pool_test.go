@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startPrefixedEchoServer runs a TCP server echoing size-prefixed messages, with a delay
+// before serving each new connection to simulate the cost of a connection setup
+func startPrefixedEchoServer(tb testing.TB, acceptDelay time.Duration) (string, *atomic.Int32) {
+	tb.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("Failed to listen: %v", err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+	accepted := new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func(conn net.Conn) {
+				defer conn.Close()
+				time.Sleep(acceptDelay)
+				for {
+					var lenBuf [2]byte
+					if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+						return
+					}
+					msg := make([]byte, 2+binary.BigEndian.Uint16(lenBuf[:]))
+					copy(msg, lenBuf[:])
+					if _, err := io.ReadFull(conn, msg[2:]); err != nil {
+						return
+					}
+					if _, err := conn.Write(msg); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), accepted
+}
+
+func pooledTCPExchange(tb testing.TB, pool *TCPConnPool, addr string, query []byte) []byte {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	var pc net.Conn
+	if pool != nil {
+		pc = pool.Get(addr)
+	}
+	if pc == nil {
+		var err error
+		if pc, err = net.DialTimeout("tcp", addr, 5*time.Second); err != nil {
+			tb.Fatalf("Failed to dial: %v", err)
+		}
+	}
+	response, err := exchangeOverTCPConn(pc, query, deadline)
+	if err != nil {
+		pc.Close()
+		tb.Fatalf("Exchange failed: %v", err)
+	}
+	if pool != nil {
+		pool.Put(addr, pc)
+	} else {
+		pc.Close()
+	}
+	return response
+}
+
+func testPrefixedQuery(tb testing.TB) []byte {
+	tb.Helper()
+	query, err := PrefixWithSize(bytes.Repeat([]byte{0x42}, 64))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return query
+}
+
+func TestTCPConnPool_Reuse(t *testing.T) {
+	addr, accepted := startPrefixedEchoServer(t, 0)
+	pool := NewTCPConnPool(2, time.Minute)
+	defer pool.Close()
+
+	query := testPrefixedQuery(t)
+	for i := range 5 {
+		response := pooledTCPExchange(t, pool, addr, query)
+		if !bytes.Equal(response, query[2:]) {
+			t.Fatalf("Unexpected response for query %d", i)
+		}
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("Expected a single connection to be opened, got %d", n)
+	}
+	if totalConns, addrCount := pool.Stats(); totalConns != 1 || addrCount != 1 {
+		t.Errorf("Expected 1 idle connection to 1 address, got %d to %d", totalConns, addrCount)
+	}
+}
+
+func TestTCPConnPool_MaxConns(t *testing.T) {
+	addr, _ := startPrefixedEchoServer(t, 0)
+	pool := NewTCPConnPool(2, time.Minute)
+	defer pool.Close()
+
+	var conns []net.Conn
+	for range 4 {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		pool.Put(addr, conn)
+	}
+	if totalConns, _ := pool.Stats(); totalConns != 2 {
+		t.Errorf("Expected 2 idle connections, got %d", totalConns)
+	}
+}
+
+func TestTCPConnPool_IdleTimeout(t *testing.T) {
+	addr, _ := startPrefixedEchoServer(t, 0)
+	pool := NewTCPConnPool(2, time.Minute)
+	defer pool.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	pool.Put(addr, conn)
+	pool.cleanupStale(time.Now().Add(2 * time.Minute))
+	if totalConns, addrCount := pool.Stats(); totalConns != 0 || addrCount != 0 {
+		t.Errorf("Expected idle connections to be closed, got %d to %d addresses", totalConns, addrCount)
+	}
+	if pool.Get(addr) != nil {
+		t.Error("Expected no connection after the idle timeout")
+	}
+}
+
+func TestTCPConnPool_Close(t *testing.T) {
+	addr, _ := startPrefixedEchoServer(t, 0)
+	pool := NewTCPConnPool(2, time.Minute)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	pool.Put(addr, conn)
+	pool.Close()
+	if totalConns, _ := pool.Stats(); totalConns != 0 {
+		t.Errorf("Expected an empty pool after Close, got %d connections", totalConns)
+	}
+
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	pool.Put(addr, conn)
+	if totalConns, _ := pool.Stats(); totalConns != 0 {
+		t.Errorf("Expected connections to be rejected after Close, got %d", totalConns)
+	}
+}
+
+// The server waits 2ms before serving a new connection, to simulate a high-latency link
+func BenchmarkTCPExchange_NoPool(b *testing.B) {
+	addr, _ := startPrefixedEchoServer(b, 2*time.Millisecond)
+	query := testPrefixedQuery(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pooledTCPExchange(b, nil, addr, query)
+	}
+}
+
+func BenchmarkTCPExchange_Pool(b *testing.B) {
+	addr, _ := startPrefixedEchoServer(b, 2*time.Millisecond)
+	pool := NewTCPConnPool(4, time.Minute)
+	defer pool.Close()
+	query := testPrefixedQuery(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pooledTCPExchange(b, pool, addr, query)
+	}
+}
+
+func TestTCPConnPool_RelayedConnsNotPooled(t *testing.T) {
+	addr, _ := startPrefixedEchoServer(t, 0)
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy()
+	proxy.xTransport = NewXTransport()
+	proxy.tcpConnPool = NewTCPConnPool(2, time.Minute)
+	t.Cleanup(proxy.tcpConnPool.Close)
+
+	exchange := func(serverInfo *ServerInfo) {
+		var sharedKey [32]byte
+		// The echoed query can't be decrypted, but the connection is returned to the pool before decryption
+		proxy.exchangeWithTCPServer(context.Background(), serverInfo, &sharedKey, testPrefixedQuery(t), make([]byte, HalfNonceSize), 5*time.Second)
+	}
+
+	target := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+	relay := &Relay{Name: "relay", Dnscrypt: &DNSCryptRelay{RelayTCPAddr: tcpAddr}}
+	exchange(&ServerInfo{Name: "relayed", TCPAddr: target, Relay: relay})
+	if total, _ := proxy.tcpConnPool.Stats(); total != 0 {
+		t.Fatalf("pooled connections = %d after a relayed query, want 0", total)
+	}
+
+	exchange(&ServerInfo{Name: "direct", TCPAddr: tcpAddr})
+	if total, _ := proxy.tcpConnPool.Stats(); total != 1 {
+		t.Errorf("pooled connections = %d, want 1", total)
+	}
+}
@@ -0,0 +1,57 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTCPNoDelay(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	for _, noDelay := range []bool{true, false} {
+		xTransport := NewXTransport()
+		xTransport.tcpNoDelay = noDelay
+		xTransport.saveCachedIP("nodelay.example", ParseIP("127.0.0.1"), -1*time.Second)
+		xTransport.rebuildTransport()
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		conn, err := xTransport.transport.DialContext(t.Context(), "tcp", net.JoinHostPort("nodelay.example", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawConn, err := conn.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value int
+		var sockErr error
+		if err := rawConn.Control(func(fd uintptr) {
+			value, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if sockErr != nil {
+			t.Fatal(sockErr)
+		}
+		if got := value != 0; got != noDelay {
+			t.Errorf("TCP_NODELAY = %v, want %v", got, noDelay)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+	"github.com/VividCortex/ewma"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+// newTestDoHServer returns a DoH server answering queries with the given handler
+func newTestDoHServer(t *testing.T, handler func(query []byte) []byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(handler(query))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func validDoHResponse(query []byte) []byte {
+	msg := dns.Msg{Data: query}
+	if err := msg.Unpack(); err != nil {
+		return nil
+	}
+	resp := EmptyResponseFromMessage(&msg)
+	rr := new(dns.A)
+	rr.Hdr = dns.Header{Name: msg.Question[0].Header().Name, Class: dns.ClassINET, TTL: 60}
+	rr.A = rdata.A{Addr: netip.MustParseAddr("192.0.2.1")}
+	resp.Answer = []dns.RR{rr}
+	if err := resp.Pack(); err != nil {
+		return nil
+	}
+	return resp.Data
+}
+
+// newTestProxyWithDoHServers returns a proxy that sends queries to the given DoH servers,
+// named "first", "second" and "third", in that order
+func newTestProxyWithDoHServers(t *testing.T, servers ...*httptest.Server) *Proxy {
+	t.Helper()
+	rootCA := filepath.Join(t.TempDir(), "ca.pem")
+	var pemCerts []byte
+	for _, server := range servers {
+		pemCerts = append(pemCerts, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})...)
+	}
+	if err := os.WriteFile(rootCA, pemCerts, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewProxy()
+	proxy.timeout = 5 * time.Second
+	proxy.maxClients = 10
+	proxy.onMalformedResponse = OnMalformedResponseServFail
+	proxy.xTransport = NewXTransport()
+	proxy.xTransport.tlsClientCreds = DOHClientCreds{rootCA: rootCA}
+	proxy.xTransport.rebuildTransport()
+	proxy.pluginsGlobals = PluginsGlobals{
+		queryPlugins:    &[]Plugin{},
+		responsePlugins: &[]Plugin{},
+		loggingPlugins:  &[]Plugin{},
+	}
+	proxy.serversInfo.lbStrategy = LBStrategyFirst{}
+	proxy.serversInfo.lbEstimator = false
+	for i, server := range servers {
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverInfo := &ServerInfo{
+			Name:    []string{"first", "second", "third"}[i],
+			Proto:   stamps.StampProtoTypeDoH,
+			URL:     serverURL,
+			Timeout: proxy.timeout,
+		}
+		serverInfo.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+		serverInfo.rtt.Set(float64(10 * (i + 1)))
+		proxy.serversInfo.inner = append(proxy.serversInfo.inner, serverInfo)
+	}
+	return proxy
+}
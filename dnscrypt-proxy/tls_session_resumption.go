@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"strings"
+	"sync"
+)
+
+const (
+	TLSSessionResumptionAll   = "all"
+	TLSSessionResumptionTLS13 = "tls13"
+	TLSSessionResumptionNone  = "none"
+)
+
+// TLSSessionCacheSize - Maximum number of TLS sessions kept for resumption
+const TLSSessionCacheSize = 64
+
+// HostSessionResumption - TLS session resumption policies overriding the global one for specific host names
+type HostSessionResumption struct {
+	sync.RWMutex
+	policies map[string]string
+}
+
+// setHostSessionResumption restricts the TLS sessions that can be resumed with a host
+func (xTransport *XTransport) setHostSessionResumption(host string, policy string) {
+	xTransport.hostSessionResumption.Lock()
+	xTransport.hostSessionResumption.policies[strings.Trim(host, "[]")] = policy
+	xTransport.hostSessionResumption.Unlock()
+}
+
+// sessionResumption returns the TLS session resumption policy of a host
+func (xTransport *XTransport) sessionResumption(host string) string {
+	xTransport.hostSessionResumption.RLock()
+	policy, ok := xTransport.hostSessionResumption.policies[strings.Trim(host, "[]")]
+	xTransport.hostSessionResumption.RUnlock()
+	if !ok {
+		return TLSSessionResumptionAll
+	}
+	return policy
+}
+
+// sessionResumptionCache - TLS client session cache only keeping the sessions that the policy of each host allows.
+// Sessions are keyed by server name, so that the policy of the host a session belongs to can be applied.
+type sessionResumptionCache struct {
+	cache      tls.ClientSessionCache
+	xTransport *XTransport
+}
+
+func newSessionResumptionCache(xTransport *XTransport) *sessionResumptionCache {
+	return &sessionResumptionCache{
+		cache:      tls.NewLRUClientSessionCache(TLSSessionCacheSize),
+		xTransport: xTransport,
+	}
+}
+
+func (cache *sessionResumptionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	if cache.xTransport.sessionResumption(sessionKey) == TLSSessionResumptionNone {
+		return nil, false
+	}
+	return cache.cache.Get(sessionKey)
+}
+
+func (cache *sessionResumptionCache) Put(sessionKey string, session *tls.ClientSessionState) {
+	switch cache.xTransport.sessionResumption(sessionKey) {
+	case TLSSessionResumptionNone:
+		return
+	case TLSSessionResumptionTLS13:
+		if session != nil && sessionVersion(session) != tls.VersionTLS13 {
+			return
+		}
+	}
+	cache.cache.Put(sessionKey, session)
+}
+
+// sessionVersion returns the TLS version of a session, or 0 if it cannot be determined
+func sessionVersion(session *tls.ClientSessionState) uint16 {
+	_, state, err := session.ResumptionState()
+	if err != nil || state == nil {
+		return 0
+	}
+	encoded, err := state.Bytes()
+	if err != nil || len(encoded) < 2 {
+		return 0
+	}
+	// The serialized state starts with the protocol version
+	return binary.BigEndian.Uint16(encoded)
+}
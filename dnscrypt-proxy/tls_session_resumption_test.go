@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newResumptionTestServer starts a TLS server, and returns it along with a transport trusting its certificate
+func newResumptionTestServer(t *testing.T, maxVersion uint16) (*httptest.Server, *XTransport) {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{MaxVersion: maxVersion}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	xTransport := NewXTransport()
+	xTransport.rebuildTransport()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	xTransport.transport.TLSClientConfig.RootCAs = rootCAs
+	// The test certificate is also valid for example.com, that is used as a second host name for the same server
+	xTransport.saveCachedIP("example.com", ParseIP("127.0.0.1"), -1*time.Second)
+	return server, xTransport
+}
+
+// resumed connects to a host twice, and returns true if the second connection resumed the session of the first one
+func resumed(t *testing.T, xTransport *XTransport, host string, port string) bool {
+	t.Helper()
+	hostURL := &url.URL{Scheme: "https", Host: host + ":" + port, Path: "/"}
+	var didResume bool
+	for range 2 {
+		xTransport.transport.CloseIdleConnections()
+		_, _, tls, _, err := xTransport.Get(hostURL, "", 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		didResume = tls.DidResume
+	}
+	return didResume
+}
+
+func TestPerHostSessionResumption(t *testing.T) {
+	server, xTransport := newResumptionTestServer(t, tls.VersionTLS13)
+	serverURL, _ := url.Parse(server.URL)
+	xTransport.setHostSessionResumption("example.com", TLSSessionResumptionNone)
+
+	if resumed(t, xTransport, "example.com", serverURL.Port()) {
+		t.Error("the session was resumed with a host for which resumption is disabled")
+	}
+	if !resumed(t, xTransport, serverURL.Hostname(), serverURL.Port()) {
+		t.Error("the session should have been resumed with a host without restrictions")
+	}
+}
+
+func TestSessionResumptionTLS13Only(t *testing.T) {
+	server, xTransport := newResumptionTestServer(t, tls.VersionTLS12)
+	serverURL, _ := url.Parse(server.URL)
+	xTransport.setHostSessionResumption("example.com", TLSSessionResumptionTLS13)
+
+	if resumed(t, xTransport, "example.com", serverURL.Port()) {
+		t.Error("a TLS 1.2 session was resumed with a host only allowing TLS 1.3 resumption")
+	}
+	if !resumed(t, xTransport, serverURL.Hostname(), serverURL.Port()) {
+		t.Error("TLS 1.2 sessions should be resumed with a host without restrictions")
+	}
+
+	server13, xTransport13 := newResumptionTestServer(t, tls.VersionTLS13)
+	server13URL, _ := url.Parse(server13.URL)
+	xTransport13.setHostSessionResumption("example.com", TLSSessionResumptionTLS13)
+	if !resumed(t, xTransport13, "example.com", server13URL.Port()) {
+		t.Error("TLS 1.3 sessions should be resumed with a host allowing TLS 1.3 resumption")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"slices"
+	"sync"
+)
+
+// TLSStatsEntry - Number of responses a server sent over connections using a TLS version and cipher suite
+type TLSStatsEntry struct {
+	Server      string `json:"server"`
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	Responses   uint64 `json:"responses"`
+}
+
+type tlsStatsKey struct {
+	server      string
+	version     uint16
+	cipherSuite uint16
+}
+
+// TLSStats - TLS versions and cipher suites negotiated with the DoH and ODoH servers, for security auditing
+type TLSStats struct {
+	sync.Mutex
+	counters map[tlsStatsKey]uint64
+}
+
+// recordTLSState accounts for a response received over a TLS connection, using the state returned along with it
+func (serversInfo *ServersInfo) recordTLSState(serverName string, state *tls.ConnectionState) {
+	if state == nil || !state.HandshakeComplete {
+		return
+	}
+	key := tlsStatsKey{server: serverName, version: state.Version, cipherSuite: state.CipherSuite}
+	tlsStats := &serversInfo.tlsStats
+	tlsStats.Lock()
+	if tlsStats.counters == nil {
+		tlsStats.counters = make(map[tlsStatsKey]uint64)
+	}
+	tlsStats.counters[key]++
+	tlsStats.Unlock()
+}
+
+// tlsStatsSnapshot returns a copy of the TLS statistics, sorted by server, version and cipher suite
+func (serversInfo *ServersInfo) tlsStatsSnapshot() []TLSStatsEntry {
+	tlsStats := &serversInfo.tlsStats
+	tlsStats.Lock()
+	entries := make([]TLSStatsEntry, 0, len(tlsStats.counters))
+	for key, responses := range tlsStats.counters {
+		entries = append(entries, TLSStatsEntry{
+			Server:      key.server,
+			Version:     tls.VersionName(key.version),
+			CipherSuite: tls.CipherSuiteName(key.cipherSuite),
+			Responses:   responses,
+		})
+	}
+	tlsStats.Unlock()
+	slices.SortFunc(entries, func(a, b TLSStatsEntry) int {
+		return cmp.Or(cmp.Compare(a.Server, b.Server), cmp.Compare(a.Version, b.Version), cmp.Compare(a.CipherSuite, b.CipherSuite))
+	})
+	return entries
+}
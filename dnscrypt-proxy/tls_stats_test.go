@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestTLSStats(t *testing.T) {
+	server := newTestDoHServer(t, validDoHResponse)
+	proxy := newTestProxyWithDoHServers(t, server)
+	query := dns.NewMsg("example.com.", dns.TypeA)
+	if err := query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		pluginsState := PluginsState{}
+		if _, err := processDoHQuery(proxy, proxy.serversInfo.inner[0], &pluginsState, query.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	proxy.serversInfo.recordTLSState("other", &tls.ConnectionState{
+		HandshakeComplete: true,
+		Version:           tls.VersionTLS12,
+		CipherSuite:       tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	})
+	proxy.serversInfo.recordTLSState("other", &tls.ConnectionState{})
+	proxy.serversInfo.recordTLSState("other", nil)
+
+	stats := proxy.serversInfo.tlsStatsSnapshot()
+	if len(stats) != 2 {
+		t.Fatalf("expected entries for two servers, got %v", stats)
+	}
+	if stats[0].Server != "first" || stats[0].Version != "TLS 1.3" || stats[0].Responses != 2 {
+		t.Errorf("the TLS parameters of the DoH responses should be counted, got %+v", stats[0])
+	}
+	if stats[1].Server != "other" || stats[1].Version != "TLS 1.2" ||
+		stats[1].CipherSuite != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" || stats[1].Responses != 1 {
+		t.Errorf("incomplete handshakes should not be counted, got %+v", stats[1])
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket - A token bucket rate limiter
+type TokenBucket struct {
+	sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // maximum number of tokens
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket - Creates a full token bucket refilled at `rate` tokens per second
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+// Allow - Takes a token if one is available
+func (tb *TokenBucket) Allow() bool {
+	return tb.allowAt(time.Now())
+}
+
+func (tb *TokenBucket) allowAt(now time.Time) bool {
+	tb.Lock()
+	defer tb.Unlock()
+	if !tb.last.IsZero() {
+		if elapsed := now.Sub(tb.last).Seconds(); elapsed > 0 {
+			tb.tokens = min(tb.burst, tb.tokens+elapsed*tb.rate)
+		}
+	}
+	if now.After(tb.last) {
+		tb.last = now
+	}
+	if tb.tokens < 1.0 {
+		return false
+	}
+	tb.tokens -= 1.0
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VividCortex/ewma"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   float64
+		offsets []time.Duration
+		want    []bool
+	}{
+		{
+			name:    "burst is allowed at once",
+			rate:    2,
+			burst:   2,
+			offsets: []time.Duration{0, 0, 0},
+			want:    []bool{true, true, false},
+		},
+		{
+			name:    "tokens are refilled over time",
+			rate:    2,
+			burst:   2,
+			offsets: []time.Duration{0, 0, 0, 500 * time.Millisecond, 500 * time.Millisecond},
+			want:    []bool{true, true, false, true, false},
+		},
+		{
+			name:    "refill is capped by the burst",
+			rate:    1,
+			burst:   1,
+			offsets: []time.Duration{0, 10 * time.Second, 10 * time.Second},
+			want:    []bool{true, true, false},
+		},
+		{
+			name:    "fractional rate",
+			rate:    0.5,
+			burst:   1,
+			offsets: []time.Duration{0, time.Second, 2 * time.Second},
+			want:    []bool{true, false, true},
+		},
+		{
+			name:    "clock going backwards doesn't add tokens",
+			rate:    1,
+			burst:   1,
+			offsets: []time.Duration{10 * time.Second, 0, 10 * time.Second},
+			want:    []bool{true, false, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := NewTokenBucket(tt.rate, tt.burst)
+			for i, offset := range tt.offsets {
+				if got := tb.allowAt(start.Add(offset)); got != tt.want[i] {
+					t.Errorf("allowAt(+%v) #%d = %v, want %v", offset, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetOneMaxQPSSpillover(t *testing.T) {
+	newServer := func(name string, rtt int, rateLimiter *TokenBucket) *ServerInfo {
+		server := &ServerInfo{Name: name, rateLimiter: rateLimiter}
+		server.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+		server.rtt.Set(float64(rtt))
+		return server
+	}
+
+	serversInfo := NewServersInfo()
+	serversInfo.lbStrategy = LBStrategyFirst{}
+	serversInfo.lbEstimator = false
+	serversInfo.inner = []*ServerInfo{
+		newServer("limited", 10, NewTokenBucket(1, 1)),
+		newServer("other", 50, nil),
+	}
+
+	if server := serversInfo.getOne(); server == nil || server.Name != "limited" {
+		t.Fatalf("first query should use the limited server, got %v", server)
+	}
+	if server := serversInfo.getOne(); server == nil || server.Name != "other" {
+		t.Fatalf("second query should spill over to the other server, got %v", server)
+	}
+	if !serversInfo.inner[0].rateCapped {
+		t.Error("limited server should be marked as rate-capped")
+	}
+
+	serversInfo.inner[1].rateLimiter = NewTokenBucket(1, 1)
+	serversInfo.inner[1].rateLimiter.Allow()
+	if server := serversInfo.getOne(); server != nil {
+		t.Errorf("no server should be returned when all of them are rate-capped, got %v", server.Name)
+	}
+}
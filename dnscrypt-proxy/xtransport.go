@@ -2,7 +2,6 @@
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/sha512"
 	"crypto/tls"
@@ -10,12 +9,16 @@
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"math/rand"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -47,6 +50,28 @@
 	resolverRetryCount          = 3
 	resolverRetryInitialBackoff = 150 * time.Millisecond
 	resolverRetryMaxBackoff     = 1 * time.Second
+	DefaultSourceMaxRedirects   = 10
+	H3HappyEyeballsDelay        = 300 * time.Millisecond
+	MaxDoHResponseLength        = 0xffff + 256 // Largest DNS message, plus room for the ODoH encapsulation
+)
+
+var (
+	ErrDoHResponseTooLarge   = errors.New("DoH response exceeds the maximum DNS message size")
+	ErrUnexpectedContentType = errors.New("Unexpected Content-Type in DoH response")
+)
+
+// How long HTTP/3 is not used for a server after it failed
+const DefaultHTTP3NegativeCacheTTL = 10 * time.Minute
+
+const (
+	DoHContentTypeCheckReject = "reject"
+	DoHContentTypeCheckWarn   = "warn"
+)
+
+const (
+	ResolutionStrategyInternal  = "internal"
+	ResolutionStrategyBootstrap = "bootstrap"
+	ResolutionStrategySystem    = "system"
 )
 
 type CachedIPItem struct {
@@ -60,20 +85,122 @@ type CachedIPs struct {
 	cache map[string]*CachedIPItem
 }
 
+// AltSupport - HTTP/3 ports of servers. A port of 0 means that HTTP/3 failed,
+// and that it shouldn't be tried again until the entry expires.
 type AltSupport struct {
 	sync.RWMutex
-	cache map[string]uint16
+	cache map[string]AltSupportEntry
+}
+
+// Default limits on the number of Alt-Svc header values, and of segments within each of them, that are parsed
+const (
+	DefaultAltSvcMaxHeaders  = 8
+	DefaultAltSvcMaxSegments = 16
+)
+
+// MaxAltSvcHeaderLength - Alt-Svc header values longer than this are ignored
+const MaxAltSvcHeaderLength = 1024
+
+// parseAltSvc returns the HTTP/3 port advertised in Alt-Svc header values, or defaultPort if no h3 alternative was
+// found. Only the first maxHeaders values, and the first maxSegments segments of each of them, are parsed, so that
+// pathological headers cannot waste CPU. false is returned if none of the values was parsed.
+func parseAltSvc(values []string, defaultPort uint16, maxHeaders int, maxSegments int) (uint16, bool) {
+	parsed := false
+	for _, value := range values[:min(len(values), maxHeaders)] {
+		if len(value) > MaxAltSvcHeaderLength || maxSegments <= 0 {
+			continue
+		}
+		parsed = true
+		for range maxSegments {
+			segment, rest, more := strings.Cut(value, ";")
+			value = rest
+			if after, ok := strings.CutPrefix(strings.TrimSpace(segment), "h3=\":"); ok {
+				if altPort, err := strconv.ParseUint(strings.TrimSuffix(after, "\""), 10, 16); err == nil {
+					return uint16(altPort), true
+				}
+			}
+			if !more {
+				break
+			}
+		}
+	}
+	return defaultPort, parsed
+}
+
+type AltSupportEntry struct {
+	port       uint16
+	expiration time.Time // Zero if the entry doesn't expire
+}
+
+// get returns the HTTP/3 port cached for a host, ignoring expired entries
+func (altSupport *AltSupport) get(host string) (uint16, bool) {
+	altSupport.RLock()
+	entry, found := altSupport.cache[host]
+	altSupport.RUnlock()
+	if !found || (!entry.expiration.IsZero() && time.Now().After(entry.expiration)) {
+		return 0, false
+	}
+	return entry.port, true
+}
+
+// set caches the HTTP/3 port of a host, for ttl, or forever if ttl is 0
+func (altSupport *AltSupport) set(host string, port uint16, ttl time.Duration) {
+	entry := AltSupportEntry{port: port}
+	if ttl > 0 {
+		entry.expiration = time.Now().Add(ttl)
+	}
+	altSupport.Lock()
+	altSupport.cache[host] = entry
+	altSupport.Unlock()
+}
+
+// HostResolutionOrders - Resolution strategies overriding the global ones for specific host names
+type HostResolutionOrders struct {
+	sync.RWMutex
+	orders map[string][]string
+}
+
+// HostProxy - Proxies overriding the global ones to connect to a specific host
+type HostProxy struct {
+	dialer       *netproxy.Dialer
+	httpProxyURL *url.URL
+}
+
+// HostProxies - Per-host proxy overrides, keyed by host name or IP address without brackets
+type HostProxies struct {
+	sync.RWMutex
+	proxies map[string]HostProxy
+}
+
+// HostTimeout - Per-host connect and response header timeouts, overriding the global timeout if not zero
+type HostTimeout struct {
+	connect  time.Duration
+	response time.Duration
+}
+
+// HostTimeouts - Per-host timeout overrides, along with the transports applying their response header timeouts
+type HostTimeouts struct {
+	sync.RWMutex
+	timeouts   map[string]HostTimeout
+	transports map[time.Duration]*http.Transport
 }
 
 type XTransport struct {
 	transport                *http.Transport
 	h3Transport              *http3.Transport
 	keepAlive                time.Duration
+	tcpNoDelay               bool
 	timeout                  time.Duration
 	cachedIPs                CachedIPs
 	altSupport               AltSupport
+	hostResolutionOrders     HostResolutionOrders
+	hostProxies              HostProxies
+	hostTimeouts             HostTimeouts
+	hostSessionResumption    HostSessionResumption
 	internalResolvers        []string
 	bootstrapResolvers       []string
+	resolverPriorities       map[string]int
+	ipOverrides              map[string]net.IP
 	mainProto                string
 	ignoreSystemDNS          bool
 	internalResolverReady    bool
@@ -81,12 +208,25 @@ type XTransport struct {
 	useIPv6                  bool
 	http3                    bool
 	http3Probe               bool
+	http3NegativeCacheTTL    time.Duration
+	altSvcMaxHeaders         int
+	altSvcMaxSegments        int
 	tlsDisableSessionTickets bool
 	tlsPreferRSA             bool
 	proxyDialer              *netproxy.Dialer
 	httpProxyFunction        func(*http.Request) (*url.URL, error)
 	tlsClientCreds           DOHClientCreds
 	keyLogWriter             io.Writer
+	sourceMaxRedirects       int
+	resolutionOrder          []string
+	httpCache                *HTTPCache
+	contentEncodings         []string
+	maxDecompressedBody      int64
+	ipv6FastFail             *IPv6FastFail
+	dohContentTypeCheck      string
+	dohDedupWindow           time.Duration
+	dohCoalescing            *DoHCoalescing // Nil unless doh_connection_coalescing is set
+	inFlightDoHRequests      *InFlightDoHRequests
 }
 
 func NewXTransport() *XTransport {
@@ -95,18 +235,32 @@ func NewXTransport() *XTransport {
 	}
 	xTransport := XTransport{
 		cachedIPs:                CachedIPs{cache: make(map[string]*CachedIPItem)},
-		altSupport:               AltSupport{cache: make(map[string]uint16)},
+		altSupport:               AltSupport{cache: make(map[string]AltSupportEntry)},
+		hostResolutionOrders:     HostResolutionOrders{orders: make(map[string][]string)},
+		hostProxies:              HostProxies{proxies: make(map[string]HostProxy)},
+		hostTimeouts:             HostTimeouts{timeouts: make(map[string]HostTimeout)},
+		hostSessionResumption:    HostSessionResumption{policies: make(map[string]string)},
 		keepAlive:                DefaultKeepAlive,
+		tcpNoDelay:               true,
 		timeout:                  DefaultTimeout,
 		bootstrapResolvers:       []string{DefaultBootstrapResolver},
 		mainProto:                "",
+		contentEncodings:         DefaultContentEncodings,
+		maxDecompressedBody:      MaxHTTPBodyLength,
+		ipv6FastFail:             NewIPv6FastFail(DefaultIPv6FastFailThreshold, DefaultIPv6FastFailCooldown),
+		dohContentTypeCheck:      DoHContentTypeCheckReject,
+		inFlightDoHRequests:      NewInFlightDoHRequests(),
 		ignoreSystemDNS:          true,
 		useIPv4:                  true,
 		useIPv6:                  false,
 		http3Probe:               false,
+		http3NegativeCacheTTL:    DefaultHTTP3NegativeCacheTTL,
+		altSvcMaxHeaders:         DefaultAltSvcMaxHeaders,
+		altSvcMaxSegments:        DefaultAltSvcMaxSegments,
 		tlsDisableSessionTickets: false,
 		tlsPreferRSA:             false,
 		keyLogWriter:             nil,
+		sourceMaxRedirects:       DefaultSourceMaxRedirects,
 	}
 	return &xTransport
 }
@@ -139,6 +293,10 @@ func uniqueNormalizedIPs(ips []net.IP) []net.IP {
 }
 
 func (xTransport *XTransport) saveCachedIPs(host string, ips []net.IP, ttl time.Duration) {
+	if _, ok := xTransport.ipOverride(host); ok {
+		dlog.Debugf("[%s] has a static IP address, not replacing it", host)
+		return
+	}
 	normalized := uniqueNormalizedIPs(ips)
 	if len(normalized) == 0 {
 		return
@@ -170,6 +328,28 @@ func (xTransport *XTransport) saveCachedIP(host string, ip net.IP, ttl time.Dura
 	xTransport.saveCachedIPs(host, []net.IP{ip}, ttl)
 }
 
+// setIPOverrides - Pins host names to static IP addresses, that never expire and are never resolved
+func (xTransport *XTransport) setIPOverrides(overrides map[string]net.IP) {
+	xTransport.ipOverrides = make(map[string]net.IP, len(overrides))
+	for host, ip := range overrides {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		xTransport.ipOverrides[host] = ip
+		xTransport.cachedIPs.Lock()
+		xTransport.cachedIPs.cache[host] = &CachedIPItem{ips: []net.IP{ip}}
+		xTransport.cachedIPs.Unlock()
+		dlog.Infof("[%s] will always be reached at [%s]", host, ip)
+	}
+}
+
+// ipOverride - Returns the static IP address of a host name, if there is one
+func (xTransport *XTransport) ipOverride(host string) (net.IP, bool) {
+	if len(xTransport.ipOverrides) == 0 {
+		return nil, false
+	}
+	ip, ok := xTransport.ipOverrides[strings.TrimSuffix(strings.ToLower(host), ".")]
+	return ip, ok
+}
+
 // Mark an entry as being updated
 func (xTransport *XTransport) markUpdatingCachedIP(host string) {
 	xTransport.cachedIPs.Lock()
@@ -222,9 +402,15 @@ func (xTransport *XTransport) rebuildTransport() {
 	if xTransport.transport != nil {
 		xTransport.transport.CloseIdleConnections()
 	}
+	xTransport.hostTimeouts.Lock()
+	for _, transport := range xTransport.hostTimeouts.transports {
+		transport.CloseIdleConnections()
+	}
+	xTransport.hostTimeouts.transports = nil
+	xTransport.hostTimeouts.Unlock()
 	timeout := xTransport.timeout
 	transport := &http.Transport{
-		DisableKeepAlives:      false,
+		DisableKeepAlives:      xTransport.keepAlive <= 0,
 		DisableCompression:     true,
 		MaxIdleConns:           1,
 		IdleConnTimeout:        xTransport.keepAlive,
@@ -247,6 +433,7 @@ func (xTransport *XTransport) rebuildTransport() {
 			}
 
 			cachedIPs, _, _ := xTransport.loadCachedIPs(host)
+			cachedIPs = xTransport.ipv6FastFail.filterIPv6(cachedIPs, time.Now())
 			targets := make([]string, 0, len(cachedIPs))
 			for _, ip := range cachedIPs {
 				targets = append(targets, formatEndpoint(ip))
@@ -256,17 +443,30 @@ func (xTransport *XTransport) rebuildTransport() {
 				targets = append(targets, formatEndpoint(nil))
 			}
 
+			connectTimeout := timeout
+			if hostTimeout, ok := xTransport.hostTimeout(host); ok && hostTimeout.connect > 0 {
+				connectTimeout = hostTimeout.connect
+			}
+			proxyDialer := xTransport.proxyDialerFor(host)
 			dial := func(address string) (net.Conn, error) {
-				if xTransport.proxyDialer == nil {
-					dialer := &net.Dialer{Timeout: timeout, KeepAlive: timeout, DualStack: true}
-					return dialer.DialContext(ctx, network, address)
+				if proxyDialer == nil {
+					dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: timeout, DualStack: true}
+					conn, err := dialer.DialContext(ctx, network, address)
+					if err == nil {
+						setTCPNoDelay(conn, xTransport.tcpNoDelay)
+					}
+					return conn, err
 				}
-				return (*xTransport.proxyDialer).Dial(network, address)
+				return (*proxyDialer).Dial(network, address)
 			}
 
 			var lastErr error
 			for idx, target := range targets {
 				conn, err := dial(target)
+				// Connections through a proxy don't depend on the local IPv6 connectivity
+				if proxyDialer == nil && idx < len(cachedIPs) && cachedIPs[idx].To4() == nil {
+					xTransport.ipv6FastFail.recordDialResult(ctx, err, time.Now())
+				}
 				if err == nil {
 					return conn, nil
 				}
@@ -278,8 +478,14 @@ func (xTransport *XTransport) rebuildTransport() {
 			return nil, lastErr
 		},
 	}
-	if xTransport.httpProxyFunction != nil {
-		transport.Proxy = xTransport.httpProxyFunction
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if hostProxy, ok := xTransport.hostProxy(req.URL.Hostname()); ok {
+			return hostProxy.httpProxyURL, nil
+		}
+		if xTransport.httpProxyFunction != nil {
+			return xTransport.httpProxyFunction(req)
+		}
+		return nil, nil
 	}
 
 	clientCreds := xTransport.tlsClientCreds
@@ -326,6 +532,8 @@ func (xTransport *XTransport) rebuildTransport() {
 
 	if xTransport.tlsDisableSessionTickets {
 		tlsClientConfig.SessionTicketsDisabled = true
+	} else {
+		tlsClientConfig.ClientSessionCache = newSessionResumptionCache(xTransport)
 	}
 	if xTransport.tlsPreferRSA {
 		tlsClientConfig.MaxVersion = tls.VersionTLS12
@@ -350,6 +558,8 @@ func (xTransport *XTransport) rebuildTransport() {
 		}
 	}
 	transport.TLSClientConfig = &tlsClientConfig
+	// HTTP/2 is offered using ALPN, but servers and proxies that only speak HTTP/1.1 are accepted as well:
+	// responses are never rejected because of their protocol version, so no option is needed to allow HTTP/1.1.
 	if http2Transport, _ := http2.ConfigureTransports(transport); http2Transport != nil {
 		http2Transport.ReadIdleTimeout = timeout
 		http2Transport.AllowHTTP = false
@@ -390,6 +600,7 @@ type udpTarget struct {
 			}
 
 			cachedIPs, _, _ := xTransport.loadCachedIPs(host)
+			cachedIPs = xTransport.ipv6FastFail.filterIPv6(cachedIPs, time.Now())
 			targets := make([]udpTarget, 0, len(cachedIPs))
 			for _, ip := range cachedIPs {
 				targets = append(targets, buildAddr(ip))
@@ -399,35 +610,122 @@ type udpTarget struct {
 				targets = append(targets, buildAddr(nil))
 			}
 
-			var lastErr error
-			for idx, target := range targets {
-				udpAddr, err := net.ResolveUDPAddr(target.network, target.addr)
-				if err != nil {
-					lastErr = err
-					if idx < len(targets)-1 {
-						dlog.Debugf("H3: failed to resolve [%s] on %s: %v", target.addr, target.network, err)
+			// dialTargets tries the targets in order; when racing, the QUIC handshake must complete.
+			// Each dial gets its own copy of the TLS configuration, as concurrent handshakes must not share it.
+			// The UDP socket is returned as well, as closing the connection doesn't close it.
+			dialTargets := func(ctx context.Context, targets []udpTarget, racing bool) (*quic.Conn, *net.UDPConn, error) {
+				var lastErr error
+				for idx, target := range targets {
+					udpAddr, err := net.ResolveUDPAddr(target.network, target.addr)
+					if err != nil {
+						lastErr = err
+						if idx < len(targets)-1 {
+							dlog.Debugf("H3: failed to resolve [%s] on %s: %v", target.addr, target.network, err)
+						}
+						continue
 					}
-					continue
-				}
-				udpConn, err := net.ListenUDP(target.network, nil)
-				if err != nil {
-					lastErr = err
-					if idx < len(targets)-1 {
-						dlog.Debugf("H3: failed to listen for [%s] on %s: %v", target.addr, target.network, err)
+					udpConn, err := net.ListenUDP(target.network, nil)
+					if err != nil {
+						lastErr = err
+						if idx < len(targets)-1 {
+							dlog.Debugf("H3: failed to listen for [%s] on %s: %v", target.addr, target.network, err)
+						}
+						continue
+					}
+					dialTLSCfg := tlsCfg.Clone()
+					dialTLSCfg.ServerName = host
+					conn, err := quic.DialEarly(ctx, udpConn, udpAddr, dialTLSCfg, cfg)
+					if err == nil && racing {
+						select {
+						case <-conn.HandshakeComplete():
+						case <-conn.Context().Done():
+							err = context.Cause(conn.Context())
+						case <-ctx.Done():
+							conn.CloseWithError(0, "")
+							err = ctx.Err()
+						}
 					}
-					continue
+					if target.network == "udp6" {
+						xTransport.ipv6FastFail.recordDialResult(ctx, err, time.Now())
+					}
+					if err != nil {
+						udpConn.Close()
+						lastErr = err
+						if idx < len(targets)-1 {
+							dlog.Debugf("H3: dialing [%s] via %s failed: %v", target.addr, target.network, err)
+						}
+						continue
+					}
+					return conn, udpConn, nil
 				}
-				tlsCfg.ServerName = host
-				conn, err := quic.DialEarly(ctx, udpConn, udpAddr, tlsCfg, cfg)
-				if err != nil {
-					udpConn.Close()
-					lastErr = err
-					if idx < len(targets)-1 {
-						dlog.Debugf("H3: dialing [%s] via %s failed: %v", target.addr, target.network, err)
+				return nil, nil, lastErr
+			}
+
+			// Happy Eyeballs: if both address families are available, start with the family of
+			// the first target, and race the other family after a short delay or a failure
+			primary, fallback := make([]udpTarget, 0, len(targets)), make([]udpTarget, 0)
+			for _, target := range targets {
+				if target.network == targets[0].network {
+					primary = append(primary, target)
+				} else {
+					fallback = append(fallback, target)
+				}
+			}
+			if len(fallback) == 0 {
+				conn, _, err := dialTargets(ctx, targets, false)
+				return conn, err
+			}
+
+			type dialResult struct {
+				conn    *quic.Conn
+				udpConn *net.UDPConn
+				err     error
+			}
+			raceCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			results := make(chan dialResult, 2)
+			startDial := func(targets []udpTarget) {
+				go func() {
+					conn, udpConn, err := dialTargets(raceCtx, targets, true)
+					results <- dialResult{conn: conn, udpConn: udpConn, err: err}
+				}()
+			}
+			startDial(primary)
+			pending, fallbackStarted := 1, false
+			fallbackTimer := time.NewTimer(H3HappyEyeballsDelay)
+			defer fallbackTimer.Stop()
+
+			var lastErr error
+			for pending > 0 {
+				select {
+				case <-fallbackTimer.C:
+					if !fallbackStarted {
+						dlog.Debugf("H3: [%s] is slow to respond over %s, racing %s", host, primary[0].network, fallback[0].network)
+						fallbackStarted = true
+						pending++
+						startDial(fallback)
+					}
+				case result := <-results:
+					pending--
+					if result.err == nil {
+						cancel()
+						go func(remaining int) {
+							for range remaining {
+								if loser := <-results; loser.conn != nil {
+									loser.conn.CloseWithError(0, "")
+									loser.udpConn.Close()
+								}
+							}
+						}(pending)
+						return result.conn, nil
+					}
+					lastErr = result.err
+					if !fallbackStarted {
+						fallbackStarted = true
+						pending++
+						startDial(fallback)
 					}
-					continue
 				}
-				return conn, nil
 			}
 			return nil, lastErr
 		}
@@ -454,6 +752,30 @@ func (xTransport *XTransport) resolveUsingSystem(host string, returnIPv4, return
 	return ips, SystemResolverIPTTL, err
 }
 
+// verifyResolverResponse checks that a response to a plaintext bootstrap query matches the query.
+// The DNS client already rejects responses with a different transaction ID, but the check is kept
+// here so that the anti-spoofing guarantees of the bootstrap path don't depend on library internals.
+func verifyResolverResponse(query, response *dns.Msg) error {
+	if response.ID != query.ID {
+		return fmt.Errorf("Unexpected transaction ID in response: %d != %d", response.ID, query.ID)
+	}
+	if !response.Response {
+		return errors.New("Not a response")
+	}
+	if len(response.Question) != 1 || len(query.Question) != 1 {
+		return errors.New("Unexpected question count in response")
+	}
+	question, expected := response.Question[0], query.Question[0]
+	if dns.RRToType(question) != dns.RRToType(expected) || !dns.EqualName(question.Header().Name, expected.Header().Name) {
+		return errors.New("Response doesn't match the question")
+	}
+	return nil
+}
+
+// resolveUsingResolver sends plaintext queries to a bootstrap resolver.
+// These queries are not authenticated, so off-path spoofing is mitigated by using a random
+// transaction ID for every query, a new socket (and thus a random source port) for every exchange,
+// and by rejecting responses whose ID or question don't match the query.
 func (xTransport *XTransport) resolveUsingResolver(
 	proto, host string,
 	resolver string,
@@ -477,11 +799,15 @@ func (xTransport *XTransport) resolveUsingResolver(
 		if msg == nil {
 			continue
 		}
+		msg.ID = dns.ID()
 		msg.RecursionDesired = true
 		msg.UDPSize = uint16(MaxDNSPacketSize)
 		msg.Security = true
 		var in *dns.Msg
 		if in, _, err = dnsClient.Exchange(ctx, msg, proto, resolver); err == nil {
+			if err = verifyResolverResponse(msg, in); err != nil {
+				continue
+			}
 			for _, answer := range in.Answer {
 				if dns.RRToType(answer) == rrType {
 					switch rrType {
@@ -501,6 +827,37 @@ func (xTransport *XTransport) resolveUsingResolver(
 	return ips, ttl, err
 }
 
+// parseBootstrapResolvers parses resolver addresses, optionally followed by ",priority=<n>".
+// Addresses are returned sorted by increasing priority, keeping the configured order for equal priorities.
+func parseBootstrapResolvers(resolvers []string) ([]string, map[string]int, error) {
+	addresses := make([]string, 0, len(resolvers))
+	priorities := make(map[string]int, len(resolvers))
+	for _, resolver := range resolvers {
+		address, priority := resolver, 0
+		if idx := strings.IndexByte(resolver, ','); idx >= 0 {
+			address = strings.TrimSpace(resolver[:idx])
+			option := strings.TrimSpace(resolver[idx+1:])
+			value, found := strings.CutPrefix(option, "priority=")
+			if !found {
+				return nil, nil, fmt.Errorf("Unsupported option [%v] for bootstrap resolver [%v]", option, address)
+			}
+			var err error
+			if priority, err = strconv.Atoi(value); err != nil || priority < 0 {
+				return nil, nil, fmt.Errorf("Invalid priority [%v] for bootstrap resolver [%v]", value, address)
+			}
+		}
+		if err := isIPAndPort(address); err != nil {
+			return nil, nil, fmt.Errorf("Bootstrap resolver [%v]: %v", address, err)
+		}
+		addresses = append(addresses, address)
+		priorities[address] = priority
+	}
+	slices.SortStableFunc(addresses, func(a, b string) int {
+		return priorities[a] - priorities[b]
+	})
+	return addresses, priorities, nil
+}
+
 func (xTransport *XTransport) resolveUsingServers(
 	proto, host string,
 	resolvers []string,
@@ -517,7 +874,13 @@ func (xTransport *XTransport) resolveUsingServers(
 			if err == nil && len(ips) > 0 {
 				if i > 0 {
 					dlog.Infof("Resolution succeeded with resolver %s[%s]", proto, resolver)
-					resolvers[0], resolvers[i] = resolvers[i], resolvers[0]
+					// Only move the resolver ahead of the ones sharing its priority,
+					// so that lower priority resolvers remain backups
+					first := i
+					for first > 0 && xTransport.resolverPriorities[resolvers[first-1]] == xTransport.resolverPriorities[resolver] {
+						first--
+					}
+					resolvers[first], resolvers[i] = resolvers[i], resolvers[first]
 				}
 				return ips, ttl, nil
 			}
@@ -544,48 +907,137 @@ func (xTransport *XTransport) resolveUsingServers(
 	return nil, 0, lastErr
 }
 
+// setHostResolutionOrder overrides the resolution strategies for a host name
+func (xTransport *XTransport) setHostResolutionOrder(host string, order []string) {
+	xTransport.hostResolutionOrders.Lock()
+	xTransport.hostResolutionOrders.orders[host] = order
+	xTransport.hostResolutionOrders.Unlock()
+}
+
+// setHostProxy overrides the proxies used to connect to a host
+func (xTransport *XTransport) setHostProxy(host string, hostProxy HostProxy) {
+	xTransport.hostProxies.Lock()
+	xTransport.hostProxies.proxies[strings.Trim(host, "[]")] = hostProxy
+	xTransport.hostProxies.Unlock()
+}
+
+// hostProxy returns the proxies overriding the global ones for a host, if any
+func (xTransport *XTransport) hostProxy(host string) (HostProxy, bool) {
+	xTransport.hostProxies.RLock()
+	hostProxy, ok := xTransport.hostProxies.proxies[strings.Trim(host, "[]")]
+	xTransport.hostProxies.RUnlock()
+	return hostProxy, ok
+}
+
+// setHostTimeout overrides the timeouts used to connect to a host and to wait for its responses
+func (xTransport *XTransport) setHostTimeout(host string, hostTimeout HostTimeout) {
+	xTransport.hostTimeouts.Lock()
+	xTransport.hostTimeouts.timeouts[strings.Trim(host, "[]")] = hostTimeout
+	xTransport.hostTimeouts.Unlock()
+}
+
+// hostTimeout returns the timeouts overriding the global one for a host, if any
+func (xTransport *XTransport) hostTimeout(host string) (HostTimeout, bool) {
+	xTransport.hostTimeouts.RLock()
+	hostTimeout, ok := xTransport.hostTimeouts.timeouts[strings.Trim(host, "[]")]
+	xTransport.hostTimeouts.RUnlock()
+	return hostTimeout, ok
+}
+
+// transportFor returns the transport used to send requests to a host. Hosts with their own response timeout
+// use a copy of the main transport with that timeout, shared by all the hosts with the same timeout.
+func (xTransport *XTransport) transportFor(host string) *http.Transport {
+	hostTimeout, ok := xTransport.hostTimeout(host)
+	if !ok || hostTimeout.response <= 0 || xTransport.transport == nil {
+		return xTransport.transport
+	}
+	xTransport.hostTimeouts.Lock()
+	defer xTransport.hostTimeouts.Unlock()
+	transport, ok := xTransport.hostTimeouts.transports[hostTimeout.response]
+	if !ok {
+		transport = xTransport.transport.Clone()
+		transport.ResponseHeaderTimeout = hostTimeout.response
+		if xTransport.hostTimeouts.transports == nil {
+			xTransport.hostTimeouts.transports = make(map[time.Duration]*http.Transport)
+		}
+		xTransport.hostTimeouts.transports[hostTimeout.response] = transport
+	}
+	return transport
+}
+
+// proxyDialerFor returns the dialer used to connect to a host, or nil for direct connections
+func (xTransport *XTransport) proxyDialerFor(host string) *netproxy.Dialer {
+	if hostProxy, ok := xTransport.hostProxy(host); ok && hostProxy.dialer != nil {
+		return hostProxy.dialer
+	}
+	return xTransport.proxyDialer
+}
+
+// resolutionStrategies returns the ordered list of strategies used to resolve a server name
+func (xTransport *XTransport) resolutionStrategies(host string) []string {
+	xTransport.hostResolutionOrders.RLock()
+	order, ok := xTransport.hostResolutionOrders.orders[host]
+	xTransport.hostResolutionOrders.RUnlock()
+	if ok {
+		return order
+	}
+	if len(xTransport.resolutionOrder) > 0 {
+		return xTransport.resolutionOrder
+	}
+	if xTransport.ignoreSystemDNS {
+		return []string{ResolutionStrategyInternal, ResolutionStrategyBootstrap, ResolutionStrategySystem}
+	}
+	return []string{ResolutionStrategySystem, ResolutionStrategyBootstrap}
+}
+
 func (xTransport *XTransport) resolve(host string, returnIPv4, returnIPv6 bool) (ips []net.IP, ttl time.Duration, err error) {
+	if ip, ok := xTransport.ipOverride(host); ok {
+		return []net.IP{ip}, 0, nil
+	}
 	protos := []string{"udp", "tcp"}
 	if xTransport.mainProto == "tcp" {
 		protos = []string{"tcp", "udp"}
 	}
-	if xTransport.ignoreSystemDNS {
-		if xTransport.internalResolverReady {
+	err = errors.New("No resolution strategies")
+	for i, strategy := range xTransport.resolutionStrategies(host) {
+		switch strategy {
+		case ResolutionStrategyInternal:
+			if !xTransport.internalResolverReady {
+				err = errors.New("dnscrypt-proxy service is not usable yet")
+				dlog.Notice(err)
+				continue
+			}
 			for _, proto := range protos {
 				ips, ttl, err = xTransport.resolveUsingServers(proto, host, xTransport.internalResolvers, returnIPv4, returnIPv6)
 				if err == nil {
 					break
 				}
 			}
-		} else {
-			err = errors.New("dnscrypt-proxy service is not usable yet")
-			dlog.Notice(err)
-		}
-	} else {
-		ips, ttl, err = xTransport.resolveUsingSystem(host, returnIPv4, returnIPv6)
-		if err != nil {
-			err = errors.New("System DNS is not usable yet")
-			dlog.Notice(err)
-		}
-	}
-	if err != nil {
-		for _, proto := range protos {
-			if err != nil {
+		case ResolutionStrategyBootstrap:
+			for _, proto := range protos {
 				dlog.Noticef(
 					"Resolving server host [%s] using bootstrap resolvers over %s",
 					host,
 					proto,
 				)
+				ips, ttl, err = xTransport.resolveUsingServers(proto, host, xTransport.bootstrapResolvers, returnIPv4, returnIPv6)
+				if err == nil {
+					break
+				}
 			}
-			ips, ttl, err = xTransport.resolveUsingServers(proto, host, xTransport.bootstrapResolvers, returnIPv4, returnIPv6)
-			if err == nil {
-				break
+		case ResolutionStrategySystem:
+			if i > 0 {
+				dlog.Noticef("Previous resolution strategies failed - Trying with the system resolver")
+			}
+			ips, ttl, err = xTransport.resolveUsingSystem(host, returnIPv4, returnIPv6)
+			if err != nil && i == 0 {
+				err = errors.New("System DNS is not usable yet")
+				dlog.Notice(err)
 			}
 		}
-	}
-	if err != nil && xTransport.ignoreSystemDNS {
-		dlog.Noticef("Bootstrap resolvers didn't respond - Trying with the system resolver as a last resort")
-		ips, ttl, err = xTransport.resolveUsingSystem(host, returnIPv4, returnIPv6)
+		if err == nil {
+			break
+		}
 	}
 	return ips, ttl, err
 }
@@ -595,9 +1047,15 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 	if xTransport.proxyDialer != nil || xTransport.httpProxyFunction != nil {
 		return nil
 	}
+	if _, ok := xTransport.hostProxy(host); ok {
+		return nil
+	}
 	if ParseIP(host) != nil {
 		return nil
 	}
+	if _, ok := xTransport.ipOverride(host); ok {
+		return nil
+	}
 	cachedIPs, expired, updating := xTransport.loadCachedIPs(host)
 	if len(cachedIPs) > 0 && (!expired || updating) {
 		return nil
@@ -641,28 +1099,94 @@ func (xTransport *XTransport) Fetch(
 	timeout time.Duration,
 	compress bool,
 ) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
+	return xTransport.fetch(context.Background(), method, url, fetchOptions{
+		accept:      accept,
+		contentType: contentType,
+		body:        body,
+		timeout:     timeout,
+		compress:    compress,
+	})
+}
+
+type upstreamAddrKey struct{}
+
+// withUpstreamAddr - Returns a context recording the remote address of the connection a request is sent over into addr
+func withUpstreamAddr(ctx context.Context, addr *string) context.Context {
+	return context.WithValue(ctx, upstreamAddrKey{}, addr)
+}
+
+type acceptHeaderKey struct{}
+
+// withAcceptHeader - Returns a context overriding the Accept header of DoH queries, unless accept is empty
+func withAcceptHeader(ctx context.Context, accept string) context.Context {
+	if len(accept) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, acceptHeaderKey{}, accept)
+}
+
+// limitRedirects returns a redirect policy following at most maxRedirects redirects, and logging them
+func limitRedirects(maxRedirects int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		from := via[len(via)-1].URL
+		if len(via) > maxRedirects {
+			dlog.Warnf("Not following the redirection from [%s] to [%s] (max redirects: %d)", from, req.URL, maxRedirects)
+			return fmt.Errorf("Too many redirects (max: %d)", maxRedirects)
+		}
+		if req.URL.Host != from.Host {
+			dlog.Warnf("[%s] redirects to a different host: [%s]", from, req.URL)
+		} else {
+			dlog.Noticef("[%s] redirects to [%s]", from, req.URL)
+		}
+		return nil
+	}
+}
+
+// fetchOptions - Optional settings of an HTTP request
+type fetchOptions struct {
+	accept        string
+	contentType   string
+	body          *[]byte
+	timeout       time.Duration // xTransport.timeout if not set
+	compress      bool          // accept compressed responses, and use the HTTP cache if enabled
+	checkRedirect func(req *http.Request, via []*http.Request) error
+	noBodyHash    bool // don't add the hash of the body to the query string
+}
+
+func (xTransport *XTransport) fetch(
+	ctx context.Context,
+	method string,
+	url *url.URL,
+	options fetchOptions,
+) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
+	timeout := options.timeout
 	if timeout <= 0 {
 		timeout = xTransport.timeout
 	}
+	host, port := ExtractHostAndPort(url.Host, 443)
 	client := http.Client{
-		Transport: xTransport.transport,
-		Timeout:   timeout,
+		Transport:     xTransport.transportFor(host),
+		Timeout:       timeout,
+		CheckRedirect: options.checkRedirect,
 	}
-	host, port := ExtractHostAndPort(url.Host, 443)
 	hasAltSupport := false
+	_, hasHostProxy := xTransport.hostProxy(host)
 
-	if xTransport.h3Transport != nil {
+	// HTTP/3 connections would bypass a per-host proxy
+	if xTransport.h3Transport != nil && !hasHostProxy {
 		if xTransport.http3Probe {
 			// Always try HTTP/3 first when http3_probe is enabled,
-			// without checking for Alt-Svc
-			client.Transport = xTransport.h3Transport
-			dlog.Debugf("Probing HTTP/3 transport for [%s]", url.Host)
+			// without checking for Alt-Svc, unless it recently failed
+			if altPort, inCache := xTransport.altSupport.get(url.Host); inCache && altPort == 0 {
+				dlog.Debugf("Not probing HTTP/3 transport for [%s] - previously failed", url.Host)
+			} else {
+				client.Transport = xTransport.h3Transport
+				dlog.Debugf("Probing HTTP/3 transport for [%s]", url.Host)
+			}
 		} else {
 			// Otherwise use traditional Alt-Svc detection
-			xTransport.altSupport.RLock()
 			var altPort uint16
-			altPort, hasAltSupport = xTransport.altSupport.cache[url.Host]
-			xTransport.altSupport.RUnlock()
+			altPort, hasAltSupport = xTransport.altSupport.get(url.Host)
 			if hasAltSupport && altPort > 0 { // altPort > 0 ensures we're not in the negative cache
 				if int(altPort) == port {
 					client.Transport = xTransport.h3Transport
@@ -672,22 +1196,39 @@ func (xTransport *XTransport) Fetch(
 		}
 	}
 	header := map[string][]string{"User-Agent": {"dnscrypt-proxy"}}
-	if len(accept) > 0 {
-		header["Accept"] = []string{accept}
+	if len(options.accept) > 0 {
+		header["Accept"] = []string{options.accept}
 	}
-	if len(contentType) > 0 {
-		header["Content-Type"] = []string{contentType}
+	if len(options.contentType) > 0 {
+		header["Content-Type"] = []string{options.contentType}
 	}
 	header["Cache-Control"] = []string{"max-stale"}
-	if body != nil {
-		h := sha512.Sum512(*body)
+	if options.body != nil && !options.noBodyHash {
+		h := sha512.Sum512(*options.body)
 		qs := url.Query()
 		qs.Add("body_hash", hex.EncodeToString(h[:32]))
 		url2 := *url
 		url2.RawQuery = qs.Encode()
 		url = &url2
 	}
-	if xTransport.proxyDialer == nil && strings.HasSuffix(host, ".onion") {
+	// Source and metadata downloads can be served from the HTTP cache
+	var httpCacheKey string
+	if xTransport.httpCache != nil && method == "GET" && options.body == nil && options.compress {
+		httpCacheKey = options.accept + " " + url.String()
+		if entry, fresh := xTransport.httpCache.Get(httpCacheKey, time.Now()); entry != nil {
+			if fresh {
+				dlog.Debugf("[%s] served from the HTTP cache", url)
+				return entry.body, http.StatusOK, entry.tls, 0, nil
+			}
+			if len(entry.etag) > 0 {
+				header["If-None-Match"] = []string{entry.etag}
+			}
+			if len(entry.lastModified) > 0 {
+				header["If-Modified-Since"] = []string{entry.lastModified}
+			}
+		}
+	}
+	if xTransport.proxyDialerFor(host) == nil && strings.HasSuffix(host, ".onion") {
 		return nil, 0, nil, 0, errors.New("Onion service is not reachable without Tor")
 	}
 	if err := xTransport.resolveAndUpdateCache(host); err != nil {
@@ -697,18 +1238,37 @@ func (xTransport *XTransport) Fetch(
 		)
 		return nil, 0, nil, 0, err
 	}
-	if compress && body == nil {
-		header["Accept-Encoding"] = []string{"gzip"}
+	if options.compress && options.body == nil && len(xTransport.contentEncodings) > 0 {
+		header["Accept-Encoding"] = []string{acceptEncodingHeader(xTransport.contentEncodings)}
 	}
 	req := &http.Request{
 		Method: method,
 		URL:    url,
 		Header: header,
-		Close:  false,
+		Close:  xTransport.keepAlive <= 0, // Connections are only reused if keepalive is set
+	}
+	if upstreamAddr, ok := ctx.Value(upstreamAddrKey{}).(*string); ok {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				*upstreamAddr = info.Conn.RemoteAddr().String()
+			},
+		})
+	}
+	ctx = traceConnTiming(ctx)
+	coalesced := false
+	if xTransport.dohCoalescing != nil && client.Transport != xTransport.h3Transport {
+		if authority, ok := xTransport.coalescedAuthority(host, port, time.Now()); ok {
+			dlog.Debugf("Sending the query to [%s] over the connection to [%s]", url.Host, authority)
+			coalescedURL := *url
+			coalescedURL.Host = authority
+			req.URL, req.Host = &coalescedURL, url.Host
+			coalesced = true
+		}
 	}
-	if body != nil {
-		req.ContentLength = int64(len(*body))
-		req.Body = io.NopCloser(bytes.NewReader(*body))
+	req = req.WithContext(ctx)
+	if options.body != nil {
+		req.ContentLength = int64(len(*options.body))
+		req.Body = io.NopCloser(bytes.NewReader(*options.body))
 	}
 	start := time.Now()
 	resp, err := client.Do(req)
@@ -723,20 +1283,25 @@ func (xTransport *XTransport) Fetch(
 		}
 
 		// Add server to negative cache when HTTP/3 fails
-		xTransport.altSupport.Lock()
-		xTransport.altSupport.cache[url.Host] = 0 // 0 port means HTTP/3 failed and should not be tried again
-		xTransport.altSupport.Unlock()
+		xTransport.altSupport.set(url.Host, 0, xTransport.http3NegativeCacheTTL)
 
 		// Retry with HTTP/2
 		client.Transport = xTransport.transport
-		if body != nil {
-			req.Body = io.NopCloser(bytes.NewReader(*body))
+		if options.body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(*options.body))
 		}
 		start = time.Now()
 		resp, err = client.Do(req)
 		rtt = time.Since(start)
 	}
 
+	if err == nil && resp != nil && resp.StatusCode == http.StatusNotModified && len(httpCacheKey) > 0 {
+		resp.Body.Close()
+		if bin, ok := xTransport.httpCache.Revalidated(httpCacheKey, resp.Header, time.Now()); ok {
+			dlog.Debugf("[%s] not modified - served from the HTTP cache", url)
+			return bin, http.StatusOK, resp.TLS, rtt, nil
+		}
+	}
 	if err == nil {
 		if resp == nil {
 			err = errors.New("Webserver returned an error")
@@ -752,17 +1317,22 @@ func (xTransport *XTransport) Fetch(
 		defer resp.Body.Close()
 		statusCode = resp.StatusCode
 	}
+	if coalesced && statusCode == http.StatusMisdirectedRequest {
+		dlog.Noticef("[%s] doesn't accept queries over the connection to [%s] - Connecting to it directly from now on", url.Host, req.URL.Host)
+		xTransport.excludeFromCoalescing(host)
+	}
 	if err != nil {
 		dlog.Debugf("[%s]: [%s]", req.URL, err)
 		return nil, statusCode, nil, rtt, err
 	}
+	if xTransport.dohCoalescing != nil && !coalesced {
+		xTransport.recordCoalescingEndpoint(host, port, url.Host, resp.TLS)
+	}
 	if xTransport.h3Transport != nil && !hasAltSupport {
 		// Check if there's entry in negative cache when using http3_probe
 		skipAltSvcParsing := false
 		if xTransport.http3Probe {
-			xTransport.altSupport.RLock()
-			altPort, inCache := xTransport.altSupport.cache[url.Host]
-			xTransport.altSupport.RUnlock()
+			altPort, inCache := xTransport.altSupport.get(url.Host)
 			// If server is in negative cache (altPort == 0), don't attempt to parse Alt-Svc header
 			if inCache && altPort == 0 {
 				dlog.Debugf("Skipping Alt-Svc parsing for [%s] - previously failed HTTP/3 probe", url.Host)
@@ -773,49 +1343,78 @@ func (xTransport *XTransport) Fetch(
 		if !skipAltSvcParsing {
 			if alt, found := resp.Header["Alt-Svc"]; found {
 				dlog.Debugf("Alt-Svc [%s]: [%s]", url.Host, alt)
-				altPort := uint16(port & 0xffff)
-				for i, xalt := range alt {
-					for j, v := range strings.Split(xalt, ";") {
-						if i >= 8 || j >= 16 {
-							break
-						}
-						v = strings.TrimSpace(v)
-						if after, ok := strings.CutPrefix(v, "h3=\":"); ok {
-							v = after
-							v = strings.TrimSuffix(v, "\"")
-							if xAltPort, err := strconv.ParseUint(v, 10, 16); err == nil && xAltPort <= 65535 {
-								altPort = uint16(xAltPort)
-								dlog.Debugf("Using HTTP/3 for [%s]", url.Host)
-								break
-							}
-						}
+				if altPort, ok := parseAltSvc(alt, uint16(port&0xffff), xTransport.altSvcMaxHeaders, xTransport.altSvcMaxSegments); ok {
+					if altPort != uint16(port&0xffff) {
+						dlog.Debugf("Using HTTP/3 on port %d for [%s]", altPort, url.Host)
 					}
+					xTransport.altSupport.set(url.Host, altPort, 0)
+					dlog.Debugf("Caching altPort for [%v]", url.Host)
 				}
-				xTransport.altSupport.Lock()
-				xTransport.altSupport.cache[url.Host] = altPort
-				dlog.Debugf("Caching altPort for [%v]", url.Host)
-				xTransport.altSupport.Unlock()
 			}
 		}
 	}
 	tls := resp.TLS
 
 	var bodyReader io.ReadCloser = resp.Body
-	if compress && resp.Header.Get("Content-Encoding") == "gzip" {
-		bodyReader, err = gzip.NewReader(io.LimitReader(resp.Body, MaxHTTPBodyLength))
+	bodyLimit := int64(MaxHTTPBodyLength)
+	if contentEncoding := resp.Header.Get("Content-Encoding"); options.compress && len(contentEncoding) > 0 {
+		decoder, err := newContentDecoder(contentEncoding, io.LimitReader(resp.Body, MaxHTTPBodyLength), xTransport.maxDecompressedBody)
 		if err != nil {
 			return nil, statusCode, tls, rtt, err
 		}
-		defer bodyReader.Close()
+		if decoder != nil {
+			bodyReader = decoder
+			defer bodyReader.Close()
+			// The decoder returns an error rather than a truncated body
+			bodyLimit = xTransport.maxDecompressedBody + 1
+		}
+	}
+
+	// A truncated DNS message would be corrupt, so oversized DoH responses are rejected instead
+	if options.accept == "application/dns-message" || options.accept == "application/oblivious-dns-message" {
+		if err := xTransport.checkContentType(resp.Header.Get("Content-Type"), options.accept, url.Host); err != nil {
+			return nil, statusCode, tls, rtt, err
+		}
+		bin, err := io.ReadAll(io.LimitReader(bodyReader, MaxDoHResponseLength+1))
+		if err != nil {
+			return nil, statusCode, tls, rtt, err
+		}
+		if len(bin) > MaxDoHResponseLength {
+			dlog.Infof("Oversized response received from [%s]", url.Host)
+			return nil, statusCode, tls, rtt, ErrDoHResponseTooLarge
+		}
+		return bin, statusCode, tls, rtt, nil
 	}
 
-	bin, err := io.ReadAll(io.LimitReader(bodyReader, MaxHTTPBodyLength))
+	bin, err := io.ReadAll(io.LimitReader(bodyReader, bodyLimit))
 	if err != nil {
+		if errors.Is(err, ErrDecompressedBodyTooLarge) || errors.Is(err, ErrSuspiciousCompression) {
+			dlog.Warnf("Response from [%s] rejected: %v", url.Host, err)
+		}
 		return nil, statusCode, tls, rtt, err
 	}
+	// A body that reached the size limit may have been truncated, so it is not cached
+	if len(httpCacheKey) > 0 && int64(len(bin)) < bodyLimit {
+		xTransport.httpCache.Put(httpCacheKey, bin, resp.Header, tls, time.Now())
+	}
 	return bin, statusCode, tls, rtt, err
 }
 
+// checkContentType verifies that a DoH response has the media type that was asked for,
+// so that an error page returned with a 200 status code is not parsed as a DNS message
+func (xTransport *XTransport) checkContentType(contentType, expected, host string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && strings.EqualFold(mediaType, expected) {
+		return nil
+	}
+	if xTransport.dohContentTypeCheck == DoHContentTypeCheckWarn {
+		dlog.Warnf("[%s] returned a response with Content-Type [%s] instead of [%s]", host, contentType, expected)
+		return nil
+	}
+	dlog.Infof("Response with Content-Type [%s] instead of [%s] received from [%s]", contentType, expected, host)
+	return fmt.Errorf("%w: [%s]", ErrUnexpectedContentType, contentType)
+}
+
 func (xTransport *XTransport) GetWithCompression(
 	url *url.URL,
 	accept string,
@@ -824,6 +1423,18 @@ func (xTransport *XTransport) GetWithCompression(
 	return xTransport.Fetch("GET", url, accept, "", nil, timeout, true)
 }
 
+// GetSource downloads a source list or signature, following at most sourceMaxRedirects redirects
+func (xTransport *XTransport) GetSource(
+	url *url.URL,
+	timeout time.Duration,
+) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
+	return xTransport.fetch(context.Background(), "GET", url, fetchOptions{
+		timeout:       timeout,
+		compress:      true,
+		checkRedirect: limitRedirects(xTransport.sourceMaxRedirects),
+	})
+}
+
 func (xTransport *XTransport) Get(
 	url *url.URL,
 	accept string,
@@ -843,37 +1454,116 @@ func (xTransport *XTransport) Post(
 }
 
 func (xTransport *XTransport) dohLikeQuery(
+	ctx context.Context,
+	dataType string,
+	useGet bool,
+	url *url.URL,
+	body []byte,
+	timeout time.Duration,
+	bodyHash bool,
+) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
+	accept := dataType
+	if override, ok := ctx.Value(acceptHeaderKey{}).(string); ok {
+		accept = override
+	}
+	uriTemplate, _ := ctx.Value(uriTemplateKey{}).(*DoHURITemplate)
+	// Identical DoH queries sent at the same time are coalesced into a single request.
+	// ODoH queries are encrypted, so they are never identical.
+	if xTransport.dohDedupWindow > 0 && dataType == "application/dns-message" {
+		key := strconv.FormatBool(useGet) + " " + accept + " " + url.String() + " " + string(body)
+		if uriTemplate != nil {
+			key += " " + uriTemplate.String()
+		}
+		response := xTransport.inFlightDoHRequests.Do(ctx, key, xTransport.dohDedupWindow, func() DoHResponse {
+			var response DoHResponse
+			// The request is shared, so it isn't canceled with ctx, but it doesn't outlive the query that started it
+			sendTimeout := timeout
+			if sendTimeout <= 0 {
+				sendTimeout = xTransport.timeout
+			}
+			sendCtx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+			defer cancel()
+			sendCtx = withConnTiming(withUpstreamAddr(sendCtx, &response.upstreamAddr), &response.connTiming)
+			response.body, response.statusCode, response.tls, response.rtt, response.err = xTransport.sendDoHLikeQuery(
+				sendCtx, dataType, accept, uriTemplate, useGet, url, body, timeout, bodyHash)
+			return response
+		})
+		if upstreamAddr, ok := ctx.Value(upstreamAddrKey{}).(*string); ok {
+			*upstreamAddr = response.upstreamAddr
+		}
+		if connTiming, ok := ctx.Value(connTimingKey{}).(*ConnTiming); ok {
+			*connTiming = response.connTiming
+		}
+		return response.body, response.statusCode, response.tls, response.rtt, response.err
+	}
+	return xTransport.sendDoHLikeQuery(ctx, dataType, accept, uriTemplate, useGet, url, body, timeout, bodyHash)
+}
+
+func (xTransport *XTransport) sendDoHLikeQuery(
+	ctx context.Context,
 	dataType string,
+	accept string,
+	uriTemplate *DoHURITemplate,
 	useGet bool,
 	url *url.URL,
 	body []byte,
 	timeout time.Duration,
+	bodyHash bool,
 ) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
+	if uriTemplate != nil {
+		encBody := ""
+		if useGet {
+			encBody = base64.RawURLEncoding.EncodeToString(body)
+		}
+		url2, err := uriTemplate.expand(url, encBody)
+		if err != nil {
+			return nil, 0, nil, 0, err
+		}
+		if useGet {
+			return xTransport.fetch(ctx, "GET", url2, fetchOptions{accept: accept, timeout: timeout})
+		}
+		return xTransport.fetch(ctx, "POST", url2, fetchOptions{
+			accept:      accept,
+			contentType: dataType,
+			body:        &body,
+			timeout:     timeout,
+			noBodyHash:  !bodyHash,
+		})
+	}
 	if useGet {
 		qs := url.Query()
 		encBody := base64.RawURLEncoding.EncodeToString(body)
 		qs.Add("dns", encBody)
 		url2 := *url
 		url2.RawQuery = qs.Encode()
-		return xTransport.Get(&url2, dataType, timeout)
+		return xTransport.fetch(ctx, "GET", &url2, fetchOptions{accept: accept, timeout: timeout})
 	}
-	return xTransport.Post(url, dataType, dataType, &body, timeout)
+	return xTransport.fetch(ctx, "POST", url, fetchOptions{
+		accept:      accept,
+		contentType: dataType,
+		body:        &body,
+		timeout:     timeout,
+		noBodyHash:  !bodyHash,
+	})
 }
 
 func (xTransport *XTransport) DoHQuery(
+	ctx context.Context,
 	useGet bool,
 	url *url.URL,
 	body []byte,
 	timeout time.Duration,
 ) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
-	return xTransport.dohLikeQuery("application/dns-message", useGet, url, body, timeout)
+	return xTransport.dohLikeQuery(ctx, "application/dns-message", useGet, url, body, timeout, true)
 }
 
 func (xTransport *XTransport) ObliviousDoHQuery(
+	ctx context.Context,
 	useGet bool,
 	url *url.URL,
 	body []byte,
 	timeout time.Duration,
+	bodyHash bool,
 ) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
-	return xTransport.dohLikeQuery("application/oblivious-dns-message", useGet, url, body, timeout)
+	return xTransport.dohLikeQuery(ctx, "application/oblivious-dns-message", useGet, url, body, timeout, bodyHash)
 }
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+	"github.com/quic-go/quic-go"
+	netproxy "golang.org/x/net/proxy"
+)
+
+func TestResolutionStrategiesPrecedence(t *testing.T) {
+	ignoreSystemDNS, useSystemDNS := true, false
+	xTransport := NewXTransport()
+	xTransport.ignoreSystemDNS = true
+	xTransport.resolutionOrder = []string{ResolutionStrategyInternal, ResolutionStrategySystem}
+
+	tests := []struct {
+		name     string
+		settings ServerSettingsConfig
+		want     []string
+	}{
+		{
+			name: "globals",
+			want: []string{ResolutionStrategyInternal, ResolutionStrategySystem},
+		},
+		{
+			name:     "per-server ignore_system_dns",
+			settings: ServerSettingsConfig{IgnoreSystemDNS: &useSystemDNS},
+			want:     []string{ResolutionStrategySystem, ResolutionStrategyBootstrap},
+		},
+		{
+			name: "per-server resolution_order wins",
+			settings: ServerSettingsConfig{
+				IgnoreSystemDNS: &ignoreSystemDNS,
+				ResolutionOrder: []string{ResolutionStrategyBootstrap},
+			},
+			want: []string{ResolutionStrategyBootstrap},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := "doh.example.com"
+			xTransport.hostResolutionOrders.orders = make(map[string][]string)
+			if order := serverResolutionOrder(tt.settings); len(order) > 0 {
+				xTransport.setHostResolutionOrder(host, order)
+			}
+			if got := xTransport.resolutionStrategies(host); !slices.Equal(got, tt.want) {
+				t.Errorf("resolutionStrategies() = %v, want %v", got, tt.want)
+			}
+			if got := xTransport.resolutionStrategies("other.example.com"); !slices.Equal(got, xTransport.resolutionOrder) {
+				t.Errorf("other hosts should use the global strategies, got %v", got)
+			}
+		})
+	}
+}
+
+// startBootstrapResolver runs a plaintext resolver that answers every query using reply
+func startBootstrapResolver(t *testing.T, reply func(query *dns.Msg) *dns.Msg) string {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			length, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := dns.Msg{Data: slices.Clone(buf[:length])}
+			if err := query.Unpack(); err != nil || len(query.Question) != 1 {
+				continue
+			}
+			response := reply(&query)
+			if err := response.Pack(); err == nil {
+				server.WriteTo(response.Data, addr)
+			}
+		}
+	}()
+	return server.LocalAddr().String()
+}
+
+func bootstrapTestAnswer(query *dns.Msg, name string) *dns.Msg {
+	response := EmptyResponseFromMessage(query)
+	rr := new(dns.A)
+	rr.Hdr = dns.Header{Name: name, Class: dns.ClassINET, TTL: 60}
+	rr.A = rdata.A{Addr: netip.MustParseAddr("192.0.2.1")}
+	response.Answer = []dns.RR{rr}
+	return response
+}
+
+func TestResolveUsingResolverVerifiesResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   func(query *dns.Msg) *dns.Msg
+		wantIPs bool
+	}{
+		{
+			name: "matching response",
+			reply: func(query *dns.Msg) *dns.Msg {
+				return bootstrapTestAnswer(query, "example.com.")
+			},
+			wantIPs: true,
+		},
+		{
+			name: "spoofed transaction ID",
+			reply: func(query *dns.Msg) *dns.Msg {
+				response := bootstrapTestAnswer(query, "example.com.")
+				response.ID = query.ID + 1
+				return response
+			},
+		},
+		{
+			name: "different question",
+			reply: func(query *dns.Msg) *dns.Msg {
+				rewritten := dns.NewMsg("attacker.example.", dns.TypeA)
+				rewritten.ID = query.ID
+				return bootstrapTestAnswer(rewritten, "attacker.example.")
+			},
+		},
+	}
+
+	xTransport := NewXTransport()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := startBootstrapResolver(t, tt.reply)
+			ips, _, err := xTransport.resolveUsingResolver("udp", "example.com", resolver, true, false)
+			if tt.wantIPs {
+				if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+					t.Fatalf("resolveUsingResolver() = %v, %v", ips, err)
+				}
+			} else if err == nil || len(ips) > 0 {
+				t.Fatalf("resolveUsingResolver() = %v, %v, want the response to be rejected", ips, err)
+			}
+		})
+	}
+}
+
+func TestResolveUsingResolverRandomizesIDs(t *testing.T) {
+	var mu sync.Mutex
+	var ids []uint16
+	resolver := startBootstrapResolver(t, func(query *dns.Msg) *dns.Msg {
+		mu.Lock()
+		ids = append(ids, query.ID)
+		mu.Unlock()
+		return bootstrapTestAnswer(query, "example.com.")
+	})
+	xTransport := NewXTransport()
+	for range 8 {
+		if _, _, err := xTransport.resolveUsingResolver("udp", "example.com", resolver, true, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	sequential := true
+	for i := 1; i < len(ids); i++ {
+		if ids[i] != ids[i-1]+1 {
+			sequential = false
+		}
+	}
+	if len(ids) != 8 || sequential {
+		t.Fatalf("Transaction IDs are not randomized: %v", ids)
+	}
+}
+
+// recordingDialer connects to a fixed address, and records the addresses it was asked to connect to
+type recordingDialer struct {
+	sync.Mutex
+	target string
+	dialed []string
+}
+
+func (dialer *recordingDialer) Dial(network, address string) (net.Conn, error) {
+	dialer.Lock()
+	dialer.dialed = append(dialer.dialed, address)
+	dialer.Unlock()
+	return net.Dial(network, dialer.target)
+}
+
+func TestPerHostProxyDialer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	xTransport := NewXTransport()
+	dialer := &recordingDialer{target: serverURL.Host}
+	var proxyDialer netproxy.Dialer = dialer
+	xTransport.setHostProxy("proxied.example", HostProxy{dialer: &proxyDialer})
+	xTransport.rebuildTransport()
+
+	// The name of a proxied server is not resolved locally, the proxy receives it as-is
+	proxiedURL := &url.URL{Scheme: "http", Host: "proxied.example:" + serverURL.Port(), Path: "/"}
+	if _, _, _, _, err := xTransport.Get(proxiedURL, "", 5*time.Second); err != nil {
+		t.Fatalf("fetch through the per-host proxy failed: %v", err)
+	}
+	if want := []string{proxiedURL.Host}; !slices.Equal(dialer.dialed, want) {
+		t.Errorf("proxy dialer was asked to connect to %v, want %v", dialer.dialed, want)
+	}
+
+	// Other hosts are still reached directly
+	if _, _, _, _, err := xTransport.Get(serverURL, "", 5*time.Second); err != nil {
+		t.Fatalf("direct fetch failed: %v", err)
+	}
+	if len(dialer.dialed) != 1 {
+		t.Errorf("proxy dialer was used for a host without an override: %v", dialer.dialed)
+	}
+	if xTransport.proxyDialerFor("[::1]") != nil {
+		t.Error("proxyDialerFor() should return nil for a host without an override")
+	}
+}
+
+func TestPerHostResponseTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	xTransport := NewXTransport()
+	xTransport.timeout = 100 * time.Millisecond
+	xTransport.rebuildTransport()
+	if _, _, _, _, err := xTransport.Get(serverURL, "", 5*time.Second); err == nil {
+		t.Fatal("a response slower than the global timeout should have been rejected")
+	}
+
+	xTransport.setHostTimeout(serverURL.Hostname(), HostTimeout{response: 2 * time.Second})
+	if _, _, _, _, err := xTransport.Get(serverURL, "", 5*time.Second); err != nil {
+		t.Fatalf("a response within the response timeout of the host was rejected: %v", err)
+	}
+	if transport := xTransport.transportFor("other.example"); transport != xTransport.transport {
+		t.Error("hosts without an override should use the main transport")
+	}
+
+	proxy := &Proxy{timeout: 5 * time.Second}
+	if _, timeout := dohServerTimeout(proxy, ServerSettingsConfig{}); timeout != proxy.timeout {
+		t.Errorf("timeout without overrides = %v, want %v", timeout, proxy.timeout)
+	}
+	hostTimeout, timeout := dohServerTimeout(proxy, ServerSettingsConfig{ConnectTimeout: 500, ResponseTimeout: 10000})
+	if hostTimeout.connect != 500*time.Millisecond || hostTimeout.response != 10*time.Second || timeout != 10500*time.Millisecond {
+		t.Errorf("dohServerTimeout() = %+v, %v", hostTimeout, timeout)
+	}
+}
+
+func TestPerHostHTTPProxy(t *testing.T) {
+	xTransport := NewXTransport()
+	httpProxyURL, _ := url.Parse("http://127.0.0.1:3128")
+	xTransport.setHostProxy("proxied.example", HostProxy{httpProxyURL: httpProxyURL})
+	xTransport.rebuildTransport()
+
+	for host, want := range map[string]*url.URL{"proxied.example": httpProxyURL, "direct.example": nil} {
+		req := &http.Request{URL: &url.URL{Scheme: "https", Host: host}}
+		got, err := xTransport.transport.Proxy(req)
+		if err != nil || got != want {
+			t.Errorf("Proxy(%v) = %v, %v, want %v", host, got, err, want)
+		}
+	}
+}
+
+func TestParseBootstrapResolvers(t *testing.T) {
+	addresses, priorities, err := parseBootstrapResolvers([]string{
+		"192.0.2.1:53,priority=2",
+		"192.0.2.2:53",
+		"[2001:db8::1]:53, priority=1",
+		"192.0.2.3:53",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.2:53", "192.0.2.3:53", "[2001:db8::1]:53", "192.0.2.1:53"}
+	if !slices.Equal(addresses, want) {
+		t.Errorf("parseBootstrapResolvers() = %v, want %v", addresses, want)
+	}
+	if priorities["192.0.2.1:53"] != 2 || priorities["192.0.2.2:53"] != 0 {
+		t.Errorf("unexpected priorities: %v", priorities)
+	}
+
+	for _, invalid := range []string{"192.0.2.1:53,priority=-1", "192.0.2.1:53,priority=x", "192.0.2.1:53,weight=1", "192.0.2.1,priority=1"} {
+		if _, _, err := parseBootstrapResolvers([]string{invalid}); err == nil {
+			t.Errorf("parseBootstrapResolvers(%q) should fail", invalid)
+		}
+	}
+}
+
+func TestResolveUsingServersKeepsPriorities(t *testing.T) {
+	failing := startBootstrapResolver(t, EmptyResponseFromMessage)
+	working := startBootstrapResolver(t, func(query *dns.Msg) *dns.Msg {
+		return bootstrapTestAnswer(query, "example.com.")
+	})
+
+	tests := []struct {
+		name       string
+		priorities map[string]int
+		wantOrder  []string
+	}{
+		{"backup stays behind the primary", map[string]int{failing: 0, working: 1}, []string{failing, working}},
+		{"same priority is reordered", nil, []string{working, failing}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xTransport := NewXTransport()
+			xTransport.resolverPriorities = tt.priorities
+			resolvers := []string{failing, working}
+			if _, _, err := xTransport.resolveUsingServers("udp", "example.com", resolvers, true, false); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(resolvers, tt.wantOrder) {
+				t.Errorf("resolvers = %v, want %v", resolvers, tt.wantOrder)
+			}
+		})
+	}
+}
+
+func TestAltSupportNegativeCacheExpires(t *testing.T) {
+	altSupport := AltSupport{cache: make(map[string]AltSupportEntry)}
+	altSupport.set("h3.example.com", 443, 0)
+	altSupport.set("failed.example.com", 0, 50*time.Millisecond)
+
+	if port, found := altSupport.get("h3.example.com"); !found || port != 443 {
+		t.Errorf("get(h3.example.com) = %d, %v, want 443, true", port, found)
+	}
+	if port, found := altSupport.get("failed.example.com"); !found || port != 0 {
+		t.Errorf("get(failed.example.com) = %d, %v, want a negative entry", port, found)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, found := altSupport.get("failed.example.com"); found {
+		t.Error("the negative entry should have expired")
+	}
+	if _, found := altSupport.get("h3.example.com"); !found {
+		t.Error("positive entries should not expire")
+	}
+}
+
+func TestProviderIPOverridesAreNeverResolved(t *testing.T) {
+	var queries atomic.Int32
+	resolver := startBootstrapResolver(t, func(query *dns.Msg) *dns.Msg {
+		queries.Add(1)
+		return bootstrapTestAnswer(query, query.Question[0].Header().Name)
+	})
+	xTransport := NewXTransport()
+	xTransport.bootstrapResolvers = []string{resolver}
+	xTransport.resolutionOrder = []string{ResolutionStrategyBootstrap}
+	xTransport.setIPOverrides(map[string]net.IP{"DoH.Example.com.": ParseIP("198.51.100.7")})
+
+	if err := xTransport.resolveAndUpdateCache("doh.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	ips, _, err := xTransport.resolve("doh.example.com", true, false)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(ParseIP("198.51.100.7")) {
+		t.Errorf("resolve() = %v, %v, want the static address", ips, err)
+	}
+	xTransport.saveCachedIP("doh.example.com", ParseIP("192.0.2.1"), -1*time.Second)
+	cachedIPs, expired, _ := xTransport.loadCachedIPs("doh.example.com")
+	if len(cachedIPs) != 1 || !cachedIPs[0].Equal(ParseIP("198.51.100.7")) || expired {
+		t.Errorf("cached IPs = %v (expired: %v), want the static address", cachedIPs, expired)
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("%d queries were sent for an overridden name", n)
+	}
+
+	if err := xTransport.resolveAndUpdateCache("other.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if queries.Load() == 0 {
+		t.Error("names without an override should still be resolved")
+	}
+}
+
+func TestCachedIPsAreUsedAtStartup(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	var queries atomic.Int32
+	resolver := startBootstrapResolver(t, func(query *dns.Msg) *dns.Msg {
+		queries.Add(1)
+		return bootstrapTestAnswer(query, query.Question[0].Header().Name)
+	})
+	config := newConfig()
+	config.BootstrapResolvers = []string{resolver}
+	config.ResolutionOrder = []string{ResolutionStrategyBootstrap}
+	config.CachedIPs = map[string]CachedIPsConfig{
+		"Seeded.Example.": {IPs: []string{"127.0.0.1"}, TTL: 86400},
+	}
+	proxy := &Proxy{xTransport: NewXTransport()}
+	if err := configureXTransport(proxy, &config); err != nil {
+		t.Fatal(err)
+	}
+	xTransport := proxy.xTransport
+
+	ips, expired, _ := xTransport.loadCachedIPs("seeded.example")
+	if len(ips) != 1 || !ips[0].Equal(ParseIP("127.0.0.1")) || expired {
+		t.Fatalf("cached IPs = %v (expired: %v), want the seeded address", ips, expired)
+	}
+
+	xTransport.rebuildTransport()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	conn, err := xTransport.transport.DialContext(t.Context(), "tcp", net.JoinHostPort("seeded.example", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not made to the seeded address")
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("%d queries were sent for a seeded name", n)
+	}
+
+	config.CachedIPs = map[string]CachedIPsConfig{"bad.example": {IPs: []string{"not an IP"}}}
+	if err := configureXTransport(&Proxy{xTransport: NewXTransport()}, &config); err == nil {
+		t.Error("invalid addresses should be rejected")
+	}
+}
+
+func TestKeepAliveReusesConnections(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	serverURL, _ := url.Parse(server.URL)
+
+	for _, tt := range []struct {
+		keepAlive       time.Duration
+		wantConnections int32
+	}{
+		{30 * time.Second, 1},
+		{0, 3},
+	} {
+		connections.Store(0)
+		xTransport := NewXTransport()
+		xTransport.keepAlive = tt.keepAlive
+		xTransport.rebuildTransport()
+		rootCAs := x509.NewCertPool()
+		rootCAs.AddCert(server.Certificate())
+		xTransport.transport.TLSClientConfig.RootCAs = rootCAs
+		for range 3 {
+			if _, _, _, _, err := xTransport.Get(serverURL, "", 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+		}
+		xTransport.transport.CloseIdleConnections()
+		if n := connections.Load(); n != tt.wantConnections {
+			t.Errorf("keepalive %v: %d connections for 3 requests, want %d", tt.keepAlive, n, tt.wantConnections)
+		}
+	}
+}
+
+func TestGetSourceMaxRedirects(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if n > 0 {
+			http.Redirect(w, r, "/"+strconv.Itoa(n-1), http.StatusFound)
+			return
+		}
+		w.Write([]byte("source"))
+	}))
+	t.Cleanup(server.Close)
+
+	for _, tt := range []struct {
+		maxRedirects int
+		redirects    int
+		wantErr      bool
+	}{
+		{maxRedirects: 0, redirects: 0, wantErr: false},
+		{maxRedirects: 0, redirects: 1, wantErr: true},
+		{maxRedirects: 2, redirects: 2, wantErr: false},
+		{maxRedirects: 2, redirects: 3, wantErr: true},
+	} {
+		xTransport := NewXTransport()
+		xTransport.sourceMaxRedirects = tt.maxRedirects
+		xTransport.rebuildTransport()
+		rootCAs := x509.NewCertPool()
+		rootCAs.AddCert(server.Certificate())
+		xTransport.transport.TLSClientConfig.RootCAs = rootCAs
+		sourceURL, _ := url.Parse(server.URL + "/" + strconv.Itoa(tt.redirects))
+		body, _, _, _, err := xTransport.GetSource(sourceURL, 5*time.Second)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("max %d: %d redirects should have been rejected", tt.maxRedirects, tt.redirects)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("max %d: %d redirects: %v", tt.maxRedirects, tt.redirects, err)
+		} else if string(body) != "source" {
+			t.Errorf("max %d: %d redirects: body = %q", tt.maxRedirects, tt.redirects, body)
+		}
+	}
+}
+
+func TestH3HappyEyeballs(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(tlsServer.Close)
+	serverTLSConfig := &tls.Config{Certificates: tlsServer.TLS.Certificates, NextProtos: []string{"h3"}}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(tlsServer.Certificate())
+
+	// Both address families listen on the same port; a blackhole reads nothing and never answers
+	listen := func(network, ip string, port int, blackhole bool) int {
+		udpConn, err := net.ListenUDP(network, &net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { udpConn.Close() })
+		if !blackhole {
+			listener, err := quic.ListenEarly(udpConn, serverTLSConfig, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { listener.Close() })
+			go func() {
+				for {
+					if _, err := listener.Accept(context.Background()); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		return udpConn.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	for _, tt := range []struct {
+		name            string
+		ipv6Blackhole   bool
+		ipv4Blackhole   bool
+		wantRemoteIP    string
+		wantFallbackRun bool
+	}{
+		{name: "primary wins", wantRemoteIP: "::1"},
+		{name: "primary loses", ipv6Blackhole: true, wantRemoteIP: "127.0.0.1", wantFallbackRun: true},
+		{name: "both fail", ipv6Blackhole: true, ipv4Blackhole: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			port := listen("udp6", "::1", 0, tt.ipv6Blackhole)
+			listen("udp4", "127.0.0.1", port, tt.ipv4Blackhole)
+
+			xTransport := NewXTransport()
+			xTransport.http3 = true
+			xTransport.rebuildTransport()
+			xTransport.saveCachedIPs("example.com", []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, time.Hour)
+			tlsCfg := &tls.Config{RootCAs: rootCAs, NextProtos: []string{"h3"}}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			start := time.Now()
+			conn, err := xTransport.h3Transport.Dial(ctx, "example.com:"+strconv.Itoa(port), tlsCfg, nil)
+			elapsed := time.Since(start)
+			if tlsCfg.ServerName != "" {
+				t.Errorf("the TLS configuration of the caller was modified")
+			}
+			if tt.wantRemoteIP == "" {
+				if err == nil {
+					conn.CloseWithError(0, "")
+					t.Fatal("dialing should fail when no address answers")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.CloseWithError(0, "")
+			if ip := conn.RemoteAddr().(*net.UDPAddr).IP.String(); ip != tt.wantRemoteIP {
+				t.Errorf("connected to %s, want %s", ip, tt.wantRemoteIP)
+			}
+			if fallbackRun := elapsed >= H3HappyEyeballsDelay; fallbackRun != tt.wantFallbackRun {
+				t.Errorf("connected after %v, fallback expected: %v", elapsed, tt.wantFallbackRun)
+			}
+		})
+	}
+}
+
+func TestParseAltSvc(t *testing.T) {
+	manySegments := strings.Repeat("x;", 20) + `h3=":8443"`
+	tests := []struct {
+		name        string
+		values      []string
+		maxHeaders  int
+		maxSegments int
+		wantPort    uint16
+		wantParsed  bool
+	}{
+		{name: "h3", values: []string{`h3=":8443"; ma=86400`}, maxHeaders: 8, maxSegments: 16, wantPort: 8443, wantParsed: true},
+		{name: "no h3", values: []string{`h2=":443"`}, maxHeaders: 8, maxSegments: 16, wantPort: 443, wantParsed: true},
+		{name: "second value", values: []string{`clear`, `h3=":8443"`}, maxHeaders: 8, maxSegments: 16, wantPort: 8443, wantParsed: true},
+		{name: "beyond the header limit", values: []string{`clear`, `h3=":8443"`}, maxHeaders: 1, maxSegments: 16, wantPort: 443, wantParsed: true},
+		{name: "beyond the segment limit", values: []string{manySegments}, maxHeaders: 8, maxSegments: 16, wantPort: 443, wantParsed: true},
+		{name: "within a raised segment limit", values: []string{manySegments}, maxHeaders: 8, maxSegments: 32, wantPort: 8443, wantParsed: true},
+		{name: "too long", values: []string{strings.Repeat(" ", MaxAltSvcHeaderLength) + `h3=":8443"`}, maxHeaders: 8, maxSegments: 16, wantPort: 443},
+		{name: "disabled", values: []string{`h3=":8443"`}, maxHeaders: 0, maxSegments: 16, wantPort: 443},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port, parsed := parseAltSvc(tt.values, 443, tt.maxHeaders, tt.maxSegments)
+			if port != tt.wantPort || parsed != tt.wantParsed {
+				t.Errorf("parseAltSvc() = %d, %v, want %d, %v", port, parsed, tt.wantPort, tt.wantParsed)
+			}
+		})
+	}
+}